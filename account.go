@@ -9,7 +9,7 @@ import (
 )
 
 func verifyCredentialsHandler(w http.ResponseWriter, r *http.Request) {
-	acct := toAccount(r.Context(), profile, &ToAccountOpts{WithSource: true})
+	acct := toAccount(r.Context(), getIdentity(r.Context()).profile, &ToAccountOpts{WithSource: true})
 	json.NewEncoder(w).Encode(acct)
 }
 
@@ -20,13 +20,16 @@ func updateCredentialsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	identity := getIdentity(r.Context())
+	profile := identity.profile
+
 	profile.Name = r.FormValue("display_name")
 	profile.About = r.FormValue("note")
 	profile.Website = r.FormValue("website")
 
 	j, _ := json.Marshal(profile)
 
-	evt, err := publish(r.Context(), &nostr.Event{
+	evt, err := identity.publish(r.Context(), &nostr.Event{
 		CreatedAt: nostr.Now(),
 		Kind:      0,
 		Content:   string(j),
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	ACTIVITYSTREAMS_CONTEXT = "https://www.w3.org/ns/activitystreams"
+	ACTIVITY_JSON           = "application/activity+json"
+	NODEINFO_SCHEMA         = "http://nodeinfo.diaspora.software/ns/schema/2.0"
+	ACTOR_OUTBOX_LIMIT      = 20
+	TAG_PAGE_LIMIT          = 20
+)
+
+// these are the urls we give to clients for accounts and statuses, they open as html in a
+// browser and as activitystreams for anything that asks for it.
+func actorURL(pubkey string) string { return "http://" + srv.Addr + "/users/" + pubkey }
+func postURL(id string) string      { return "http://" + srv.Addr + "/posts/" + id }
+
+func wantsActivityJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, ACTIVITY_JSON) || strings.Contains(accept, "application/ld+json")
+}
+
+// decodePubkey takes a hex pubkey, an npub or an nprofile.
+func decodePubkey(s string) string {
+	if nostr.IsValidPublicKeyHex(s) {
+		return s
+	}
+	prefix, value, err := nip19.Decode(s)
+	if err != nil {
+		return ""
+	}
+	switch prefix {
+	case "npub":
+		return value.(string)
+	case "nprofile":
+		return value.(nostr.ProfilePointer).PublicKey
+	}
+	return ""
+}
+
+// decodeEventID takes a hex id, a note or an nevent.
+func decodeEventID(s string) string {
+	// ids look just like hex pubkeys
+	if nostr.IsValidPublicKeyHex(s) {
+		return s
+	}
+	prefix, value, err := nip19.Decode(s)
+	if err != nil {
+		return ""
+	}
+	switch prefix {
+	case "note":
+		return value.(string)
+	case "nevent":
+		return value.(nostr.EventPointer).ID
+	}
+	return ""
+}
+
+type localOnlyContextKey struct{}
+
+// localOnly is for the pages anyone can load without logging in: nothing is fetched from
+// relays on their behalf, so they only show what is already in the local store.
+func localOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localOnlyContextKey{}, true)
+}
+
+func isLocalOnly(ctx context.Context) bool {
+	yes, _ := ctx.Value(localOnlyContextKey{}).(bool)
+	return yes
+}
+
+// profileOrPlaceholder never returns nil, for people whose metadata we couldn't find.
+func profileOrPlaceholder(ctx context.Context, pubkey string) *Profile {
+	if profile := loadProfile(ctx, pubkey); profile != nil && profile.event != nil {
+		return profile
+	}
+	return &Profile{pubkey: pubkey, event: &nostr.Event{PubKey: pubkey, Kind: 0}}
+}
+
+type webfingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+type webfingerResponse struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases"`
+	Links   []webfingerLink `json:"links"`
+}
+
+// webfingerHandler answers for acct:<npub or hex pubkey or name of one of our identities>@host
+// and for actor urls.
+func webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	name := ""
+	if strings.HasPrefix(resource, "acct:") {
+		name = strings.TrimPrefix(resource, "acct:")
+		if i := strings.LastIndex(name, "@"); i != -1 {
+			name = name[:i]
+		}
+		name = strings.TrimPrefix(name, "@")
+	} else if strings.HasPrefix(resource, actorURL("")) {
+		name = strings.TrimPrefix(resource, actorURL(""))
+	}
+
+	pubkey := decodePubkey(name)
+	if pubkey == "" && name != "" {
+		for _, id := range identities {
+			if id.profile != nil && strings.EqualFold(id.profile.Name, name) {
+				pubkey = id.pubkey
+				break
+			}
+		}
+	}
+	if pubkey == "" {
+		jsonError(w, "unknown resource", 404)
+		return
+	}
+
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(webfingerResponse{
+		Subject: "acct:" + npub + "@" + srv.Addr,
+		Aliases: []string{actorURL(pubkey)},
+		Links: []webfingerLink{
+			{Rel: "self", Type: ACTIVITY_JSON, Href: actorURL(pubkey)},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: actorURL(pubkey)},
+		},
+	})
+}
+
+func nodeInfoHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"links": []webfingerLink{{Rel: NODEINFO_SCHEMA, Href: "http://" + srv.Addr + "/nodeinfo/2.0"}},
+	})
+}
+
+func nodeInfoSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/nodeinfo/2.0" {
+		jsonError(w, "only nodeinfo 2.0 is supported", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; profile=\""+NODEINFO_SCHEMA+"#\"")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":           "2.0",
+		"software":          map[string]string{"name": "bisu", "version": "0.0.0"},
+		"protocols":         []string{"activitypub"},
+		"services":          map[string][]string{"inbound": {}, "outbound": {}},
+		"openRegistrations": false,
+		"usage":             map[string]any{"users": map[string]int{"total": len(identities)}},
+		"metadata":          map[string]string{"nodeName": "bisu", "nodeDescription": "nostr personal homeserver"},
+	})
+}
+
+type apImage struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type apPerson struct {
+	Context           string   `json:"@context"`
+	ID                string   `json:"id"`
+	Type              string   `json:"type"`
+	PreferredUsername string   `json:"preferredUsername"`
+	Name              string   `json:"name"`
+	Summary           string   `json:"summary"`
+	URL               string   `json:"url"`
+	Inbox             string   `json:"inbox"`
+	Outbox            string   `json:"outbox"`
+	Icon              *apImage `json:"icon,omitempty"`
+	Image             *apImage `json:"image,omitempty"`
+}
+
+type apTag struct {
+	Type string `json:"type"`
+	Href string `json:"href,omitempty"`
+	Name string `json:"name"`
+}
+
+type apDocument struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+}
+
+type apPost struct {
+	Context      string       `json:"@context,omitempty"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type"`
+	AttributedTo string       `json:"attributedTo"`
+	Content      string       `json:"content"`
+	Summary      *string      `json:"summary"`
+	Sensitive    bool         `json:"sensitive"`
+	Published    string       `json:"published"`
+	URL          string       `json:"url"`
+	InReplyTo    *string      `json:"inReplyTo"`
+	To           []string     `json:"to"`
+	Cc           []string     `json:"cc"`
+	Tag          []apTag      `json:"tag"`
+	Attachment   []apDocument `json:"attachment"`
+}
+
+func toPerson(ctx context.Context, p *Profile) apPerson {
+	npub, _ := nip19.EncodePublicKey(p.pubkey)
+	person := apPerson{
+		Context:           ACTIVITYSTREAMS_CONTEXT,
+		ID:                actorURL(p.pubkey),
+		Type:              "Person",
+		PreferredUsername: npub,
+		Name:              p.Name,
+		Summary:           renderContent(ctx, p.About, nil).HTML,
+		URL:               actorURL(p.pubkey),
+		Inbox:             actorURL(p.pubkey) + "/inbox",
+		Outbox:            actorURL(p.pubkey) + "/outbox",
+	}
+	if p.DisplayName != "" {
+		person.Name = p.DisplayName
+	}
+	if p.Picture != "" {
+		person.Icon = &apImage{Type: "Image", URL: p.Picture}
+	}
+	if p.Banner != "" {
+		person.Image = &apImage{Type: "Image", URL: p.Banner}
+	}
+	return person
+}
+
+func toPost(ctx context.Context, evt *nostr.Event) apPost {
+	attachments := toAttachments(evt.Content)
+	post := apPost{
+		ID:           postURL(evt.ID),
+		Type:         "Note",
+		AttributedTo: actorURL(evt.PubKey),
+		Content:      renderContent(ctx, evt.Content, attachments).HTML,
+		Published:    evt.CreatedAt.Time().UTC().Format(time.RFC3339),
+		URL:          postURL(evt.ID),
+		To:           []string{ACTIVITYSTREAMS_PUBLIC},
+		Cc:           []string{},
+		Tag:          []apTag{},
+		Attachment:   []apDocument{},
+	}
+	if reply := nip10.GetImmediateReply(evt.Tags); reply != nil {
+		inReplyTo := postURL(reply.Value())
+		post.InReplyTo = &inReplyTo
+	}
+	if cw := evt.Tags.GetFirst([]string{"content-warning", ""}); cw != nil {
+		post.Sensitive = true
+		summary := cw.Value()
+		post.Summary = &summary
+	}
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			if nostr.IsValidPublicKeyHex(tag[1]) {
+				npub, _ := nip19.EncodePublicKey(tag[1])
+				post.Tag = append(post.Tag, apTag{Type: "Mention", Href: actorURL(tag[1]), Name: "@" + npub})
+				post.Cc = append(post.Cc, actorURL(tag[1]))
+			}
+		case "t":
+			post.Tag = append(post.Tag, apTag{Type: "Hashtag", Name: "#" + tag[1]})
+		}
+	}
+	for _, att := range attachments {
+		u, _ := url.Parse(att.URL)
+		post.Attachment = append(post.Attachment, apDocument{
+			Type:      "Document",
+			MediaType: mime.TypeByExtension(path.Ext(u.Path)),
+			URL:       att.URL,
+		})
+	}
+	return post
+}
+
+// recentNotes is what we have locally from someone, newest first.
+func recentNotes(ctx context.Context, pubkey string, limit int) []*nostr.Event {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{1}, Authors: []string{pubkey}, Limit: limit})
+	if err != nil {
+		return nil
+	}
+	notes := make([]*nostr.Event, 0, limit)
+	for evt := range ch {
+		notes = append(notes, evt)
+	}
+	return notes
+}
+
+// actorHandler serves /users/<pubkey> and /users/<pubkey>/outbox. bisu doesn't federate, so
+// there is no inbox to post to.
+func actorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := localOnly(r.Context())
+	name, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+	pubkey := decodePubkey(name)
+	if pubkey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if profile := loadProfile(ctx, pubkey); (profile == nil || profile.event == nil) &&
+		len(recentNotes(ctx, pubkey, 1)) == 0 {
+		// nobody we know about
+		http.NotFound(w, r)
+		return
+	}
+
+	switch sub {
+	case "":
+	case "outbox":
+		notes := recentNotes(ctx, pubkey, ACTOR_OUTBOX_LIMIT)
+		items := make([]map[string]any, len(notes))
+		for i, evt := range notes {
+			items[i] = map[string]any{
+				"id":     postURL(evt.ID) + "/activity",
+				"type":   "Create",
+				"actor":  actorURL(pubkey),
+				"object": toPost(ctx, evt),
+			}
+		}
+		w.Header().Set("Content-Type", ACTIVITY_JSON)
+		json.NewEncoder(w).Encode(map[string]any{
+			"@context":     ACTIVITYSTREAMS_CONTEXT,
+			"id":           actorURL(pubkey) + "/outbox",
+			"type":         "OrderedCollection",
+			"totalItems":   len(items),
+			"orderedItems": items,
+		})
+		return
+	case "inbox":
+		jsonError(w, "bisu doesn't federate over activitypub", 405)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	profile := profileOrPlaceholder(ctx, pubkey)
+	if wantsActivityJSON(r) {
+		w.Header().Set("Content-Type", ACTIVITY_JSON)
+		json.NewEncoder(w).Encode(toPerson(ctx, profile))
+		return
+	}
+
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	page := profilePage{Profile: profile, Npub: npub}
+	for _, evt := range recentNotes(ctx, pubkey, ACTOR_OUTBOX_LIMIT) {
+		page.Notes = append(page.Notes, pageNote{ID: evt.ID, Content: evt.Content, CreatedAt: evt.CreatedAt.Time().UTC()})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	profileTemplate.Execute(w, page)
+}
+
+// postHandler serves /posts/<id>.
+func postHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := localOnly(r.Context())
+	name, activity, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/posts/"), "/")
+	id := decodeEventID(name)
+	if id == "" || (activity != "" && activity != "activity") {
+		http.NotFound(w, r)
+		return
+	}
+	evt := loadEvent(ctx, id, nil, nil)
+	if evt != nil && evt.Kind == 30023 {
+		http.Redirect(w, r, "/articles/"+encodeAddress(evt), http.StatusFound)
+		return
+	}
+	if evt == nil || evt.Kind != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if wantsActivityJSON(r) {
+		post := toPost(ctx, evt)
+		post.Context = ACTIVITYSTREAMS_CONTEXT
+		w.Header().Set("Content-Type", ACTIVITY_JSON)
+		json.NewEncoder(w).Encode(post)
+		return
+	}
+
+	page := pageNote{
+		ID:           evt.ID,
+		Content:      evt.Content,
+		CreatedAt:    evt.CreatedAt.Time().UTC(),
+		Author:       profileOrPlaceholder(ctx, evt.PubKey),
+		AuthorPubkey: evt.PubKey,
+	}
+	if reply := nip10.GetImmediateReply(evt.Tags); reply != nil {
+		page.InReplyTo = reply.Value()
+	}
+	if cw := evt.Tags.GetFirst([]string{"content-warning", ""}); cw != nil {
+		page.ContentWarning = cw.Value()
+	}
+	for _, att := range toAttachments(evt.Content) {
+		if att.Type == "image" {
+			page.Images = append(page.Images, att.URL)
+		}
+	}
+	nevent, _ := nip19.EncodeEvent(evt.ID, nil, evt.PubKey)
+	page.NostrURI = template.URL("nostr:" + nevent)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	postTemplate.Execute(w, page)
+}
+
+// tagHandler serves /tags/<tag>, the notes with a hashtag that we have.
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := localOnly(r.Context())
+	tag := strings.TrimPrefix(r.URL.Path, "/tags/")
+	if tag == "" || strings.Contains(tag, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := tagPage{Tag: tag}
+	ch, err := store.QueryEvents(ctx, nostr.Filter{
+		Kinds: []int{1},
+		Tags:  nostr.TagMap{"t": hashtagValues(tag)},
+		Limit: TAG_PAGE_LIMIT,
+	})
+	if err == nil {
+		for evt := range ch {
+			page.Notes = append(page.Notes, pageNote{
+				ID:           evt.ID,
+				Content:      evt.Content,
+				CreatedAt:    evt.CreatedAt.Time().UTC(),
+				Author:       profileOrPlaceholder(ctx, evt.PubKey),
+				AuthorPubkey: evt.PubKey,
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tagTemplate.Execute(w, page)
+}
+
+type profilePage struct {
+	Profile *Profile
+	Npub    string
+	Notes   []pageNote
+}
+
+type tagPage struct {
+	Tag   string
+	Notes []pageNote
+}
+
+type pageNote struct {
+	ID             string
+	NostrURI       template.URL
+	Content        string
+	ContentWarning string
+	CreatedAt      time.Time
+	InReplyTo      string
+	Images         []string
+	Author         *Profile
+	AuthorPubkey   string
+}
+
+var pageStyle = `<style>
+  body { max-width: 40em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; }
+  .content { white-space: pre-wrap; overflow-wrap: anywhere; }
+  .meta { color: gray; font-size: small; }
+  img.avatar { width: 4em; height: 4em; border-radius: 50%; }
+  img.media { max-width: 100%; }
+  article img { max-width: 100%; }
+</style>`
+
+var profileTemplate = template.Must(template.New("profile").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{or .Profile.Name .Npub}}</title>` + pageStyle + `</head>
+<body>
+  {{if .Profile.Banner}}<img class="media" src="{{.Profile.Banner}}" alt="">{{end}}
+  <h1>{{if .Profile.Picture}}<img class="avatar" src="{{.Profile.Picture}}" alt=""> {{end}}{{or .Profile.DisplayName .Profile.Name .Npub}}</h1>
+  <p class="meta">{{.Npub}}{{if .Profile.NIP05}} · {{.Profile.NIP05}}{{end}}</p>
+  {{if .Profile.About}}<p class="content">{{.Profile.About}}</p>{{end}}
+  {{if .Profile.Website}}<p><a href="{{.Profile.Website}}" rel="nofollow noopener">{{.Profile.Website}}</a></p>{{end}}
+  {{range .Notes}}
+  <hr>
+  <p class="content">{{.Content}}</p>
+  <p class="meta"><a href="/posts/{{.ID}}">{{.CreatedAt.Format "2006-01-02 15:04"}}</a></p>
+  {{else}}
+  <p class="meta">no notes from them here yet</p>
+  {{end}}
+</body>
+</html>`))
+
+var postTemplate = template.Must(template.New("post").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{or .Author.DisplayName .Author.Name "note"}}</title>` + pageStyle + `</head>
+<body>
+  <p><a href="/users/{{.AuthorPubkey}}">{{if .Author.Picture}}<img class="avatar" src="{{.Author.Picture}}" alt=""> {{end}}{{or .Author.DisplayName .Author.Name "someone"}}</a></p>
+  {{if .InReplyTo}}<p class="meta">in reply to <a href="/posts/{{.InReplyTo}}">this</a></p>{{end}}
+  {{if .ContentWarning}}<details><summary>{{.ContentWarning}}</summary>{{end}}
+  <p class="content">{{.Content}}</p>
+  {{range .Images}}<p><img class="media" src="{{.}}" alt=""></p>{{end}}
+  {{if .ContentWarning}}</details>{{end}}
+  <p class="meta">{{.CreatedAt.Format "2006-01-02 15:04"}} · <a href="{{.NostrURI}}">open in a nostr client</a></p>
+</body>
+</html>`))
+
+var tagTemplate = template.Must(template.New("tag").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>#{{.Tag}}</title>` + pageStyle + `</head>
+<body>
+  <h1>#{{.Tag}}</h1>
+  {{range .Notes}}
+  <hr>
+  <p><a href="/users/{{.AuthorPubkey}}">{{if .Author.Picture}}<img class="avatar" src="{{.Author.Picture}}" alt=""> {{end}}{{or .Author.DisplayName .Author.Name "someone"}}</a></p>
+  <p class="content">{{.Content}}</p>
+  <p class="meta"><a href="/posts/{{.ID}}">{{.CreatedAt.Format "2006-01-02 15:04"}}</a></p>
+  {{else}}
+  <p class="meta">no notes with this tag here yet</p>
+  {{end}}
+</body>
+</html>`))
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestActivityPubEndpoints(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+	setTestAddr(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	npub, _ := nip19.EncodePublicKey(pk)
+	friend := nostr.GeneratePrivateKey()
+	friendpk, _ := nostr.GetPublicKey(friend)
+
+	sign := func(sk string, evt *nostr.Event) *nostr.Event {
+		evt.CreatedAt = nostr.Now()
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+		return evt
+	}
+	metadata := sign(sk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "fiatjaf", "about": "<b>hi</b>"}`})
+	sign(friend, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "friend"}`})
+	parent := sign(friend, &nostr.Event{Kind: 1, Tags: nostr.Tags{}, Content: "first"})
+	note := sign(sk, &nostr.Event{
+		Kind:    1,
+		Content: "<script>alert(1)</script>\nhttps://example.com/cat.png",
+		Tags: nostr.Tags{
+			{"e", parent.ID, "", "reply"},
+			{"p", friendpk},
+			{"t", "cats"},
+		},
+	})
+
+	previous := identities
+	identities = []*Identity{{pubkey: pk, profile: toProfile(metadata)}}
+	t.Cleanup(func() { identities = previous })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", actorHandler)
+	mux.HandleFunc("/posts/", postHandler)
+	mux.HandleFunc("/.well-known/webfinger", webfingerHandler)
+	mux.HandleFunc("/.well-known/nodeinfo", nodeInfoHandler)
+	mux.HandleFunc("/nodeinfo/", nodeInfoSchemaHandler)
+	get := func(target string, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) map[string]any {
+		var v map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("invalid json %s: %s", w.Body.String(), err)
+		}
+		return v
+	}
+
+	for _, resource := range []string{"acct:fiatjaf@bisu.test:7001", "acct:" + npub + "@bisu.test:7001", actorURL(pk)} {
+		w := get("/.well-known/webfinger?resource="+resource, "")
+		if w.Code != 200 || decode(w)["subject"] != "acct:"+npub+"@bisu.test:7001" {
+			t.Errorf("webfinger for %s: %d %s", resource, w.Code, w.Body.String())
+		}
+	}
+	if w := get("/.well-known/webfinger?resource=acct:nobody@bisu.test:7001", ""); w.Code != 404 {
+		t.Errorf("unknown account should be 404, got %d", w.Code)
+	}
+
+	links := decode(get("/.well-known/nodeinfo", ""))["links"].([]any)
+	if href := links[0].(map[string]any)["href"]; href != "http://bisu.test:7001/nodeinfo/2.0" {
+		t.Errorf("unexpected nodeinfo link %v", href)
+	}
+	if info := decode(get("/nodeinfo/2.0", "")); info["version"] != "2.0" || info["openRegistrations"] != false {
+		t.Errorf("unexpected nodeinfo %v", info)
+	}
+
+	actor := decode(get("/users/"+npub, ACTIVITY_JSON))
+	if actor["id"] != actorURL(pk) || actor["type"] != "Person" || actor["name"] != "fiatjaf" ||
+		actor["summary"] != "<p>&lt;b&gt;hi&lt;/b&gt;</p>" {
+		t.Errorf("unexpected actor %v", actor)
+	}
+	outbox := decode(get("/users/"+pk+"/outbox", ACTIVITY_JSON))
+	if outbox["totalItems"] != float64(1) {
+		t.Errorf("unexpected outbox %v", outbox)
+	}
+	if w := get("/users/"+pk, "text/html"); w.Code != 200 || !strings.Contains(w.Body.String(), "&lt;script&gt;") ||
+		strings.Contains(w.Body.String(), "<script>") || !strings.Contains(w.Body.String(), "/posts/"+note.ID) {
+		t.Errorf("unexpected profile page %s", w.Body.String())
+	}
+
+	post := decode(get("/posts/"+note.ID, "application/ld+json; profile=\"https://www.w3.org/ns/activitystreams\""))
+	if post["attributedTo"] != actorURL(pk) || post["inReplyTo"] != postURL(parent.ID) ||
+		post["content"] != "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>" {
+		t.Errorf("unexpected post %v", post)
+	}
+	if tags := post["tag"].([]any); len(tags) != 2 || tags[1].(map[string]any)["name"] != "#cats" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if att := post["attachment"].([]any); len(att) != 1 || att[0].(map[string]any)["mediaType"] != "image/png" {
+		t.Errorf("unexpected attachments %v", att)
+	}
+
+	page := get("/posts/"+note.ID, "text/html,application/xhtml+xml").Body.String()
+	if strings.Contains(page, "<script>") || !strings.Contains(page, `<img class="media" src="https://example.com/cat.png"`) ||
+		!strings.Contains(page, "/posts/"+parent.ID) || !strings.Contains(page, "nostr:nevent1") {
+		t.Errorf("unexpected post page %s", page)
+	}
+
+	for _, target := range []string{"/posts/xyz", "/users/xyz", "/posts/" + note.ID + "/likes"} {
+		if w := get(target, ""); w.Code != 404 {
+			t.Errorf("%s should be 404, got %d", target, w.Code)
+		}
+	}
+
+	// anyone can load these pages, so they don't make us go look for things on relays
+	relay := startTestRelay(t)
+	setTestConfig(t, func(c *Config) { c.DefaultRelays = []string{relay.URL} })
+	stranger := nostr.GeneratePrivateKey()
+	strangerpk, _ := nostr.GetPublicKey(stranger)
+	elsewhere := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "not here"}
+	elsewhere.Sign(stranger)
+	relay.events = append(relay.events, &elsewhere)
+	for _, target := range []string{"/posts/" + elsewhere.ID, "/users/" + strangerpk, "/users/" + strangerpk + "/outbox"} {
+		if w := get(target, ACTIVITY_JSON); w.Code != 404 {
+			t.Errorf("%s should be 404, got %d", target, w.Code)
+		}
+	}
+	if storedEvent(t, elsewhere.ID) != nil {
+		t.Errorf("a public page fetched an event from a relay")
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	ARCHIVE_JSONL = "jsonl"
+	ARCHIVE_CAR   = "car"
+
+	ARCHIVE_MAX_LINE = 1 << 24 // bytes, for a jsonl line or a car section
+)
+
+// exportOptions tells what goes into an archive: by default the events of the given pubkeys
+// (which includes their lists) and the DMs they got. with all everything in the store goes.
+type exportOptions struct {
+	Pubkeys []string
+	All     bool
+	Format  string
+}
+
+type importResult struct {
+	Imported    int `json:"imported"`
+	Skipped     int `json:"skipped"`
+	Invalid     int `json:"invalid"`
+	Rebroadcast int `json:"rebroadcast"`
+}
+
+// exportEvents writes the events selected by opts to w and returns how many were written.
+func exportEvents(ctx context.Context, w io.Writer, opts exportOptions) (int, error) {
+	var filters []nostr.Filter
+	if opts.All {
+		filters = []nostr.Filter{{}}
+	} else {
+		filters = []nostr.Filter{
+			{Authors: opts.Pubkeys},
+			{Kinds: []int{4}, Tags: nostr.TagMap{"p": opts.Pubkeys}},
+		}
+	}
+
+	var write func(*nostr.Event) error
+	switch opts.Format {
+	case ARCHIVE_JSONL, "":
+		enc := json.NewEncoder(w)
+		write = func(evt *nostr.Event) error { return enc.Encode(evt) }
+	case ARCHIVE_CAR:
+		manifest, _ := json.Marshal(struct {
+			Pubkeys []string        `json:"pubkeys"`
+			All     bool            `json:"all"`
+			Created nostr.Timestamp `json:"created_at"`
+		}{opts.Pubkeys, opts.All, nostr.Now()})
+		if err := writeCARHeader(w, manifest); err != nil {
+			return 0, err
+		}
+		write = func(evt *nostr.Event) error {
+			j, _ := json.Marshal(evt)
+			return writeCARBlock(w, j)
+		}
+	default:
+		return 0, fmt.Errorf("unknown archive format '%s'", opts.Format)
+	}
+
+	seen := make(map[string]struct{})
+	for _, filter := range filters {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return len(seen), fmt.Errorf("failed to query events: %w", err)
+		}
+		for evt := range ch {
+			if _, ok := seen[evt.ID]; ok {
+				continue
+			}
+			seen[evt.ID] = struct{}{}
+			if err := write(evt); err != nil {
+				// drain so the store can release the query
+				for range ch {
+				}
+				return len(seen), err
+			}
+		}
+	}
+
+	return len(seen), nil
+}
+
+// readArchive calls fn for each event in a JSONL or CAR archive, telling them apart by the
+// first byte.
+func readArchive(r io.Reader, fn func(*nostr.Event) error) error {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if first[0] == '{' {
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(make([]byte, 0, 64*1024), ARCHIVE_MAX_LINE)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			evt := &nostr.Event{}
+			if err := json.Unmarshal(scanner.Bytes(), evt); err != nil {
+				return fmt.Errorf("invalid event on line %d: %w", line, err)
+			}
+			if err := fn(evt); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	return readCAR(br, func(block []byte) error {
+		evt := &nostr.Event{}
+		if err := json.Unmarshal(block, evt); err != nil || evt.ID == "" {
+			// the manifest or something else that isn't an event
+			return nil
+		}
+		return fn(evt)
+	})
+}
+
+// importEvents stores the valid events from an archive, learning relay hints from them as if
+// they had come from relays. our own events can be queued to be published again.
+func importEvents(ctx context.Context, r io.Reader, rebroadcastTo []string) (importResult, error) {
+	var res importResult
+	err := readArchive(r, func(evt *nostr.Event) error {
+		if err := checkEvent(evt); err != nil {
+			log.Debug().Err(err).Str("id", evt.ID).Msg("skipping invalid event from archive")
+			res.Invalid++
+			return nil
+		}
+		if isGone(ctx, evt) {
+			res.Skipped++
+			return nil
+		}
+
+		if alreadyStored(ctx, evt.ID) {
+			// still published again below, relays may be missing it even if we have it
+			res.Skipped++
+		} else {
+			if evt.Kind == 5 {
+				handleDeletion(ctx, evt)
+			}
+			if err := saveEvent(ctx, evt); err != nil {
+				res.Skipped++
+				return nil
+			}
+			grabRelaysFromEvent(ctx, evt)
+			res.Imported++
+		}
+
+		if len(rebroadcastTo) > 0 && isOwnPubkey(evt.PubKey) && rebroadcastable(evt) {
+			if err := enqueuePublish(ctx, evt, rebroadcastTo, nil); err != nil {
+				return fmt.Errorf("failed to queue event for rebroadcast: %w", err)
+			}
+			res.Rebroadcast++
+		}
+		return nil
+	})
+	if res.Rebroadcast > 0 {
+		nudgePublishQueue()
+	}
+	return res, err
+}
+
+func alreadyStored(ctx context.Context, id string) bool {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}, Limit: 1})
+	if err != nil {
+		return false
+	}
+	found := false
+	for range ch {
+		found = true
+	}
+	return found
+}
+
+// rebroadcast queues all the events of an identity we have to be published to the given
+// relays, for when moving to new relays.
+func (id *Identity) rebroadcast(ctx context.Context, relays []string) (int, error) {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Authors: []string{id.pubkey}})
+	if err != nil {
+		return 0, err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		if rebroadcastable(evt) {
+			events = append(events, evt)
+		}
+	}
+
+	for _, evt := range events {
+		if err := enqueuePublish(ctx, evt, relays, nil); err != nil {
+			return 0, fmt.Errorf("failed to queue event for rebroadcast: %w", err)
+		}
+	}
+	nudgePublishQueue()
+	return len(events), nil
+}
+
+func rebroadcastable(evt *nostr.Event) bool {
+	// ephemeral events and auth aren't meant to be stored by relays
+	return !(evt.Kind >= 20000 && evt.Kind < 30000) && evt.Kind != 22242
+}
+
+// writeCARHeader starts a CARv1 archive with the given block as its root, the root is
+// also written as the first block.
+func writeCARHeader(w io.Writer, root []byte) error {
+	rootCID := rawCID(root)
+
+	// dag-cbor: {"roots": [cid], "version": 1}
+	header := []byte{0xa2, 0x65, 'r', 'o', 'o', 't', 's', 0x81, 0xd8, 0x2a, 0x58, byte(len(rootCID) + 1), 0x00}
+	header = append(header, rootCID...)
+	header = append(header, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x01)
+
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(header)))); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	return writeCARBlock(w, root)
+}
+
+func writeCARBlock(w io.Writer, data []byte) error {
+	cid := rawCID(data)
+	section := binary.AppendUvarint(nil, uint64(len(cid)+len(data)))
+	section = append(section, cid...)
+	section = append(section, data...)
+	_, err := w.Write(section)
+	return err
+}
+
+// rawCID is a CIDv1 with the raw codec and a sha2-256 multihash.
+func rawCID(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return append([]byte{0x01, 0x55, 0x12, 0x20}, hash[:]...)
+}
+
+// readCAR calls fn with each block of a CARv1 archive after checking it matches its CID.
+func readCAR(r *bufio.Reader, fn func([]byte) error) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("invalid car header: %w", err)
+	}
+	if size > ARCHIVE_MAX_LINE {
+		return fmt.Errorf("car header is too big")
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("invalid car header: %w", err)
+	}
+	if !bytes.HasSuffix(header, []byte{0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x01}) &&
+		!bytes.HasPrefix(header, []byte{0xa2, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x01}) {
+		return fmt.Errorf("only car version 1 is supported")
+	}
+
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid car section: %w", err)
+		}
+		if size > ARCHIVE_MAX_LINE {
+			return fmt.Errorf("car section is too big")
+		}
+		section := make([]byte, size)
+		if _, err := io.ReadFull(r, section); err != nil {
+			return fmt.Errorf("truncated car section: %w", err)
+		}
+
+		// only the CIDs we write are supported: v1, any codec, sha2-256
+		br := bytes.NewReader(section)
+		version, _ := binary.ReadUvarint(br)
+		binary.ReadUvarint(br) // codec
+		hashCode, _ := binary.ReadUvarint(br)
+		hashSize, _ := binary.ReadUvarint(br)
+		if version != 1 || hashCode != 0x12 || hashSize != 32 || br.Len() < 32 {
+			return fmt.Errorf("unsupported cid in car section")
+		}
+		digest := make([]byte, 32)
+		br.Read(digest)
+		data := section[len(section)-br.Len():]
+		if hash := sha256.Sum256(data); !bytes.Equal(hash[:], digest) {
+			return fmt.Errorf("car block doesn't match its cid")
+		}
+
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
+
+// exportHandler streams an archive of the identity's events, ?all=true includes everything
+// we have and ?format=car gives a CAR file instead of JSONL.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	identity := getIdentity(r.Context())
+	opts := exportOptions{
+		Pubkeys: []string{identity.pubkey},
+		All:     r.URL.Query().Get("all") == "true",
+		Format:  r.URL.Query().Get("format"),
+	}
+	if opts.Format == "" {
+		opts.Format = ARCHIVE_JSONL
+	}
+	if opts.Format != ARCHIVE_JSONL && opts.Format != ARCHIVE_CAR {
+		jsonError(w, "format must be jsonl or car", 400)
+		return
+	}
+
+	if opts.Format == ARCHIVE_CAR {
+		w.Header().Set("Content-Type", "application/vnd.ipld.car")
+	} else {
+		w.Header().Set("Content-Type", "application/jsonl")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="bisu-%s.%s"`, short(identity.pubkey), opts.Format))
+	if _, err := exportEvents(r.Context(), w, opts); err != nil {
+		log.Warn().Err(err).Msg("export failed midway")
+	}
+}
+
+// importHandler reads an archive from the body. with ?rebroadcast=true our own events in it are
+// published again to ?relays= (comma-separated) or to our write relays.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, "use POST", 405)
+		return
+	}
+	identity := getIdentity(r.Context())
+
+	var relays []string
+	if r.URL.Query().Get("rebroadcast") == "true" {
+		relays = rebroadcastRelays(identity, r.URL.Query().Get("relays"))
+	}
+
+	res, err := importEvents(r.Context(), r.Body, relays)
+	if err != nil {
+		jsonError(w, "import failed after "+fmt.Sprint(res.Imported)+" events: "+err.Error(), 400)
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// rebroadcastHandler queues all our events to be published to ?relays= or to our write relays.
+func rebroadcastHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, "use POST", 405)
+		return
+	}
+	identity := getIdentity(r.Context())
+
+	n, err := identity.rebroadcast(r.Context(), rebroadcastRelays(identity, r.URL.Query().Get("relays")))
+	if err != nil {
+		jsonError(w, "failed to rebroadcast: "+err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(importResult{Rebroadcast: n})
+}
+
+func rebroadcastRelays(id *Identity, list string) []string {
+	relays := make([]string, 0, 5)
+	for _, relay := range splitList(list) {
+		if relay = nostr.NormalizeURL(relay); relay != "" && !slices.Contains(relays, relay) &&
+			(strings.HasPrefix(relay, "wss://") || strings.HasPrefix(relay, "ws://")) {
+			relays = append(relays, relay)
+		}
+	}
+	if len(relays) == 0 {
+		relays = append(relays, id.writeRelays...)
+	}
+	return relays
+}
+
+// archiveCommand runs the export, import and rebroadcast subcommands.
+func archiveCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bisu "+args[0], flag.ContinueOnError)
+	pubkey := fs.String("pubkey", "", "only this identity (default all of them)")
+	all := fs.Bool("all", false, "export every event we have, not only ours")
+	format := fs.String("format", ARCHIVE_JSONL, "archive format, jsonl or car")
+	output := fs.String("o", "-", "file to write the archive to")
+	rebroadcast := fs.Bool("rebroadcast", false, "publish our own events from the archive again")
+	relays := fs.String("relays", "", "comma-separated relays to rebroadcast to (default our write relays)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	selected := make([]*Identity, 0, len(identities))
+	for _, id := range identities {
+		if *pubkey == "" || id.pubkey == *pubkey {
+			selected = append(selected, id)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("no identity with pubkey %s", *pubkey)
+	}
+
+	switch args[0] {
+	case "export":
+		opts := exportOptions{All: *all, Format: *format}
+		for _, id := range selected {
+			opts.Pubkeys = append(opts.Pubkeys, id.pubkey)
+		}
+		w := os.Stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := exportEvents(ctx, w, opts)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("events", n).Msg("exported")
+
+	case "import":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: bisu import [-rebroadcast] [-relays wss://...] <file or - for stdin>")
+		}
+		r := os.Stdin
+		if fs.Arg(0) != "-" {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var to []string
+		if *rebroadcast {
+			to = rebroadcastRelays(selected[0], *relays)
+		}
+		res, err := importEvents(ctx, r, to)
+		log.Info().Int("imported", res.Imported).Int("skipped", res.Skipped).Int("invalid", res.Invalid).
+			Int("queued", res.Rebroadcast).Msg("imported")
+		if err != nil {
+			return err
+		}
+
+	case "rebroadcast":
+		for _, id := range selected {
+			n, err := id.rebroadcast(ctx, rebroadcastRelays(id, *relays))
+			if err != nil {
+				return err
+			}
+			log.Info().Str("pubkey", id.pubkey).Int("events", n).Msg("queued for rebroadcast")
+		}
+	}
+
+	return nil
+}
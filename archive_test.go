@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	for _, format := range []string{ARCHIVE_JSONL, ARCHIVE_CAR} {
+		t.Run(format, func(t *testing.T) {
+			setupTestStorage(t)
+
+			me := nostr.GeneratePrivateKey()
+			mypk, _ := nostr.GetPublicKey(me)
+			stranger := nostr.GeneratePrivateKey()
+			previous := identities
+			identities = []*Identity{{pubkey: mypk}}
+			t.Cleanup(func() { identities = previous })
+
+			var events []*nostr.Event
+			post := func(sk string, kind int, tags nostr.Tags) *nostr.Event {
+				evt := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: tags, Content: "x"}
+				evt.Sign(sk)
+				saveEvent(ctx, evt)
+				events = append(events, evt)
+				return evt
+			}
+			note := post(me, 1, nostr.Tags{})
+			list := post(me, 10002, nostr.Tags{{"r", "wss://new.relay", "write"}})
+			dm := post(stranger, 4, nostr.Tags{{"p", mypk}})
+			other := post(stranger, 1, nostr.Tags{})
+
+			buf := &bytes.Buffer{}
+			n, err := exportEvents(ctx, buf, exportOptions{Pubkeys: []string{mypk}, Format: format})
+			if err != nil || n != 3 {
+				t.Fatalf("expected 3 events exported, got %d, %v", n, err)
+			}
+			archive := bytes.Clone(buf.Bytes())
+
+			buf.Reset()
+			if n, _ := exportEvents(ctx, buf, exportOptions{All: true, Format: format}); n != 4 {
+				t.Fatalf("expected the whole cache exported, got %d", n)
+			}
+
+			// a fresh install gets everything back, and learns where we write from our list
+			setupTestStorage(t)
+			res, err := importEvents(ctx, bytes.NewReader(archive), nil)
+			if err != nil || res.Imported != 3 || res.Invalid != 0 {
+				t.Fatalf("import: %+v, %v", res, err)
+			}
+			for _, evt := range []*nostr.Event{note, list, dm} {
+				if storedEvent(t, evt.ID) == nil {
+					t.Errorf("kind %d event wasn't imported", evt.Kind)
+				}
+			}
+			if storedEvent(t, other.ID) != nil {
+				t.Errorf("an event that wasn't exported got imported")
+			}
+			if relays := fetchOutboxRelaysForUser(ctx, mypk, 5, true); !slices.Contains(relays, "wss://new.relay") {
+				t.Errorf("relay hints weren't rebuilt, got %v", relays)
+			}
+
+			// importing again changes nothing
+			res, _ = importEvents(ctx, bytes.NewReader(archive), nil)
+			if res.Imported != 0 {
+				t.Errorf("reimported %d events", res.Imported)
+			}
+		})
+	}
+}
+
+func TestImportRejectsInvalid(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	sk := nostr.GeneratePrivateKey()
+	good := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "hello"}
+	good.Sign(sk)
+	forged := good
+	forged.Content = "goodbye"
+
+	archive := good.String() + "\n\n" + forged.String() + "\n"
+	res, err := importEvents(ctx, strings.NewReader(archive), nil)
+	if err != nil || res.Imported != 1 || res.Invalid != 1 {
+		t.Fatalf("expected one imported and one invalid, got %+v, %v", res, err)
+	}
+
+	// a car block that doesn't match its cid
+	buf := &bytes.Buffer{}
+	writeCARHeader(buf, []byte("{}"))
+	writeCARBlock(buf, []byte(good.String()))
+	car := buf.Bytes()
+	car[len(car)-2] ^= 1
+	if _, err := importEvents(ctx, bytes.NewReader(car), nil); err == nil {
+		t.Fatalf("a corrupted car should fail")
+	}
+
+	// a section claiming to be huge is refused before anything is allocated for it
+	buf.Reset()
+	writeCARHeader(buf, []byte("{}"))
+	buf.Write(binary.AppendUvarint(nil, 1<<50))
+	if _, err := importEvents(ctx, bytes.NewReader(buf.Bytes()), nil); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("an oversized car section should fail, got %v", err)
+	}
+}
+
+func TestRebroadcast(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	me := nostr.GeneratePrivateKey()
+	mypk, _ := nostr.GetPublicKey(me)
+	id := &Identity{pubkey: mypk, writeRelays: []string{"wss://old.relay"}}
+	previous := identities
+	identities = []*Identity{id}
+	t.Cleanup(func() { identities = previous })
+
+	var note *nostr.Event
+	for _, kind := range []int{0, 1, 22242} {
+		evt := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "x"}
+		evt.Sign(me)
+		saveEvent(ctx, evt)
+		if kind == 1 {
+			note = evt
+		}
+	}
+
+	relays := rebroadcastRelays(id, "wss://new.relay, wss://new.relay/,,")
+	if len(relays) != 1 || relays[0] != "wss://new.relay" {
+		t.Fatalf("unexpected relays %v", relays)
+	}
+	n, err := id.rebroadcast(ctx, relays)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 events queued, got %d, %v", n, err)
+	}
+	var queued []string
+	db.SelectContext(ctx, &queued, `SELECT relay FROM publish_queue`)
+	if len(queued) != 2 || queued[0] != "wss://new.relay" || queued[1] != "wss://new.relay" {
+		t.Fatalf("unexpected queue %v", queued)
+	}
+
+	if relays := rebroadcastRelays(id, ""); len(relays) != 1 || relays[0] != "wss://old.relay" {
+		t.Fatalf("should default to our write relays, got %v", relays)
+	}
+
+	// importing an event we already have still publishes it again
+	res, err := importEvents(ctx, strings.NewReader(note.String()+"\n"), []string{"wss://other.relay"})
+	if err != nil || res.Imported != 0 || res.Skipped != 1 || res.Rebroadcast != 1 {
+		t.Fatalf("expected the stored note to be rebroadcast, got %+v, %v", res, err)
+	}
+	var count int
+	db.GetContext(ctx, &count, `SELECT count(*) FROM publish_queue WHERE relay = 'wss://other.relay'`)
+	if count != 1 {
+		t.Fatalf("expected the note to be queued for the other relay, got %d", count)
+	}
+}
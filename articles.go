@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomarkdown/markdown"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+const (
+	ARTICLE_SUMMARY_CHARS = 280 // for articles without a summary tag
+	ARTICLE_FETCH_TIMEOUT = time.Second * 10
+)
+
+var (
+	articlePolicy = bluemonday.UGCPolicy()
+
+	// nostr: references, either bare or as the target of a markdown link
+	nostrReference = regexp.MustCompile(`(\]\(|^|[^\w/(<])nostr:((?:npub|nprofile|note|nevent|naddr)1[02-9ac-hj-np-z]+)`)
+)
+
+func articleURL(naddr string) string { return "http://" + srv.Addr + "/articles/" + naddr }
+
+// isAddressable is for events that are replaced by newer ones with the same kind, author and
+// "d" tag, like articles.
+func isAddressable(kind int) bool { return kind >= 30000 && kind < 40000 }
+
+// dTag is the identifier of an addressable event, empty when it has no "d" tag.
+func dTag(evt *nostr.Event) string {
+	if tag := evt.Tags.GetFirst([]string{"d", ""}); tag != nil {
+		return tag.Value()
+	}
+	return ""
+}
+
+func encodeAddress(evt *nostr.Event) string {
+	naddr, _ := nip19.EncodeEntity(evt.PubKey, evt.Kind, dTag(evt), nil)
+	return naddr
+}
+
+// decodeAddress takes an naddr.
+func decodeAddress(s string) *nostr.EntityPointer {
+	prefix, value, err := nip19.Decode(s)
+	if err != nil || prefix != "naddr" {
+		return nil
+	}
+	pointer := value.(nostr.EntityPointer)
+	if !nostr.IsValidPublicKeyHex(pointer.PublicKey) || !isAddressable(pointer.Kind) {
+		return nil
+	}
+	return &pointer
+}
+
+// replaceAddressable removes the versions of an addressable event that are older than evt. it
+// returns false when we already have this one or a newer one, so evt shouldn't be saved.
+func replaceAddressable(ctx context.Context, evt *nostr.Event) bool {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{evt.Kind},
+		Authors: []string{evt.PubKey},
+		Tags:    nostr.TagMap{"d": []string{dTag(evt)}},
+	})
+	if err != nil {
+		return true
+	}
+	var older []*nostr.Event
+	newer := false
+	for existing := range ch {
+		switch {
+		case existing.ID == evt.ID:
+			newer = true
+		case existing.CreatedAt > evt.CreatedAt || (existing.CreatedAt == evt.CreatedAt && existing.ID < evt.ID):
+			newer = true
+		default:
+			older = append(older, existing)
+		}
+	}
+	if newer {
+		return false
+	}
+	for _, existing := range older {
+		removeEvent(ctx, existing)
+	}
+	return true
+}
+
+// loadAddressableEvent finds the latest version of an addressable event, in the local store
+// or on the relays of the pointer and of its author.
+func loadAddressableEvent(ctx context.Context, pointer nostr.EntityPointer) *nostr.Event {
+	filter := nostr.Filter{
+		Kinds:   []int{pointer.Kind},
+		Authors: []string{pointer.PublicKey},
+		Tags:    nostr.TagMap{"d": []string{pointer.Identifier}},
+	}
+	if ch, err := store.QueryEvents(ctx, filter); err == nil {
+		var latest *nostr.Event
+		for evt := range ch {
+			if latest == nil || evt.CreatedAt > latest.CreatedAt {
+				latest = evt
+			}
+		}
+		if latest != nil {
+			touchEvent(latest.ID)
+			return latest
+		}
+	}
+	if isLocalOnly(ctx) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ARTICLE_FETCH_TIMEOUT)
+	defer cancel()
+	relays := append(append([]string{}, pointer.Relays...),
+		fetchOutboxRelaysForUser(ctx, pointer.PublicKey, 3, false)...)
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	seen := make(map[string]bool, len(relays))
+	var latest *nostr.Event
+	for _, url := range relays {
+		url = nostr.NormalizeURL(url)
+		if seen[url] || !relayUsable(url) {
+			continue
+		}
+		seen[url] = true
+
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := ensureRelay(url)
+			if err != nil {
+				return
+			}
+			events, _ := relay.QuerySync(ctx, filter)
+			for _, evt := range events {
+				if !filter.Matches(evt) || !acceptEvent(ctx, url, evt) {
+					continue
+				}
+				mu.Lock()
+				if latest == nil || evt.CreatedAt > latest.CreatedAt {
+					latest = evt
+				}
+				mu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	if latest != nil {
+		saveEvent(ctx, latest)
+	}
+	return latest
+}
+
+// loadStatusEvent is loadEvent for status ids, which can also be the naddr of an article.
+func loadStatusEvent(ctx context.Context, id string) *nostr.Event {
+	if pointer := decodeAddress(id); pointer != nil {
+		return loadAddressableEvent(ctx, *pointer)
+	}
+	return loadEvent(ctx, id, nil, nil)
+}
+
+type articleInfo struct {
+	Title       string
+	Summary     string
+	Image       string
+	PublishedAt time.Time
+}
+
+func parseArticle(evt *nostr.Event) articleInfo {
+	info := articleInfo{PublishedAt: evt.CreatedAt.Time()}
+	if tag := evt.Tags.GetFirst([]string{"title", ""}); tag != nil {
+		info.Title = tag.Value()
+	}
+	if tag := evt.Tags.GetFirst([]string{"summary", ""}); tag != nil {
+		info.Summary = tag.Value()
+	}
+	if tag := evt.Tags.GetFirst([]string{"image", ""}); tag != nil && isHTTPURL(tag.Value()) {
+		info.Image = tag.Value()
+	}
+	if tag := evt.Tags.GetFirst([]string{"published_at", ""}); tag != nil {
+		if ts, err := strconv.ParseInt(tag.Value(), 10, 64); err == nil && ts > 0 {
+			info.PublishedAt = time.Unix(ts, 0)
+		}
+	}
+
+	if info.Title == "" {
+		info.Title = "untitled"
+	}
+	if info.Summary == "" {
+		// the beginning of the text, without the markdown
+		text := strings.Join(strings.Fields(html.UnescapeString(
+			bluemonday.StrictPolicy().Sanitize(renderMarkdown(evt.Content)))), " ")
+		if runes := []rune(text); len(runes) > ARTICLE_SUMMARY_CHARS {
+			text = string(runes[:ARTICLE_SUMMARY_CHARS-1]) + "…"
+		}
+		info.Summary = text
+	}
+	return info
+}
+
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// renderMarkdown turns the markdown of an article into html that is safe to show: raw html
+// in it is dropped, links to nostr entities point to our own pages and everything goes
+// through an allowlist of tags and attributes at the end.
+func renderMarkdown(content string) string {
+	content = nostrReference.ReplaceAllStringFunc(content, func(match string) string {
+		groups := nostrReference.FindStringSubmatch(match)
+		path := localNostrPath(groups[2])
+		if path == "" {
+			return match
+		}
+		if groups[1] == "](" {
+			return groups[1] + path
+		}
+		return groups[1] + "[" + shortenEntity(groups[2]) + "](" + path + ")"
+	})
+
+	p := parser.NewWithExtensions(parser.CommonExtensions | parser.AutoHeadingIDs)
+	renderer := mdhtml.NewRenderer(mdhtml.RendererOptions{
+		Flags: mdhtml.CommonFlags | mdhtml.SkipHTML | mdhtml.Safelink | mdhtml.NofollowLinks | mdhtml.NoopenerLinks,
+	})
+	return articlePolicy.Sanitize(string(markdown.ToHTML([]byte(content), p, renderer)))
+}
+
+// localNostrPath is the page we serve for a nip19 entity.
+func localNostrPath(entity string) string {
+	switch {
+	case decodePubkey(entity) != "":
+		return "/users/" + entity
+	case decodeEventID(entity) != "":
+		return "/posts/" + entity
+	case decodeAddress(entity) != nil:
+		return "/articles/" + entity
+	}
+	return ""
+}
+
+func shortenEntity(entity string) string {
+	if len(entity) <= 20 {
+		return entity
+	}
+	return entity[:14] + "…" + entity[len(entity)-4:]
+}
+
+// articleContent is what clients show of an article in timelines: the title and summary,
+// the rest is in the card that links to the article page.
+func articleContent(info articleInfo) string {
+	return "<p><strong>" + html.EscapeString(info.Title) + "</strong></p><p>" + html.EscapeString(info.Summary) + "</p>"
+}
+
+func toArticleCard(evt *nostr.Event, info articleInfo, author *Profile) *PreviewCard {
+	card := &PreviewCard{
+		URL:          articleURL(encodeAddress(evt)),
+		Title:        info.Title,
+		Description:  info.Summary,
+		Type:         "link",
+		AuthorURL:    actorURL(evt.PubKey),
+		ProviderName: "nostr",
+		Image:        info.Image,
+	}
+	if author != nil {
+		card.AuthorName = author.DisplayName
+		if card.AuthorName == "" {
+			card.AuthorName = author.Name
+		}
+	}
+	return card
+}
+
+type pageArticle struct {
+	articleInfo
+	Body         template.HTML
+	NostrURI     template.URL
+	Author       *Profile
+	AuthorPubkey string
+	UpdatedAt    time.Time
+}
+
+// articleHandler serves /articles/<naddr>, the article rendered as html.
+func articleHandler(w http.ResponseWriter, r *http.Request) {
+	naddr := strings.TrimPrefix(r.URL.Path, "/articles/")
+	pointer := decodeAddress(naddr)
+	if pointer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := localOnly(r.Context())
+	evt := loadAddressableEvent(ctx, *pointer)
+	if evt == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	page := pageArticle{
+		articleInfo:  parseArticle(evt),
+		Body:         template.HTML(renderMarkdown(evt.Content)),
+		NostrURI:     template.URL("nostr:" + encodeAddress(evt)),
+		Author:       profileOrPlaceholder(ctx, evt.PubKey),
+		AuthorPubkey: evt.PubKey,
+		UpdatedAt:    evt.CreatedAt.Time().UTC(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := articleTemplate.Execute(w, page); err != nil {
+		log.Warn().Err(err).Str("naddr", naddr).Msg("failed to render article")
+	}
+}
+
+var articleTemplate = template.Must(template.New("article").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title>` + pageStyle + `</head>
+<body>
+  <p><a href="/users/{{.AuthorPubkey}}">{{if .Author.Picture}}<img class="avatar" src="{{.Author.Picture}}" alt=""> {{end}}{{or .Author.DisplayName .Author.Name "someone"}}</a></p>
+  {{if .Image}}<img class="media" src="{{.Image}}" alt="">{{end}}
+  <h1>{{.Title}}</h1>
+  <p class="meta">{{.PublishedAt.Format "2006-01-02"}}{{if ne (.PublishedAt.Format "2006-01-02") (.UpdatedAt.Format "2006-01-02")}} · updated {{.UpdatedAt.Format "2006-01-02"}}{{end}}</p>
+  <article>{{.Body}}</article>
+  <p class="meta"><a href="{{.NostrURI}}">open in a nostr client</a></p>
+</body>
+</html>`))
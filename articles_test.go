@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestArticles(t *testing.T) {
+	ctx := context.Background()
+	relay := setupZapTest(t, nil)
+	setTestAddr(t)
+
+	sk := nostr.GeneratePrivateKey()
+	me := &Identity{readRelays: []string{relay.URL}}
+	me.pubkey, _ = nostr.GetPublicKey(sk)
+	rctx := context.WithValue(ctx, identityContextKey{}, me)
+	aliceSk := nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSk)
+	alicenpub, _ := nip19.EncodePublicKey(alice)
+
+	sign := func(sk string, evt *nostr.Event) *nostr.Event {
+		if evt.CreatedAt == 0 {
+			evt.CreatedAt = nostr.Now()
+		}
+		evt.Sign(sk)
+		return evt
+	}
+	saveEvent(ctx, sign(sk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "me"}`}))
+	saveEvent(ctx, sign(sk, &nostr.Event{Kind: 3, Tags: nostr.Tags{{"p", alice}}}))
+	saveEvent(ctx, sign(aliceSk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "alice"}`}))
+
+	article := func(createdAt nostr.Timestamp, title string, content string) *nostr.Event {
+		return sign(aliceSk, &nostr.Event{
+			Kind:      30023,
+			CreatedAt: createdAt,
+			Tags: nostr.Tags{
+				{"d", "cats"},
+				{"title", title},
+				{"summary", "all about <cats>"},
+				{"image", "javascript:alert(1)"},
+			},
+			Content: content,
+		})
+	}
+	now := nostr.Now()
+	first := article(now-100, "Cats", "meow")
+	edited := article(now-50, "Cats & dogs", "# Cats\n\n<script>alert(1)</script>[click](javascript:alert(1)) "+
+		"by nostr:"+alicenpub+"\n\n**meow**")
+	saveEvent(ctx, first)
+	saveEvent(ctx, edited)
+	saveEvent(ctx, first) // arriving late from some relay
+	saveEvent(ctx, sign(aliceSk, &nostr.Event{Kind: 1, CreatedAt: now - 10, Tags: nostr.Tags{}, Content: "a note"}))
+
+	versions, _ := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{30023}, Authors: []string{alice}})
+	var ids []string
+	for evt := range versions {
+		ids = append(ids, evt.ID)
+	}
+	if len(ids) != 1 || ids[0] != edited.ID {
+		t.Fatalf("expected only the edited article to be stored, got %v", ids)
+	}
+
+	naddr := encodeAddress(edited)
+	listStatuses := func(handler http.HandlerFunc, target string) []Status {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", target, nil).WithContext(rctx))
+		var statuses []Status
+		if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+			t.Fatalf("invalid response %d %s: %s", w.Code, w.Body.String(), err)
+		}
+		return statuses
+	}
+	for _, target := range []string{
+		"/api/v1/timelines/home",
+		"/api/v1/accounts/" + alice + "/statuses",
+		"/api/v1/accounts/" + alicenpub + "/statuses",
+	} {
+		var statuses []Status
+		if strings.HasPrefix(target, "/api/v1/timelines") {
+			statuses = listStatuses(homeHandler, target)
+		} else {
+			statuses = listStatuses(accountStatusesHandler, target)
+		}
+		if len(statuses) != 2 {
+			t.Fatalf("%s: expected the note and one version of the article, got %d", target, len(statuses))
+		}
+		status := statuses[1]
+		if status.ID != edited.ID || status.Card == nil {
+			t.Fatalf("%s: expected the edited article with a card, got %+v", target, status)
+		}
+		if status.Content != "<p><strong>Cats &amp; dogs</strong></p><p>all about &lt;cats&gt;</p>" {
+			t.Errorf("%s: unexpected content %s", target, status.Content)
+		}
+		if status.Card.URL != "http://bisu.test:7001/articles/"+naddr || status.URL != status.Card.URL ||
+			status.Card.Title != "Cats & dogs" || status.Card.AuthorName != "alice" || status.Card.Image != "" {
+			t.Errorf("%s: unexpected card %+v", target, status.Card)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	getOrDeleteStatusHandler(w, httptest.NewRequest("GET", "/api/v1/statuses/"+naddr, nil).WithContext(rctx))
+	var status Status
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.ID != edited.ID {
+		t.Errorf("expected the article by its naddr, got %d %s", w.Code, w.Body.String())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/posts/", postHandler)
+	mux.HandleFunc("/articles/", articleHandler)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	w = get("/articles/" + naddr)
+	page := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("expected the article page, got %d %s", w.Code, page)
+	}
+	for _, expected := range []string{"<title>Cats &amp; dogs</title>", "<h1", "<strong>meow</strong>", `href="/users/` + alicenpub + `"`} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("expected %q in article page:\n%s", expected, page)
+		}
+	}
+	for _, unexpected := range []string{"<script", "javascript:"} {
+		if strings.Contains(page, unexpected) {
+			t.Errorf("unexpected %q in article page:\n%s", unexpected, page)
+		}
+	}
+
+	if w := get("/posts/" + edited.ID); w.Code != http.StatusFound || w.Header().Get("Location") != "/articles/"+naddr {
+		t.Errorf("expected a redirect to the article, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := get("/articles/" + alicenpub); w.Code != 404 {
+		t.Errorf("expected 404 for something that isn't an naddr, got %d", w.Code)
+	}
+
+	// articles we don't have are fetched from the relays in the naddr, but not for anyone who
+	// opens the public page
+	elsewhere := sign(aliceSk, &nostr.Event{
+		Kind:    30023,
+		Tags:    nostr.Tags{{"d", "dogs"}, {"title", "Dogs"}},
+		Content: "woof woof",
+	})
+	relay.mu.Lock()
+	relay.events = append(relay.events, elsewhere)
+	relay.mu.Unlock()
+	hinted, _ := nip19.EncodeEntity(alice, 30023, "dogs", []string{relay.URL})
+	if w := get("/articles/" + hinted); w.Code != 404 || storedEvent(t, elsewhere.ID) != nil {
+		t.Errorf("the public page shouldn't fetch articles, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	getOrDeleteStatusHandler(w, httptest.NewRequest("GET", "/api/v1/statuses/"+hinted, nil).WithContext(rctx))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "woof woof") {
+		t.Errorf("expected the article from the relay, got %d %s", w.Code, w.Body.String())
+	}
+	if storedEvent(t, elsewhere.ID) == nil {
+		t.Errorf("expected the fetched article to be stored")
+	}
+	if w := get("/articles/" + hinted); w.Code != 200 || !strings.Contains(w.Body.String(), "woof woof") {
+		t.Errorf("expected the stored article on the page, got %d %s", w.Code, w.Body.String())
+	}
+	if info := parseArticle(elsewhere); info.Summary != "woof woof" {
+		t.Errorf("expected the summary to default to the text, got %q", info.Summary)
+	}
+}
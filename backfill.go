@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	BACKFILL_PAGE_LIMIT   = 200
+	BACKFILL_MAX_PAGES    = 25
+	BACKFILL_CHUNK_SIZE   = 50
+	BACKFILL_PAGE_TIMEOUT = time.Second * 15
+)
+
+// backfill fetches posts from the given authors that were published while we were offline,
+// starting from the newest event we've seen from each one on each relay. the authors we
+// interact with most are fetched first.
+func (id *Identity) backfill(ctx context.Context, authors []string) {
+	days := getConfig().BackfillDays
+	if days == 0 {
+		return
+	}
+	oldest := nostr.Now() - nostr.Timestamp(days*24*60*60)
+
+	authors = id.sortByInteractions(ctx, authors)
+	log.Debug().Int("n", len(authors)).Str("pubkey", id.pubkey).Msg("backfilling")
+
+	for start := 0; start < len(authors); start += BACKFILL_CHUNK_SIZE {
+		end := start + BACKFILL_CHUNK_SIZE
+		if end > len(authors) {
+			end = len(authors)
+		}
+
+		perRelay := make(map[string][]string)
+		for _, author := range authors[start:end] {
+			for _, relay := range fetchOutboxRelaysForUser(ctx, author, 3, false) {
+				perRelay[relay] = append(perRelay[relay], author)
+			}
+		}
+
+		wg := sync.WaitGroup{}
+		wg.Add(len(perRelay))
+		for relay, authors := range perRelay {
+			go func(relay string, authors []string) {
+				defer wg.Done()
+				backfillRelay(ctx, relay, authors, oldest)
+			}(relay, authors)
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// backfillRelay pages backwards on a relay from now until the oldest last-seen timestamp of
+// the given authors (but never before the maximum lookback).
+func backfillRelay(ctx context.Context, url string, authors []string, oldest nostr.Timestamp) {
+	since := nostr.Now()
+	for _, author := range authors {
+		from := oldest
+		if last := getLastFetched(ctx, author, url); last != nil && *last > oldest {
+			from = *last
+		}
+		if from < since {
+			since = from
+		}
+	}
+
+	relay, err := ensureRelay(url)
+	if err != nil {
+		log.Debug().Err(err).Str("relay", url).Msg("not backfilling")
+		return
+	}
+
+	until := nostr.Now()
+	total := 0
+	for page := 0; page < BACKFILL_MAX_PAGES; page++ {
+		filter := nostr.Filter{
+			Kinds:   []int{1, 5, 30023},
+			Authors: authors,
+			Since:   &since,
+			Until:   &until,
+			Limit:   BACKFILL_PAGE_LIMIT,
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, BACKFILL_PAGE_TIMEOUT)
+		events, err := relay.QuerySync(qctx, filter, nostr.WithLabel("backfill"))
+		cancel()
+		if err != nil {
+			log.Warn().Err(err).Str("relay", url).Msg("backfill query failed")
+			return
+		}
+
+		next := until
+		for _, evt := range events {
+			ingestFollowedEvent(ctx, url, evt)
+			if evt.CreatedAt < next {
+				next = evt.CreatedAt
+			}
+		}
+		total += len(events)
+
+		if len(events) < BACKFILL_PAGE_LIMIT || next <= since {
+			break
+		}
+		if next == until {
+			// a full page in a single second, skip it so we don't loop forever
+			next--
+		}
+		until = next
+	}
+
+	log.Debug().Str("relay", url).Int("authors", len(authors)).Int("events", total).Msg("backfilled")
+}
+
+// sortByInteractions puts first the authors we reply to, repost and react to the most.
+func (id *Identity) sortByInteractions(ctx context.Context, authors []string) []string {
+	scores := make(map[string]int)
+	if ch, err := store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{1, 6, 7},
+		Authors: []string{id.pubkey},
+		Limit:   500,
+	}); err == nil {
+		for evt := range ch {
+			for _, tag := range evt.Tags {
+				if len(tag) >= 2 && tag[0] == "p" {
+					scores[tag[1]]++
+				}
+			}
+		}
+	}
+
+	sorted := make([]string, len(authors))
+	copy(sorted, authors)
+	sort.SliceStable(sorted, func(i, j int) bool { return scores[sorted[i]] > scores[sorted[j]] })
+	return sorted
+}
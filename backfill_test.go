@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBackfillRelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+
+	r, _ := ensureRelay(relay.URL)
+	publishAt := func(ago time.Duration) *nostr.Event {
+		evt := nostr.Event{
+			Kind:      1,
+			CreatedAt: nostr.Timestamp(time.Now().Add(-ago).Unix()),
+			Tags:      nostr.Tags{},
+			Content:   ago.String() + " ago",
+		}
+		evt.Sign(sk)
+		r.Publish(ctx, evt)
+		return &evt
+	}
+	tooOld := publishAt(time.Hour * 5)
+	alreadySeen := publishAt(time.Hour * 3)
+	missed1 := publishAt(time.Hour * 2)
+	missed2 := publishAt(time.Hour * 1)
+
+	saveLastSeen(ctx, pk, relay.URL, alreadySeen.CreatedAt)
+	backfillRelay(ctx, relay.URL, []string{pk}, nostr.Timestamp(time.Now().Add(-time.Hour*4).Unix()))
+
+	for _, evt := range []*nostr.Event{missed1, missed2, alreadySeen} {
+		if storedEvent(t, evt.ID) == nil {
+			t.Fatalf("event from %s wasn't backfilled", evt.Content)
+		}
+	}
+	if storedEvent(t, tooOld.ID) != nil {
+		t.Fatalf("event from before the last seen shouldn't have been fetched")
+	}
+	if last := getLastFetched(ctx, pk, relay.URL); last == nil || *last != missed2.CreatedAt {
+		t.Fatalf("last seen should have moved to the newest event, got %v", last)
+	}
+}
+
+func TestSortByInteractions(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	id := &Identity{pubkey: pk}
+
+	friend := "1111111111111111111111111111111111111111111111111111111111111111"
+	acquaintance := "2222222222222222222222222222222222222222222222222222222222222222"
+	stranger := "3333333333333333333333333333333333333333333333333333333333333333"
+
+	for i, target := range []string{friend, friend, acquaintance, friend} {
+		evt := &nostr.Event{Kind: 7, CreatedAt: nostr.Now() - nostr.Timestamp(i), Tags: nostr.Tags{{"p", target}}, Content: "+"}
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+	}
+
+	sorted := id.sortByInteractions(ctx, []string{stranger, acquaintance, friend})
+	if sorted[0] != friend || sorted[1] != acquaintance || sorted[2] != stranger {
+		t.Fatalf("wrong order: %v", sorted)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+const BUNKER_RPC_TIMEOUT = time.Second * 30
+
+// bunkerConfig is what we store on the key file for identities that use a remote signer.
+type bunkerConfig struct {
+	URI          string `json:"bunker"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type bunkerRequest struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type bunkerResponse struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bunkerSigner is a NIP-46 client: it holds an ephemeral key of its own and asks a remote
+// signer (a "bunker") to sign and encrypt things on behalf of the user.
+type bunkerSigner struct {
+	clientSecret string
+	clientPubkey string
+	remotePubkey string
+	relays       []string
+	secret       string
+
+	userPubkey string
+
+	mu        sync.Mutex
+	listeners map[string]chan bunkerResponse
+}
+
+// parseBunkerURI parses bunker://<remote-pubkey>?relay=wss://...&secret=...
+func parseBunkerURI(uri string) (remotePubkey string, relays []string, secret string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "bunker" {
+		return "", nil, "", fmt.Errorf("invalid bunker URI '%s'", uri)
+	}
+
+	remotePubkey = u.Host
+	if !nostr.IsValidPublicKeyHex(remotePubkey) {
+		return "", nil, "", fmt.Errorf("bunker URI has an invalid pubkey '%s'", remotePubkey)
+	}
+
+	for _, relay := range u.Query()["relay"] {
+		if relay = nostr.NormalizeURL(relay); relay != "" {
+			relays = append(relays, relay)
+		}
+	}
+	if len(relays) == 0 {
+		return "", nil, "", fmt.Errorf("bunker URI has no relays")
+	}
+
+	return remotePubkey, relays, u.Query().Get("secret"), nil
+}
+
+// connectBunker starts listening for responses from the bunker, sends "connect" and asks
+// for the user pubkey, so by the time it returns the signer is ready to be used.
+func connectBunker(ctx context.Context, cfg bunkerConfig) (*bunkerSigner, error) {
+	remotePubkey, relays, secret, err := parseBunkerURI(cfg.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := newBunkerSigner(cfg.ClientSecret, relays)
+	if err != nil {
+		return nil, err
+	}
+	bs.remotePubkey = remotePubkey
+	bs.secret = secret
+	bs.listen()
+
+	if _, err := bs.rpc(ctx, "connect", remotePubkey, secret); err != nil {
+		return nil, fmt.Errorf("bunker refused to connect: %w", err)
+	}
+	if bs.userPubkey, err = bs.rpc(ctx, "get_public_key"); err != nil {
+		return nil, fmt.Errorf("bunker didn't give us a pubkey: %w", err)
+	}
+	if !nostr.IsValidPublicKeyHex(bs.userPubkey) {
+		return nil, fmt.Errorf("bunker gave us an invalid pubkey '%s'", bs.userPubkey)
+	}
+
+	return bs, nil
+}
+
+// waitNostrConnect does the opposite of connectBunker: we give the nostrconnect:// URI to the
+// user, they paste it into their signer app, and then we wait for the signer to reach out.
+func waitNostrConnect(ctx context.Context, clientSecret string, relays []string, uri chan<- string) (*bunkerSigner, error) {
+	bs, err := newBunkerSigner(clientSecret, relays)
+	if err != nil {
+		return nil, err
+	}
+	bs.secret = randomString(8)
+
+	qs := url.Values{}
+	for _, relay := range relays {
+		qs.Add("relay", relay)
+	}
+	qs.Set("secret", bs.secret)
+	qs.Set("metadata", `{"name":"bisu"}`)
+	uri <- "nostrconnect://" + bs.clientPubkey + "?" + qs.Encode()
+
+	wctx, stop := context.WithCancel(ctx)
+	defer stop()
+	answers := make(chan *nostr.Event)
+	for _, url := range relays {
+		go keepSubscribed(wctx, url, "nostrconnect", func() nostr.Filter {
+			return nostr.Filter{
+				Kinds: []int{nostr.KindNostrConnect},
+				Tags:  nostr.TagMap{"p": []string{bs.clientPubkey}},
+			}
+		}, func(evt *nostr.Event) {
+			select {
+			case answers <- evt:
+			case <-wctx.Done():
+			}
+		})
+	}
+	for bs.remotePubkey == "" {
+		select {
+		case evt := <-answers:
+			resp, err := bs.decryptResponse(evt)
+			if err != nil {
+				continue
+			}
+			// only whoever got the uri knows the secret, anyone else could answer "ack" and
+			// become our signer
+			if resp.Result == bs.secret {
+				bs.remotePubkey = evt.PubKey
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no signer connected: %w", ctx.Err())
+		}
+	}
+	stop()
+
+	bs.listen()
+	if bs.userPubkey, err = bs.rpc(ctx, "get_public_key"); err != nil {
+		return nil, fmt.Errorf("bunker didn't give us a pubkey: %w", err)
+	}
+
+	return bs, nil
+}
+
+func newBunkerSigner(clientSecret string, relays []string) (*bunkerSigner, error) {
+	clientPubkey, err := nostr.GetPublicKey(clientSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bunker client key: %w", err)
+	}
+
+	return &bunkerSigner{
+		clientSecret: clientSecret,
+		clientPubkey: clientPubkey,
+		relays:       relays,
+		listeners:    make(map[string]chan bunkerResponse),
+	}, nil
+}
+
+// config returns what must be saved so we can reconnect to the same bunker later.
+func (bs *bunkerSigner) config() bunkerConfig {
+	qs := url.Values{}
+	for _, relay := range bs.relays {
+		qs.Add("relay", relay)
+	}
+	return bunkerConfig{
+		URI:          "bunker://" + bs.remotePubkey + "?" + qs.Encode(),
+		ClientSecret: bs.clientSecret,
+	}
+}
+
+func (bs *bunkerSigner) listen() {
+	for _, url := range bs.relays {
+		go keepSubscribed(context.Background(), url, "bunker", func() nostr.Filter {
+			since := nostr.Now() - 60
+			return nostr.Filter{
+				Kinds:   []int{nostr.KindNostrConnect},
+				Authors: []string{bs.remotePubkey},
+				Tags:    nostr.TagMap{"p": []string{bs.clientPubkey}},
+				Since:   &since,
+			}
+		}, func(evt *nostr.Event) {
+			resp, err := bs.decryptResponse(evt)
+			if err != nil {
+				log.Debug().Err(err).Str("relay", url).Msg("got invalid response from bunker")
+				return
+			}
+
+			if resp.Result == "auth_url" {
+				log.Warn().Str("url", resp.Error).Msg("bunker wants you to open this url to authorize bisu")
+				return
+			}
+
+			bs.mu.Lock()
+			listener, ok := bs.listeners[resp.ID]
+			delete(bs.listeners, resp.ID)
+			bs.mu.Unlock()
+			if ok {
+				listener <- resp
+			}
+		})
+	}
+}
+
+func (bs *bunkerSigner) decryptResponse(evt *nostr.Event) (bunkerResponse, error) {
+	var resp bunkerResponse
+
+	key, err := nip04.ComputeSharedSecret(evt.PubKey, bs.clientSecret)
+	if err != nil {
+		return resp, err
+	}
+	plaintext, err := nip04.Decrypt(evt.Content, key)
+	if err != nil {
+		return resp, err
+	}
+
+	err = json.Unmarshal([]byte(plaintext), &resp)
+	return resp, err
+}
+
+// rpc sends a request to the bunker on all its relays and waits for the first response.
+func (bs *bunkerSigner) rpc(ctx context.Context, method string, params ...string) (string, error) {
+	req := bunkerRequest{
+		ID:     randomString(8),
+		Method: method,
+		Params: params,
+	}
+	if req.Params == nil {
+		req.Params = []string{}
+	}
+	j, _ := json.Marshal(req)
+
+	key, err := nip04.ComputeSharedSecret(bs.remotePubkey, bs.clientSecret)
+	if err != nil {
+		return "", err
+	}
+	content, err := nip04.Encrypt(string(j), key)
+	if err != nil {
+		return "", err
+	}
+
+	evt := nostr.Event{
+		Kind:      nostr.KindNostrConnect,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", bs.remotePubkey}},
+		Content:   content,
+	}
+	if err := evt.Sign(bs.clientSecret); err != nil {
+		return "", err
+	}
+
+	listener := make(chan bunkerResponse, 1)
+	bs.mu.Lock()
+	bs.listeners[req.ID] = listener
+	bs.mu.Unlock()
+	defer func() {
+		bs.mu.Lock()
+		delete(bs.listeners, req.ID)
+		bs.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, BUNKER_RPC_TIMEOUT)
+	defer cancel()
+
+	sent := 0
+	for _, url := range bs.relays {
+		relay, err := ensureRelay(url)
+		if err != nil {
+			log.Warn().Err(err).Str("relay", url).Msg("failed to connect to bunker relay")
+			continue
+		}
+		if _, err := relay.Publish(ctx, evt); err != nil {
+			log.Warn().Err(err).Str("relay", url).Msg("failed to send request to bunker")
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return "", fmt.Errorf("couldn't reach the bunker on any of %v", bs.relays)
+	}
+
+	select {
+	case resp := <-listener:
+		if resp.Error != "" {
+			return "", fmt.Errorf("bunker error: %s", resp.Error)
+		}
+		return resp.Result, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("bunker didn't answer '%s': %w", method, ctx.Err())
+	}
+}
+
+func (bs *bunkerSigner) GetPublicKey(ctx context.Context) (string, error) {
+	return bs.userPubkey, nil
+}
+
+func (bs *bunkerSigner) SignEvent(ctx context.Context, evt *nostr.Event) error {
+	evt.PubKey = bs.userPubkey
+	if evt.Tags == nil {
+		evt.Tags = nostr.Tags{}
+	}
+	j, _ := json.Marshal(evt)
+
+	result, err := bs.rpc(ctx, "sign_event", string(j))
+	if err != nil {
+		return err
+	}
+
+	var signed nostr.Event
+	if err := json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("bunker returned an invalid event: %w", err)
+	}
+	if signed.PubKey != bs.userPubkey || signed.GetID() != evt.GetID() {
+		return fmt.Errorf("bunker signed something else")
+	}
+	if ok, _ := signed.CheckSignature(); !ok {
+		return fmt.Errorf("bunker returned an invalid signature")
+	}
+
+	evt.ID = signed.ID
+	evt.Sig = signed.Sig
+	return nil
+}
+
+func (bs *bunkerSigner) Encrypt(ctx context.Context, plaintext string, recipient string) (string, error) {
+	return bs.rpc(ctx, "nip44_encrypt", recipient, plaintext)
+}
+
+func (bs *bunkerSigner) Decrypt(ctx context.Context, ciphertext string, sender string) (string, error) {
+	return bs.rpc(ctx, "nip44_decrypt", sender, ciphertext)
+}
+
+func isBunkerInput(text string) bool {
+	return strings.HasPrefix(text, "bunker://") || text == "nostrconnect"
+}
@@ -7,14 +7,18 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/fiatjaf/bisu/nip49"
 	"github.com/mitchellh/go-homedir"
 	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/term"
 )
 
 type Config struct {
 	DataDir         string `json:"-"`
 	PrivateKey      string `json:"privatekey,omitempty"`
+	NcryptSec       string `json:"-"` // the encrypted form of PrivateKey, what we save on disk
 	PublicKey       string
 	Following       []Follow          `json:"following"`
 	Relays          map[string]Policy `json:"relays,omitempty"`
@@ -36,9 +40,12 @@ type Policy struct {
 
 func handleConfig() (*Config, error) {
 	var config Config
+	var encryptKey bool
 
 	flag.StringVar(&config.DataDir, "datadir", "~/.config/nostr",
 		"Base directory for configurations and data from Nostr.")
+	flag.BoolVar(&encryptKey, "encrypt-key", false,
+		"Encrypt the plaintext private key on the config file with a passphrase.")
 	flag.Parse()
 	config.DataDir, _ = homedir.Expand(config.DataDir)
 	os.Mkdir(config.DataDir, 0700)
@@ -55,6 +62,25 @@ func handleConfig() (*Config, error) {
 		return nil, fmt.Errorf("invalid json (%s): %w", path, err)
 	}
 
+	if strings.HasPrefix(config.PrivateKey, "ncryptsec1") {
+		config.NcryptSec = config.PrivateKey
+		config.PrivateKey, err = nip49.Decrypt(config.NcryptSec, askPassphrase("passphrase: "))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+		}
+	} else if encryptKey && config.PrivateKey != "" {
+		passphrase := askPassphrase("passphrase to encrypt your key with: ")
+		if passphrase == "" {
+			return nil, fmt.Errorf("no passphrase given, set BISU_PASSPHRASE or run this on a terminal")
+		}
+		config.NcryptSec, err = nip49.Encrypt(config.PrivateKey, passphrase,
+			nip49.DefaultLogN, nip49.KnownToHaveBeenHandledInsecurely)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt private key: %w", err)
+		}
+		saveConfig(path, config)
+	}
+
 	if len(config.FallbackRelays) == 0 {
 		for relay, policy := range config.Relays {
 			if policy.Read {
@@ -103,7 +129,28 @@ func handleConfig() (*Config, error) {
 	return &config, nil
 }
 
+// askPassphrase reads the passphrase from BISU_PASSPHRASE or prompts for it on the terminal.
+func askPassphrase(prompt string) string {
+	if passphrase := os.Getenv("BISU_PASSPHRASE"); passphrase != "" {
+		return passphrase
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return ""
+	}
+	fmt.Print(prompt)
+	b, _ := term.ReadPassword(fd)
+	fmt.Println()
+	return string(b)
+}
+
 func saveConfig(path string, config Config) {
+	if config.NcryptSec != "" {
+		// never write the decrypted key back
+		config.PrivateKey = config.NcryptSec
+	}
+
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
 	if err != nil {
 		log.Fatal("can't open config file " + path + ": " + err.Error())
@@ -3,19 +3,20 @@ package main
 import (
 	"context"
 	"database/sql"
-	_ "embed"
+	"embed"
 	"encoding/json"
 	"log"
 	"path/filepath"
 	"time"
 
+	"github.com/fiatjaf/bisu/migrate"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nbd-wtf/go-nostr"
 )
 
-//go:embed schema.sql
-var schema string
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
 
 type Store struct {
 	db *sqlx.DB
@@ -28,7 +29,13 @@ func initStore(datadir string) *Store {
 		log.Fatalln(err)
 	}
 
-	db.MustExec(schema)
+	migrations, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := migrate.Run(db.DB, migrations); err != nil {
+		log.Fatalln("failed to migrate database:", err)
+	}
 	db.SetMaxOpenConns(1)
 
 	return &Store{db: db}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Config is everything that can be tweaked without touching the code. it's read from a JSON
+// file (<datadir>/config.json by default), then overridden by BISU_* environment variables
+// and then by command line flags.
+type Config struct {
+	Listen  string `json:"listen"`
+	DataDir string `json:"datadir"`
+
+	// used for our identities when they don't have a relay list
+	ReadRelays  []string `json:"read_relays"`
+	WriteRelays []string `json:"write_relays"`
+
+	// used when we don't know where to find something
+	DefaultRelays []string `json:"default_relays"`
+	ProfileRelays []string `json:"profile_relays"`
+	SearchRelays  []string `json:"search_relays"`
+
+	// events from people we follow are kept in the local store for at least this long
+	RetentionDays int `json:"retention_days"`
+
+	// above this the least recently used events that aren't ours, aren't in threads we took
+	// part in and aren't bookmarked or favourited are evicted, 0 disables it
+	MaxStoreMB int `json:"max_store_mb"`
+
+	// how far back to look for posts we missed while offline, 0 disables it
+	BackfillDays int `json:"backfill_days"`
+
+	MaxTootChars int `json:"max_toot_chars"`
+
+	// a Blossom or NIP-96 server where media is uploaded to
+	MediaServer string `json:"media_server"`
+
+	// a NIP-47 connection string (nostr+walletconnect://...) of the wallet zaps are paid with
+	WalletConnect string `json:"wallet_connect"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:  "127.0.0.1:7001",
+		DataDir: "~/.config/bisu",
+		ReadRelays: []string{
+			"wss://nostr.mom",
+			"wss://relayable.org",
+		},
+		WriteRelays: []string{
+			"wss://nostr.mom",
+			"wss://nostr-pub.wellorder.net",
+		},
+		DefaultRelays: []string{
+			"wss://nostr-pub.wellorder.net",
+			"wss://nos.lol",
+			"wss://relay.damus.io",
+			"wss://nostr.mom",
+			"wss://relay.nostr.band",
+			"wss://relay.shitforce.one",
+		},
+		ProfileRelays: []string{
+			"wss://purplepag.es",
+			"wss://relay.nostr.band",
+		},
+		SearchRelays: []string{
+			"wss://relay.nostr.band",
+			"wss://nostr.wine",
+			"wss://relay.noswhere.com",
+		},
+		RetentionDays: 30 * 7,
+		MaxStoreMB:    1024,
+		BackfillDays:  3,
+		MaxTootChars:  900,
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// getConfig returns the config in effect. it may be swapped by a reload at any time, so
+// callers shouldn't hold on to it for long.
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// configArgs are the command line arguments the config was loaded from, so it can be reloaded.
+var configArgs []string
+
+// loadConfig reads the config from file, env and flags and returns it along with the
+// arguments that are left after the flags (the subcommand, if any).
+func loadConfig(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("bisu", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the config file (default <datadir>/config.json)")
+	listen := fs.String("listen", "", "address to listen on")
+	datadir := fs.String("datadir", "", "directory where keys and databases are stored")
+	readRelays := fs.String("read-relays", "", "comma-separated fallback read relays")
+	writeRelays := fs.String("write-relays", "", "comma-separated fallback write relays")
+	defaultRelays := fs.String("default-relays", "", "comma-separated relays used when nothing better is known")
+	profileRelays := fs.String("profile-relays", "", "comma-separated relays for fetching profiles")
+	searchRelays := fs.String("search-relays", "", "comma-separated relays for search")
+	retentionDays := fs.Int("retention-days", 0, "days to keep events from people we follow")
+	maxStoreMB := fs.Int("max-store-mb", 0, "size of the event store above which old events are evicted")
+	backfillDays := fs.Int("backfill-days", 0, "days to look back for posts missed while offline")
+	maxTootChars := fs.Int("max-toot-chars", 0, "maximum length of a post")
+	mediaServer := fs.String("media-server", "", "Blossom or NIP-96 server to upload media to")
+	walletConnect := fs.String("wallet-connect", "", "nostr+walletconnect:// connection string of the wallet to zap with")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := defaultConfig()
+
+	// we need the datadir before anything else to find the config file
+	if v := os.Getenv("BISU_DATADIR"); v != "" {
+		cfg.DataDir = v
+	}
+	if *datadir != "" {
+		cfg.DataDir = *datadir
+	}
+	dir, _ := homedir.Expand(cfg.DataDir)
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("BISU_CONFIG")
+	}
+	if path == "" {
+		path = filepath.Join(dir, "config.json")
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) || *configPath != "" {
+		return nil, nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	// env overrides the file
+	for env, target := range map[string]*string{
+		"BISU_LISTEN":         &cfg.Listen,
+		"BISU_DATADIR":        &cfg.DataDir,
+		"BISU_MEDIA_SERVER":   &cfg.MediaServer,
+		"BISU_WALLET_CONNECT": &cfg.WalletConnect,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*target = v
+		}
+	}
+	for env, target := range map[string]*[]string{
+		"BISU_READ_RELAYS":    &cfg.ReadRelays,
+		"BISU_WRITE_RELAYS":   &cfg.WriteRelays,
+		"BISU_DEFAULT_RELAYS": &cfg.DefaultRelays,
+		"BISU_PROFILE_RELAYS": &cfg.ProfileRelays,
+		"BISU_SEARCH_RELAYS":  &cfg.SearchRelays,
+	} {
+		if v := os.Getenv(env); v != "" {
+			*target = splitList(v)
+		}
+	}
+	for env, target := range map[string]*int{
+		"BISU_RETENTION_DAYS": &cfg.RetentionDays,
+		"BISU_MAX_STORE_MB":   &cfg.MaxStoreMB,
+		"BISU_BACKFILL_DAYS":  &cfg.BackfillDays,
+		"BISU_MAX_TOOT_CHARS": &cfg.MaxTootChars,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s must be a number, got '%s'", env, v)
+			}
+			*target = n
+		}
+	}
+
+	// and flags override everything
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "datadir":
+			cfg.DataDir = *datadir
+		case "read-relays":
+			cfg.ReadRelays = splitList(*readRelays)
+		case "write-relays":
+			cfg.WriteRelays = splitList(*writeRelays)
+		case "default-relays":
+			cfg.DefaultRelays = splitList(*defaultRelays)
+		case "profile-relays":
+			cfg.ProfileRelays = splitList(*profileRelays)
+		case "search-relays":
+			cfg.SearchRelays = splitList(*searchRelays)
+		case "retention-days":
+			cfg.RetentionDays = *retentionDays
+		case "max-store-mb":
+			cfg.MaxStoreMB = *maxStoreMB
+		case "backfill-days":
+			cfg.BackfillDays = *backfillDays
+		case "max-toot-chars":
+			cfg.MaxTootChars = *maxTootChars
+		case "media-server":
+			cfg.MediaServer = *mediaServer
+		case "wallet-connect":
+			cfg.WalletConnect = *walletConnect
+		}
+	})
+
+	cfg.DataDir, _ = homedir.Expand(cfg.DataDir)
+	if err := cfg.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return &cfg, fs.Args(), nil
+}
+
+func (cfg *Config) validate() error {
+	if _, port, err := net.SplitHostPort(cfg.Listen); err != nil || port == "" {
+		return fmt.Errorf("listen address '%s' must be in the host:port form", cfg.Listen)
+	}
+	if cfg.DataDir == "" {
+		return fmt.Errorf("datadir can't be empty")
+	}
+
+	for name, relays := range map[string][]string{
+		"read_relays":    cfg.ReadRelays,
+		"write_relays":   cfg.WriteRelays,
+		"default_relays": cfg.DefaultRelays,
+		"profile_relays": cfg.ProfileRelays,
+		"search_relays":  cfg.SearchRelays,
+	} {
+		if len(relays) == 0 {
+			return fmt.Errorf("%s can't be empty", name)
+		}
+		for i, relay := range relays {
+			u, err := url.Parse(relay)
+			if err != nil || (u.Scheme != "wss" && u.Scheme != "ws") || u.Host == "" {
+				return fmt.Errorf("%s has an invalid relay url '%s'", name, relay)
+			}
+			relays[i] = strings.TrimSuffix(relay, "/")
+		}
+	}
+
+	if cfg.RetentionDays < 1 {
+		return fmt.Errorf("retention_days must be at least 1")
+	}
+	if cfg.MaxStoreMB < 0 {
+		return fmt.Errorf("max_store_mb can't be negative")
+	}
+	if cfg.BackfillDays < 0 {
+		return fmt.Errorf("backfill_days can't be negative")
+	}
+	if cfg.MaxTootChars < 1 {
+		return fmt.Errorf("max_toot_chars must be at least 1")
+	}
+	if cfg.MediaServer != "" {
+		u, err := url.Parse(cfg.MediaServer)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("media_server must be an http url, got '%s'", cfg.MediaServer)
+		}
+		cfg.MediaServer = strings.TrimSuffix(cfg.MediaServer, "/")
+	}
+	if cfg.WalletConnect != "" {
+		if _, err := parseWalletConnect(cfg.WalletConnect); err != nil {
+			return fmt.Errorf("wallet_connect is invalid: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// reloadConfig reads the config again and swaps it in. things that are only used at startup
+// (the listen address and the datadir) can't change without a restart.
+func reloadConfig() error {
+	cfg, _, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+
+	old := getConfig()
+	if cfg.Listen != old.Listen || cfg.DataDir != old.DataDir {
+		log.Warn().Msg("listen and datadir changes only take effect after a restart")
+		cfg.Listen = old.Listen
+		cfg.DataDir = old.DataDir
+	}
+
+	currentConfig.Store(cfg)
+	return nil
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0, 5)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
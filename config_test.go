@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "config.json"), []byte(`{
+  "listen": "127.0.0.1:8001",
+  "search_relays": ["wss://search.example.com/"],
+  "max_toot_chars": 500
+}`), 0644)
+
+	t.Setenv("BISU_DATADIR", dir)
+	t.Setenv("BISU_LISTEN", "127.0.0.1:8002")
+	t.Setenv("BISU_RETENTION_DAYS", "10")
+
+	cfg, args, err := loadConfig([]string{"-max-toot-chars", "2000", "add-key"})
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	if cfg.Listen != "127.0.0.1:8002" {
+		t.Fatalf("env should override the file, got listen %s", cfg.Listen)
+	}
+	if cfg.MaxTootChars != 2000 {
+		t.Fatalf("flag should override the file, got max_toot_chars %d", cfg.MaxTootChars)
+	}
+	if cfg.RetentionDays != 10 {
+		t.Fatalf("got retention_days %d", cfg.RetentionDays)
+	}
+	if len(cfg.SearchRelays) != 1 || cfg.SearchRelays[0] != "wss://search.example.com" {
+		t.Fatalf("got search_relays %v", cfg.SearchRelays)
+	}
+	if len(cfg.DefaultRelays) == 0 {
+		t.Fatalf("defaults should be kept for what isn't set")
+	}
+	if len(args) != 1 || args[0] != "add-key" {
+		t.Fatalf("got args %v", args)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for name, mutate := range map[string]func(*Config){
+		"no port":          func(c *Config) { c.Listen = "127.0.0.1" },
+		"http relay":       func(c *Config) { c.DefaultRelays = []string{"https://relay.example.com"} },
+		"no write relays":  func(c *Config) { c.WriteRelays = nil },
+		"zero retention":   func(c *Config) { c.RetentionDays = 0 },
+		"negative maxchar": func(c *Config) { c.MaxTootChars = -1 },
+		"wallet no secret": func(c *Config) {
+			c.WalletConnect = "nostr+walletconnect://" + strings.Repeat("a", 64) + "?relay=wss://relay.example.com"
+		},
+	} {
+		cfg := defaultConfig()
+		mutate(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("default config should be valid: %s", err)
+	}
+}
+
+// setTestConfig makes getConfig() return the defaults changed by mutate during a test.
+func setTestConfig(t *testing.T, mutate func(*Config)) {
+	cfg := defaultConfig()
+	if mutate != nil {
+		mutate(&cfg)
+	}
+	previous := currentConfig.Swap(&cfg)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+}
+
+// setTestAddr makes the urls bisu gives out point to bisu.test:7001 during a test.
+func setTestAddr(t *testing.T) {
+	previous := srv.Addr
+	srv.Addr = "bisu.test:7001"
+	t.Cleanup(func() { srv.Addr = previous })
+}
+
+// setContactListRelays makes contact lists be looked for in the given relays during a test.
+func setContactListRelays(t *testing.T, relays ...string) {
+	previous := contactListRelays
+	contactListRelays = relays
+	t.Cleanup(func() { contactListRelays = previous })
+}
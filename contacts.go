@@ -21,21 +21,26 @@ func loadContactList(ctx context.Context, pubkey string) *[]Follow {
 		log.Debug().Str("pubkey", pubkey).Msg("failed to load contact list event")
 		return nil
 	} else {
-		follows := make([]Follow, 0, len(evt.Tags))
-		for _, tag := range evt.Tags {
-			if len(tag) >= 2 && tag[0] == "p" {
-				follow := Follow{Pubkey: tag[1], Relay: tag.Relay()}
-				if len(tag) >= 4 {
-					follow.Petname = tag[3]
-				}
-				follows = append(follows, follow)
-			}
-		}
+		follows := parseContactList(evt)
 		contactListsCache.Set(pubkey, &follows, 1)
 		return &follows
 	}
 }
 
+func parseContactList(evt *nostr.Event) []Follow {
+	follows := make([]Follow, 0, len(evt.Tags))
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			follow := Follow{Pubkey: tag[1], Relay: tag.Relay()}
+			if len(tag) >= 4 {
+				follow.Petname = tag[3]
+			}
+			follows = append(follows, follow)
+		}
+	}
+	return follows
+}
+
 func loadRelaysList(ctx context.Context, pubkey string) (read []string, write []string) {
 	if evt := loadReplaceableEvent(ctx, pubkey, 10002); evt != nil {
 		for _, tag := range evt.Tags {
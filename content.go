@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var (
+	nostrEntityMatcher = regexp.MustCompile(`nostr:((?:npub|nprofile|note|nevent|naddr)1[02-9ac-hj-np-z]+)`)
+	// at least one letter so "#1" isn't a tag, and not right after something that makes it
+	// part of a word or an url
+	hashtagMatcher   = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/#])(#[\p{L}\p{N}_]*[\p{L}_][\p{L}\p{N}_]*)`)
+	paragraphMatcher = regexp.MustCompile(`\n\s*\n`)
+)
+
+func tagURL(tag string) string { return "http://" + srv.Addr + "/tags/" + url.PathEscape(tag) }
+
+// hashtagValues are the "t" tags to look for a hashtag in: lowercase, like NIP-24 says they
+// should be, and as it was asked for.
+func hashtagValues(tag string) []string {
+	if lower := strings.ToLower(tag); lower != tag {
+		return []string{lower, tag}
+	}
+	return []string{tag}
+}
+
+// renderedContent is the html for the text of a note along with what was found in it.
+type renderedContent struct {
+	HTML     string
+	Mentions []string // pubkeys mentioned with nostr:npub or nostr:nprofile
+	Tags     []string // hashtags, without the #
+}
+
+type contentToken struct {
+	start, end int
+	html       string
+}
+
+// renderContent turns note text into html that is safe to show: everything is escaped,
+// paragraphs and line breaks are kept, http urls, hashtags and NIP-27 references become links
+// and the urls of the attachments, which clients show on their own, are left out.
+func renderContent(ctx context.Context, content string, attachments []Attachment) renderedContent {
+	var rendered renderedContent
+	skip := make(map[string]bool, len(attachments))
+	for _, attachment := range attachments {
+		skip[attachment.URL] = true
+	}
+	mentioned := make(map[string]bool)
+	tagged := make(map[string]bool)
+
+	renderLine := func(line string) string {
+		var tokens []contentToken
+
+		for _, m := range nostrEntityMatcher.FindAllStringSubmatchIndex(line, -1) {
+			entity := line[m[2]:m[3]]
+			token := contentToken{start: m[0], end: m[1]}
+			if pubkey := decodePubkey(entity); pubkey != "" {
+				token.html = `<span class="h-card"><a href="` + html.EscapeString(actorURL(pubkey)) +
+					`" class="u-url mention" rel="nofollow">@<span>` + html.EscapeString(mentionName(ctx, pubkey)) + `</span></a></span>`
+				if !mentioned[pubkey] {
+					mentioned[pubkey] = true
+					rendered.Mentions = append(rendered.Mentions, pubkey)
+				}
+			} else if id := decodeEventID(entity); id != "" {
+				token.html = quoteLink(postURL(id), entity)
+			} else if decodeAddress(entity) != nil {
+				token.html = quoteLink(articleURL(entity), entity)
+			} else {
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+
+		for _, m := range urlMatcher.FindAllStringIndex(line, -1) {
+			link := line[m[0]:m[1]]
+			token := contentToken{start: m[0], end: m[1]}
+			switch {
+			case skip[link]:
+				// shown as an attachment, so it is just removed
+			case isHTTPURL(link):
+				token.html = `<a href="` + html.EscapeString(link) + `" rel="nofollow noopener noreferrer" target="_blank">` +
+					html.EscapeString(link) + `</a>`
+			default:
+				continue
+			}
+			tokens = append(tokens, token)
+		}
+
+		for _, m := range hashtagMatcher.FindAllStringSubmatchIndex(line, -1) {
+			tag := line[m[2]+1 : m[3]]
+			tokens = append(tokens, contentToken{
+				start: m[2],
+				end:   m[3],
+				html: `<a href="` + html.EscapeString(tagURL(strings.ToLower(tag))) + `" class="mention hashtag" rel="tag">#<span>` +
+					html.EscapeString(tag) + `</span></a>`,
+			})
+			if lower := strings.ToLower(tag); !tagged[lower] {
+				tagged[lower] = true
+				rendered.Tags = append(rendered.Tags, lower)
+			}
+		}
+
+		// when matches overlap the one that starts first wins, nostr references before urls
+		// before hashtags when they start at the same place
+		sort.SliceStable(tokens, func(i, j int) bool { return tokens[i].start < tokens[j].start })
+
+		var b strings.Builder
+		pos := 0
+		for _, token := range tokens {
+			if token.start < pos {
+				continue
+			}
+			b.WriteString(html.EscapeString(line[pos:token.start]))
+			b.WriteString(token.html)
+			pos = token.end
+		}
+		b.WriteString(html.EscapeString(line[pos:]))
+		return strings.TrimSpace(b.String())
+	}
+
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	var paragraphs []string
+	for _, paragraph := range paragraphMatcher.Split(strings.TrimSpace(content), -1) {
+		var lines []string
+		for _, line := range strings.Split(paragraph, "\n") {
+			// lines that only had attachments in them go away entirely
+			if line := renderLine(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			paragraphs = append(paragraphs, "<p>"+strings.Join(lines, "<br>")+"</p>")
+		}
+	}
+	rendered.HTML = strings.Join(paragraphs, "")
+	return rendered
+}
+
+// mentionName is what goes after the @ in a mention.
+func mentionName(ctx context.Context, pubkey string) string {
+	if profile := loadProfile(ctx, pubkey); profile != nil {
+		if profile.DisplayName != "" {
+			return profile.DisplayName
+		}
+		if profile.Name != "" {
+			return profile.Name
+		}
+	}
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	return shortenEntity(npub)
+}
+
+func quoteLink(target string, entity string) string {
+	return `<a href="` + html.EscapeString(target) + `" class="quote-inline" rel="nofollow">` +
+		html.EscapeString(shortenEntity(entity)) + `</a>`
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestRenderContent(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+	relay := startTestRelay(t)
+	setTestConfig(t, func(cfg *Config) { cfg.DefaultRelays = []string{relay.URL} })
+	setContactListRelays(t, relay.URL)
+	t.Cleanup(waitForCountRefreshes)
+	setTestAddr(t)
+
+	aliceSk := nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSk)
+	metadata := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Tags: nostr.Tags{},
+		Content: `{"name": "alice", "display_name": "<img src=x onerror=alert(1)>"}`}
+	metadata.Sign(aliceSk)
+	saveEvent(ctx, metadata)
+	npub, _ := nip19.EncodePublicKey(alice)
+	nprofile, _ := nip19.EncodeProfile(alice, []string{"wss://relay.example.com"})
+	id := strings.Repeat("ab", 32)
+	note, _ := nip19.EncodeNote(id)
+	nevent, _ := nip19.EncodeEvent(id, []string{"wss://relay.example.com"}, alice)
+	naddr, _ := nip19.EncodeEntity(alice, 30023, "cats", nil)
+	mention := `<span class="h-card"><a href="http://bisu.test:7001/users/` + alice +
+		`" class="u-url mention" rel="nofollow">@<span>&lt;img src=x onerror=alert(1)&gt;</span></a></span>`
+
+	for _, test := range []struct {
+		name        string
+		content     string
+		attachments []string
+		html        string
+		mentions    []string
+		tags        []string
+	}{
+		{
+			name:    "paragraphs",
+			content: "hello\r\nworld\n\n\n  \nbye\n",
+			html:    "<p>hello<br>world</p><p>bye</p>",
+		},
+		{
+			name:    "markup",
+			content: `<script>alert(1)</script><b onclick="x()">'hi'</b> &amp;`,
+			html:    `<p>&lt;script&gt;alert(1)&lt;/script&gt;&lt;b onclick=&#34;x()&#34;&gt;&#39;hi&#39;&lt;/b&gt; &amp;amp;</p>`,
+		},
+		{
+			name:    "link",
+			content: "see https://example.com/a?b=1&c=<2>.",
+			html: `<p>see <a href="https://example.com/a?b=1&amp;c=" rel="nofollow noopener noreferrer" target="_blank">` +
+				`https://example.com/a?b=1&amp;c=</a>&lt;2&gt;.</p>`,
+		},
+		{
+			name:    "link breaking out of the attribute",
+			content: `https://example.com/"onmouseover="alert(1)`,
+			html: `<p><a href="https://example.com/" rel="nofollow noopener noreferrer" target="_blank">https://example.com/</a>` +
+				`&#34;onmouseover=&#34;alert(1)</p>`,
+		},
+		{
+			name:    "other schemes",
+			content: "javascript:alert(1) javascript://example.com/%0aalert(1) data:text/html,<script>",
+			html:    "<p>javascript:alert(1) javascript://example.com/%0aalert(1) data:text/html,&lt;script&gt;</p>",
+		},
+		{
+			name:    "hashtags",
+			content: "#nostr, #Café and #nostr again but not #1, a#b, &#39; or https://example.com/#top",
+			html: `<p><a href="http://bisu.test:7001/tags/nostr" class="mention hashtag" rel="tag">#<span>nostr</span></a>, ` +
+				`<a href="http://bisu.test:7001/tags/caf%C3%A9" class="mention hashtag" rel="tag">#<span>Café</span></a> and ` +
+				`<a href="http://bisu.test:7001/tags/nostr" class="mention hashtag" rel="tag">#<span>nostr</span></a> again but not #1, a#b, &amp;#39; or ` +
+				`<a href="https://example.com/#top" rel="nofollow noopener noreferrer" target="_blank">https://example.com/#top</a></p>`,
+			tags: []string{"nostr", "café"},
+		},
+		{
+			name:     "mentions",
+			content:  "hi nostr:" + npub + " and nostr:" + nprofile,
+			html:     "<p>hi " + mention + " and " + mention + "</p>",
+			mentions: []string{alice},
+		},
+		{
+			name:    "quotes",
+			content: "nostr:" + note + "\nnostr:" + nevent + "\nnostr:" + naddr,
+			html: `<p><a href="http://bisu.test:7001/posts/` + id + `" class="quote-inline" rel="nofollow">` + shortenEntity(note) + `</a><br>` +
+				`<a href="http://bisu.test:7001/posts/` + id + `" class="quote-inline" rel="nofollow">` + shortenEntity(nevent) + `</a><br>` +
+				`<a href="http://bisu.test:7001/articles/` + naddr + `" class="quote-inline" rel="nofollow">` + shortenEntity(naddr) + `</a></p>`,
+		},
+		{
+			name:    "invalid references",
+			content: `nostr:npub1invalid nostr:note1"><script>`,
+			html:    `<p>nostr:npub1invalid nostr:note1&#34;&gt;&lt;script&gt;</p>`,
+		},
+		{
+			name:        "attachments",
+			content:     "look\nhttps://example.com/cat.png\n\nhttps://example.com/dog.png https://example.com/cat.png?big",
+			attachments: []string{"https://example.com/cat.png", "https://example.com/dog.png"},
+			html: `<p>look</p><p><a href="https://example.com/cat.png?big" rel="nofollow noopener noreferrer" target="_blank">` +
+				`https://example.com/cat.png?big</a></p>`,
+		},
+		{
+			name:        "only attachments",
+			content:     "https://example.com/cat.png\n\n",
+			attachments: []string{"https://example.com/cat.png"},
+			html:        "",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			attachments := make([]Attachment, len(test.attachments))
+			for i, link := range test.attachments {
+				attachments[i] = Attachment{URL: link}
+			}
+			rendered := renderContent(ctx, test.content, attachments)
+			if rendered.HTML != test.html {
+				t.Errorf("expected\n%s\ngot\n%s", test.html, rendered.HTML)
+			}
+			if !reflect.DeepEqual(rendered.Mentions, test.mentions) {
+				t.Errorf("expected mentions %v, got %v", test.mentions, rendered.Mentions)
+			}
+			if !reflect.DeepEqual(rendered.Tags, test.tags) {
+				t.Errorf("expected tags %v, got %v", test.tags, rendered.Tags)
+			}
+		})
+	}
+
+	// people mentioned in the text aren't listed again before it, the others are
+	bobSk := nostr.GeneratePrivateKey()
+	bob, _ := nostr.GetPublicKey(bobSk)
+	bobMetadata := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: `{"name": "bob"}`}
+	bobMetadata.Sign(bobSk)
+	saveEvent(ctx, bobMetadata)
+	evt := &nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", alice}, {"p", bob}},
+		Content:   "hey nostr:" + npub + " #bisu\nhttps://example.com/cat.png",
+	}
+	evt.Sign(bobSk)
+	status := toStatus(ctx, evt)
+	if strings.Count(status.Content, "/users/"+alice) != 1 || !strings.Contains(status.Content, `class="recipients-inline"`) ||
+		!strings.Contains(status.Content, "/users/"+bob) || strings.Contains(status.Content, "cat.png") {
+		t.Errorf("unexpected content %s", status.Content)
+	}
+	if len(status.Mentions) != 2 || len(status.MediaAttachments) != 1 ||
+		!reflect.DeepEqual(status.Tags, []Tag{{Name: "bisu", URL: "http://bisu.test:7001/tags/bisu"}}) {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+	relay := startTestRelay(t)
+	setTestConfig(t, func(cfg *Config) { cfg.DefaultRelays = []string{relay.URL} })
+	setContactListRelays(t, relay.URL)
+	t.Cleanup(waitForCountRefreshes)
+
+	sk := nostr.GeneratePrivateKey()
+	metadata := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: `{"name": "<b>alice</b>"}`}
+	metadata.Sign(sk)
+	saveEvent(ctx, metadata)
+	var tagged []*nostr.Event
+	for i, tags := range []nostr.Tags{{{"t", "café"}}, {{"t", "Café"}, {"t", "café"}}, {{"t", "dogs"}}} {
+		evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - nostr.Timestamp(i), Tags: tags, Content: fmt.Sprint("<i>note</i> ", i)}
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+		tagged = append(tagged, evt)
+	}
+	// only on a relay, so the public page doesn't show it
+	elsewhere := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"t", "café"}}, Content: "elsewhere"}
+	elsewhere.Sign(sk)
+	relay.events = append(relay.events, elsewhere)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tags/", tagHandler)
+	mux.HandleFunc("/api/v1/timelines/tag/", tagTimelineHandler)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	// the links we make for hashtags work
+	u, _ := url.Parse(tagURL("café"))
+	w := get(u.Path)
+	page := w.Body.String()
+	if w.Code != 200 || !strings.Contains(page, "<h1>#café</h1>") || !strings.Contains(page, "/posts/"+tagged[0].ID) ||
+		!strings.Contains(page, "/posts/"+tagged[1].ID) || strings.Contains(page, "/posts/"+tagged[2].ID) ||
+		strings.Contains(page, "elsewhere") || strings.Contains(page, "<i>") || !strings.Contains(page, "&lt;b&gt;alice") {
+		t.Errorf("unexpected tag page %d %s", w.Code, page)
+	}
+	if storedEvent(t, elsewhere.ID) != nil {
+		t.Errorf("the tag page fetched an event from a relay")
+	}
+
+	w = get("/api/v1/timelines/tag/Caf%C3%A9?limit=1")
+	var statuses []Status
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 || statuses[0].ID != tagged[0].ID {
+		t.Fatalf("unexpected tag timeline %d %s", w.Code, w.Body.String())
+	}
+	w = get("/api/v1/timelines/tag/caf%C3%A9?max_id=" + tagged[0].ID)
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil || len(statuses) != 1 || statuses[0].ID != tagged[1].ID {
+		t.Errorf("unexpected next page %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/api/v1/timelines/tag/"); w.Code != 404 {
+		t.Errorf("expected 404 without a tag, got %d", w.Code)
+	}
+}
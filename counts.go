@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/bisu/nip45"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+)
+
+const (
+	COUNTS_TTL               = time.Minute * 10 // counts older than this are refreshed when asked for
+	COUNTS_RELAYS            = 3
+	COUNTS_TIMEOUT           = time.Second * 7
+	COUNTS_UNSUPPORTED_RETRY = time.Hour * 6
+	COUNTS_BATCH_WAIT        = time.Millisecond * 300 // so all the statuses of a page share a round
+)
+
+// eventCounts are the interactions with a note we know about. they start with what's in the
+// local store and are completed with what relays tell us in the background.
+type eventCounts struct {
+	Replies    int64
+	Reposts    int64
+	Favourites int64
+	Zaps       int64 // millisatoshis
+
+	refreshedAt time.Time
+}
+
+type profileCounts struct {
+	Followers int64
+	Following int64
+	Statuses  int64
+
+	refreshedAt time.Time
+}
+
+// countQuery is one number we want. distinct counts are of people, not of events, so results
+// from different relays can be merged with HyperLogLog. when match is set only the local events
+// it accepts are counted, and relays aren't asked as their COUNT can't tell which ones those are.
+type countQuery struct {
+	filter   nostr.Filter
+	distinct bool
+	match    func(*nostr.Event) bool
+}
+
+type relayCount struct {
+	Count int64  `json:"count"`
+	HLL   string `json:"hll"`
+}
+
+var (
+	// relays that didn't answer COUNT
+	noCount = newUnsupportedRelays(COUNTS_UNSUPPORTED_RETRY)
+
+	countsRefreshing sync.Map
+
+	// relay -> the COUNT round that is still gathering filters
+	countRounds   = make(map[string]*countRound)
+	countRoundsMu sync.Mutex
+)
+
+// countRound is a single connection to a relay with the COUNT queries of everybody who asked
+// for them around the same time.
+type countRound struct {
+	filters []nostr.Filter
+	answers []*relayCount
+	err     error
+	done    chan struct{}
+}
+
+// eventCountQueries are the replies, reposts and reactions to a note. replies to replies also
+// tag the note, so only the direct ones are counted and that can only be done locally.
+func eventCountQueries(id string) []countQuery {
+	tags := nostr.TagMap{"e": []string{id}}
+	return []countQuery{
+		{filter: nostr.Filter{Kinds: []int{1}, Tags: tags}, match: func(evt *nostr.Event) bool {
+			reply := nip10.GetImmediateReply(evt.Tags)
+			return reply != nil && (*reply)[1] == id
+		}},
+		{filter: nostr.Filter{Kinds: []int{6, 16}, Tags: tags}},
+		{filter: nostr.Filter{Kinds: []int{7}, Tags: tags}, distinct: true},
+	}
+}
+
+// getEventCounts never waits for relays: it returns what we have and refreshes it in the
+// background if it's old.
+func getEventCounts(ctx context.Context, evt *nostr.Event) eventCounts {
+	c, ok := eventCountsCache.Get(evt.ID)
+	if !ok {
+		n := aggregateCounts(ctx, eventCountQueries(evt.ID), nil)
+		c = eventCounts{Replies: n[0], Reposts: n[1], Favourites: n[2], Zaps: zapsAmount(ctx, evt.ID)}
+		eventCountsCache.Set(evt.ID, c, 1)
+	}
+	if time.Since(c.refreshedAt) > COUNTS_TTL {
+		refreshCounts("e"+evt.ID, func(ctx context.Context) {
+			// interactions are sent to the inbox of the author
+			relays := fetchInboxRelaysForUser(ctx, evt.PubKey, COUNTS_RELAYS, false)
+			n := aggregateCounts(ctx, eventCountQueries(evt.ID), relays)
+			// zaps can't be counted, their amounts are in the receipts
+			fetchZapReceipts(ctx, evt.ID, relays)
+			eventCountsCache.Set(evt.ID, eventCounts{
+				Replies:     n[0],
+				Reposts:     n[1],
+				Favourites:  n[2],
+				Zaps:        zapsAmount(ctx, evt.ID),
+				refreshedAt: time.Now(),
+			}, 1)
+		})
+	}
+	return c
+}
+
+// getProfileCounts is like getEventCounts, the following count is always the local one.
+func getProfileCounts(ctx context.Context, pubkey string) profileCounts {
+	followers := countQuery{filter: nostr.Filter{Kinds: []int{3}, Tags: nostr.TagMap{"p": []string{pubkey}}}, distinct: true}
+	statuses := countQuery{filter: nostr.Filter{Kinds: []int{1}, Authors: []string{pubkey}}}
+
+	c, ok := profileCountsCache.Get(pubkey)
+	if !ok {
+		n := aggregateCounts(ctx, []countQuery{followers, statuses}, nil)
+		c = profileCounts{Followers: n[0], Statuses: n[1]}
+		if evt := loadReplaceableEventFromLocalStore(ctx, pubkey, 3); evt != nil {
+			c.Following = int64(len(parseContactList(evt)))
+		}
+		profileCountsCache.Set(pubkey, c, 1)
+	}
+	if time.Since(c.refreshedAt) > COUNTS_TTL {
+		refreshCounts("p"+pubkey, func(ctx context.Context) {
+			wg := sync.WaitGroup{}
+			wg.Add(2)
+			var nFollowers, nStatuses []int64
+			go func() {
+				defer wg.Done()
+				nFollowers = aggregateCounts(ctx, []countQuery{followers}, contactListRelays)
+			}()
+			go func() {
+				defer wg.Done()
+				nStatuses = aggregateCounts(ctx, []countQuery{statuses},
+					fetchOutboxRelaysForUser(ctx, pubkey, COUNTS_RELAYS, false))
+			}()
+			wg.Wait()
+
+			refreshed := c
+			refreshed.Followers = nFollowers[0]
+			refreshed.Statuses = nStatuses[0]
+			refreshed.refreshedAt = time.Now()
+			profileCountsCache.Set(pubkey, refreshed, 1)
+		})
+	}
+	return c
+}
+
+// refreshCounts runs fn in the background unless it's already running for this key.
+func refreshCounts(key string, fn func(context.Context)) {
+	if _, running := countsRefreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer countsRefreshing.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), COUNTS_BATCH_WAIT+RELAY_CONNECT_TIMEOUT+COUNTS_TIMEOUT)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// aggregateCounts counts in the local store and asks the given relays, taking the largest
+// number for each query. for distinct queries the HyperLogLog values relays give are merged
+// with our own events, which counts people that no single relay knows all about.
+func aggregateCounts(ctx context.Context, queries []countQuery, relays []string) []int64 {
+	results := make([]int64, len(queries))
+	hlls := make([]*nip45.HyperLogLog, len(queries))
+	merged := make([]bool, len(queries))
+
+	for i, q := range queries {
+		if q.distinct {
+			hlls[i] = newQueryHLL(q.filter)
+		}
+		if hlls[i] == nil && q.match == nil {
+			results[i], _ = store.CountEvents(ctx, q.filter)
+			continue
+		}
+		if ch, err := store.QueryEvents(ctx, q.filter); err == nil {
+			for evt := range ch {
+				if q.match != nil && !q.match(evt) {
+					continue
+				}
+				results[i]++
+				if hlls[i] != nil {
+					hlls[i].Add(evt.PubKey)
+				}
+			}
+		}
+	}
+
+	// the queries relays can answer, each answer goes to queries[asked[j]]
+	var filters []nostr.Filter
+	var asked []int
+	for i, q := range queries {
+		if q.match == nil {
+			filters = append(filters, q.filter)
+			asked = append(asked, i)
+		}
+	}
+	if len(filters) == 0 {
+		relays = nil
+	}
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	seen := make(map[string]bool, len(relays))
+	for _, url := range relays {
+		url = nostr.NormalizeURL(url)
+		if seen[url] || !relayUsable(url) || !noCount.supported(url) {
+			continue
+		}
+		seen[url] = true
+
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			answers, err := queueCount(ctx, url, filters)
+			if err != nil {
+				log.Debug().Err(err).Str("relay", url).Msg("COUNT failed")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for j, answer := range answers {
+				if answer == nil {
+					continue
+				}
+				i := asked[j]
+				if answer.Count > results[i] {
+					results[i] = answer.Count
+				}
+				if hlls[i] != nil && answer.HLL != "" && hlls[i].Merge(answer.HLL) == nil {
+					merged[i] = true
+				}
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	for i, hll := range hlls {
+		if merged[i] {
+			if estimate := int64(hll.Estimate()); estimate > results[i] {
+				results[i] = estimate
+			}
+		}
+	}
+	return results
+}
+
+// newQueryHLL is only possible for filters with a single tag value, like NIP-45 says.
+func newQueryHLL(filter nostr.Filter) *nip45.HyperLogLog {
+	if len(filter.Tags) != 1 {
+		return nil
+	}
+	for _, values := range filter.Tags {
+		if len(values) != 1 {
+			return nil
+		}
+		offset, err := nip45.Offset(values[0])
+		if err != nil {
+			return nil
+		}
+		return nip45.New(offset)
+	}
+	return nil
+}
+
+// queueCount adds filters to the next COUNT round on a relay and waits for their answers. a
+// round starts a little after its first filter is queued, so a page of statuses is counted on
+// a single connection instead of one per status.
+func queueCount(ctx context.Context, url string, filters []nostr.Filter) ([]*relayCount, error) {
+	countRoundsMu.Lock()
+	round, ok := countRounds[url]
+	if !ok {
+		round = &countRound{done: make(chan struct{})}
+		countRounds[url] = round
+		time.AfterFunc(COUNTS_BATCH_WAIT, func() { round.run(url) })
+	}
+	offset := len(round.filters)
+	round.filters = append(round.filters, filters...)
+	countRoundsMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-round.done:
+		return round.answers[offset : offset+len(filters)], round.err
+	}
+}
+
+func (round *countRound) run(url string) {
+	countRoundsMu.Lock()
+	delete(countRounds, url)
+	countRoundsMu.Unlock()
+
+	// nobody's context is the round's, as everybody waits for it
+	ctx, cancel := context.WithTimeout(context.Background(), RELAY_CONNECT_TIMEOUT+COUNTS_TIMEOUT)
+	defer cancel()
+	round.answers, round.err = countOnRelay(ctx, url, round.filters)
+	if round.answers == nil {
+		round.answers = make([]*relayCount, len(round.filters))
+	}
+	close(round.done)
+}
+
+// countOnRelay sends a COUNT for each filter on a connection of its own, as the relay library
+// doesn't give us the HyperLogLog values, and returns the answers in the same order.
+func countOnRelay(ctx context.Context, url string, filters []nostr.Filter) ([]*relayCount, error) {
+	conn, done, err := dialRelay(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	for i, filter := range filters {
+		if err := writeRelayMessage(conn, "COUNT", fmt.Sprintf("count-%d", i), filter); err != nil {
+			return nil, err
+		}
+	}
+
+	answers := make([]*relayCount, len(filters))
+	pending := len(filters)
+	for pending > 0 {
+		label, args, err := readRelayMessage(conn, COUNTS_TIMEOUT)
+		if err != nil {
+			// a relay that says nothing at all probably ignores COUNT, but a dropped connection
+			// tells nothing about it
+			var nerr net.Error
+			if pending == len(filters) && ctx.Err() == nil && errors.As(err, &nerr) && nerr.Timeout() {
+				noCount.mark(url)
+			}
+			return answers, err
+		}
+
+		var sub string
+		json.Unmarshal(args[0], &sub)
+		var i int
+		if _, err := fmt.Sscanf(sub, "count-%d", &i); err != nil && label != "NOTICE" {
+			continue
+		}
+
+		switch label {
+		case "NOTICE":
+			recordRelayNotice(url, sub)
+			noCount.mark(url)
+			return answers, fmt.Errorf("notice: %s", sub)
+		case "CLOSED":
+			if i >= 0 && i < len(answers) {
+				pending--
+			}
+			var reason string
+			if len(args) > 1 {
+				json.Unmarshal(args[1], &reason)
+			}
+			if rejectsCount(reason) {
+				noCount.mark(url)
+				return answers, fmt.Errorf("closed: %s", reason)
+			}
+		case "COUNT":
+			if i >= 0 && i < len(answers) && answers[i] == nil && len(args) > 1 {
+				answer := &relayCount{}
+				if json.Unmarshal(args[1], answer) == nil {
+					answers[i] = answer
+				}
+				pending--
+			}
+		}
+	}
+	return answers, nil
+}
+
+// rejectsCount tells a CLOSED that is about COUNT itself from one about a single filter, like
+// "auth-required:" or "restricted:".
+func rejectsCount(reason string) bool {
+	reason = strings.ToLower(reason)
+	return strings.HasPrefix(reason, "unsupported:") || strings.Contains(reason, "count")
+}
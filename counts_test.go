@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// waitForCountRefreshes is a cleanup for tests that render statuses, as counts refreshed in
+// the background need the config that is about to be removed.
+func waitForCountRefreshes() {
+	for start := time.Now(); time.Since(start) < time.Second*10; time.Sleep(time.Millisecond * 20) {
+		running := false
+		countsRefreshing.Range(func(_, _ any) bool { running = true; return false })
+		if !running {
+			return
+		}
+	}
+}
+
+func TestCounts(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	withCount := startTestRelay(t)
+	withCount.Count = true
+	withoutCount := startTestRelay(t)
+	setTestConfig(t, func(cfg *Config) { cfg.DefaultRelays = []string{withCount.URL, withoutCount.URL} })
+	setContactListRelays(t, withCount.URL, withoutCount.URL)
+
+	// fixed keys and timestamps so the HyperLogLog estimates don't change between runs, as
+	// they depend on the pubkeys and on the id of the note
+	key := func(name string) string {
+		h := sha256.Sum256([]byte(name))
+		return hex.EncodeToString(h[:])
+	}
+	createdAt := nostr.Timestamp(1700000000)
+	sign := func(name string, kind int, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags, Content: name}
+		evt.Sign(key(name))
+		return evt
+	}
+
+	authorSk := key("author")
+	author, _ := nostr.GetPublicKey(authorSk)
+	note := sign("author", 1, nostr.Tags{})
+	saveEvent(ctx, note)
+	e := nostr.Tags{{"e", note.ID}, {"p", author}}
+
+	// what we have here
+	reply := sign("reply 1", 1, e)
+	saveEvent(ctx, reply)
+	saveEvent(ctx, sign("reply 2", 1, e))
+	// a reply to a reply tags the note too but isn't counted
+	nested := sign("nested reply", 1, nostr.Tags{{"e", note.ID, "", "root"}, {"e", reply.ID, "", "reply"}})
+	saveEvent(ctx, nested)
+	saveEvent(ctx, sign("reposter", 6, e))
+	shared := sign("reactor 0", 7, e)
+	saveEvent(ctx, shared)
+	saveEvent(ctx, sign("reactor 1", 7, e))
+	follower := sign("follower 0", 3, nostr.Tags{{"p", author}})
+	saveEvent(ctx, follower)
+	saveEvent(ctx, sign("author", 3, nostr.Tags{{"p", key("a")}, {"p", key("b")}}))
+
+	// what only the relays know, some of it on both
+	withCount.events = append(withCount.events, shared, follower, note, nested)
+	for i := 2; i < 7; i++ {
+		withCount.events = append(withCount.events, sign(fmt.Sprint("reactor ", i), 7, e))
+	}
+	for i := 1; i < 4; i++ {
+		withCount.events = append(withCount.events, sign(fmt.Sprint("follower ", i), 3, nostr.Tags{{"p", author}}))
+	}
+	withoutCount.events = append(withoutCount.events, sign("reactor 7", 7, e))
+
+	// local counts come right away
+	if c := getEventCounts(ctx, note); c.Replies != 2 || c.Reposts != 1 || c.Favourites != 2 {
+		t.Fatalf("unexpected local counts %+v", c)
+	}
+
+	waitFor := func(get func() bool) {
+		for start := time.Now(); !get(); time.Sleep(time.Millisecond * 20) {
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("counts weren't refreshed")
+			}
+		}
+	}
+
+	var c eventCounts
+	waitFor(func() bool {
+		c, _ = eventCountsCache.Get(note.ID)
+		return !c.refreshedAt.IsZero()
+	})
+	// the relay has 6 reactions, one of them from someone who reacted here too, and it doesn't
+	// know about the other reaction we have, so only merging both sides gets to 7
+	if c.Replies != 2 || c.Reposts != 1 || c.Favourites != 7 {
+		t.Errorf("unexpected refreshed counts %+v", c)
+	}
+	if got := getEventCounts(ctx, note); got != c {
+		t.Errorf("expected the cached counts, got %+v", got)
+	}
+	if noCount.supported(nostr.NormalizeURL(withoutCount.URL)) {
+		t.Errorf("relay should have been marked as not supporting COUNT")
+	}
+
+	// a dropped connection says nothing about COUNT, a CLOSED about it does
+	dropping := startRawRelay(t, func(ws *websocket.Conn, message []byte) bool { return false })
+	if _, err := countOnRelay(ctx, dropping, []nostr.Filter{{Kinds: []int{1}}}); err == nil {
+		t.Errorf("expected COUNT to fail on a dropped connection")
+	}
+	if !noCount.supported(nostr.NormalizeURL(dropping)) {
+		t.Errorf("a relay that dropped the connection shouldn't be marked as not supporting COUNT")
+	}
+	closing := startRawRelay(t, func(ws *websocket.Conn, message []byte) bool {
+		var msg []string
+		json.Unmarshal(message, &msg)
+		b, _ := json.Marshal([]string{"CLOSED", msg[1], "unsupported: COUNT isn't supported"})
+		ws.WriteMessage(websocket.TextMessage, b)
+		return true
+	})
+	if _, err := countOnRelay(ctx, closing, []nostr.Filter{{Kinds: []int{1}}}); err == nil {
+		t.Errorf("expected COUNT to fail when the relay closes it")
+	}
+	if noCount.supported(nostr.NormalizeURL(closing)) {
+		t.Errorf("a relay that rejected COUNT should be marked as not supporting it")
+	}
+
+	if p := getProfileCounts(ctx, author); p.Followers != 1 || p.Following != 2 || p.Statuses != 1 {
+		t.Fatalf("unexpected local profile counts %+v", p)
+	}
+	var p profileCounts
+	waitFor(func() bool {
+		p, _ = profileCountsCache.Get(author)
+		return !p.refreshedAt.IsZero()
+	})
+	if p.Followers != 4 || p.Following != 2 || p.Statuses != 1 {
+		t.Errorf("unexpected refreshed profile counts %+v", p)
+	}
+}
+
+func TestCountsBatched(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	relay.Count = true
+	setTestConfig(t, func(cfg *Config) { cfg.DefaultRelays = []string{relay.URL} })
+
+	sk := nostr.GeneratePrivateKey()
+	notes := make([]*nostr.Event, 10)
+	for i := range notes {
+		notes[i] = &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: fmt.Sprint("note ", i)}
+		notes[i].Sign(sk)
+		saveEvent(ctx, notes[i])
+		repost := &nostr.Event{Kind: 6, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", notes[i].ID}}}
+		repost.Sign(nostr.GeneratePrivateKey())
+		relay.events = append(relay.events, repost)
+	}
+
+	// like a timeline page being rendered
+	for _, note := range notes {
+		getEventCounts(ctx, note)
+	}
+	for _, note := range notes {
+		for start := time.Now(); ; time.Sleep(time.Millisecond * 20) {
+			if c, _ := eventCountsCache.Get(note.ID); !c.refreshedAt.IsZero() {
+				if c.Reposts != 1 {
+					t.Errorf("expected the repost on the relay to be counted, got %+v", c)
+				}
+				break
+			}
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("counts weren't refreshed")
+			}
+		}
+	}
+	if n := relay.CountConnections(); n != 1 {
+		t.Errorf("expected all the counts to be asked on a single connection, got %d", n)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const EXPIRATION_SWEEP_INTERVAL = time.Minute
+
+// eventAddress returns the "kind:pubkey:d" address of replaceable events, or "" for the others.
+func eventAddress(evt *nostr.Event) string {
+	switch {
+	case evt.Kind == 0 || evt.Kind == 3 || (evt.Kind >= 10000 && evt.Kind < 20000):
+		return strconv.Itoa(evt.Kind) + ":" + evt.PubKey + ":"
+	case evt.Kind >= 30000 && evt.Kind < 40000:
+		d := ""
+		if tag := evt.Tags.GetFirst([]string{"d", ""}); tag != nil {
+			d = tag.Value()
+		}
+		return strconv.Itoa(evt.Kind) + ":" + evt.PubKey + ":" + d
+	}
+	return ""
+}
+
+// eventExpiration returns the NIP-40 expiration of an event, or 0 if it doesn't have one.
+func eventExpiration(evt *nostr.Event) nostr.Timestamp {
+	if tag := evt.Tags.GetFirst([]string{"expiration", ""}); tag != nil {
+		if ts, err := strconv.ParseInt(tag.Value(), 10, 64); err == nil {
+			return nostr.Timestamp(ts)
+		}
+	}
+	return 0
+}
+
+// isGone tells if an event was deleted by its author or has expired, so we shouldn't keep it.
+func isGone(ctx context.Context, evt *nostr.Event) bool {
+	if exp := eventExpiration(evt); exp != 0 && exp <= nostr.Now() {
+		return true
+	}
+
+	var n int
+	db.GetContext(ctx, &n, `SELECT count(*) FROM tombstones WHERE target = $1 AND pubkey = $2`, evt.ID, evt.PubKey)
+	if n > 0 {
+		return true
+	}
+
+	if addr := eventAddress(evt); addr != "" {
+		db.GetContext(ctx, &n, `SELECT count(*) FROM tombstones WHERE target = $1 AND pubkey = $2 AND deleted_at >= $3`,
+			addr, evt.PubKey, evt.CreatedAt)
+		return n > 0
+	}
+
+	return false
+}
+
+// saveEvent puts an event in the local store, remembering when it expires if it does and
+// keeping track of it for eviction.
+func saveEvent(ctx context.Context, evt *nostr.Event) error {
+	if isAddressable(evt.Kind) && !replaceAddressable(ctx, evt) {
+		return nil // we already have this version or a newer one
+	}
+	if err := store.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+	if exp := eventExpiration(evt); exp != 0 {
+		db.ExecContext(ctx, `INSERT INTO expirations (id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`,
+			evt.ID, exp)
+	}
+	trackEvent(ctx, evt, time.Now().Unix())
+	return nil
+}
+
+// removeEvent deletes an event from everywhere we may have it and tells streaming clients.
+func removeEvent(ctx context.Context, evt *nostr.Event) {
+	eventCache.Delete(evt.ID)
+	if err := store.DeleteEvent(ctx, evt); err != nil {
+		log.Warn().Err(err).Str("id", evt.ID).Msg("failed to delete event from store")
+	}
+	db.ExecContext(ctx, `DELETE FROM expirations WHERE id = $1`, evt.ID)
+	db.ExecContext(ctx, `DELETE FROM event_access WHERE id = $1`, evt.ID)
+	if evt.Kind == 1 || evt.Kind == 30023 {
+		broadcastDelete(evt.ID)
+	}
+}
+
+// handleDeletion applies a NIP-09 deletion request: the targets are removed if they belong
+// to the same author and tombstones are kept so they don't come back.
+func handleDeletion(ctx context.Context, deletion *nostr.Event) {
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		var targets []*nostr.Event
+		switch tag[0] {
+		case "e":
+			// ids are 32-byte hex just like pubkeys
+			if !nostr.IsValidPublicKeyHex(tag[1]) {
+				continue
+			}
+			db.ExecContext(ctx, `INSERT INTO tombstones (target, pubkey, deleted_at) VALUES ($1, $2, $3)
+                ON CONFLICT (target, pubkey) DO NOTHING`, tag[1], deletion.PubKey, deletion.CreatedAt)
+			if ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: []string{tag[1]}}); err == nil {
+				for evt := range ch {
+					targets = append(targets, evt)
+				}
+			}
+		case "a":
+			spl := strings.SplitN(tag[1], ":", 3)
+			if len(spl) != 3 || spl[1] != deletion.PubKey {
+				continue
+			}
+			kind, err := strconv.Atoi(spl[0])
+			if err != nil {
+				continue
+			}
+			db.ExecContext(ctx, `INSERT INTO tombstones (target, pubkey, deleted_at) VALUES ($1, $2, $3)
+                ON CONFLICT (target, pubkey) DO UPDATE SET deleted_at = max(deleted_at, excluded.deleted_at)`,
+				tag[1], deletion.PubKey, deletion.CreatedAt)
+			filter := nostr.Filter{Kinds: []int{kind}, Authors: []string{spl[1]}, Until: &deletion.CreatedAt}
+			if kind >= 30000 && kind < 40000 {
+				filter.Tags = nostr.TagMap{"d": []string{spl[2]}}
+			}
+			if ch, err := store.QueryEvents(ctx, filter); err == nil {
+				for evt := range ch {
+					targets = append(targets, evt)
+				}
+			}
+		}
+
+		for _, evt := range targets {
+			if evt.PubKey == deletion.PubKey {
+				log.Debug().Str("id", evt.ID).Str("pubkey", evt.PubKey).Msg("deleting event as requested by author")
+				removeEvent(ctx, evt)
+			}
+		}
+	}
+}
+
+// sweepExpiredEvents keeps removing events whose NIP-40 expiration has passed.
+func sweepExpiredEvents() {
+	for {
+		if n := removeExpiredEvents(context.Background()); n > 0 {
+			log.Debug().Int("n", n).Msg("removed expired events")
+		}
+		time.Sleep(EXPIRATION_SWEEP_INTERVAL)
+	}
+}
+
+func removeExpiredEvents(ctx context.Context) int {
+	var ids []string
+	db.SelectContext(ctx, &ids, `SELECT id FROM expirations WHERE expires_at <= $1`, nostr.Now())
+	if len(ids) == 0 {
+		return 0
+	}
+
+	var expired []*nostr.Event
+	if ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: ids}); err == nil {
+		for evt := range ch {
+			expired = append(expired, evt)
+		}
+	}
+	for _, evt := range expired {
+		removeEvent(ctx, evt)
+	}
+
+	// also forget the ones that weren't in the store anymore
+	for _, id := range ids {
+		db.ExecContext(ctx, `DELETE FROM expirations WHERE id = $1`, id)
+	}
+
+	return len(expired)
+}
+
+// broadcastDelete tells all streaming clients of all identities that a status is gone.
+func broadcastDelete(id string) {
+	for _, identity := range identities {
+		identity.stream("delete", id)
+	}
+}
+
+// stream sends a message to all the streaming clients of this identity, dropping the dead ones.
+func (id *Identity) stream(event string, payload string) {
+	msg, _ := json.Marshal(struct {
+		Event   string `json:"event"`
+		Payload string `json:"payload"`
+	}{event, payload})
+
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	alive := id.streamingConns[:0]
+	for _, conn := range id.streamingConns {
+		conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			conn.Close()
+			continue
+		}
+		alive = append(alive, conn)
+	}
+	id.streamingConns = alive
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func storedEvent(t *testing.T, id string) *nostr.Event {
+	ch, err := store.QueryEvents(context.Background(), nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		t.Fatalf("failed to query store: %s", err)
+	}
+	return <-ch
+}
+
+func TestHandleDeletion(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	author := nostr.GeneratePrivateKey()
+	other := nostr.GeneratePrivateKey()
+
+	note := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 10, Tags: nostr.Tags{}, Content: "oops"}
+	note.Sign(author)
+	saveEvent(ctx, note)
+
+	article := &nostr.Event{Kind: 30023, CreatedAt: nostr.Now() - 10, Tags: nostr.Tags{{"d", "post"}}, Content: "long"}
+	article.Sign(author)
+	saveEvent(ctx, article)
+
+	// somebody else can't delete it
+	forged := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"e", note.ID}}}
+	forged.Sign(other)
+	handleDeletion(ctx, forged)
+	if storedEvent(t, note.ID) == nil || isGone(ctx, note) {
+		t.Fatalf("note was deleted by someone else")
+	}
+
+	// but the author can
+	deletion := &nostr.Event{Kind: 5, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"e", note.ID},
+		{"a", "30023:" + article.PubKey + ":post"},
+	}}
+	deletion.Sign(author)
+	handleDeletion(ctx, deletion)
+	if storedEvent(t, note.ID) != nil || storedEvent(t, article.ID) != nil {
+		t.Fatalf("events weren't deleted")
+	}
+
+	// and tombstones prevent them from coming back
+	if !isGone(ctx, note) || !isGone(ctx, article) {
+		t.Fatalf("deleted events should be gone")
+	}
+
+	// unless it's a newer version of the replaceable event
+	newer := &nostr.Event{Kind: 30023, CreatedAt: nostr.Now() + 10, Tags: nostr.Tags{{"d", "post"}}, Content: "again"}
+	newer.Sign(author)
+	if isGone(ctx, newer) {
+		t.Fatalf("newer version of a deleted article should be accepted")
+	}
+}
+
+func TestRemoveExpiredEvents(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+	sk := nostr.GeneratePrivateKey()
+
+	expiring := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 10, Content: "soon gone", Tags: nostr.Tags{
+		{"expiration", strconv.FormatInt(int64(nostr.Now()-1), 10)},
+	}}
+	expiring.Sign(sk)
+	saveEvent(ctx, expiring)
+
+	lasting := &nostr.Event{Kind: 1, CreatedAt: nostr.Now() - 10, Content: "still here", Tags: nostr.Tags{
+		{"expiration", strconv.FormatInt(int64(nostr.Now()+3600), 10)},
+	}}
+	lasting.Sign(sk)
+	saveEvent(ctx, lasting)
+
+	if !isGone(ctx, expiring) || isGone(ctx, lasting) {
+		t.Fatalf("expiration wasn't taken into account")
+	}
+
+	if n := removeExpiredEvents(ctx); n != 1 {
+		t.Fatalf("expected 1 expired event to be removed, got %d", n)
+	}
+	if storedEvent(t, expiring.ID) != nil || storedEvent(t, lasting.ID) == nil {
+		t.Fatalf("sweeper removed the wrong events")
+	}
+}
@@ -3,49 +3,94 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"strconv"
+	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	qs := r.URL.Query()
-	limit, _ := strconv.Atoi(qs.Get("limit"))
-	if limit == 0 {
-		limit = 20
-	}
-	maxId := qs.Get("max_id")
+	identity := getIdentity(r.Context())
 
 	var keys []string
-	if follows := loadContactList(r.Context(), profile.pubkey); follows != nil {
+	if follows := loadContactList(r.Context(), identity.pubkey); follows != nil {
 		keys = make([]string, len(*follows))
 		for i, f := range *follows {
 			keys[i] = f.Pubkey
 		}
 	}
-	keys = append(keys, profile.pubkey)
+	keys = append(keys, identity.pubkey)
 
-	var until *nostr.Timestamp
-	if maxId != "" {
-		max := loadEvent(r.Context(), maxId, nil, nil)
-		until = &max.CreatedAt
+	paginator := parsePaginator(r.Context(), r.URL.Query())
+	events, err := paginator.query(r.Context(), nostr.Filter{
+		Kinds:   []int{1, 30023},
+		Authors: keys,
+	})
+	if err != nil {
+		jsonError(w, "error querying internal db: "+err.Error(), 500)
+		return
 	}
 
-	events, err := store.QueryEvents(r.Context(), nostr.Filter{
-		Kinds:   []int{1},
-		Authors: keys,
-		Limit:   limit,
-		Until:   until,
+	statuses := make([]*Status, 0, len(events))
+	for _, evt := range events {
+		statuses = append(statuses, toStatus(r.Context(), evt))
+	}
+
+	paginator.setLinkHeader(w, r, events)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// accountStatusesHandler serves /api/v1/accounts/<pubkey or npub>/statuses, notes and
+// articles by one person.
+func accountStatusesHandler(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/accounts/"), "/")
+	pubkey := decodePubkey(name)
+	if pubkey == "" || rest != "statuses" {
+		jsonError(w, "not found", 404)
+		return
+	}
+
+	paginator := parsePaginator(r.Context(), r.URL.Query())
+	events, err := paginator.query(r.Context(), nostr.Filter{
+		Kinds:   []int{1, 30023},
+		Authors: []string{pubkey},
+	})
+	if err != nil {
+		jsonError(w, "error querying internal db: "+err.Error(), 500)
+		return
+	}
+
+	statuses := make([]*Status, 0, len(events))
+	for _, evt := range events {
+		statuses = append(statuses, toStatus(r.Context(), evt))
+	}
+
+	paginator.setLinkHeader(w, r, events)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// tagTimelineHandler serves /api/v1/timelines/tag/<tag>, notes and articles with a hashtag.
+func tagTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(r.URL.Path, "/api/v1/timelines/tag/")
+	if tag == "" || strings.Contains(tag, "/") {
+		jsonError(w, "not found", 404)
+		return
+	}
+
+	paginator := parsePaginator(r.Context(), r.URL.Query())
+	events, err := paginator.query(r.Context(), nostr.Filter{
+		Kinds: []int{1, 30023},
+		Tags:  nostr.TagMap{"t": hashtagValues(tag)},
 	})
 	if err != nil {
 		jsonError(w, "error querying internal db: "+err.Error(), 500)
 		return
 	}
 
-	statuses := make([]*Status, 0, limit)
-	for evt := range events {
+	statuses := make([]*Status, 0, len(events))
+	for _, evt := range events {
 		statuses = append(statuses, toStatus(r.Context(), evt))
 	}
 
+	paginator.setLinkHeader(w, r, events)
 	json.NewEncoder(w).Encode(statuses)
 }
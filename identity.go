@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/bisu/nip49"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/term"
+)
+
+// Identity is one of the nostr keys served by this bisu instance. each has its own profile,
+// relays, listeners and streaming clients, but they all share the same caches and databases.
+type Identity struct {
+	signer Signer
+	pubkey string
+
+	profile                 *Profile
+	readRelays, writeRelays []string
+
+	mu             sync.Mutex
+	streamingConns []*websocket.Conn
+	stopListening  context.CancelFunc
+	follows        *followManager
+}
+
+// identities is only written to at startup, so it's safe to read without locking.
+var identities []*Identity
+
+type identityContextKey struct{}
+
+func getIdentity(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+func getIdentityByPubkey(pubkey string) *Identity {
+	for _, id := range identities {
+		if id.pubkey == pubkey {
+			return id
+		}
+	}
+	return nil
+}
+
+func isOwnPubkey(pubkey string) bool {
+	return getIdentityByPubkey(pubkey) != nil
+}
+
+// readSigners returns the signer for the main key at <datadir>/key -- asking for it on stdin
+// if it doesn't exist yet -- followed by the signers for all the extra keys under <datadir>/keys/.
+func readSigners(ctx context.Context, datadir string) ([]Signer, error) {
+	path := filepath.Join(datadir, "key")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		b, err = promptKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		os.WriteFile(path, b, 0600)
+	}
+	main, err := parseKeyFile(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key from %s: %w", path, err)
+	}
+	signers := []Signer{main}
+
+	extra, _ := filepath.Glob(filepath.Join(datadir, "keys", "*"))
+	for _, path := range extra {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping unreadable key file")
+			continue
+		}
+		signer, err := parseKeyFile(ctx, b)
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping invalid key file")
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+// parseKeyFile turns the contents of a key file into a signer. key files either have
+// the 32 raw bytes of a private key, an ncryptsec followed by the pubkey in the next line
+// or the json of a bunkerConfig.
+func parseKeyFile(ctx context.Context, b []byte) (Signer, error) {
+	if len(b) == 32 {
+		return newKeySigner(hex.EncodeToString(b))
+	}
+
+	if lines := strings.Fields(string(b)); len(lines) > 0 && strings.HasPrefix(lines[0], "ncryptsec1") {
+		es := &encryptedKeySigner{ncryptsec: lines[0]}
+		if len(lines) > 1 {
+			es.pubkey = lines[1]
+		}
+		if passphrase := askPassphrase("passphrase to unlock your key: "); passphrase != "" {
+			if err := es.Unlock(passphrase); err != nil {
+				return nil, err
+			}
+		} else if es.pubkey == "" {
+			return nil, fmt.Errorf("no passphrase given for an encrypted key that doesn't have its pubkey saved")
+		}
+		return es, nil
+	}
+
+	var cfg bunkerConfig
+	if err := json.Unmarshal(b, &cfg); err == nil && cfg.URI != "" {
+		return connectBunker(ctx, cfg)
+	}
+
+	return nil, fmt.Errorf("key file is neither a 32-byte private key nor a bunker config")
+}
+
+// addKey asks for a private key or bunker on stdin and saves it as an extra identity.
+func addKey(ctx context.Context, datadir string) (string, error) {
+	b, err := promptKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	signer, err := parseKeyFile(ctx, b)
+	if err != nil {
+		return "", err
+	}
+	pk, err := signer.GetPublicKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	os.MkdirAll(filepath.Join(datadir, "keys"), 0700)
+	if err := os.WriteFile(filepath.Join(datadir, "keys", pk), b, 0600); err != nil {
+		return "", err
+	}
+	return pk, nil
+}
+
+// promptKey reads a hex or nsec private key, a bunker:// URI or the word "nostrconnect"
+// from stdin and returns what should be written to the key file.
+func promptKey(ctx context.Context) ([]byte, error) {
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Printf("paste your private key, a bunker:// URI or type 'nostrconnect': ")
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("can't read from stdin")
+	}
+	text := strings.TrimSpace(scanner.Text())
+
+	if isBunkerInput(text) {
+		var bs *bunkerSigner
+		var err error
+		clientSecret := nostr.GeneratePrivateKey()
+
+		if text == "nostrconnect" {
+			uri := make(chan string, 1)
+			go func() { fmt.Printf("paste this on your signer app:\n\n  %s\n\n", <-uri) }()
+			ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+			defer cancel()
+			bs, err = waitNostrConnect(ctx, clientSecret, []string{"wss://relay.nsecbunker.com"}, uri)
+		} else {
+			bs, err = connectBunker(ctx, bunkerConfig{URI: text, ClientSecret: clientSecret})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(bs.config())
+	}
+
+	if strings.HasPrefix(text, "ncryptsec1") {
+		sk, err := nip49.Decrypt(text, askPassphrase("passphrase for this ncryptsec: "))
+		if err != nil {
+			return nil, err
+		}
+		pk, _ := nostr.GetPublicKey(sk)
+		return encryptedKeyFile(text, pk), nil
+	}
+
+	if prefix, value, _ := nip19.Decode(text); prefix == "nsec" {
+		text = value.(string)
+	}
+	b, err := hex.DecodeString(text)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("private key is not 32 bytes of hex or an nsec")
+	}
+
+	if passphrase := askPassphrase("passphrase to encrypt the key on disk (leave empty to store it unencrypted): "); passphrase != "" {
+		return encryptKey(b, passphrase)
+	}
+	return b, nil
+}
+
+func encryptedKeyFile(ncryptsec string, pubkey string) []byte {
+	return []byte(ncryptsec + "\n" + pubkey + "\n")
+}
+
+// encryptKey turns a raw private key into the contents of an encrypted key file.
+func encryptKey(b []byte, passphrase string) ([]byte, error) {
+	sk := hex.EncodeToString(b)
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	ncryptsec, err := nip49.Encrypt(sk, passphrase, nip49.DefaultLogN, nip49.KnownToHaveBeenHandledInsecurely)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedKeyFile(ncryptsec, pk), nil
+}
+
+// askPassphrase reads the passphrase from BISU_PASSPHRASE or prompts for it on the terminal.
+// it returns an empty string if neither is available.
+func askPassphrase(prompt string) string {
+	if passphrase := os.Getenv("BISU_PASSPHRASE"); passphrase != "" {
+		return passphrase
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return ""
+	}
+	fmt.Print(prompt)
+	b, _ := term.ReadPassword(fd)
+	fmt.Println()
+	return string(b)
+}
+
+// encryptKeyFiles converts all the raw private keys in the data directory into ncryptsecs.
+func encryptKeyFiles(datadir string) error {
+	paths, _ := filepath.Glob(filepath.Join(datadir, "keys", "*"))
+	paths = append([]string{filepath.Join(datadir, "key")}, paths...)
+
+	var passphrase string
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil || len(b) != 32 {
+			// not a raw key, already encrypted or a bunker
+			continue
+		}
+
+		if passphrase == "" {
+			passphrase = askPassphrase("passphrase to encrypt your keys with: ")
+			if passphrase == "" {
+				return fmt.Errorf("no passphrase given, set BISU_PASSPHRASE or run this on a terminal")
+			}
+			if os.Getenv("BISU_PASSPHRASE") == "" && askPassphrase("type it again: ") != passphrase {
+				return fmt.Errorf("passphrases don't match")
+			}
+		}
+
+		encrypted, err := encryptKey(b, passphrase)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt %s: %w", path, err)
+		}
+
+		// write to a temporary file first so we never end up without a key
+		if err := os.WriteFile(path+".tmp", encrypted, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+		log.Info().Str("path", path).Msg("encrypted key")
+	}
+
+	return nil
+}
+
+// isLocked tells if this identity's key is still encrypted and waiting for a passphrase.
+func (id *Identity) isLocked() bool {
+	es, ok := id.signer.(*encryptedKeySigner)
+	return ok && es.IsLocked()
+}
+
+func loadIdentity(ctx context.Context, signer Signer) (*Identity, error) {
+	pk, err := signer.GetPublicKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	id := &Identity{signer: signer, pubkey: pk}
+
+	lctx, cancel := context.WithTimeout(ctx, time.Second*3)
+	defer cancel()
+
+	id.profile = loadProfile(lctx, pk)
+	if id.profile == nil {
+		// generate a new profile
+		event := &nostr.Event{
+			Content:   `{}`,
+			CreatedAt: nostr.Now(),
+			Kind:      0,
+		}
+		if err := signer.SignEvent(ctx, event); err != nil {
+			// the key may be locked, this event is never published anyway
+			log.Debug().Err(err).Str("pubkey", pk).Msg("couldn't sign placeholder profile")
+			event.PubKey = pk
+		}
+		id.profile = &Profile{
+			pubkey: pk,
+			event:  event,
+		}
+	}
+
+	id.readRelays, id.writeRelays = loadRelaysList(lctx, pk)
+	if len(id.readRelays) == 0 {
+		id.readRelays = append(id.readRelays, getConfig().ReadRelays...)
+	}
+	if len(id.writeRelays) == 0 {
+		id.writeRelays = append(id.writeRelays, getConfig().WriteRelays...)
+	}
+
+	return id, nil
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"io"
 	"net/http"
-
-	"github.com/tidwall/gjson"
+	"strconv"
+	"strings"
 )
 
 type urls struct {
@@ -30,7 +29,7 @@ type app struct {
 	Website      string `json:"website"`
 	RedirectURI  any    `json:"redirect_uri"`
 	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
+	ClientSecret string `json:"client_secret,omitempty"`
 	VapidKey     string `json:"vapid_key"`
 }
 
@@ -41,7 +40,7 @@ func instanceHandler(w http.ResponseWriter, r *http.Request) {
 		Description:      "nostr personal homeserver",
 		ShortDescription: "nostr homeserver",
 		Registrations:    false,
-		MaxTootChars:     900,
+		MaxTootChars:     getConfig().MaxTootChars,
 		Version:          "2.7.2 (compatible; bisu 0.0.0)",
 		Rules:            []any{},
 		Urls: urls{
@@ -50,33 +49,17 @@ func instanceHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func createAppHandler(w http.ResponseWriter, r *http.Request) {
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		jsonError(w, "wrong body: "+err.Error(), 400)
-		return
+func toAppResponse(a oauthApp, withSecret bool) app {
+	resp := app{
+		ID:          strconv.FormatInt(a.ID, 10),
+		Name:        a.Name,
+		Website:     a.Website,
+		RedirectURI: strings.Join(strings.Fields(a.RedirectURIs), "\n"),
+		ClientID:    a.ClientID,
+		VapidKey:    "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB=",
 	}
-	defer r.Body.Close()
-
-	json.NewEncoder(w).Encode(app{
-		ID:           "2",
-		Name:         "bisu",
-		Website:      "https://_/",
-		RedirectURI:  gjson.GetBytes(b, "redirect_uris").Value(),
-		ClientID:     "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
-		ClientSecret: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
-		VapidKey:     "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB=",
-	})
-}
-
-func appCredentialsHandler(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(app{
-		ID:           "2",
-		Name:         "bisu",
-		Website:      "https://_/",
-		RedirectURI:  "urn:ietf:wg:oauth:2.0:oob",
-		ClientID:     "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
-		ClientSecret: "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
-		VapidKey:     "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB=",
-	})
+	if withSecret {
+		resp.ClientSecret = a.ClientSecret
+	}
+	return resp
 }
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/hex"
+	"embed"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,68 +11,60 @@ import (
 	"syscall"
 	"time"
 
-	_ "embed"
-
 	"github.com/arriqaaq/flashdb"
+	"github.com/fiatjaf/bisu/migrate"
 	"github.com/fiatjaf/khatru/plugins/storage/lmdbn"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/mitchellh/go-homedir"
-	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
 )
 
-//go:embed schema.sql
-var schema string
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
 
 var (
-	log                     = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
-	srv                     http.Server
-	profile                 *Profile
-	readRelays, writeRelays []string
-	sk                      string
-	flash                   *flashdb.FlashDB
-	store                   lmdbn.LMDBBackend
-	db                      *sqlx.DB
-	serial                  = 0
+	log    = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	srv    http.Server
+	flash  *flashdb.FlashDB
+	store  lmdbn.LMDBBackend
+	db     *sqlx.DB
+	serial = 0
 )
 
 func main() {
-	// load default stuff
-	datadir, _ := homedir.Expand("~/.config/bisu")
-	os.MkdirAll(datadir, 0700)
-	path := filepath.Join(datadir, "key")
-	b, err := os.ReadFile(path)
-	save := false
+	// load config
+	configArgs = os.Args[1:]
+	cfg, args, err := loadConfig(configArgs)
 	if err != nil {
-		scanner := bufio.NewScanner(os.Stdin)
-		save = true
-		fmt.Printf("paste your private key: ")
-		if scanner.Scan() {
-			text := scanner.Text()
-			prefix, value, _ := nip19.Decode(text)
-			if prefix == "nsec" {
-				text = value.(string)
+		log.Fatal().Err(err).Msg("invalid config")
+		return
+	}
+	currentConfig.Store(cfg)
+	datadir := cfg.DataDir
+	os.MkdirAll(datadir, 0700)
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "add-key":
+			pk, err := addKey(context.Background(), datadir)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to add key")
+				return
+			}
+			log.Info().Str("pubkey", pk).Msg("added identity, restart bisu to use it")
+			return
+		case "encrypt-keys":
+			if err := encryptKeyFiles(datadir); err != nil {
+				log.Fatal().Err(err).Msg("failed to encrypt keys")
 			}
-			b, _ = hex.DecodeString(text)
-		} else {
-			log.Fatal().Err(err).Msg("can't can't read from stdin")
 			return
 		}
 	}
-	if len(b) != 32 {
-		log.Fatal().Err(err).Str("path", path).Msg("private key is not 32 bytes")
-		return
-	}
-	if save {
-		os.WriteFile(path, b, 0600)
-	}
-	sk = hex.EncodeToString(b)
-	pk, err := nostr.GetPublicKey(sk)
+
+	signers, err := readSigners(context.Background(), datadir)
 	if err != nil {
-		log.Fatal().Err(err).Str("key", sk).Msg("private key is invalid")
+		log.Fatal().Err(err).Msg("failed to read keys")
 		return
 	}
 
@@ -85,7 +75,10 @@ func main() {
 	} else {
 		db = sql
 
-		sql.Exec(schema)
+		if err := migrateDatabase(db); err != nil {
+			log.Fatal().Err(err).Msg("failed to migrate sqlite3")
+			return
+		}
 	}
 
 	// start flashdb
@@ -106,117 +99,151 @@ func main() {
 	// initialize data loaders stuff
 	initializeDataloaders()
 
-	// cleanup old stuff from event storage
-	go func() {
-		ctx := context.Background()
-		sevenMonthsAgo := nostr.Now() - 60*60*24*30*7
-		events, _ := store.QueryEvents(ctx, nostr.Filter{Until: &sevenMonthsAgo})
-		for evt := range events {
-			if evt.PubKey != profile.pubkey {
-				store.DeleteEvent(ctx, evt)
-			}
+	// load metadata for all our identities
+	for _, signer := range signers {
+		id, err := loadIdentity(context.Background(), signer)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to load identity")
+			return
 		}
-	}()
+		identities = append(identities, id)
+	}
 
-	// load user metadata
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	profile = loadProfile(ctx, pk)
-	if profile == nil {
-		// generate a new profile
-		event := &nostr.Event{
-			Content:   `{}`,
-			CreatedAt: nostr.Now(),
-			Kind:      0,
-		}
-		event.Sign(sk)
-		profile = &Profile{
-			pubkey: pk,
-			event:  event,
+	if len(args) > 0 {
+		switch args[0] {
+		case "export", "import", "rebroadcast":
+			if err := archiveCommand(context.Background(), args); err != nil {
+				log.Fatal().Err(err).Msg(args[0] + " failed")
+			}
+			if args[0] != "export" {
+				// whatever was queued is published now, retries are left for when bisu runs
+				drainPublishQueue(context.Background(), PUBLISH_DRAIN_TIMEOUT)
+			}
+			return
+		case "mastodon-import":
+			if err := mastodonImportCommand(context.Background(), args); err != nil {
+				log.Fatal().Err(err).Msg("mastodon import failed")
+			}
+			drainPublishQueue(context.Background(), PUBLISH_DRAIN_TIMEOUT)
+			return
+		case "sync":
+			if err := syncCommand(context.Background(), args); err != nil {
+				log.Fatal().Err(err).Msg("sync failed")
+			}
+			drainPublishQueue(context.Background(), PUBLISH_DRAIN_TIMEOUT)
+			return
 		}
 	}
-	readRelays, writeRelays = loadRelaysList(ctx, pk)
-	if len(readRelays) == 0 {
-		readRelays = append(readRelays, "wss://nostr.mom")
-		readRelays = append(readRelays, "wss://relayable.org")
-	}
-	if len(writeRelays) == 0 {
-		writeRelays = append(writeRelays, "wss://nostr.mom")
-		writeRelays = append(writeRelays, "wss://nostr-pub.wellorder.net")
-	}
-	cancel()
 
 	// start listening to relays
-	go startListening()
+	for _, id := range identities {
+		go id.startListening()
+	}
+
+	// keep publishing whatever is pending
+	go runPublishQueue()
+
+	// remove events as they expire
+	go sweepExpiredEvents()
+
+	// keep the event store from growing forever
+	go runRetention()
+
+	// and in sync with our relays
+	go runRelaySync()
 
 	// routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/streaming", streamingHandler)
-	mux.HandleFunc("/api/v1/streaming/", streamingHandler)
-	// 	mux.HandleFunc("/users/:username", actorHandler)
-	// 	mux.HandleFunc("/nodeinfo/:version", nodeInfoSchemaHandler)
+	mux.HandleFunc("/api/v1/streaming", scoped("statuses", streamingHandler))
+	mux.HandleFunc("/api/v1/streaming/", scoped("statuses", streamingHandler))
+	mux.HandleFunc("/users/", actorHandler)
+	mux.HandleFunc("/posts/", postHandler)
+	mux.HandleFunc("/articles/", articleHandler)
+	mux.HandleFunc("/tags/", tagHandler)
+	mux.HandleFunc("/.well-known/webfinger", webfingerHandler)
+	mux.HandleFunc("/.well-known/nodeinfo", nodeInfoHandler)
+	mux.HandleFunc("/nodeinfo/", nodeInfoSchemaHandler)
 	mux.HandleFunc("/api/v1/instance", instanceHandler)
 	mux.HandleFunc("/api/v1/apps/verify_credentials", appCredentialsHandler)
 	mux.HandleFunc("/api/v1/apps", createAppHandler)
 	mux.HandleFunc("/oauth/token", createTokenHandler)
-	mux.HandleFunc("/oauth/revoke", constantHandler(map[string]any{}))
+	mux.HandleFunc("/oauth/revoke", revokeTokenHandler)
 	mux.HandleFunc("/oauth/authorize", oauthHandler)
 	mux.HandleFunc("/api/v1/acccounts",
 		constantHandler(map[string]string{
 			"error": "this is meant to be run locally, not logged in from the external world",
 		}),
 	)
-	mux.HandleFunc("/api/v1/accounts/verify_credentials", verifyCredentialsHandler)
-	mux.HandleFunc("/api/v1/accounts/update_credentials", updateCredentialsHandler)
+	mux.HandleFunc("/api/v1/accounts/verify_credentials", authorized("read:accounts", verifyCredentialsHandler))
+	mux.HandleFunc("/api/v1/accounts/update_credentials", authorized("write:accounts", updateCredentialsHandler))
 	//	mux.HandleFunc("/api/v1/accounts/search", accountSearchHandler)
 	//	mux.HandleFunc("/api/v1/accounts/lookup", accountLookupHandler)
-	mux.HandleFunc("/api/v1/accounts/relationships", relationshipsHandler)
-	//	mux.HandleFunc("/api/v1/accounts/:pubkey{[0-9a-f]{64}}/statuses", accountStatusesHandler)
+	mux.HandleFunc("/api/v1/accounts/relationships", authorized("read:follows", relationshipsHandler))
+	mux.HandleFunc("/api/v1/accounts/", authorized("read:statuses", accountStatusesHandler))
 	//	mux.HandleFunc("/api/v1/accounts/:pubkey{[0-9a-f]{64}}", accountHandler)
 	//	mux.HandleFunc("/api/v1/statuses/:id{[0-9a-f]{64}}/context", contextHandler)
 	//	mux.HandleFunc("/api/v1/statuses/:id{[0-9a-f]{64}}/favourite", favouriteHandler)
-	mux.HandleFunc("/api/v1/statuses", createStatusHandler)
-	mux.HandleFunc("/api/v1/statuses/", getOrDeleteStatusHandler)
-	mux.HandleFunc("/api/v1/timelines/home", homeHandler)
+	mux.HandleFunc("/api/v1/statuses", authorized("write:statuses", createStatusHandler))
+	mux.HandleFunc("/api/v1/statuses/", scoped("statuses", getOrDeleteStatusHandler))
+	mux.HandleFunc("/api/v1/timelines/home", authorized("read:statuses", homeHandler))
+	mux.HandleFunc("/api/v1/timelines/tag/", authorized("read:statuses", tagTimelineHandler))
 	// mux.HandleFunc("/api/v1/timelines/public", publicHandler)
-	mux.HandleFunc("/api/v1/preferences", constantHandler(map[string]any{
+	mux.HandleFunc("/api/v1/preferences", authorized("read:accounts", constantHandler(map[string]any{
 		"posting:default:visibility": "public",
 		"posting:default:sensitive":  false,
 		"posting:default:language":   nil,
 		"reading:expand:media":       "default",
 		"reading:expand:spoilers":    false,
-	}))
-	mux.HandleFunc("/api/v1/search", searchHandler)
-	mux.HandleFunc("/api/v2/search", searchHandler)
+	})))
+	mux.HandleFunc("/api/v1/notifications", authorized("read:notifications", notificationsHandler))
+	mux.HandleFunc("/api/v1/search", authorized("read:search", searchHandler))
+	mux.HandleFunc("/api/v2/search", authorized("read:search", searchHandler))
+	mux.HandleFunc("/api/bisu/queue", adminScoped("queue", queueHandler))
+	mux.HandleFunc("/api/bisu/relays", adminScoped("relays", relaysHandler))
+	mux.HandleFunc("/api/bisu/export", adminScoped("archive", exportHandler))
+	mux.HandleFunc("/api/bisu/import", adminScoped("archive", importHandler))
+	mux.HandleFunc("/api/bisu/rebroadcast", adminScoped("archive", rebroadcastHandler))
+	mux.HandleFunc("/api/bisu/zap", adminScoped("zap", zapHandler))
 	mux.HandleFunc("/api/pleroma/frontend_configurations", constantHandler(map[string]any{}))
 	//	mux.HandleFunc("/api/v1/trends/tags", trendingTagsHandler)
 	//	mux.HandleFunc("/api/v1/trends", trendingTagsHandler)
 
 	// not yet implemented
-	mux.HandleFunc("/api/v1/notifications", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/bookmarks", constantHandler([]any{}))
+	mux.HandleFunc("/api/v1/bookmarks", authorized("read:bookmarks", constantHandler([]any{})))
 	mux.HandleFunc("/api/v1/custom_emojis", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/accounts/search", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/filters", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/blocks", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/mutes", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/domain_blocks", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/markers", constantHandler(map[string]any{}))
-	mux.HandleFunc("/api/v1/conversations", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/favourites", constantHandler([]any{}))
-	mux.HandleFunc("/api/v1/lists", constantHandler([]any{}))
+	mux.HandleFunc("/api/v1/accounts/search", authorized("read:accounts", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/filters", authorized("read:filters", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/blocks", authorized("read:blocks", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/mutes", authorized("read:mutes", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/domain_blocks", authorized("read:blocks", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/markers", authorized("read:statuses", constantHandler(map[string]any{})))
+	mux.HandleFunc("/api/v1/conversations", authorized("read:statuses", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/favourites", authorized("read:favourites", constantHandler([]any{})))
+	mux.HandleFunc("/api/v1/lists", authorized("read:lists", constantHandler([]any{})))
 
 	// listen for http with graceful shutdown over sigterm etc
 	srv = http.Server{
-		Handler: cors.AllowAll().Handler(mux),
-		Addr:    fmt.Sprintf("127.0.0.1:7001"),
+		Handler: cors.AllowAll().Handler(withRelay(newLocalRelay("ws://"+cfg.Listen), mux)),
+		Addr:    cfg.Listen,
 	}
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		<-sigs
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-		defer cancel()
-		srv.Shutdown(ctx)
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(); err != nil {
+					log.Error().Err(err).Msg("failed to reload config, keeping the old one")
+				} else {
+					log.Info().Msg("config reloaded")
+				}
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			srv.Shutdown(ctx)
+			return
+		}
 	}()
 
 	log.Info().Msg("listening at http://" + srv.Addr)
@@ -226,6 +253,20 @@ func main() {
 	}
 }
 
+// migrateDatabase brings the sqlite schema up to date, refusing to go on if it can't.
+func migrateDatabase(db *sqlx.DB) error {
+	migrations, err := migrate.Load(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+	n, err := migrate.Run(db.DB, migrations)
+	if n > 0 {
+		log.Info().Int("applied", n).Int("version", migrations[len(migrations)-1].Version).
+			Msg("migrated database schema")
+	}
+	return err
+}
+
 func constantHandler(val any) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(val)
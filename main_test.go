@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	sql, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "params.sqlite3"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %s", err)
+	}
+	defer sql.Close()
+
+	// what older versions created at startup, before there were migrations
+	initial, _ := migrationFiles.ReadFile("migrations/001_initial.sql")
+	if _, err := sql.Exec(string(initial)); err != nil {
+		t.Fatalf("failed to create old schema: %s", err)
+	}
+	sql.Exec(`INSERT INTO pubkey_relays (pubkey, relay, last_nip65_outbox) VALUES ('abc', 'wss://relay', 10)`)
+
+	if err := migrateDatabase(sql); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	var seen int
+	if err := sql.Get(&seen, `SELECT last_seen_event FROM pubkey_relays WHERE pubkey = 'abc'`); err != nil || seen != 0 {
+		t.Fatalf("existing rows should get the new columns: %d, %v", seen, err)
+	}
+	for _, table := range []string{"oauth_tokens", "publish_queue", "tombstones", "notifications", "zaps"} {
+		var n int
+		sql.Get(&n, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, table)
+		if n != 1 {
+			t.Errorf("table %s wasn't created", table)
+		}
+	}
+
+	// running again at the next startup does nothing
+	if err := migrateDatabase(sql); err != nil {
+		t.Fatalf("second migration run failed: %s", err)
+	}
+}
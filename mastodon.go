@@ -62,11 +62,19 @@ type Status struct {
 	Application        any          `json:"application"`
 	MediaAttachments   []Attachment `json:"mediaAttachments"`
 	Mentions           []Mention    `json:"mentions"`
-	Tags               []any        `json:"tags"`
+	Tags               []Tag        `json:"tags"`
 	Emojis             []Emoji      `json:"emojis"`
 	Poll               any          `json:"poll"`
 	URI                string       `json:"uri"`
 	URL                string       `json:"url"`
+
+	Pleroma StatusPleroma `json:"pleroma"`
+}
+
+// StatusPleroma has the extensions to statuses that aren't in mastodon, in the same place
+// Pleroma puts its own.
+type StatusPleroma struct {
+	ZapsAmount int64 `json:"zaps_amount"` // sats
 }
 
 type Source struct {
@@ -85,6 +93,11 @@ type Mention struct {
 	URL      string `json:"url"`
 }
 
+type Tag struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
 type Emoji struct {
 	Shortcode string `json:"shortcode"`
 	StaticURL string `json:"staticURL"`
@@ -149,6 +162,8 @@ func toAccount(ctx context.Context, p *Profile, opts *ToAccountOpts) *Account {
 		acct, _ = nip19.EncodePublicKey(p.pubkey)
 	}
 
+	counts := getProfileCounts(ctx, p.pubkey)
+
 	account := Account{
 		ID:                  p.pubkey,
 		Acct:                acct,
@@ -161,8 +176,8 @@ func toAccount(ctx context.Context, p *Profile, opts *ToAccountOpts) *Account {
 		Emojis:              toEmojis(p.event),
 		Fields:              []any{},
 		FollowRequestsCount: 0,
-		FollowersCount:      0,
-		FollowingCount:      0,
+		FollowersCount:      int(counts.Followers),
+		FollowingCount:      int(counts.Following),
 		FQN:                 p.handle(),
 		Header:              p.Banner,
 		HeaderStatic:        p.Banner,
@@ -171,8 +186,8 @@ func toAccount(ctx context.Context, p *Profile, opts *ToAccountOpts) *Account {
 		Note:                html.EscapeString(p.About),
 		Roles:               []string{},
 		Source:              nil,
-		StatusesCount:       0,
-		URL:                 "http://" + srv.Addr + "/users/" + p.pubkey,
+		StatusesCount:       int(counts.Statuses),
+		URL:                 actorURL(p.pubkey),
 		Username:            p.handle(),
 	}
 
@@ -208,7 +223,7 @@ func toMention(ctx context.Context, pubkey string) Mention {
 		ID:       pubkey,
 		Acct:     npub,
 		Username: npub[:8],
-		URL:      "http://" + srv.Addr + "/users/" + pubkey,
+		URL:      actorURL(pubkey),
 	}
 }
 
@@ -228,18 +243,110 @@ func toStatus(ctx context.Context, evt *nostr.Event) *Status {
 
 	mentionedPubkeys := make(map[string]bool, len(evt.Tags))
 	mentions := make([]Mention, 0, len(evt.Tags))
+	tagged := make([]string, 0, len(evt.Tags))
 	for _, tag := range evt.Tags {
 		if tag[0] == "p" {
 			pubkey := tag[1]
 			if _, exists := mentionedPubkeys[pubkey]; !exists {
 				mentionedPubkeys[pubkey] = true
 				mentions = append(mentions, toMention(ctx, pubkey))
+				tagged = append(tagged, pubkey)
+			}
+		}
+	}
+
+	var card *PreviewCard
+	var text string
+	var tags []Tag
+	attachments := toAttachments(evt.Content)
+	uri := postURL(evt.ID)
+	recipients := mentions
+	if evt.Kind == 30023 {
+		info := parseArticle(evt)
+		card = toArticleCard(evt, info, profile)
+		attachments = nil
+		text = articleContent(info)
+		uri = card.URL
+	} else {
+		rendered := renderContent(ctx, evt.Content, attachments)
+		text = rendered.HTML
+		inline := make(map[string]bool, len(rendered.Mentions))
+		for _, pubkey := range rendered.Mentions {
+			inline[pubkey] = true
+			if !mentionedPubkeys[pubkey] {
+				mentionedPubkeys[pubkey] = true
+				mentions = append(mentions, toMention(ctx, pubkey))
 			}
 		}
+		// people who are already mentioned in the text aren't listed again before it
+		recipients = make([]Mention, 0, len(mentions))
+		for i, pubkey := range tagged {
+			if !inline[pubkey] {
+				recipients = append(recipients, mentions[i])
+			}
+		}
+		for _, tag := range rendered.Tags {
+			tags = append(tags, Tag{Name: tag, URL: tagURL(tag)})
+		}
+	}
+
+	if len(recipients) > 0 {
+		elements := make([]string, len(recipients))
+		for i, mention := range recipients {
+			username := mention.Username
+			if strings.HasPrefix(username, "npub1") {
+				username = username[:8]
+			}
+			elements[i] = fmt.Sprintf(`<a href="%s" class="u-url mention" rel="ugc">@<span>%s</span></a>`,
+				html.EscapeString(mention.URL), html.EscapeString(username))
+		}
+		text = fmt.Sprintf(`<span class="recipients-inline">%s</span>`, strings.Join(elements, " ")) + text
 	}
 
+	cw := evt.Tags.GetFirst([]string{"content-warning", ""})
+	cwText := ""
+	if cw != nil {
+		cwText = (*cw)[1]
+	}
+
+	counts := getEventCounts(ctx, evt)
+
+	return &Status{
+		ID:                 evt.ID,
+		Account:            account,
+		Card:               card,
+		Content:            text,
+		CreatedAt:          evt.CreatedAt.Time().Format(time.RFC3339),
+		InReplyToID:        inReplyToId,
+		InReplyToAccountID: nil,
+		Sensitive:          cw != nil,
+		SpoilerText:        cwText,
+		Visibility:         "public",
+		Language:           "",
+		RepliesCount:       int(counts.Replies),
+		ReblogsCount:       int(counts.Reposts),
+		FavouritesCount:    int(counts.Favourites),
+		Favourited:         false,
+		Reblogged:          false,
+		Muted:              false,
+		Bookmarked:         false,
+		Reblog:             nil,
+		Application:        nil,
+		MediaAttachments:   attachments,
+		Mentions:           mentions,
+		Tags:               tags,
+		Emojis:             toEmojis(evt),
+		Poll:               nil,
+		URI:                uri,
+		URL:                uri,
+		Pleroma:            StatusPleroma{ZapsAmount: counts.Zaps / 1000},
+	}
+}
+
+// toAttachments turns the links to media in a note into attachments.
+func toAttachments(content string) []Attachment {
 	attachments := make([]Attachment, 0, 5)
-	for _, link := range urlMatcher.FindAllString(evt.Content, -1) {
+	for _, link := range urlMatcher.FindAllString(content, -1) {
 		u, err := url.Parse(link)
 		if err != nil {
 			continue
@@ -282,55 +389,7 @@ func toStatus(ctx context.Context, evt *nostr.Event) *Status {
 			Blurhash:    "",
 		})
 	}
-
-	text := evt.Content
-	if len(mentions) > 0 {
-		elements := make([]string, len(mentions))
-		for i, mention := range mentions {
-			username := mention.Username
-			if strings.HasPrefix(username, "npub1") {
-				username = username[:8]
-			}
-			elements[i] = fmt.Sprintf(`<a href="%s" class="u-url mention" rel="ugc">@<span>%s</span></a>`, mention.URL, username)
-		}
-		text = fmt.Sprintf(`<span class="recipients-inline">%s</span>`, strings.Join(elements, " ")) + text
-	}
-
-	cw := evt.Tags.GetFirst([]string{"content-warning", ""})
-	cwText := ""
-	if cw != nil {
-		cwText = (*cw)[1]
-	}
-
-	return &Status{
-		ID:                 evt.ID,
-		Account:            account,
-		Card:               nil,
-		Content:            text,
-		CreatedAt:          evt.CreatedAt.Time().Format(time.RFC3339),
-		InReplyToID:        inReplyToId,
-		InReplyToAccountID: nil,
-		Sensitive:          cw != nil,
-		SpoilerText:        cwText,
-		Visibility:         "public",
-		Language:           "",
-		RepliesCount:       0,
-		ReblogsCount:       0,
-		FavouritesCount:    0,
-		Favourited:         false,
-		Reblogged:          false,
-		Muted:              false,
-		Bookmarked:         false,
-		Reblog:             nil,
-		Application:        nil,
-		MediaAttachments:   attachments,
-		Mentions:           mentions,
-		Tags:               nil,
-		Emojis:             toEmojis(evt),
-		Poll:               nil,
-		URI:                "http://" + srv.Addr + "/posts/" + evt.ID,
-		URL:                "http://" + srv.Addr + "/posts/" + evt.ID,
-	}
+	return attachments
 }
 
 func toRelationship(ctx context.Context, from string, to string) *Relationship {
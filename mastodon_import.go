@@ -0,0 +1,798 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/exp/slices"
+)
+
+const ACTIVITYSTREAMS_PUBLIC = "https://www.w3.org/ns/activitystreams#Public"
+
+// activityPubBridges mirror fediverse accounts as nostr keys and give them NIP-05 addresses
+// in the user_at_domain@bridge form.
+var activityPubBridges = []string{"mostr.pub"}
+
+// mastodonArchive is the zip Mastodon gives when asking for an archive of an account.
+type mastodonArchive struct {
+	files map[string]*zip.File
+}
+
+func openMastodonArchive(r io.ReaderAt, size int64) (*mastodonArchive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("not a zip file: %w", err)
+	}
+	archive := &mastodonArchive{files: make(map[string]*zip.File, len(zr.File))}
+	for _, f := range zr.File {
+		archive.files[strings.TrimPrefix(f.Name, "/")] = f
+	}
+	if _, ok := archive.files["outbox.json"]; !ok {
+		return nil, fmt.Errorf("outbox.json not found, is this a mastodon archive?")
+	}
+	return archive, nil
+}
+
+// read returns the contents of a file in the archive, or nil if it isn't there. files bigger
+// than max bytes are an error, unless max is 0.
+func (a *mastodonArchive) read(name string, max int64) ([]byte, error) {
+	f, ok := a.files[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return nil, nil
+	}
+	if max > 0 && f.UncompressedSize64 > uint64(max) {
+		return nil, fmt.Errorf("%s is too big (%d bytes)", name, f.UncompressedSize64)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if max == 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(b)) > max {
+		return nil, fmt.Errorf("%s is too big (more than %d bytes)", name, max)
+	}
+	return b, err
+}
+
+func (a *mastodonArchive) readJSON(name string, v any) (bool, error) {
+	b, err := a.read(name, 0)
+	if err != nil || b == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return true, nil
+}
+
+type apActor struct {
+	PreferredUsername string    `json:"preferredUsername"`
+	Name              string    `json:"name"`
+	Summary           string    `json:"summary"`
+	URL               string    `json:"url"`
+	Icon              *apMedia  `json:"icon"`
+	Image             *apMedia  `json:"image"`
+	Attachment        []apMedia `json:"attachment"`
+}
+
+// apMedia is an image or a profile field, which are both attachments in activitypub.
+type apMedia struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+}
+
+type apObject struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+type apActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	To     []string        `json:"to"`
+	Cc     []string        `json:"cc"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apNote struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	URL        string     `json:"url"`
+	Published  time.Time  `json:"published"`
+	Summary    string     `json:"summary"`
+	Content    string     `json:"content"`
+	InReplyTo  string     `json:"inReplyTo"`
+	To         []string   `json:"to"`
+	Cc         []string   `json:"cc"`
+	Attachment []apMedia  `json:"attachment"`
+	Tag        []apObject `json:"tag"`
+}
+
+// public is true for public and unlisted toots, the others weren't meant for everybody.
+func (act apActivity) public(note apNote) bool {
+	for _, list := range [][]string{act.To, act.Cc, note.To, note.Cc} {
+		if slices.Contains(list, ACTIVITYSTREAMS_PUBLIC) || slices.Contains(list, "as:Public") {
+			return true
+		}
+	}
+	return false
+}
+
+// importStep is a line in the progress log, one for each thing that is done.
+type importStep struct {
+	Source  string         `json:"source"`
+	Event   string         `json:"event,omitempty"`
+	Media   *uploadedMedia `json:"media,omitempty"`
+	Skipped string         `json:"skipped,omitempty"`
+}
+
+// importProgress is what was already imported, so an import can be run again after
+// failing midway without publishing or uploading anything twice.
+type importProgress struct {
+	file *os.File
+	done map[string]importStep
+}
+
+// openImportProgress reads the progress log at path. it's only written to when write is true.
+func openImportProgress(path string, write bool) (*importProgress, error) {
+	p := &importProgress{done: make(map[string]importStep)}
+	if path == "" {
+		return p, nil
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var step importStep
+			if json.Unmarshal(scanner.Bytes(), &step) == nil && step.Source != "" {
+				p.done[step.Source] = step
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if write {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open progress log: %w", err)
+		}
+		p.file = f
+	}
+	return p, nil
+}
+
+func (p *importProgress) record(step importStep) error {
+	p.done[step.Source] = step
+	if p.file == nil {
+		return nil
+	}
+	j, _ := json.Marshal(step)
+	_, err := p.file.Write(append(j, '\n'))
+	return err
+}
+
+func (p *importProgress) close() {
+	if p.file != nil {
+		p.file.Close()
+	}
+}
+
+type mastodonImportOptions struct {
+	DryRun       bool
+	SkipMedia    bool
+	ProgressPath string
+	Out          io.Writer // where the events are written to in a dry run
+}
+
+type mastodonImportResult struct {
+	Profile      bool     `json:"profile"`
+	Notes        int      `json:"notes"`
+	Skipped      int      `json:"skipped"`
+	Media        int      `json:"media"`
+	SkippedMedia int      `json:"skipped_media"`
+	Follows      int      `json:"follows"`
+	Unmatched    []string `json:"unmatched"`
+	Bookmarks    int      `json:"bookmarks"`
+}
+
+// mastodonImport turns an account archive into events of this identity: the profile, the
+// public toots, the follows we can find on nostr and the bookmarks.
+type mastodonImport struct {
+	id       *Identity
+	archive  *mastodonArchive
+	opts     mastodonImportOptions
+	progress *importProgress
+	res      mastodonImportResult
+	ids      map[string]string // activitypub id or url of a toot: id of the note
+}
+
+func (id *Identity) importMastodon(ctx context.Context, archive *mastodonArchive, opts mastodonImportOptions) (mastodonImportResult, error) {
+	if !opts.DryRun && !opts.SkipMedia && getConfig().MediaServer == "" {
+		return mastodonImportResult{}, fmt.Errorf("media_server isn't configured, set it or skip media")
+	}
+
+	progress, err := openImportProgress(opts.ProgressPath, !opts.DryRun)
+	if err != nil {
+		return mastodonImportResult{}, err
+	}
+	defer progress.close()
+
+	mi := &mastodonImport{id: id, archive: archive, opts: opts, progress: progress, ids: make(map[string]string)}
+	mi.res.Unmatched = make([]string, 0)
+	for _, step := range progress.done {
+		if step.Event != "" {
+			mi.ids[step.Source] = step.Event
+		}
+	}
+
+	for _, run := range []func(context.Context) error{mi.profile, mi.notes, mi.follows, mi.bookmarks} {
+		if err := run(ctx); err != nil {
+			return mi.res, err
+		}
+	}
+	return mi.res, nil
+}
+
+// emit publishes an event, or writes it out in a dry run, and returns its id.
+func (mi *mastodonImport) emit(ctx context.Context, evt *nostr.Event) (string, error) {
+	if evt.Tags == nil {
+		evt.Tags = nostr.Tags{}
+	}
+	if mi.opts.DryRun {
+		evt.PubKey = mi.id.pubkey
+		evt.ID = evt.GetID()
+		if mi.opts.Out != nil {
+			j, _ := json.Marshal(evt)
+			fmt.Fprintln(mi.opts.Out, string(j))
+		}
+		return evt.ID, nil
+	}
+
+	if _, err := mi.id.publish(ctx, evt); err != nil {
+		return "", err
+	}
+	return evt.ID, nil
+}
+
+// media uploads a file from the archive, once. files that can't be uploaded are left out
+// with a warning instead of stopping the import.
+func (mi *mastodonImport) media(ctx context.Context, file string, mimeType string) (*uploadedMedia, error) {
+	file = strings.TrimPrefix(file, "/")
+	source := "media:" + file
+	if step, ok := mi.progress.done[source]; ok {
+		return step.Media, nil
+	}
+
+	data, err := mi.archive.read(file, MEDIA_MAX_SIZE)
+	if err != nil {
+		return mi.skipMedia(source, fmt.Errorf("failed to read %s: %w", file, err))
+	}
+	if data == nil {
+		log.Warn().Str("file", file).Msg("media missing from the archive")
+		return nil, nil
+	}
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(file))
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+
+	var media uploadedMedia
+	if mi.opts.DryRun {
+		hash := sha256.Sum256(data)
+		media = uploadedMedia{URL: file, SHA256: hex.EncodeToString(hash[:]), MimeType: mimeType}
+	} else {
+		media, err = mi.id.uploadMedia(ctx, data, mimeType)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			return mi.skipMedia(source, fmt.Errorf("failed to upload %s: %w", file, err))
+		}
+	}
+	mi.res.Media++
+	return &media, mi.progress.record(importStep{Source: source, Media: &media})
+}
+
+func (mi *mastodonImport) skipMedia(source string, err error) (*uploadedMedia, error) {
+	log.Warn().Err(err).Msg("leaving media out")
+	mi.res.SkippedMedia++
+	return nil, mi.progress.record(importStep{Source: source, Skipped: err.Error()})
+}
+
+func (mi *mastodonImport) profile(ctx context.Context) error {
+	if _, ok := mi.progress.done["profile"]; ok {
+		return nil
+	}
+	var actor apActor
+	if ok, err := mi.archive.readJSON("actor.json", &actor); err != nil || !ok {
+		return err
+	}
+
+	// what we already have on nostr takes precedence
+	metadata := make(map[string]any)
+	if evt := mi.id.latestList(ctx, 0); evt != nil {
+		json.Unmarshal([]byte(evt.Content), &metadata)
+	}
+	changed := false
+	set := func(key string, value string) {
+		if s, _ := metadata[key].(string); s == "" && value != "" {
+			metadata[key] = value
+			changed = true
+		}
+	}
+
+	set("name", actor.PreferredUsername)
+	set("display_name", actor.Name)
+	about := htmlToText(actor.Summary)
+	for _, field := range actor.Attachment {
+		if field.Type == "PropertyValue" {
+			about += "\n" + field.Name + ": " + htmlToText(field.Value)
+		}
+	}
+	set("about", strings.TrimSpace(about))
+	if actor.URL != "" {
+		set("website", actor.URL)
+	}
+	if !mi.opts.SkipMedia {
+		for key, img := range map[string]*apMedia{"picture": actor.Icon, "banner": actor.Image} {
+			if img == nil || img.URL == "" {
+				continue
+			}
+			if s, _ := metadata[key].(string); s != "" {
+				continue
+			}
+			media, err := mi.media(ctx, img.URL, img.MediaType)
+			if err != nil {
+				return err
+			}
+			if media != nil {
+				set(key, media.URL)
+			}
+		}
+	}
+
+	if !changed {
+		return mi.progress.record(importStep{Source: "profile", Skipped: "nothing new"})
+	}
+	j, _ := json.Marshal(metadata)
+	evt := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Content: string(j)}
+	eventID, err := mi.emit(ctx, evt)
+	if err != nil {
+		return fmt.Errorf("failed to publish profile: %w", err)
+	}
+	if !mi.opts.DryRun {
+		if profile := toProfile(evt); profile != nil {
+			mi.id.profile = profile
+			metadataCache.Set(mi.id.pubkey, profile, 1)
+		}
+	}
+	mi.res.Profile = true
+	return mi.progress.record(importStep{Source: "profile", Event: eventID})
+}
+
+func (mi *mastodonImport) notes(ctx context.Context) error {
+	var outbox struct {
+		OrderedItems []apActivity `json:"orderedItems"`
+	}
+	if _, err := mi.archive.readJSON("outbox.json", &outbox); err != nil {
+		return err
+	}
+
+	// threads are only kept together when they're all ours
+	roots := make(map[string]string)
+	for _, act := range outbox.OrderedItems {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var note apNote
+		if act.Type != "Create" || json.Unmarshal(act.Object, &note) != nil || note.ID == "" {
+			// boosts and whatever else we can't turn into a note
+			mi.res.Skipped++
+			continue
+		}
+		if step, ok := mi.progress.done[note.ID]; ok {
+			if step.Event != "" {
+				mi.ids[note.URL] = step.Event
+				roots[step.Event] = mi.threadRoot(note, roots)
+			}
+			continue
+		}
+		if !act.public(note) {
+			mi.res.Skipped++
+			if err := mi.progress.record(importStep{Source: note.ID, Skipped: "not public"}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		evt, err := mi.toNote(ctx, note, roots)
+		if err != nil {
+			return err
+		}
+		eventID, err := mi.emit(ctx, evt)
+		if err != nil {
+			return fmt.Errorf("failed to publish %s: %w", note.ID, err)
+		}
+		mi.ids[note.ID] = eventID
+		mi.ids[note.URL] = eventID
+		roots[eventID] = mi.threadRoot(note, roots)
+		mi.res.Notes++
+		if err := mi.progress.record(importStep{Source: note.ID, Event: eventID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// threadRoot is the id of the first note of the thread this toot is in, if all of it is ours.
+func (mi *mastodonImport) threadRoot(note apNote, roots map[string]string) string {
+	if parent, ok := mi.ids[note.InReplyTo]; ok && note.InReplyTo != "" {
+		if root := roots[parent]; root != "" {
+			return root
+		}
+		return parent
+	}
+	return ""
+}
+
+func (mi *mastodonImport) toNote(ctx context.Context, note apNote, roots map[string]string) (*nostr.Event, error) {
+	content := htmlToText(note.Content)
+	tags := nostr.Tags{{"proxy", note.ID, "activitypub"}}
+
+	if parent, ok := mi.ids[note.InReplyTo]; ok && note.InReplyTo != "" {
+		if root := roots[parent]; root != "" && root != parent {
+			tags = append(tags, nostr.Tag{"e", root, "", "root"}, nostr.Tag{"e", parent, "", "reply"})
+		} else {
+			tags = append(tags, nostr.Tag{"e", parent, "", "root"})
+		}
+	} else if note.InReplyTo != "" {
+		// a reply to someone else, we can only point to it
+		content += "\n\n" + note.InReplyTo
+	}
+
+	if note.Summary != "" {
+		tags = append(tags, nostr.Tag{"content-warning", htmlToText(note.Summary)})
+	}
+	for _, tag := range note.Tag {
+		if tag.Type == "Hashtag" {
+			if name := strings.ToLower(strings.TrimPrefix(tag.Name, "#")); name != "" {
+				tags = tags.AppendUnique(nostr.Tag{"t", name})
+			}
+		}
+	}
+
+	if !mi.opts.SkipMedia {
+		for _, att := range note.Attachment {
+			if att.URL == "" {
+				continue
+			}
+			if strings.HasPrefix(att.URL, "http://") || strings.HasPrefix(att.URL, "https://") {
+				content += "\n" + att.URL
+				continue
+			}
+			media, err := mi.media(ctx, att.URL, att.MediaType)
+			if err != nil {
+				return nil, err
+			}
+			if media != nil {
+				content += "\n" + media.URL
+				tags = append(tags, media.imeta(att.Name))
+			}
+		}
+	}
+
+	createdAt := nostr.Timestamp(note.Published.Unix())
+	if note.Published.IsZero() {
+		createdAt = nostr.Now()
+	}
+	return &nostr.Event{
+		Kind:      1,
+		CreatedAt: createdAt,
+		Content:   strings.TrimSpace(content),
+		Tags:      tags,
+	}, nil
+}
+
+func (mi *mastodonImport) follows(ctx context.Context) error {
+	if _, ok := mi.progress.done["follows"]; ok {
+		return nil
+	}
+	data, err := mi.archive.read("following_accounts.csv", 0)
+	if err != nil || data == nil {
+		return err
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return fmt.Errorf("invalid following_accounts.csv: %w", err)
+	}
+
+	var tags nostr.Tags
+	content := ""
+	if evt := mi.id.latestList(ctx, 3); evt != nil {
+		tags = append(tags, evt.Tags...)
+		content = evt.Content
+	}
+
+	added := 0
+	for _, row := range rows {
+		if len(row) == 0 || !strings.Contains(row[0], "@") {
+			// the header
+			continue
+		}
+		acct := strings.TrimPrefix(strings.TrimSpace(row[0]), "@")
+		pubkey := resolveFediverseAccount(ctx, acct)
+		if pubkey == "" {
+			mi.res.Unmatched = append(mi.res.Unmatched, acct)
+			continue
+		}
+		mi.res.Follows++
+		if pubkey != mi.id.pubkey && !tags.ContainsAny("p", []string{pubkey}) {
+			tags = append(tags, nostr.Tag{"p", pubkey})
+			added++
+		}
+	}
+
+	if added == 0 {
+		return mi.progress.record(importStep{Source: "follows", Skipped: "nothing new"})
+	}
+	eventID, err := mi.emit(ctx, &nostr.Event{Kind: 3, CreatedAt: nostr.Now(), Tags: tags, Content: content})
+	if err != nil {
+		return fmt.Errorf("failed to publish contact list: %w", err)
+	}
+	if !mi.opts.DryRun {
+		contactListsCache.Delete(mi.id.pubkey)
+	}
+	return mi.progress.record(importStep{Source: "follows", Event: eventID})
+}
+
+// bookmarks become a NIP-51 bookmark list, with our own toots as notes and the rest as urls.
+func (mi *mastodonImport) bookmarks(ctx context.Context) error {
+	if _, ok := mi.progress.done["bookmarks"]; ok {
+		return nil
+	}
+	var bookmarks struct {
+		OrderedItems []string `json:"orderedItems"`
+	}
+	if ok, err := mi.archive.readJSON("bookmarks.json", &bookmarks); err != nil || !ok {
+		return err
+	}
+
+	var tags nostr.Tags
+	if evt := mi.id.latestList(ctx, 10003); evt != nil {
+		tags = append(tags, evt.Tags...)
+	}
+	before := len(tags)
+	for _, item := range bookmarks.OrderedItems {
+		if eventID, ok := mi.ids[item]; ok {
+			tags = tags.AppendUnique(nostr.Tag{"e", eventID})
+		} else if u, err := url.Parse(item); err == nil && u.Host != "" {
+			tags = tags.AppendUnique(nostr.Tag{"r", item})
+		}
+	}
+	mi.res.Bookmarks = len(tags) - before
+
+	if mi.res.Bookmarks == 0 {
+		return mi.progress.record(importStep{Source: "bookmarks", Skipped: "nothing new"})
+	}
+	eventID, err := mi.emit(ctx, &nostr.Event{Kind: 10003, CreatedAt: nostr.Now(), Tags: tags})
+	if err != nil {
+		return fmt.Errorf("failed to publish bookmarks: %w", err)
+	}
+	return mi.progress.record(importStep{Source: "bookmarks", Event: eventID})
+}
+
+// latestList is our newest event of a replaceable kind, so imports add to it instead of
+// replacing it.
+func (id *Identity) latestList(ctx context.Context, kind int) *nostr.Event {
+	if _, ok := replaceableLoaders[kind]; ok {
+		return loadReplaceableEvent(ctx, id.pubkey, kind)
+	}
+	return loadReplaceableEventFromLocalStore(ctx, id.pubkey, kind)
+}
+
+var npubRegex = regexp.MustCompile(`npub1[02-9ac-hj-np-z]{58}`)
+
+// resolveFediverseAccount finds the nostr key of a user@domain account: a NIP-05 address with
+// the same name, the address a bridge gives it or an npub in its profile.
+func resolveFediverseAccount(ctx context.Context, acct string) string {
+	i := strings.LastIndex(acct, "@")
+	if i <= 0 {
+		return ""
+	}
+	user, domain := strings.ToLower(acct[:i]), strings.ToLower(acct[i+1:])
+
+	// a nostr user seen through a bridge
+	if slices.Contains(activityPubBridges, domain) && nostr.IsValidPublicKeyHex(user) {
+		return user
+	}
+
+	if pubkey := queryNip05(ctx, user, domain); pubkey != "" {
+		return pubkey
+	}
+	for _, bridge := range activityPubBridges {
+		if pubkey := queryNip05(ctx, user+"_at_"+domain, bridge); pubkey != "" {
+			return pubkey
+		}
+	}
+	return npubFromActor(ctx, user, domain)
+}
+
+func queryNip05(ctx context.Context, name string, domain string) string {
+	var res struct {
+		Names  map[string]string   `json:"names"`
+		Relays map[string][]string `json:"relays"`
+	}
+	if err := fetchJSON(ctx, "https://"+domain+"/.well-known/nostr.json?name="+url.QueryEscape(name), "", &res); err != nil {
+		return ""
+	}
+	pubkey := res.Names[name]
+	if !nostr.IsValidPublicKeyHex(pubkey) {
+		return ""
+	}
+	for _, relay := range res.Relays[pubkey] {
+		saveNip05Hint(ctx, pubkey, nostr.NormalizeURL(relay), nostr.Now())
+	}
+	return pubkey
+}
+
+func npubFromActor(ctx context.Context, user string, domain string) string {
+	var finger struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := fetchJSON(ctx, "https://"+domain+"/.well-known/webfinger?resource=acct:"+url.QueryEscape(user+"@"+domain),
+		"", &finger); err != nil {
+		return ""
+	}
+
+	for _, link := range finger.Links {
+		if link.Rel != "self" || !strings.Contains(link.Type, "activity+json") {
+			continue
+		}
+		var actor apActor
+		if err := fetchJSON(ctx, link.Href, "application/activity+json", &actor); err != nil {
+			return ""
+		}
+		// people write their npub in their bio or in a profile field
+		texts := []string{actor.Summary}
+		for _, field := range actor.Attachment {
+			texts = append(texts, field.Name, field.Value)
+		}
+		for _, text := range texts {
+			for _, npub := range npubRegex.FindAllString(text, -1) {
+				if prefix, pubkey, err := nip19.Decode(npub); err == nil && prefix == "npub" {
+					return pubkey.(string)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func fetchJSON(ctx context.Context, u string, accept string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got status %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+var (
+	htmlBreak     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlParagraph = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+	htmlTag       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// htmlToText turns the html mastodon gives into plain text. links are fine with their tags
+// stripped because mastodon keeps the full url in the text, just partly hidden.
+func htmlToText(s string) string {
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlParagraph.ReplaceAllString(s, "\n\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// mastodonImportCommand runs the mastodon-import subcommand.
+func mastodonImportCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bisu mastodon-import", flag.ContinueOnError)
+	pubkey := fs.String("pubkey", "", "identity to import into (default the only one)")
+	dryRun := fs.Bool("dry-run", false, "print the events instead of publishing them")
+	skipMedia := fs.Bool("skip-media", false, "don't upload images and videos")
+	progress := fs.String("progress", "", "progress log, to resume an import (default <archive>.progress)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: bisu mastodon-import [-dry-run] [-skip-media] [-pubkey hex] <archive.zip>")
+	}
+
+	var id *Identity
+	if *pubkey != "" {
+		id = getIdentityByPubkey(*pubkey)
+	} else if len(identities) == 1 {
+		id = identities[0]
+	} else {
+		return fmt.Errorf("there is more than one identity, pick one with -pubkey")
+	}
+	if id == nil {
+		return fmt.Errorf("no identity with pubkey %s", *pubkey)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	archive, err := openMastodonArchive(f, info.Size())
+	if err != nil {
+		return err
+	}
+
+	opts := mastodonImportOptions{DryRun: *dryRun, SkipMedia: *skipMedia, ProgressPath: *progress, Out: os.Stdout}
+	if opts.ProgressPath == "" {
+		opts.ProgressPath = fs.Arg(0) + ".progress"
+	}
+	res, err := id.importMastodon(ctx, archive, opts)
+	for _, acct := range res.Unmatched {
+		log.Warn().Str("account", acct).Msg("couldn't find this account on nostr")
+	}
+	log.Info().Bool("profile", res.Profile).Int("notes", res.Notes).Int("skipped", res.Skipped).
+		Int("media", res.Media).Int("skipped-media", res.SkippedMedia).Int("follows", res.Follows).Int("bookmarks", res.Bookmarks).
+		Bool("dry-run", opts.DryRun).Msg("mastodon import")
+	if err != nil {
+		return fmt.Errorf("%w (run again to resume)", err)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// startTestBlossom is a media server that checks the upload authorization like a real one.
+func startTestBlossom(t *testing.T) (string, *atomic.Int32) {
+	uploads := &atomic.Int32{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upload" {
+			http.NotFound(w, r)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		hash := sha256.Sum256(data)
+		x := hex.EncodeToString(hash[:])
+
+		auth := &nostr.Event{}
+		b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Nostr "))
+		if json.Unmarshal(b, auth) != nil || auth.Kind != 24242 || checkEvent(auth) != nil ||
+			!auth.Tags.ContainsAny("x", []string{x}) || !auth.Tags.ContainsAny("t", []string{"upload"}) {
+			w.Header().Set("X-Reason", "bad auth")
+			w.WriteHeader(401)
+			return
+		}
+
+		uploads.Add(1)
+		json.NewEncoder(w).Encode(uploadedMedia{URL: server.URL + "/" + x, SHA256: x, MimeType: r.Header.Get("Content-Type")})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, uploads
+}
+
+func mastodonTestArchive(t *testing.T, files map[string]any) *mastodonArchive {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		switch c := content.(type) {
+		case string:
+			w.Write([]byte(c))
+		default:
+			json.NewEncoder(w).Encode(c)
+		}
+	}
+	zw.Close()
+
+	archive, err := openMastodonArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to open archive: %s", err)
+	}
+	return archive
+}
+
+func TestMastodonImport(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	blossom, uploads := startTestBlossom(t)
+	setTestConfig(t, func(c *Config) { c.MediaServer = blossom })
+
+	alice, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bob, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	bobNpub, _ := nip19.EncodePublicKey(bob)
+	bridged, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	// a fediverse server where alice has a nostr address and bob has an npub in their profile
+	var fedi *httptest.Server
+	fedi = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/.well-known/nostr.json" && r.URL.Query().Get("name") == "alice":
+			fmt.Fprintf(w, `{"names": {"alice": "%s"}, "relays": {"%s": ["wss://alice.relay"]}}`, alice, alice)
+		case r.URL.Path == "/.well-known/webfinger" && strings.HasPrefix(r.URL.Query().Get("resource"), "acct:bob@"):
+			fmt.Fprintf(w, `{"links": [{"rel": "self", "type": "application/activity+json", "href": "%s/users/bob"}]}`, fedi.URL)
+		case r.URL.Path == "/users/bob":
+			fmt.Fprintf(w, `{"summary": "hi", "attachment": [{"type": "PropertyValue", "name": "nostr", "value": "%s"}]}`, bobNpub)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(fedi.Close)
+	previousClient, previousBridges := httpClient, activityPubBridges
+	httpClient, activityPubBridges = fedi.Client(), []string{"bridge.example"}
+	t.Cleanup(func() { httpClient, activityPubBridges = previousClient, previousBridges })
+	host := strings.TrimPrefix(fedi.URL, "https://")
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	mypk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: mypk, writeRelays: []string{"wss://write.example.com"}}
+
+	public := []string{ACTIVITYSTREAMS_PUBLIC}
+	toot := func(n int, replyTo string, extra map[string]any) map[string]any {
+		note := map[string]any{
+			"id":        fmt.Sprintf("https://social.example/users/me/statuses/%d", n),
+			"url":       fmt.Sprintf("https://social.example/@me/%d", n),
+			"type":      "Note",
+			"published": fmt.Sprintf("2022-01-0%dT10:00:00Z", n),
+			"content":   fmt.Sprintf("<p>toot %d</p>", n),
+			"inReplyTo": replyTo,
+			"to":        public,
+		}
+		for k, v := range extra {
+			note[k] = v
+		}
+		return map[string]any{"type": "Create", "to": note["to"], "object": note}
+	}
+	files := map[string]any{
+		"actor.json": map[string]any{
+			"preferredUsername": "me",
+			"name":              "Me Myself",
+			"summary":           "<p>I &amp; my toots</p>",
+			"icon":              map[string]any{"url": "/avatar.png", "mediaType": "image/png"},
+			"attachment":        []any{map[string]any{"type": "PropertyValue", "name": "pronouns", "value": "they/them"}},
+		},
+		"avatar.png":                    "fake png",
+		"media_attachments/files/1.jpg": "fake jpg",
+		"outbox.json": map[string]any{"orderedItems": []any{
+			toot(1, "", map[string]any{
+				"summary":    "spoilers",
+				"content":    `<p>hello <a href="https://social.example/tags/Nostr" class="mention hashtag">#<span>Nostr</span></a><br>bye</p><p>again</p>`,
+				"tag":        []any{map[string]any{"type": "Hashtag", "name": "#Nostr"}},
+				"attachment": []any{map[string]any{"type": "Document", "mediaType": "image/jpeg", "url": "/media_attachments/files/1.jpg", "name": "a cat"}},
+			}),
+			toot(2, "https://social.example/users/me/statuses/1", nil),
+			toot(3, "https://social.example/users/me/statuses/2", nil),
+			toot(4, "", map[string]any{"to": []string{"https://social.example/users/me/followers"}}),
+			map[string]any{"type": "Announce", "to": public, "object": "https://elsewhere.example/statuses/9"},
+		}},
+		"following_accounts.csv": fmt.Sprintf("Account address,Show boosts,Notify on new posts,Languages\n"+
+			"alice@%s,true,false,\nbob@%s,true,false,\ncarol@%s,true,false,\n%s@bridge.example,true,false,\n",
+			host, host, host, bridged),
+		"bookmarks.json": map[string]any{"orderedItems": []string{
+			"https://social.example/users/me/statuses/1",
+			"https://elsewhere.example/statuses/9",
+		}},
+	}
+	archive := mastodonTestArchive(t, files)
+	progressPath := filepath.Join(t.TempDir(), "import.progress")
+
+	// a dry run changes nothing
+	out := &bytes.Buffer{}
+	res, err := id.importMastodon(ctx, archive, mastodonImportOptions{DryRun: true, ProgressPath: progressPath, Out: out})
+	if err != nil || res.Notes != 3 || res.Skipped != 2 || res.Follows != 3 || !res.Profile {
+		t.Fatalf("dry run: %+v, %v", res, err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 6 {
+		t.Fatalf("expected 6 events in the dry run, got %d", lines)
+	}
+	var queued int
+	db.GetContext(ctx, &queued, `SELECT count(*) FROM publish_queue`)
+	if queued != 0 || uploads.Load() != 0 {
+		t.Fatalf("dry run published %d events and uploaded %d files", queued, uploads.Load())
+	}
+	if _, err := os.Stat(progressPath); !os.IsNotExist(err) {
+		t.Fatalf("dry run wrote the progress log")
+	}
+
+	res, err = id.importMastodon(ctx, archive, mastodonImportOptions{ProgressPath: progressPath})
+	if err != nil || res.Notes != 3 || res.Media != 2 || res.Bookmarks != 2 {
+		t.Fatalf("import: %+v, %v", res, err)
+	}
+	if len(res.Unmatched) != 1 || res.Unmatched[0] != "carol@"+host {
+		t.Fatalf("expected carol to be unmatched, got %v", res.Unmatched)
+	}
+
+	latest := func(kind int) []*nostr.Event {
+		var events []*nostr.Event
+		ch, _ := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{kind}, Authors: []string{mypk}})
+		for evt := range ch {
+			events = append(events, evt)
+		}
+		return events
+	}
+
+	notes := latest(1)
+	if len(notes) != 3 {
+		t.Fatalf("expected 3 notes, got %d", len(notes))
+	}
+	byContent := make(map[string]*nostr.Event)
+	for _, note := range notes {
+		byContent[strings.SplitN(note.Content, "\n", 2)[0]] = note
+	}
+	first := byContent["hello #Nostr"]
+	if first == nil || first.CreatedAt != 1641031200 {
+		t.Fatalf("first toot is wrong: %v", first)
+	}
+	if !strings.HasPrefix(first.Content, "hello #Nostr\nbye\n\nagain\n"+blossom+"/") {
+		t.Errorf("unexpected content %q", first.Content)
+	}
+	for _, tag := range []nostr.Tag{
+		{"t", "nostr"},
+		{"content-warning", "spoilers"},
+		{"proxy", "https://social.example/users/me/statuses/1", "activitypub"},
+	} {
+		if !first.Tags.ContainsAny(tag[0], tag[1:2]) {
+			t.Errorf("missing %v", tag)
+		}
+	}
+	if imeta := first.Tags.GetFirst([]string{"imeta"}); imeta == nil || (*imeta)[len(*imeta)-1] != "alt a cat" {
+		t.Errorf("missing imeta, got %v", first.Tags)
+	}
+	second, third := byContent["toot 2"], byContent["toot 3"]
+	if root := second.Tags.GetFirst([]string{"e", first.ID, "", "root"}); root == nil {
+		t.Errorf("reply should point to the first toot, got %v", second.Tags)
+	}
+	if third.Tags.GetFirst([]string{"e", first.ID, "", "root"}) == nil ||
+		third.Tags.GetFirst([]string{"e", second.ID, "", "reply"}) == nil {
+		t.Errorf("reply to a reply should keep the root, got %v", third.Tags)
+	}
+
+	var metadata map[string]string
+	json.Unmarshal([]byte(latest(0)[0].Content), &metadata)
+	if metadata["name"] != "me" || metadata["about"] != "I & my toots\npronouns: they/them" ||
+		!strings.HasPrefix(metadata["picture"], blossom) {
+		t.Errorf("unexpected profile %v", metadata)
+	}
+	if contacts := latest(3); len(contacts) != 1 || !contacts[0].Tags.ContainsAny("p", []string{alice}) ||
+		!contacts[0].Tags.ContainsAny("p", []string{bob}) || !contacts[0].Tags.ContainsAny("p", []string{bridged}) {
+		t.Errorf("unexpected contact list %v", contacts)
+	}
+	if relays := fetchOutboxRelaysForUser(ctx, alice, 3, true); len(relays) != 1 || relays[0] != "wss://alice.relay" {
+		t.Errorf("nip05 relays should be hints, got %v", relays)
+	}
+	bookmarks := latest(10003)
+	if len(bookmarks) != 1 || !bookmarks[0].Tags.ContainsAny("e", []string{first.ID}) ||
+		!bookmarks[0].Tags.ContainsAny("r", []string{"https://elsewhere.example/statuses/9"}) {
+		t.Errorf("unexpected bookmarks %v", bookmarks)
+	}
+
+	// running again does nothing
+	db.GetContext(ctx, &queued, `SELECT count(DISTINCT event_id) FROM publish_queue`)
+	res, err = id.importMastodon(ctx, archive, mastodonImportOptions{ProgressPath: progressPath})
+	var queuedAgain int
+	db.GetContext(ctx, &queuedAgain, `SELECT count(DISTINCT event_id) FROM publish_queue`)
+	if err != nil || res.Notes != 0 || res.Profile || queuedAgain != queued || uploads.Load() != 2 {
+		t.Fatalf("second run: %+v, %v, %d events queued, %d uploads", res, err, queuedAgain-queued, uploads.Load())
+	}
+
+	// an import that stopped after the avatar and the profile picks up from there
+	b, _ := os.ReadFile(progressPath)
+	lines := strings.SplitAfter(string(b), "\n")
+	os.WriteFile(progressPath, []byte(lines[0]+lines[1]), 0600)
+	setupTestStorage(t)
+	res, err = id.importMastodon(ctx, archive, mastodonImportOptions{ProgressPath: progressPath})
+	if err != nil || res.Profile || res.Notes != 3 || uploads.Load() != 3 {
+		t.Fatalf("resumed: %+v, %v, %d uploads", res, err, uploads.Load())
+	}
+}
+
+func TestMastodonImportSkipsMedia(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	// a media server that refuses everything
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Reason", "no space left")
+		w.WriteHeader(507)
+	}))
+	t.Cleanup(broken.Close)
+	setTestConfig(t, func(c *Config) { c.MediaServer = broken.URL })
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	mypk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: mypk, writeRelays: []string{"wss://write.example.com"}}
+
+	archive := mastodonTestArchive(t, map[string]any{
+		"media_attachments/files/1.jpg": "fake jpg",
+		"outbox.json": map[string]any{"orderedItems": []any{map[string]any{
+			"type": "Create",
+			"to":   []string{ACTIVITYSTREAMS_PUBLIC},
+			"object": map[string]any{
+				"id":         "https://social.example/users/me/statuses/1",
+				"type":       "Note",
+				"content":    "<p>a cat</p>",
+				"to":         []string{ACTIVITYSTREAMS_PUBLIC},
+				"attachment": []any{map[string]any{"type": "Document", "mediaType": "image/jpeg", "url": "/media_attachments/files/1.jpg"}},
+			},
+		}}},
+	})
+
+	// the toot is still imported, without the picture
+	progressPath := filepath.Join(t.TempDir(), "progress")
+	res, err := id.importMastodon(ctx, archive, mastodonImportOptions{ProgressPath: progressPath})
+	if err != nil || res.Notes != 1 || res.Media != 0 || res.SkippedMedia != 1 {
+		t.Fatalf("unexpected result %+v, %v", res, err)
+	}
+	ch, _ := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{1}, Authors: []string{mypk}})
+	var notes []*nostr.Event
+	for evt := range ch {
+		notes = append(notes, evt)
+	}
+	if len(notes) != 1 || notes[0].Content != "a cat" {
+		t.Fatalf("expected the note without media, got %v", notes)
+	}
+
+	// and it isn't tried again
+	progress, _ := openImportProgress(progressPath, false)
+	if step := progress.done["media:media_attachments/files/1.jpg"]; step.Skipped == "" || step.Media != nil {
+		t.Fatalf("the failed upload should be recorded as skipped, got %+v", step)
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	for html, text := range map[string]string{
+		`<p>a &lt;b&gt; &amp; c</p>`:      `a <b> & c`,
+		`<p>one<br />two</p><p>three</p>`: "one\ntwo\n\nthree",
+		`<p><a href="https://x.com/a/b" rel="nofollow"><span class="invisible">https://</span><span class="ellipsis">x.com/a</span><span class="invisible">/b</span></a></p>`: "https://x.com/a/b",
+		`<p><span class="h-card"><a href="https://x.com/@bob" class="u-url mention">@<span>bob</span></a></span> hi</p>`:                                                      "@bob hi",
+	} {
+		if got := htmlToText(html); got != text {
+			t.Errorf("%s: expected %q, got %q", html, text, got)
+		}
+	}
+}
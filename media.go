@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const MEDIA_MAX_SIZE = 1 << 26
+
+// httpClient is used for everything we fetch over http that isn't a relay.
+var httpClient = &http.Client{Timeout: time.Second * 60}
+
+// uploadedMedia is what we know about a file once it's on the media server.
+type uploadedMedia struct {
+	URL      string `json:"url"`
+	SHA256   string `json:"sha256"`
+	MimeType string `json:"type"`
+}
+
+// imeta is the NIP-92 tag describing the file, alt may be empty.
+func (m uploadedMedia) imeta(alt string) nostr.Tag {
+	tag := nostr.Tag{"imeta", "url " + m.URL}
+	if m.MimeType != "" {
+		tag = append(tag, "m "+m.MimeType)
+	}
+	if m.SHA256 != "" {
+		tag = append(tag, "x "+m.SHA256)
+	}
+	if alt != "" {
+		tag = append(tag, "alt "+alt)
+	}
+	return tag
+}
+
+var (
+	nip96Mu   sync.Mutex
+	nip96APIs = make(map[string]string) // server: api url, empty when it isn't a NIP-96 server
+)
+
+// nip96API returns the upload url of a NIP-96 server, or "" if the server doesn't say it
+// speaks NIP-96, in which case it's taken to be a Blossom server.
+func nip96API(ctx context.Context, server string) string {
+	nip96Mu.Lock()
+	defer nip96Mu.Unlock()
+	if api, ok := nip96APIs[server]; ok {
+		return api
+	}
+
+	api := ""
+	req, _ := http.NewRequestWithContext(ctx, "GET", server+"/.well-known/nostr/nip96.json", nil)
+	if resp, err := httpClient.Do(req); err == nil {
+		var info struct {
+			APIURL string `json:"api_url"`
+		}
+		if resp.StatusCode == 200 && json.NewDecoder(resp.Body).Decode(&info) == nil {
+			api = info.APIURL
+		}
+		resp.Body.Close()
+	}
+	nip96APIs[server] = api
+	return api
+}
+
+// uploadMedia sends a file to the configured media server, signing the authorization
+// with the identity's key.
+func (id *Identity) uploadMedia(ctx context.Context, data []byte, mimeType string) (uploadedMedia, error) {
+	server := getConfig().MediaServer
+	if server == "" {
+		return uploadedMedia{}, fmt.Errorf("media_server isn't configured")
+	}
+	if len(data) > MEDIA_MAX_SIZE {
+		return uploadedMedia{}, fmt.Errorf("file is too big (%d bytes)", len(data))
+	}
+	hash := sha256.Sum256(data)
+	x := hex.EncodeToString(hash[:])
+
+	if api := nip96API(ctx, server); api != "" {
+		return id.uploadNip96(ctx, api, data, x, mimeType)
+	}
+	return id.uploadBlossom(ctx, server, data, x, mimeType)
+}
+
+func (id *Identity) uploadBlossom(ctx context.Context, server string, data []byte, x string, mimeType string) (uploadedMedia, error) {
+	auth, err := id.httpAuth(ctx, &nostr.Event{
+		Kind:    24242,
+		Content: "Upload " + x,
+		Tags: nostr.Tags{
+			{"t", "upload"},
+			{"x", x},
+			{"expiration", fmt.Sprint(time.Now().Add(time.Minute * 5).Unix())},
+		},
+	})
+	if err != nil {
+		return uploadedMedia{}, err
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "PUT", server+"/upload", bytes.NewReader(data))
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", mimeType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return uploadedMedia{}, fmt.Errorf("failed to upload: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return uploadedMedia{}, fmt.Errorf("blossom server said %d: %s", resp.StatusCode, resp.Header.Get("X-Reason"))
+	}
+
+	media := uploadedMedia{}
+	if err := json.NewDecoder(resp.Body).Decode(&media); err != nil || media.URL == "" {
+		return uploadedMedia{}, fmt.Errorf("invalid blob descriptor from blossom server")
+	}
+	if media.SHA256 != x {
+		return uploadedMedia{}, fmt.Errorf("blossom server stored something else (%s)", media.SHA256)
+	}
+	if media.MimeType == "" {
+		media.MimeType = mimeType
+	}
+	return media, nil
+}
+
+func (id *Identity) uploadNip96(ctx context.Context, api string, data []byte, x string, mimeType string) (uploadedMedia, error) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("content_type", mimeType)
+	mw.WriteField("size", fmt.Sprint(len(data)))
+	fw, _ := mw.CreateFormFile("file", x)
+	fw.Write(data)
+	mw.Close()
+
+	payload := sha256.Sum256(body.Bytes())
+	auth, err := id.httpAuth(ctx, &nostr.Event{
+		Kind: 27235,
+		Tags: nostr.Tags{
+			{"u", api},
+			{"method", "POST"},
+			{"payload", hex.EncodeToString(payload[:])},
+		},
+	})
+	if err != nil {
+		return uploadedMedia{}, err
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", api, body)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return uploadedMedia{}, fmt.Errorf("failed to upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Status     string `json:"status"`
+		Message    string `json:"message"`
+		Nip94Event struct {
+			Tags nostr.Tags `json:"tags"`
+		} `json:"nip94_event"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return uploadedMedia{}, fmt.Errorf("invalid response from nip96 server (%d)", resp.StatusCode)
+	}
+	if res.Status != "success" {
+		return uploadedMedia{}, fmt.Errorf("nip96 server said %s: %s", res.Status, res.Message)
+	}
+
+	media := uploadedMedia{SHA256: x, MimeType: mimeType}
+	if tag := res.Nip94Event.Tags.GetFirst([]string{"url", ""}); tag != nil {
+		media.URL = tag.Value()
+	}
+	if tag := res.Nip94Event.Tags.GetFirst([]string{"m", ""}); tag != nil {
+		media.MimeType = tag.Value()
+	}
+	if media.URL == "" {
+		return uploadedMedia{}, fmt.Errorf("nip96 server didn't give us an url")
+	}
+	return media, nil
+}
+
+// httpAuth signs an authorization event and returns it as an Authorization header value.
+func (id *Identity) httpAuth(ctx context.Context, evt *nostr.Event) (string, error) {
+	evt.CreatedAt = nostr.Now()
+	if err := id.signer.SignEvent(ctx, evt); err != nil {
+		return "", fmt.Errorf("failed to sign authorization: %w", err)
+	}
+	return "Nostr " + base64.StdEncoding.EncodeToString([]byte(evt.String())), nil
+}
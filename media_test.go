@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestUploadNip96(t *testing.T) {
+	ctx := context.Background()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/nostr/nip96.json":
+			fmt.Fprintf(w, `{"api_url": "%s/api/upload"}`, server.URL)
+		case "/api/upload":
+			auth := &nostr.Event{}
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Nostr "))
+			json.Unmarshal(b, auth)
+			if auth.Kind != 27235 || checkEvent(auth) != nil ||
+				!auth.Tags.ContainsAny("u", []string{server.URL + "/api/upload"}) {
+				w.WriteHeader(401)
+				fmt.Fprint(w, `{"status": "error", "message": "bad auth"}`)
+				return
+			}
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			data, _ := io.ReadAll(file)
+			fmt.Fprintf(w, `{"status": "success", "nip94_event": {"tags": [["url", "%s/%s.png"], ["m", "image/png"]]}}`,
+				server.URL, data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	setTestConfig(t, func(c *Config) { c.MediaServer = server.URL })
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	pk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: pk}
+
+	media, err := id.uploadMedia(ctx, []byte("picture"), "image/png")
+	if err != nil {
+		t.Fatalf("failed to upload: %s", err)
+	}
+	if media.URL != server.URL+"/picture.png" || media.MimeType != "image/png" || len(media.SHA256) != 64 {
+		t.Fatalf("unexpected result %+v", media)
+	}
+	if imeta := media.imeta("alt text"); len(imeta) != 5 || imeta[1] != "url "+media.URL {
+		t.Fatalf("unexpected imeta %v", imeta)
+	}
+}
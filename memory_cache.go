@@ -34,4 +34,8 @@ var (
 	eventCache        = newHex32Cache[*nostr.Event](36_000)
 	metadataCache     = newHex32Cache[*Profile](8_000)
 	contactListsCache = newHex32Cache[*[]Follow](8_000)
+	zapParamsCache    = newHex32Cache[*lnurlPayParams](8_000)
+
+	eventCountsCache   = newHex32Cache[eventCounts](36_000)
+	profileCountsCache = newHex32Cache[profileCounts](8_000)
 )
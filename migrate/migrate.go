@@ -0,0 +1,114 @@
+// Package migrate applies numbered SQL migrations to a sqlite database, keeping track of the
+// ones that were already applied in a schema_version table.
+//
+// migrations are files named like "003_add_something.sql", each one is applied inside its own
+// transaction and they must be numbered without gaps starting from 1.
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Load reads all the .sql files in dir and returns them sorted by version.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		spl := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(spl[0])
+		if err != nil || len(spl) != 2 || version < 1 {
+			return nil, fmt.Errorf("migration '%s' should be named like 001_description.sql", entry.Name())
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration '%s': %w", entry.Name(), err)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: spl[1], SQL: string(b)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing or duplicated", i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Version returns the version the database is at, 0 if no migrations were applied.
+func Version(db *sql.DB) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+  version int PRIMARY KEY,
+  name text NOT NULL,
+  applied_at int NOT NULL
+)`); err != nil {
+		return 0, fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Run applies the migrations the database doesn't have yet and returns how many were applied.
+// it refuses to do anything if the database was migrated by a newer version of the program.
+func Run(db *sql.DB, migrations []Migration) (int, error) {
+	current, err := Version(db)
+	if err != nil {
+		return 0, err
+	}
+	if current > len(migrations) {
+		return 0, fmt.Errorf("database schema is at version %d but we only know up to %d, was it used by a newer version?",
+			current, len(migrations))
+	}
+
+	applied := 0
+	for _, m := range migrations[current:] {
+		if err := apply(db, m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func apply(db *sql.DB, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)`,
+		m.Version, m.Name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"m/002_second.sql": {Data: []byte("CREATE TABLE b (x int);")},
+		"m/001_first.sql":  {Data: []byte("CREATE TABLE a (x int);")},
+		"m/README":         {Data: []byte("not a migration")},
+	}, "m")
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].Version != 2 {
+		t.Fatalf("got %+v", migrations)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"gap":       {"m/001_a.sql": {}, "m/003_c.sql": {}},
+		"duplicate": {"m/001_a.sql": {}, "m/001_b.sql": {}},
+		"bad name":  {"m/first.sql": {}},
+	} {
+		if _, err := Load(fsys, "m"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	db := openTestDB(t)
+	migrations := []Migration{
+		{1, "first", "CREATE TABLE a (x int); INSERT INTO a VALUES (1);"},
+		{2, "second", "ALTER TABLE a ADD COLUMN y int NOT NULL DEFAULT 2;"},
+	}
+
+	if n, err := Run(db, migrations[0:1]); err != nil || n != 1 {
+		t.Fatalf("expected 1 migration applied, got %d, %v", n, err)
+	}
+	if n, err := Run(db, migrations); err != nil || n != 1 {
+		t.Fatalf("expected only the second migration to be applied, got %d, %v", n, err)
+	}
+	if n, err := Run(db, migrations); err != nil || n != 0 {
+		t.Fatalf("expected nothing to be applied, got %d, %v", n, err)
+	}
+
+	var y int
+	if err := db.QueryRow(`SELECT y FROM a`).Scan(&y); err != nil || y != 2 {
+		t.Fatalf("migrations weren't applied: %d, %v", y, err)
+	}
+	if v, _ := Version(db); v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+
+	// an older program shouldn't touch this database
+	if _, err := Run(db, migrations[0:1]); err == nil {
+		t.Fatalf("expected an error when the database is newer than the migrations")
+	}
+}
+
+func TestRunRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	migrations := []Migration{
+		{1, "first", "CREATE TABLE a (x int);"},
+		{2, "broken", "CREATE TABLE b (x int); INSERT INTO nowhere VALUES (1);"},
+	}
+
+	if n, err := Run(db, migrations); err == nil || n != 1 {
+		t.Fatalf("expected the second migration to fail after the first, got %d, %v", n, err)
+	}
+	if v, _ := Version(db); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	var n int
+	db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'b'`).Scan(&n)
+	if n != 0 {
+		t.Fatalf("the failed migration wasn't rolled back")
+	}
+}
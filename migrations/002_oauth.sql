@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS oauth_apps (
+  client_id text PRIMARY KEY,
+  client_secret text NOT NULL,
+  name text NOT NULL,
+  website text NOT NULL DEFAULT '',
+  redirect_uris text NOT NULL,
+  scopes text NOT NULL,
+  created_at int NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+  token text PRIMARY KEY,
+  client_id text NOT NULL,
+  pubkey text NOT NULL DEFAULT '',
+  scopes text NOT NULL,
+  user_authorized int NOT NULL DEFAULT 0,
+  created_at int NOT NULL
+);
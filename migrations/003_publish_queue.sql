@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS publish_queue (
+  event_id text NOT NULL,
+  relay text NOT NULL,
+  pubkey text NOT NULL,
+  event text NOT NULL,
+  inbox int NOT NULL DEFAULT 0,
+  attempts int NOT NULL DEFAULT 0,
+  next_attempt int NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  created_at int NOT NULL,
+  expires_at int NOT NULL,
+
+  UNIQUE (event_id, relay)
+);
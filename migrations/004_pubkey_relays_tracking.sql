@@ -0,0 +1,2 @@
+ALTER TABLE pubkey_relays ADD COLUMN last_invalid_data int NOT NULL DEFAULT 0;
+ALTER TABLE pubkey_relays ADD COLUMN last_seen_event int NOT NULL DEFAULT 0;
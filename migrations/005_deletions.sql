@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS tombstones (
+  target text NOT NULL, -- an event id or a kind:pubkey:d address
+  pubkey text NOT NULL,
+  deleted_at int NOT NULL,
+
+  UNIQUE (target, pubkey)
+);
+
+CREATE TABLE IF NOT EXISTS expirations (
+  id text PRIMARY KEY,
+  expires_at int NOT NULL
+);
+CREATE INDEX IF NOT EXISTS expirations_expires_at ON expirations (expires_at);
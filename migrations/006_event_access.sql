@@ -0,0 +1,18 @@
+-- what we need to know about each stored event to decide what to evict
+CREATE TABLE IF NOT EXISTS event_access (
+  id text PRIMARY KEY,
+  pubkey text NOT NULL,
+  kind int NOT NULL,
+  created_at int NOT NULL,
+  root text NOT NULL DEFAULT '', -- the thread this event is part of, if any
+  size int NOT NULL,
+  accessed_at int NOT NULL
+);
+CREATE INDEX IF NOT EXISTS event_access_accessed_at ON event_access (accessed_at);
+
+-- how far we got indexing the events that were stored before this table existed, 0 means we
+-- haven't started and -1 that we're done
+CREATE TABLE IF NOT EXISTS event_access_backfill (
+  until int NOT NULL
+);
+INSERT INTO event_access_backfill (until) VALUES (0);
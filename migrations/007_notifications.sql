@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS notifications (
+  id text NOT NULL, -- the id of the event that caused it
+  pubkey text NOT NULL, -- the identity that is notified
+  type text NOT NULL, -- 'mention', 'reblog', 'favourite', 'follow' etc
+  account text NOT NULL, -- who did it
+  status_id text NOT NULL DEFAULT '', -- our event they acted on, if any
+  created_at int NOT NULL,
+
+  UNIQUE (id, pubkey)
+);
+CREATE INDEX IF NOT EXISTS notifications_pubkey_created_at ON notifications (pubkey, created_at);
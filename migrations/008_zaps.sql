@@ -0,0 +1,12 @@
+-- zap receipts we validated, to show who zapped what
+CREATE TABLE IF NOT EXISTS zaps (
+  id text PRIMARY KEY, -- of the receipt (kind 9735)
+  recipient text NOT NULL,
+  sender text NOT NULL, -- who signed the zap request
+  event_id text NOT NULL DEFAULT '', -- the zapped event, if any
+  amount int NOT NULL, -- millisatoshis
+  comment text NOT NULL DEFAULT '',
+  created_at int NOT NULL
+);
+CREATE INDEX IF NOT EXISTS zaps_event_id ON zaps (event_id);
+CREATE INDEX IF NOT EXISTS zaps_recipient ON zaps (recipient);
@@ -0,0 +1,3 @@
+-- rows are now kept for a while after the relay answers so we can tell what happened
+ALTER TABLE publish_queue ADD COLUMN status text NOT NULL DEFAULT 'pending';
+CREATE INDEX IF NOT EXISTS publish_queue_status ON publish_queue (status, next_attempt);
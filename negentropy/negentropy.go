@@ -0,0 +1,412 @@
+// Package negentropy implements the range-based set reconciliation protocol used by NIP-77
+// (protocol version 1), so two sides holding sets of events can find out which ones each is
+// missing while exchanging only fingerprints of what they have in common.
+package negentropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	version = 0x61
+
+	idSize          = 32
+	fingerprintSize = 16
+
+	// ranges smaller than this are sent as plain id lists instead of being split further.
+	buckets = 16
+)
+
+const (
+	modeSkip        = 0
+	modeFingerprint = 1
+	modeIDList      = 2
+)
+
+const maxTimestamp = math.MaxUint64
+
+type item struct {
+	timestamp uint64
+	id        [idSize]byte
+}
+
+func (it item) less(other item) bool {
+	if it.timestamp != other.timestamp {
+		return it.timestamp < other.timestamp
+	}
+	return bytes.Compare(it.id[:], other.id[:]) < 0
+}
+
+// bound is the upper end of a range: a timestamp and the shortest id prefix that separates
+// the items on each side.
+type bound struct {
+	timestamp uint64
+	prefix    []byte
+}
+
+func (b bound) lessOrEqual(it item) bool {
+	if b.timestamp != it.timestamp {
+		return b.timestamp < it.timestamp
+	}
+	return bytes.Compare(b.prefix, it.id[:len(b.prefix)]) <= 0
+}
+
+// Negentropy holds one side of a reconciliation. add all the items first, then either call
+// Initiate and feed the answers to Reconcile (client) or just answer with Reconcile (relay).
+type Negentropy struct {
+	items     []item
+	sealed    bool
+	initiator bool
+}
+
+func New() *Negentropy {
+	return &Negentropy{}
+}
+
+// Add inserts an event, given by its created_at and hex id.
+func (n *Negentropy) Add(timestamp int64, id string) error {
+	if n.sealed {
+		return errors.New("can't add items after reconciliation started")
+	}
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != idSize {
+		return fmt.Errorf("invalid id '%s'", id)
+	}
+	it := item{timestamp: uint64(timestamp)}
+	copy(it.id[:], b)
+	n.items = append(n.items, it)
+	return nil
+}
+
+func (n *Negentropy) seal() {
+	if n.sealed {
+		return
+	}
+	n.sealed = true
+	sort.Slice(n.items, func(i, j int) bool { return n.items[i].less(n.items[j]) })
+
+	// an id added twice would throw the fingerprints off
+	deduped := n.items[:0]
+	for _, it := range n.items {
+		if len(deduped) == 0 || it != deduped[len(deduped)-1] {
+			deduped = append(deduped, it)
+		}
+	}
+	n.items = deduped
+}
+
+// Initiate returns the first message, to be sent hex-encoded in a NEG-OPEN.
+func (n *Negentropy) Initiate() []byte {
+	n.seal()
+	n.initiator = true
+
+	enc := encoder{}
+	enc.buf = append(enc.buf, version)
+	n.splitRange(&enc, 0, len(n.items), bound{timestamp: maxTimestamp})
+	return enc.buf
+}
+
+// Reconcile processes a message from the other side. the initiator gets back the ids it has
+// and the other side needs and the ids it needs, plus the next message to send, which is nil
+// when the reconciliation is complete. the other side only gets the message to answer with.
+func (n *Negentropy) Reconcile(msg []byte) (out []byte, have []string, need []string, err error) {
+	n.seal()
+
+	dec := decoder{buf: msg}
+	v, err := dec.byte()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if v != version {
+		if n.initiator {
+			return nil, nil, nil, fmt.Errorf("unsupported protocol version 0x%x", v)
+		}
+		// tell them which version we speak
+		return []byte{version}, nil, nil, nil
+	}
+
+	enc := encoder{}
+	enc.buf = append(enc.buf, version)
+
+	prevBound := bound{}
+	prevIndex := 0
+	skip := false
+	flushSkip := func() {
+		if skip {
+			skip = false
+			enc.bound(prevBound)
+			enc.varint(modeSkip)
+		}
+	}
+
+	for !dec.done() {
+		currBound, err := dec.bound()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mode, err := dec.varint()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		lower := prevIndex
+		upper := n.findLowerBound(prevIndex, currBound)
+
+		switch mode {
+		case modeSkip:
+			skip = true
+		case modeFingerprint:
+			theirs, err := dec.bytes(fingerprintSize)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ours := n.fingerprint(lower, upper)
+			if bytes.Equal(theirs, ours[:]) {
+				skip = true
+			} else {
+				flushSkip()
+				n.splitRange(&enc, lower, upper, currBound)
+			}
+		case modeIDList:
+			count, err := dec.varint()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			theirs := make(map[[idSize]byte]struct{}, count)
+			for i := uint64(0); i < count; i++ {
+				b, err := dec.bytes(idSize)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				theirs[[idSize]byte(b)] = struct{}{}
+			}
+
+			if n.initiator {
+				skip = true
+				for _, it := range n.items[lower:upper] {
+					if _, ok := theirs[it.id]; ok {
+						delete(theirs, it.id)
+					} else {
+						have = append(have, hex.EncodeToString(it.id[:]))
+					}
+				}
+				for id := range theirs {
+					need = append(need, hex.EncodeToString(id[:]))
+				}
+			} else {
+				// answer with everything we have in this range, they'll figure it out
+				flushSkip()
+				enc.bound(currBound)
+				enc.varint(modeIDList)
+				enc.varint(uint64(upper - lower))
+				for _, it := range n.items[lower:upper] {
+					enc.buf = append(enc.buf, it.id[:]...)
+				}
+			}
+		default:
+			return nil, nil, nil, fmt.Errorf("unexpected mode %d", mode)
+		}
+
+		prevIndex = upper
+		prevBound = currBound
+	}
+
+	if n.initiator && len(enc.buf) == 1 {
+		// nothing left to ask
+		return nil, have, need, nil
+	}
+	return enc.buf, have, need, nil
+}
+
+// splitRange describes the items in [lower, upper) either as a list of ids, if there are few
+// of them, or as fingerprints of a number of smaller ranges.
+func (n *Negentropy) splitRange(enc *encoder, lower, upper int, upperBound bound) {
+	count := upper - lower
+	if count < buckets*2 {
+		enc.bound(upperBound)
+		enc.varint(modeIDList)
+		enc.varint(uint64(count))
+		for _, it := range n.items[lower:upper] {
+			enc.buf = append(enc.buf, it.id[:]...)
+		}
+		return
+	}
+
+	perBucket := count / buckets
+	withExtra := count % buckets
+	curr := lower
+	for i := 0; i < buckets; i++ {
+		size := perBucket
+		if i < withExtra {
+			size++
+		}
+		fp := n.fingerprint(curr, curr+size)
+		curr += size
+
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(n.items[curr-1], n.items[curr])
+		}
+		enc.bound(next)
+		enc.varint(modeFingerprint)
+		enc.buf = append(enc.buf, fp[:]...)
+	}
+}
+
+// findLowerBound returns the index of the first item from start on that isn't below b.
+func (n *Negentropy) findLowerBound(start int, b bound) int {
+	return start + sort.Search(len(n.items)-start, func(i int) bool {
+		return b.lessOrEqual(n.items[start+i])
+	})
+}
+
+// fingerprint is the hash of the sum of the ids (as little-endian 256-bit numbers) and their
+// count, truncated.
+func (n *Negentropy) fingerprint(lower, upper int) [fingerprintSize]byte {
+	var sum [idSize]byte
+	for _, it := range n.items[lower:upper] {
+		var carry uint16
+		for i := 0; i < idSize; i++ {
+			s := uint16(sum[i]) + uint16(it.id[i]) + carry
+			sum[i] = byte(s)
+			carry = s >> 8
+		}
+	}
+
+	enc := encoder{buf: sum[:]}
+	enc.varint(uint64(upper - lower))
+	hash := sha256.Sum256(enc.buf)
+
+	var fp [fingerprintSize]byte
+	copy(fp[:], hash[:])
+	return fp
+}
+
+func minimalBound(prev, curr item) bound {
+	if curr.timestamp != prev.timestamp {
+		return bound{timestamp: curr.timestamp}
+	}
+	shared := 0
+	for shared < idSize && prev.id[shared] == curr.id[shared] {
+		shared++
+	}
+	return bound{timestamp: curr.timestamp, prefix: append([]byte{}, curr.id[:shared+1]...)}
+}
+
+// encoder writes varints, and timestamps as deltas from the previous one in the same message.
+type encoder struct {
+	buf           []byte
+	lastTimestamp uint64
+}
+
+func (e *encoder) varint(n uint64) {
+	var digits []byte
+	for {
+		digits = append(digits, byte(n&0x7f))
+		n >>= 7
+		if n == 0 {
+			break
+		}
+	}
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		if i != 0 {
+			d |= 0x80
+		}
+		e.buf = append(e.buf, d)
+	}
+}
+
+func (e *encoder) bound(b bound) {
+	if b.timestamp == maxTimestamp {
+		e.lastTimestamp = maxTimestamp
+		e.varint(0)
+	} else {
+		delta := b.timestamp - e.lastTimestamp
+		e.lastTimestamp = b.timestamp
+		e.varint(delta + 1)
+	}
+	e.varint(uint64(len(b.prefix)))
+	e.buf = append(e.buf, b.prefix...)
+}
+
+type decoder struct {
+	buf           []byte
+	lastTimestamp uint64
+}
+
+var errTruncated = errors.New("message ended unexpectedly")
+
+func (d *decoder) done() bool { return len(d.buf) == 0 }
+
+func (d *decoder) byte() (byte, error) {
+	if len(d.buf) == 0 {
+		return 0, errTruncated
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b, nil
+}
+
+func (d *decoder) bytes(n int) ([]byte, error) {
+	if len(d.buf) < n {
+		return nil, errTruncated
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	var n uint64
+	for i := 0; ; i++ {
+		if i == 10 {
+			return 0, errors.New("varint too long")
+		}
+		b, err := d.byte()
+		if err != nil {
+			return 0, err
+		}
+		n = (n << 7) | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+}
+
+func (d *decoder) bound() (bound, error) {
+	ts, err := d.varint()
+	if err != nil {
+		return bound{}, err
+	}
+	if ts == 0 {
+		ts = maxTimestamp
+	} else {
+		ts--
+		if d.lastTimestamp == maxTimestamp || ts > maxTimestamp-d.lastTimestamp {
+			ts = maxTimestamp
+		} else {
+			ts += d.lastTimestamp
+		}
+	}
+	d.lastTimestamp = ts
+
+	size, err := d.varint()
+	if err != nil {
+		return bound{}, err
+	}
+	if size > idSize {
+		return bound{}, errors.New("bound prefix too long")
+	}
+	prefix, err := d.bytes(int(size))
+	if err != nil {
+		return bound{}, err
+	}
+	return bound{timestamp: ts, prefix: prefix}, nil
+}
@@ -0,0 +1,190 @@
+package negentropy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func testID(i int) string {
+	h := sha256.Sum256([]byte(fmt.Sprint(i)))
+	return hex.EncodeToString(h[:])
+}
+
+func TestReconcile(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		client, relay     []int
+		sameTimestampEach int
+	}{
+		{"empty", nil, nil, 1},
+		{"identical", span(0, 500), span(0, 500), 1},
+		{"client empty", nil, span(0, 300), 1},
+		{"relay empty", span(0, 300), nil, 1},
+		{"small difference", span(0, 20), span(5, 25), 1},
+		{"large overlap", append(span(0, 2000), 5000), append(span(10, 1990), 7000, 7001), 1},
+		{"same timestamps", span(0, 1000), span(200, 1200), 300},
+		{"interleaved", evens(0, 100), span(1, 100), 3},
+		{"duplicates", append(span(0, 100), span(0, 50)...), span(25, 100), 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := New()
+			for _, i := range tc.client {
+				client.Add(int64(i/tc.sameTimestampEach), testID(i))
+			}
+			relay := New()
+			for _, i := range tc.relay {
+				relay.Add(int64(i/tc.sameTimestampEach), testID(i))
+			}
+
+			var have, need []string
+			msg := client.Initiate()
+			for rounds := 0; msg != nil; rounds++ {
+				if rounds > 20 {
+					t.Fatalf("didn't converge")
+				}
+				answer, _, _, err := relay.Reconcile(msg)
+				if err != nil {
+					t.Fatalf("relay failed: %s", err)
+				}
+				var h, n []string
+				msg, h, n, err = client.Reconcile(answer)
+				if err != nil {
+					t.Fatalf("client failed: %s", err)
+				}
+				have = append(have, h...)
+				need = append(need, n...)
+			}
+
+			if expected := difference(tc.client, tc.relay); !equal(have, expected) {
+				t.Errorf("have: expected %d ids, got %d", len(expected), len(have))
+			}
+			if expected := difference(tc.relay, tc.client); !equal(need, expected) {
+				t.Errorf("need: expected %d ids, got %d", len(expected), len(need))
+			}
+		})
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, n := range []uint64{0, 1, 127, 128, 300, 1 << 32, maxTimestamp} {
+		enc := encoder{}
+		enc.varint(n)
+		dec := decoder{buf: enc.buf}
+		if got, err := dec.varint(); err != nil || got != n || !dec.done() {
+			t.Errorf("%d: got %d, %v", n, got, err)
+		}
+	}
+
+	enc := encoder{}
+	enc.varint(300)
+	if hex.EncodeToString(enc.buf) != "822c" {
+		t.Errorf("300 should be 822c, got %x", enc.buf)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	relay := New()
+	if answer, _, _, err := relay.Reconcile([]byte{0x62}); err != nil || len(answer) != 1 || answer[0] != version {
+		t.Errorf("expected the relay to answer with its version, got %x %v", answer, err)
+	}
+
+	client := New()
+	client.Initiate()
+	if _, _, _, err := client.Reconcile([]byte{0x62}); err == nil {
+		t.Errorf("expected an error")
+	}
+	if _, _, _, err := client.Reconcile([]byte{version, 0x05}); err == nil {
+		t.Errorf("expected an error for a truncated message")
+	}
+}
+
+func span(from, to int) []int {
+	s := make([]int, 0, to-from)
+	for i := from; i < to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func difference(a, b []int) []string {
+	in := make(map[int]bool, len(b))
+	for _, i := range b {
+		in[i] = true
+	}
+	var d []string
+	for _, i := range a {
+		if !in[i] {
+			d = append(d, testID(i))
+			in[i] = true
+		}
+	}
+	return d
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func evens(from, to int) []int {
+	var s []int
+	for i := from; i < to; i += 2 {
+		s = append(s, i)
+	}
+	return s
+}
+
+// TestFixedMessages checks the exact bytes we put on the wire, as computed by hand from the
+// NIP-77 description, so we don't only agree with ourselves.
+func TestFixedMessages(t *testing.T) {
+	three := func() *Negentropy {
+		n := New()
+		for i := 0; i < 3; i++ {
+			n.Add(int64(1000+i), testID(i))
+		}
+		return n
+	}
+	forty := func() *Negentropy {
+		n := New()
+		for i := 0; i < 40; i++ {
+			n.Add(int64(1000+i/4), testID(i))
+		}
+		return n
+	}
+	idList := "61000002035feceb66ffc86f38d952786c6d696c79c2dbc239dd4e91b46729d73a27fb57e96b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4bd4735e3a265e16eee03f59718b9b5d03019c07d8b6c51f90da3a666eec13ab35"
+	fingerprints := "61876901d401d6b05d206f062846a624fd753d5e0bd30201e7011b05cad39ae43071831cd2f000126da002012c017184cbdd4722051181c081bf4ba35586020001d5814041c63a7b091624bfea53d25e970101e60181c8db5862eeeb9cd26d366c9c5da93902019401a0462fc91fb0f54e54ecc1d714cb7f2902016f0160378c6a99413acde0ee7f1fc8403708020001eac5f67f2c80885a42f997ac6065b8470101b70180d17a2954ffa3009c19ee02cd47c81a020001a57f13f5f8ad26a8cba9f839680ac411010162011b32db6c33a10ceebb4b7226d294390902000162a4e875a0e6a907a24b674b07ba757d0101c601a9ac17542c17a6706013013b1ef76e44020001c7ede50d42338f611ba343f4eeb978fb01017a01a293647512a87b33beb13185b635de25000001eaf88a53c31c9ff6e21e2368863756fd"
+
+	if msg := hex.EncodeToString(New().Initiate()); msg != "6100000200" {
+		t.Errorf("empty set: got %s", msg)
+	}
+	if msg := hex.EncodeToString(three().Initiate()); msg != idList {
+		t.Errorf("few items should be sent as ids, got %s", msg)
+	}
+	if msg := hex.EncodeToString(forty().Initiate()); msg != fingerprints {
+		t.Errorf("many items should be sent as fingerprints, got %s", msg)
+	}
+
+	// a relay answers a list of ids with everything it has in that range
+	empty, _ := hex.DecodeString("6100000200")
+	if answer, _, _, err := three().Reconcile(empty); err != nil || hex.EncodeToString(answer) != idList {
+		t.Errorf("unexpected answer to an empty list: %x %v", answer, err)
+	}
+
+	// and has nothing to say when all fingerprints match
+	msg, _ := hex.DecodeString(fingerprints)
+	if answer, _, _, err := forty().Reconcile(msg); err != nil || hex.EncodeToString(answer) != "61" {
+		t.Errorf("unexpected answer to matching fingerprints: %x %v", answer, err)
+	}
+}
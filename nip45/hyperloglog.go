@@ -0,0 +1,93 @@
+// Package nip45 implements the HyperLogLog estimates relays can attach to COUNT results as
+// described in NIP-45, so the number of distinct pubkeys behind a count (followers, people
+// who reacted) can be combined across relays without counting anybody twice.
+package nip45
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+const registers = 256
+
+type HyperLogLog struct {
+	offset    int
+	registers [registers]uint8
+}
+
+// Offset is where in each pubkey the bits used for a count begin. it depends on the value
+// of the single tag in the filter (the "#p" of a followers count, the "#e" of a reactions
+// count) so different counts don't all depend on the same bits.
+func Offset(tagValue string) (int, error) {
+	if len(tagValue) < 33 {
+		return 0, fmt.Errorf("tag value too short")
+	}
+	n, err := strconv.ParseUint(tagValue[32:33], 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("tag value isn't hex: %w", err)
+	}
+	return int(n) + 8, nil
+}
+
+func New(offset int) *HyperLogLog {
+	return &HyperLogLog{offset: offset}
+}
+
+// Add counts a pubkey, adding the same one again changes nothing.
+func (h *HyperLogLog) Add(pubkey string) error {
+	b, err := hex.DecodeString(pubkey)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid pubkey '%s'", pubkey)
+	}
+	x := b[h.offset : h.offset+8]
+	ri := x[0]
+	// leading zeros of the 56 bits that follow the register index
+	rho := uint8(bits.LeadingZeros64(binary.BigEndian.Uint64(x)<<8|0xff) + 1)
+	if rho > h.registers[ri] {
+		h.registers[ri] = rho
+	}
+	return nil
+}
+
+// Merge adds the hex-encoded registers some relay sent, the result is the same as if all
+// the pubkeys they counted had been added here.
+func (h *HyperLogLog) Merge(encoded string) error {
+	b, err := hex.DecodeString(encoded)
+	if err != nil || len(b) != registers {
+		return fmt.Errorf("invalid hll value")
+	}
+	for i, r := range b {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (h *HyperLogLog) Encode() string {
+	return hex.EncodeToString(h.registers[:])
+}
+
+// Estimate is how many distinct pubkeys were added, within a few percent.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(registers)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// few items, linear counting is better here
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
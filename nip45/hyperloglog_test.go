@@ -0,0 +1,63 @@
+package nip45
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func testPubkey(i int) string {
+	h := sha256.Sum256([]byte(fmt.Sprint(i)))
+	return hex.EncodeToString(h[:])
+}
+
+func TestEstimate(t *testing.T) {
+	offset, err := Offset(testPubkey(-1))
+	if err != nil {
+		t.Fatalf("failed to get offset: %s", err)
+	}
+
+	for _, n := range []int{0, 1, 10, 100, 1000, 20000} {
+		hll := New(offset)
+		for i := 0; i < n; i++ {
+			hll.Add(testPubkey(i))
+			hll.Add(testPubkey(i)) // duplicates don't count
+		}
+		estimate := float64(hll.Estimate())
+		if estimate < float64(n)*0.85 || estimate > float64(n)*1.15 {
+			t.Errorf("%d pubkeys estimated as %.0f", n, estimate)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := New(10), New(10), New(10)
+	for i := 0; i < 500; i++ {
+		all.Add(testPubkey(i))
+		if i < 300 {
+			a.Add(testPubkey(i))
+		}
+		if i >= 200 {
+			b.Add(testPubkey(i))
+		}
+	}
+	if err := a.Merge(b.Encode()); err != nil {
+		t.Fatalf("failed to merge: %s", err)
+	}
+	if a.Encode() != all.Encode() {
+		t.Errorf("merging should be the same as counting the union")
+	}
+	if err := a.Merge("abcd"); err == nil {
+		t.Errorf("expected an error for a short value")
+	}
+}
+
+func TestOffset(t *testing.T) {
+	if _, err := Offset("abc"); err == nil {
+		t.Errorf("expected an error for a short value")
+	}
+	if o, _ := Offset("00000000000000000000000000000000f0000000000000000000000000000000"); o != 23 {
+		t.Errorf("expected 23, got %d", o)
+	}
+}
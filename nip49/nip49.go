@@ -0,0 +1,116 @@
+// Package nip49 encrypts and decrypts private keys with a password as described in NIP-49,
+// producing "ncryptsec1..." strings that are safe(r) to keep on disk.
+package nip49
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+type KeySecurityByte byte
+
+const (
+	KnownToHaveBeenHandledInsecurely    KeySecurityByte = 0x00
+	NotKnownToHaveBeenHandledInsecurely KeySecurityByte = 0x01
+	ClientDoesNotTrackThisData          KeySecurityByte = 0x02
+)
+
+const (
+	version = 0x02
+
+	// DefaultLogN is what we use when encrypting: scrypt takes around a second with it.
+	DefaultLogN = 16
+)
+
+// Encrypt takes a hex private key and returns it as an ncryptsec bech32 string.
+func Encrypt(secretKey string, password string, logn uint8, ksb KeySecurityByte) (string, error) {
+	skb, err := hex.DecodeString(secretKey)
+	if err != nil || len(skb) != 32 {
+		return "", fmt.Errorf("invalid secret key")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to read salt: %w", err)
+	}
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to read nonce: %w", err)
+	}
+
+	key, err := deriveKey(password, salt, logn)
+	if err != nil {
+		return "", err
+	}
+	c, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	ad := []byte{byte(ksb)}
+	ciphertext := c.Seal(nil, nonce, skb, ad)
+
+	data := make([]byte, 0, 1+1+16+24+1+len(ciphertext))
+	data = append(data, version, logn)
+	data = append(data, salt...)
+	data = append(data, nonce...)
+	data = append(data, ad...)
+	data = append(data, ciphertext...)
+
+	bits5, err := bech32.ConvertBits(data, 8, 5, true)
+	if err != nil {
+		return "", err
+	}
+	return bech32.Encode("ncryptsec", bits5)
+}
+
+// Decrypt takes an ncryptsec bech32 string and returns the hex private key.
+func Decrypt(ncryptsec string, password string) (string, error) {
+	prefix, bits5, err := bech32.DecodeNoLimit(ncryptsec)
+	if err != nil {
+		return "", fmt.Errorf("invalid bech32: %w", err)
+	}
+	if prefix != "ncryptsec" {
+		return "", fmt.Errorf("expected ncryptsec, got %s", prefix)
+	}
+	data, err := bech32.ConvertBits(bits5, 5, 8, false)
+	if err != nil {
+		return "", err
+	}
+	if len(data) != 91 || data[0] != version {
+		return "", fmt.Errorf("unsupported ncryptsec version or length")
+	}
+
+	logn := data[1]
+	salt := data[2:18]
+	nonce := data[18:42]
+	ad := data[42:43]
+	ciphertext := data[43:]
+
+	key, err := deriveKey(password, salt, logn)
+	if err != nil {
+		return "", err
+	}
+	c, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	skb, err := c.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return "", fmt.Errorf("wrong password")
+	}
+
+	return hex.EncodeToString(skb), nil
+}
+
+func deriveKey(password string, salt []byte, logn uint8) ([]byte, error) {
+	if logn > 22 {
+		return nil, fmt.Errorf("log_n %d is too big", logn)
+	}
+	return scrypt.Key([]byte(norm.NFKC.String(password)), salt, 1<<logn, 8, 1, 32)
+}
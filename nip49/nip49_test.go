@@ -0,0 +1,37 @@
+package nip49
+
+import (
+	"testing"
+)
+
+func TestDecryptSpecVector(t *testing.T) {
+	sk, err := Decrypt("ncryptsec1qgg9947rlpvqu76pj5ecreduf9jxhselq2nae2kghhvd5g7dgjtcxfqtd67p9m0w57lspw8gsq6yphnm8623nsl8xn9j4jdzz84zm3frztj3z7s35vpzmqf6ksu8r89qk5z2zxfmu5gv8th8wclt0h4p", "nostr")
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err)
+	}
+	if sk != "3501454135014541350145413501453fefb02227e449e57cf4d3a3ce05378683" {
+		t.Fatalf("decrypted to the wrong key: %s", sk)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	sk := "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"
+
+	// the password from the NIP-49 text, composed, and the same in decomposed form
+	composed := "\u212b\u2126\u1e9b\u0323"
+	decomposed := "A\u030a\u03a9\u017f\u0323\u0307"
+
+	ncryptsec, err := Encrypt(sk, composed, 8, ClientDoesNotTrackThisData)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+
+	// the same password in a different unicode normalization form must work
+	if decrypted, err := Decrypt(ncryptsec, decomposed); err != nil || decrypted != sk {
+		t.Fatalf("roundtrip failed: %s, %v", decrypted, err)
+	}
+
+	if _, err := Decrypt(ncryptsec, "wrong"); err == nil {
+		t.Fatalf("decrypted with the wrong password")
+	}
+}
@@ -3,42 +3,153 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
 )
 
-func publish(ctx context.Context, evt *nostr.Event) (*nostr.Event, error) {
+const (
+	INBOX_RELAYS_PER_MENTION = 2
+	MAX_PUBLISH_RELAYS       = 20
+	PUBLISH_TIMEOUT          = time.Second * 10
+)
+
+// inboxLookups are the deliverToUnknownInboxes still running.
+var inboxLookups sync.WaitGroup
+
+// publishResult is what happened when we sent an event to a single relay.
+type publishResult struct {
+	Relay string `json:"relay"`
+	Inbox bool   `json:"inbox"` // true when the relay is there because of a mention
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// publish signs the event, saves it locally and queues it for our write relays and the inboxes
+// of the people it mentions. it returns as soon as the event is queued, even if we're offline.
+func (id *Identity) publish(ctx context.Context, evt *nostr.Event) (*nostr.Event, error) {
 	if evt.Tags == nil {
 		evt.Tags = nostr.Tags{}
 	}
 
-	if err := evt.Sign(sk); err != nil {
-		return nil, fmt.Errorf("failed to sign event")
+	if err := id.signer.SignEvent(ctx, evt); err != nil {
+		return nil, fmt.Errorf("failed to sign event: %w", err)
+	}
+
+	if err := id.publishSigned(ctx, evt); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
+
+// publishSigned does the same for an event that was signed elsewhere.
+func (id *Identity) publishSigned(ctx context.Context, evt *nostr.Event) error {
+	if err := saveEvent(ctx, evt); err != nil {
+		return fmt.Errorf("failed to save event: %w", err)
+	}
+
+	targets, inbox, unknown := id.publishTargets(ctx, evt)
+	if err := enqueuePublish(ctx, evt, targets, inbox); err != nil {
+		return fmt.Errorf("failed to queue event for publishing: %w", err)
+	}
+	nudgePublishQueue()
+	if len(unknown) > 0 {
+		inboxLookups.Add(1)
+		go func() {
+			defer inboxLookups.Done()
+			deliverToUnknownInboxes(evt, unknown, targets)
+		}()
 	}
 
-	if err := store.SaveEvent(ctx, evt); err != nil {
-		return nil, fmt.Errorf("failed to save event")
+	return nil
+}
+
+// publishTargets returns our write relays followed by the inbox relays of everybody mentioned
+// in the event, up to MAX_PUBLISH_RELAYS in total. the map tells which ones are inboxes. the
+// mentioned people whose relays we don't know anything about are returned at the end.
+func (id *Identity) publishTargets(ctx context.Context, evt *nostr.Event) ([]string, map[string]bool, []string) {
+	targets := make([]string, 0, MAX_PUBLISH_RELAYS)
+	inbox := make(map[string]bool)
+	var unknown []string
+	for _, relay := range id.writeRelays {
+		if !slices.Contains(targets, relay) && len(targets) < MAX_PUBLISH_RELAYS {
+			targets = append(targets, relay)
+		}
 	}
 
-	successes := 0
-	for _, relay := range writeRelays {
-		r, err := pool.EnsureRelay(relay)
-		if err != nil {
-			log.Warn().Err(err).Str("relay", relay).Msg("failed to ensure relay when publishing")
+	for _, tag := range evt.Tags {
+		if len(targets) >= MAX_PUBLISH_RELAYS {
+			log.Debug().Str("id", evt.ID).Msg("too many mentions, not delivering to all of their inboxes")
+			break
+		}
+		if len(tag) < 2 || tag[0] != "p" || !nostr.IsValidPublicKeyHex(tag[1]) || tag[1] == id.pubkey {
+			continue
+		}
+
+		relays := fetchInboxRelaysForUser(ctx, tag[1], INBOX_RELAYS_PER_MENTION, true)
+		if len(relays) == 0 {
+			if !slices.Contains(unknown, tag[1]) {
+				unknown = append(unknown, tag[1])
+			}
 			continue
 		}
-		status, err := r.Publish(r.Context(), *evt)
-		if err == nil && status == nostr.PublishStatusSucceeded {
-			log.Debug().Str("id", evt.ID).Str("relay", relay).Msg("event published")
-			successes++
-		} else {
-			log.Warn().Str("id", evt.ID).Str("relay", relay).Err(err).Msg("event probably failed to be published")
+		for _, relay := range relays {
+			if len(targets) >= MAX_PUBLISH_RELAYS {
+				break
+			}
+			if !slices.Contains(targets, relay) {
+				targets = append(targets, relay)
+				inbox[relay] = true
+			}
 		}
 	}
 
-	if successes == 0 {
-		return nil, fmt.Errorf("failed to publish to any relay of %v", writeRelays)
+	return targets, inbox, unknown
+}
+
+// deliverToUnknownInboxes looks for the relay lists of mentioned people we had never heard of
+// and queues the event for their inboxes too, on top of the relays it is already queued for.
+func deliverToUnknownInboxes(evt *nostr.Event, pubkeys []string, queued []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), PUBLISH_TIMEOUT)
+	defer cancel()
+
+	lists := make([]*nostr.Event, len(pubkeys))
+	wg := sync.WaitGroup{}
+	wg.Add(len(pubkeys))
+	for i, pubkey := range pubkeys {
+		go func(i int, pubkey string) {
+			defer wg.Done()
+			lists[i] = loadReplaceableEvent(ctx, pubkey, 10002)
+		}(i, pubkey)
+	}
+	wg.Wait()
+
+	targets := make([]string, 0, MAX_PUBLISH_RELAYS)
+	inbox := make(map[string]bool)
+	for i, list := range lists {
+		if list == nil {
+			continue
+		}
+		grabRelaysFromEvent(ctx, list)
+		for _, relay := range fetchInboxRelaysForUser(ctx, pubkeys[i], INBOX_RELAYS_PER_MENTION, true) {
+			if len(queued)+len(targets) >= MAX_PUBLISH_RELAYS {
+				break
+			}
+			if !slices.Contains(queued, relay) && !slices.Contains(targets, relay) {
+				targets = append(targets, relay)
+				inbox[relay] = true
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return
 	}
 
-	return evt, nil
+	if err := enqueuePublish(ctx, evt, targets, inbox); err != nil {
+		log.Warn().Err(err).Str("id", evt.ID).Msg("failed to queue event for newly found inboxes")
+		return
+	}
+	nudgePublishQueue()
 }
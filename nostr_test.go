@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arriqaaq/flashdb"
+	"github.com/graph-gophers/dataloader/v7"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupTestStorage points the global sqlite, event store, flashdb and replaceable loaders to
+// fresh ones under a temp dir.
+func setupTestStorage(t *testing.T) {
+	// for tests that set up a second time, what is still running uses the first one
+	inboxLookups.Wait()
+	dir := t.TempDir()
+
+	sql, err := sqlx.Open("sqlite3", filepath.Join(dir, "params.sqlite3"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite: %s", err)
+	}
+	if err := migrateDatabase(sql); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	db = sql
+	t.Cleanup(func() { sql.Close() })
+
+	store.Path = filepath.Join(dir, "events.db")
+	store.MaxLimit = 1000
+	if err := store.Init(); err != nil {
+		t.Fatalf("failed to init store: %s", err)
+	}
+	t.Cleanup(store.Close)
+
+	previousFlash := flash
+	flash, err = flashdb.New(&flashdb.Config{})
+	if err != nil {
+		t.Fatalf("failed to start flashdb: %s", err)
+	}
+	t.Cleanup(func() {
+		flash.Close()
+		flash = previousFlash
+	})
+
+	previousLoaders := replaceableLoaders
+	replaceableLoaders = make(map[int]*dataloader.Loader[string, *nostr.Event])
+	initializeDataloaders()
+	t.Cleanup(func() { replaceableLoaders = previousLoaders })
+
+	// lookups started by publishing still use all of the above
+	t.Cleanup(inboxLookups.Wait)
+}
+
+func TestPublishToMentionedInboxes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+
+	ours := startTestRelay(t)
+	theirs := startTestRelay(t)
+	unrelated := startTestRelay(t)
+
+	mentioned := nostr.GeneratePrivateKey()
+	mentionedPk, _ := nostr.GetPublicKey(mentioned)
+	db.MustExec(`INSERT INTO pubkey_relays (pubkey, relay, last_nip65_inbox) VALUES ($1, $2, 100)`,
+		mentionedPk, theirs.URL)
+	// an outbox-only relay of some other user must not be picked up by the inbox query
+	db.MustExec(`INSERT INTO pubkey_relays (pubkey, relay, last_nip65_outbox) VALUES ($1, $2, 100)`,
+		"0000000000000000000000000000000000000000000000000000000000000001", unrelated.URL)
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	pk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: pk, writeRelays: []string{ours.URL}}
+
+	evt, err := id.publish(ctx, &nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now(),
+		Content:   "hello nostr:npub",
+		Tags:      nostr.Tags{{"p", mentionedPk}},
+	})
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+
+	results := processPublishQueue(ctx)
+	if len(results) != 2 {
+		t.Fatalf("unexpected targets: %v", results)
+	}
+	for _, res := range results {
+		if !res.OK {
+			t.Fatalf("publish to %s failed: %s", res.Relay, res.Error)
+		}
+		if res.Inbox != (res.Relay == theirs.URL) {
+			t.Fatalf("%s should have inbox=%v", res.Relay, !res.Inbox)
+		}
+	}
+	for _, rl := range []*testRelay{ours, theirs} {
+		if events := rl.Events(); len(events) != 1 || events[0].ID != evt.ID {
+			t.Fatalf("relay %s didn't get the event: %v", rl.URL, events)
+		}
+	}
+	if len(unrelated.Events()) != 0 {
+		t.Fatalf("event shouldn't have gone to an unrelated relay")
+	}
+}
+
+func TestPublishTargetsCap(t *testing.T) {
+	setupTestStorage(t)
+
+	evt := &nostr.Event{Kind: 1}
+	for i := 0; i < 50; i++ {
+		pk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+		evt.Tags = append(evt.Tags, nostr.Tag{"p", pk})
+		for j := 0; j < 3; j++ {
+			db.MustExec(`INSERT INTO pubkey_relays (pubkey, relay, last_kind3_inbox) VALUES ($1, $2, $3)`,
+				pk, "wss://relay"+string(rune('a'+j))+".example.com/"+pk[0:8], j+1)
+		}
+	}
+
+	id := &Identity{pubkey: "x", writeRelays: []string{"wss://write.example.com"}}
+	targets, inbox, unknown := id.publishTargets(context.Background(), evt)
+	if len(targets) != MAX_PUBLISH_RELAYS {
+		t.Fatalf("expected %d targets, got %d", MAX_PUBLISH_RELAYS, len(targets))
+	}
+	if targets[0] != "wss://write.example.com" || inbox[targets[0]] {
+		t.Fatalf("write relays should come first")
+	}
+	if targets[1] != "wss://relayc.example.com/"+evt.Tags[0][1][0:8] {
+		t.Fatalf("most recent inbox should come first, got %s", targets[1])
+	}
+	if len(unknown) != 0 {
+		t.Fatalf("everybody had inbox relays, got %v as unknown", unknown)
+	}
+}
+
+func TestPublishToUnknownInboxes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+
+	ours := startTestRelay(t)
+	theirs := startTestRelay(t)
+	lists := startTestRelay(t)
+	setTestConfig(t, func(c *Config) { c.DefaultRelays = []string{lists.URL} })
+	previous := relayListRelays
+	relayListRelays = []string{lists.URL}
+	t.Cleanup(func() { relayListRelays = previous })
+
+	// somebody we never heard of, whose relay list is only out there
+	stranger := nostr.GeneratePrivateKey()
+	strangerPk, _ := nostr.GetPublicKey(stranger)
+	list := nostr.Event{
+		Kind:      10002,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"r", theirs.URL, "read"}},
+	}
+	list.Sign(stranger)
+	lists.events = append(lists.events, &list)
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	pk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: pk, writeRelays: []string{ours.URL}}
+
+	evt, err := id.publish(ctx, &nostr.Event{
+		Kind:      1,
+		CreatedAt: nostr.Now(),
+		Content:   "hello stranger",
+		Tags:      nostr.Tags{{"p", strangerPk}},
+	})
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+
+	for len(theirs.Events()) == 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("the stranger's inbox never got the event")
+		case <-time.After(time.Millisecond * 50):
+			processPublishQueue(ctx)
+		}
+	}
+	if events := theirs.Events(); events[0].ID != evt.ID {
+		t.Fatalf("inbox got the wrong event: %v", events)
+	}
+	if len(ours.Events()) != 1 {
+		t.Fatalf("our relay didn't get the event")
+	}
+}
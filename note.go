@@ -15,6 +15,9 @@ var urlMatcher = xurls.Strict()
 
 func loadEvent(ctx context.Context, id string, relayHints []string, authorHint *string) *nostr.Event {
 	if evt, ok := eventCache.Get(id); ok {
+		if evt != nil {
+			touchEvent(id)
+		}
 		return evt
 	}
 
@@ -22,10 +25,14 @@ func loadEvent(ctx context.Context, id string, relayHints []string, authorHint *
 
 	if ch, err := store.QueryEvents(ctx, filter); err == nil {
 		if evt := <-ch; evt != nil {
+			touchEvent(id)
 			eventCache.Set(evt.ID, evt, 1)
 			return evt
 		}
 	}
+	if isLocalOnly(ctx) {
+		return nil
+	}
 
 	max := len(relayHints)
 	if max < 3 {
@@ -39,7 +46,8 @@ func loadEvent(ctx context.Context, id string, relayHints []string, authorHint *
 			relay = relayHints[i]
 		} else {
 			serial++
-			relay = defaultRelays[serial&len(defaultRelays)]
+			defaultRelays := getConfig().DefaultRelays
+			relay = defaultRelays[serial%len(defaultRelays)]
 		}
 		relays = append(relays, relay)
 	}
@@ -48,23 +56,48 @@ func loadEvent(ctx context.Context, id string, relayHints []string, authorHint *
 		// TODO: gather relays from NIP-65
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second*4)
-	ie := pool.QuerySingle(ctx, relays, filter)
+	// ask all of them at the same time, the first good answer wins
+	qctx, cancel := context.WithTimeout(ctx, time.Second*4)
+	found := make(chan *nostr.Event, len(relays))
+	for _, url := range relays {
+		go func(url string) {
+			var evt *nostr.Event
+			defer func() { found <- evt }()
+
+			relay, err := ensureRelay(url)
+			if err != nil {
+				return
+			}
+			events, _ := relay.QuerySync(qctx, filter)
+			for _, candidate := range events {
+				if filter.Matches(candidate) && acceptEvent(qctx, url, candidate) {
+					evt = candidate
+					return
+				}
+			}
+		}(url)
+	}
+	var evt *nostr.Event
+	for range relays {
+		if evt = <-found; evt != nil {
+			break
+		}
+	}
 	cancel()
 
-	if ie != nil {
-		store.SaveEvent(ctx, ie.Event)
-		eventCache.Set(ie.Event.ID, ie.Event, 1)
-	} else {
+	if evt == nil {
 		// cache this even if it's nil so we don't keep trying to fetch it
-		eventCache.SetWithTTL(ie.Event.ID, ie.Event, 1, CACHE_TTL_NOT_FOUND)
+		eventCache.SetWithTTL(id, nil, 1, CACHE_TTL_NOT_FOUND)
+		return nil
 	}
 
-	return ie.Event
+	saveEvent(ctx, evt)
+	eventCache.Set(evt.ID, evt, 1)
+	return evt
 }
 
-func deleteEvent(ctx context.Context, evt *nostr.Event) error {
-	_, err := publish(ctx, &nostr.Event{
+func (id *Identity) deleteEvent(ctx context.Context, evt *nostr.Event) error {
+	_, err := id.publish(ctx, &nostr.Event{
 		Kind:      5,
 		CreatedAt: nostr.Now(),
 		Tags:      nostr.Tags{nostr.Tag{"e", evt.ID}},
@@ -73,20 +106,28 @@ func deleteEvent(ctx context.Context, evt *nostr.Event) error {
 		return err
 	}
 
-	eventCache.Delete(evt.ID)
-	return store.DeleteEvent(ctx, evt)
+	cancelQueuedPublish(ctx, evt.ID)
+	db.ExecContext(ctx, `INSERT INTO tombstones (target, pubkey, deleted_at) VALUES ($1, $2, $3)
+        ON CONFLICT (target, pubkey) DO NOTHING`, evt.ID, evt.PubKey, nostr.Now())
+	removeEvent(ctx, evt)
+	return nil
 }
 
 func getOrDeleteStatusHandler(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Path[len("/api/v1/statuses/"):]
-	evt := loadEvent(r.Context(), id, nil, nil)
+	evt := loadStatusEvent(r.Context(), id)
 	if evt == nil {
 		jsonError(w, "couldn't find event", 404)
 		return
 	}
 
 	if r.Method == "DELETE" {
-		if err := deleteEvent(r.Context(), evt); err != nil {
+		identity := getIdentity(r.Context())
+		if evt.PubKey != identity.pubkey {
+			jsonError(w, "can't delete other people's statuses", 403)
+			return
+		}
+		if err := identity.deleteEvent(r.Context(), evt); err != nil {
 			jsonError(w, "failed to delete: "+err.Error(), 500)
 			return
 		}
@@ -194,7 +235,7 @@ func createStatusHandler(w http.ResponseWriter, r *http.Request) {
 	switch data.Visibility {
 	case "public":
 		var err error
-		evt, err = publish(r.Context(), evt)
+		evt, err = getIdentity(r.Context()).publish(r.Context(), evt)
 		if err != nil {
 			jsonError(w, err.Error(), 500)
 			return
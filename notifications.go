@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type Notification struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	CreatedAt string           `json:"created_at"`
+	Account   *Account         `json:"account"`
+	Status    *Status          `json:"status,omitempty"`
+	Zap       *NotificationZap `json:"zap,omitempty"`
+}
+
+type NotificationZap struct {
+	Amount  int64  `json:"amount"` // sats
+	Comment string `json:"comment"`
+}
+
+type notificationRow struct {
+	ID        string          `db:"id"`
+	Type      string          `db:"type"`
+	Account   string          `db:"account"`
+	StatusID  string          `db:"status_id"`
+	CreatedAt nostr.Timestamp `db:"created_at"`
+	Amount    int64           `db:"amount"`
+	Comment   string          `db:"comment"`
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	identity := getIdentity(ctx)
+	qs := r.URL.Query()
+
+	paginator := parsePaginatorWith(qs, func(id string) *pageCursor {
+		var cursor pageCursor
+		if err := db.QueryRowxContext(ctx, `SELECT created_at, id FROM notifications WHERE pubkey = $1 AND id = $2`,
+			identity.pubkey, id).Scan(&cursor.CreatedAt, &cursor.ID); err != nil {
+			return nil
+		}
+		return &cursor
+	})
+	if paginator.unknown {
+		json.NewEncoder(w).Encode([]Notification{})
+		return
+	}
+
+	conditions := []string{"n.pubkey = ?"}
+	args := []any{identity.pubkey}
+	if paginator.max != nil {
+		conditions = append(conditions, "(n.created_at < ? OR (n.created_at = ? AND n.id < ?))")
+		args = append(args, paginator.max.CreatedAt, paginator.max.CreatedAt, paginator.max.ID)
+	}
+	for _, lower := range []*pageCursor{paginator.since, paginator.min} {
+		if lower != nil {
+			conditions = append(conditions, "(n.created_at > ? OR (n.created_at = ? AND n.id > ?))")
+			args = append(args, lower.CreatedAt, lower.CreatedAt, lower.ID)
+		}
+	}
+	if types := qs["types[]"]; len(types) > 0 {
+		conditions = append(conditions, "n.type IN (?)")
+		args = append(args, types)
+	}
+	if types := qs["exclude_types[]"]; len(types) > 0 {
+		conditions = append(conditions, "n.type NOT IN (?)")
+		args = append(args, types)
+	}
+
+	// min_id wants the ones right after it
+	order := "DESC"
+	if paginator.min != nil {
+		order = "ASC"
+	}
+	query, args, err := sqlx.In(`
+SELECT n.id, n.type, n.account, n.status_id, n.created_at,
+  coalesce(z.amount, 0) AS amount, coalesce(z.comment, '') AS comment
+FROM notifications AS n LEFT JOIN zaps AS z ON z.id = n.id
+WHERE `+strings.Join(conditions, " AND ")+`
+ORDER BY n.created_at `+order+`, n.id `+order+`
+LIMIT ?
+    `, append(args, paginator.limit)...)
+	if err != nil {
+		jsonError(w, "error building query: "+err.Error(), 500)
+		return
+	}
+	var rows []notificationRow
+	if err := db.SelectContext(ctx, &rows, db.Rebind(query), args...); err != nil {
+		jsonError(w, "error querying notifications: "+err.Error(), 500)
+		return
+	}
+	if paginator.min != nil {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	notifications := make([]Notification, 0, len(rows))
+	for _, row := range rows {
+		notifications = append(notifications, toNotification(ctx, row))
+	}
+
+	if len(rows) > 0 {
+		paginator.setLinkHeaderIDs(w, r, rows[0].ID, rows[len(rows)-1].ID)
+	}
+	json.NewEncoder(w).Encode(notifications)
+}
+
+func toNotification(ctx context.Context, row notificationRow) Notification {
+	notification := Notification{
+		ID:        row.ID,
+		Type:      row.Type,
+		CreatedAt: row.CreatedAt.Time().Format(time.RFC3339),
+		Account:   toAccount(ctx, profileOrPlaceholder(ctx, row.Account), nil),
+	}
+	if row.StatusID != "" {
+		if evt := loadEvent(ctx, row.StatusID, nil, nil); evt != nil {
+			notification.Status = toStatus(ctx, evt)
+		}
+	}
+	if row.Type == "zap" {
+		notification.Zap = &NotificationZap{Amount: row.Amount / 1000, Comment: row.Comment}
+	}
+	return notification
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"html/template"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/arriqaaq/flashdb"
 	"github.com/nbd-wtf/go-nostr"
 )
 
+const (
+	OOB_REDIRECT_URI   = "urn:ietf:wg:oauth:2.0:oob"
+	DEFAULT_SCOPES     = "read"
+	AUTHORIZE_CODE_TTL = time.Minute * 10
+)
+
 type token struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
@@ -15,13 +31,380 @@ type token struct {
 	CreatedAt   int64  `json:"created_at"`
 }
 
+type oauthApp struct {
+	ID           int64  `db:"rowid"`
+	ClientID     string `db:"client_id"`
+	ClientSecret string `db:"client_secret"`
+	Name         string `db:"name"`
+	Website      string `db:"website"`
+	RedirectURIs string `db:"redirect_uris"`
+	Scopes       string `db:"scopes"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type oauthToken struct {
+	Token          string `db:"token"`
+	ClientID       string `db:"client_id"`
+	Pubkey         string `db:"pubkey"` // the identity this token acts as, empty for app-only tokens
+	Scopes         string `db:"scopes"`
+	UserAuthorized bool   `db:"user_authorized"`
+	CreatedAt      int64  `db:"created_at"`
+}
+
+// authorizationGrant is what we keep on flashdb between /oauth/authorize and /oauth/token
+type authorizationGrant struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	Pubkey      string `json:"pubkey"`
+	Scopes      string `json:"scopes"`
+}
+
+type tokenContextKey struct{}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (app oauthApp) allowsRedirect(uri string) bool {
+	for _, allowed := range strings.Fields(app.RedirectURIs) {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeAllows checks if the space-separated granted scopes cover the wanted one,
+// considering that "read" covers "read:statuses" and the legacy "follow" scope.
+func scopeAllows(granted string, wanted string) bool {
+	for _, scope := range strings.Fields(granted) {
+		if scope == wanted || strings.HasPrefix(wanted, scope+":") {
+			return true
+		}
+		if scope == "follow" {
+			switch wanted {
+			case "read:follows", "write:follows", "read:blocks", "write:blocks", "read:mutes", "write:mutes":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scopesSubset returns only the requested scopes that the app is allowed to ask for.
+func scopesSubset(requested string, allowed string) string {
+	result := make([]string, 0, 4)
+	for _, scope := range strings.Fields(requested) {
+		if scopeAllows(allowed, scope) {
+			result = append(result, scope)
+		}
+	}
+	return strings.Join(result, " ")
+}
+
+func loadApp(ctx context.Context, clientID string) *oauthApp {
+	var app oauthApp
+	err := db.GetContext(ctx, &app, `SELECT rowid, * FROM oauth_apps WHERE client_id = $1`, clientID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Str("client_id", clientID).Msg("failed to load app")
+		}
+		return nil
+	}
+	return &app
+}
+
+func loadToken(ctx context.Context, accessToken string) *oauthToken {
+	var tok oauthToken
+	err := db.GetContext(ctx, &tok, `SELECT * FROM oauth_tokens WHERE token = $1`, accessToken)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Msg("failed to load token")
+		}
+		return nil
+	}
+	return &tok
+}
+
+func issueToken(ctx context.Context, clientID string, pubkey string, scopes string, userAuthorized bool) (*oauthToken, error) {
+	tok := &oauthToken{
+		Token:          randomString(32),
+		ClientID:       clientID,
+		Pubkey:         pubkey,
+		Scopes:         scopes,
+		UserAuthorized: userAuthorized,
+		CreatedAt:      time.Now().Unix(),
+	}
+	_, err := db.NamedExecContext(ctx, `
+INSERT INTO oauth_tokens (token, client_id, pubkey, scopes, user_authorized, created_at)
+VALUES (:token, :client_id, :pubkey, :scopes, :user_authorized, :created_at)
+    `, tok)
+	return tok, err
+}
+
+// bearerToken reads the access token from the Authorization header, or from the
+// places streaming clients put it, since browsers can't set headers on websockets.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if t := r.URL.Query().Get("access_token"); t != "" {
+		return t
+	}
+	return r.Header.Get("Sec-WebSocket-Protocol")
+}
+
+// authorized only calls the handler if the request carries a token that was granted
+// by the user through /oauth/authorize and includes the given scope. the identity the
+// token was granted for is made available to the handler through getIdentity().
+func authorized(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tok := loadToken(r.Context(), bearerToken(r))
+		if tok == nil || !tok.UserAuthorized {
+			jsonError(w, "The access token is invalid", 401)
+			return
+		}
+		if !scopeAllows(tok.Scopes, scope) {
+			jsonError(w, "This action is outside the authorized scopes", 403)
+			return
+		}
+		identity := getIdentityByPubkey(tok.Pubkey)
+		if identity == nil {
+			jsonError(w, "The identity for this access token is not loaded", 401)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tokenContextKey{}, tok)
+		ctx = context.WithValue(ctx, identityContextKey{}, identity)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// scoped is like authorized, but requires "read:<resource>" for GET requests and
+// "write:<resource>" for everything else.
+func scoped(resource string, handler http.HandlerFunc) http.HandlerFunc {
+	read := authorized("read:"+resource, handler)
+	write := authorized("write:"+resource, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			read(w, r)
+		} else {
+			write(w, r)
+		}
+	}
+}
+
+// adminScoped is like scoped, but for bisu's own admin endpoints.
+func adminScoped(resource string, handler http.HandlerFunc) http.HandlerFunc {
+	read := authorized("admin:read:"+resource, handler)
+	write := authorized("admin:write:"+resource, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			read(w, r)
+		} else {
+			write(w, r)
+		}
+	}
+}
+
+func createAppHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := requestParams(r)
+	if err != nil {
+		jsonError(w, "wrong body: "+err.Error(), 400)
+		return
+	}
+
+	if params.Get("client_name") == "" || len(params["redirect_uris"]) == 0 {
+		jsonError(w, "client_name and redirect_uris are required", 422)
+		return
+	}
+
+	scopes := params.Get("scopes")
+	if scopes == "" {
+		scopes = DEFAULT_SCOPES
+	}
+
+	app := oauthApp{
+		ClientID:     randomString(32),
+		ClientSecret: randomString(32),
+		Name:         params.Get("client_name"),
+		Website:      params.Get("website"),
+		RedirectURIs: strings.Join(params["redirect_uris"], " "),
+		Scopes:       scopes,
+		CreatedAt:    time.Now().Unix(),
+	}
+	res, err := db.NamedExecContext(r.Context(), `
+INSERT INTO oauth_apps (client_id, client_secret, name, website, redirect_uris, scopes, created_at)
+VALUES (:client_id, :client_secret, :name, :website, :redirect_uris, :scopes, :created_at)
+    `, app)
+	if err != nil {
+		jsonError(w, "failed to save app: "+err.Error(), 500)
+		return
+	}
+	app.ID, _ = res.LastInsertId()
+
+	json.NewEncoder(w).Encode(toAppResponse(app, true))
+}
+
+func appCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	tok := loadToken(r.Context(), bearerToken(r))
+	if tok == nil {
+		jsonError(w, "The access token is invalid", 401)
+		return
+	}
+
+	app := loadApp(r.Context(), tok.ClientID)
+	if app == nil {
+		jsonError(w, "The access token is invalid", 401)
+		return
+	}
+
+	json.NewEncoder(w).Encode(toAppResponse(*app, false))
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>authorize {{.App.Name}} on bisu</title></head>
+<body>
+  <h1>{{.App.Name}} wants to use bisu</h1>
+  {{if .App.Website}}<p><a href="{{.App.Website}}">{{.App.Website}}</a></p>{{end}}
+  <p>requested scopes: <code>{{.Scopes}}</code></p>
+  {{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+  <form method="post" action="/oauth/authorize">
+    <input type="hidden" name="client_id" value="{{.App.ClientID}}">
+    <input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+    <input type="hidden" name="scope" value="{{.Scopes}}">
+    <input type="hidden" name="state" value="{{.State}}">
+    <label>
+      act as
+      <select name="pubkey">
+        {{range .Identities}}<option value="{{.Pubkey}}">{{.Name}}{{if .Locked}} (locked){{end}}</option>{{end}}
+      </select>
+    </label>
+    {{if .AnyLocked}}
+    <label>
+      key passphrase (only needed for locked identities)
+      <input type="password" name="passphrase">
+    </label>
+    {{end}}
+    <label>
+      {{if .UsesPassword}}password{{else}}one-time code (printed on bisu's terminal){{end}}
+      <input type="password" name="password" autofocus>
+    </label>
+    <button>authorize</button>
+  </form>
+</body>
+</html>`))
+
+var oobTemplate = template.Must(template.New("oob").Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>authorization code</title></head>
+<body>
+  <p>copy this code into {{.Name}}:</p>
+  <pre>{{.Code}}</pre>
+</body>
+</html>`))
+
 func oauthHandler(w http.ResponseWriter, r *http.Request) {
-	var redir string
-	if r.Method == "POST" {
-		r.ParseForm()
-		redir = r.FormValue("redirect_uri")
-	} else if r.Method == "GET" {
-		redir = r.URL.Query().Get("redirect_uri")
+	params, err := requestParams(r)
+	if err != nil {
+		http.Error(w, "invalid request", 400)
+		return
+	}
+
+	app := loadApp(r.Context(), params.Get("client_id"))
+	if app == nil {
+		http.Error(w, "unknown client_id", 400)
+		return
+	}
+
+	redir := params.Get("redirect_uri")
+	if !app.allowsRedirect(redir) {
+		http.Error(w, "redirect_uri doesn't match the app", 400)
+		return
+	}
+
+	scopes := params.Get("scope")
+	if scopes == "" {
+		scopes = DEFAULT_SCOPES
+	}
+	scopes = scopesSubset(scopes, app.Scopes)
+
+	type identityOption struct {
+		Pubkey, Name string
+		Locked       bool
+	}
+	options := make([]identityOption, len(identities))
+	anyLocked := false
+	for i, id := range identities {
+		options[i] = identityOption{id.pubkey, id.profile.handle(), id.isLocked()}
+		anyLocked = anyLocked || options[i].Locked
+	}
+
+	page := struct {
+		App          *oauthApp
+		RedirectURI  string
+		Scopes       string
+		State        string
+		Identities   []identityOption
+		AnyLocked    bool
+		UsesPassword bool
+		Error        string
+	}{app, redir, scopes, params.Get("state"), options, anyLocked, os.Getenv("BISU_PASSWORD") != "", ""}
+
+	if r.Method == "GET" {
+		if !page.UsesPassword {
+			log.Info().Str("app", app.Name).Str("code", newOneTimeCode()).
+				Msg("one-time code for authorizing app")
+		}
+		authorizeTemplate.Execute(w, page)
+		return
+	} else if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	if !checkLocalPassword(params.Get("password")) {
+		page.Error = "wrong password or code"
+		w.WriteHeader(403)
+		authorizeTemplate.Execute(w, page)
+		return
+	}
+
+	identity := getIdentityByPubkey(params.Get("pubkey"))
+	if identity == nil {
+		page.Error = "unknown identity"
+		w.WriteHeader(400)
+		authorizeTemplate.Execute(w, page)
+		return
+	}
+
+	if es, ok := identity.signer.(*encryptedKeySigner); ok && es.IsLocked() {
+		if err := es.Unlock(params.Get("passphrase")); err != nil {
+			page.Error = "wrong passphrase for this identity's key"
+			w.WriteHeader(403)
+			authorizeTemplate.Execute(w, page)
+			return
+		}
+		log.Info().Str("pubkey", identity.pubkey).Msg("unlocked key")
+	}
+
+	code := randomString(24)
+	grant, _ := json.Marshal(authorizationGrant{
+		ClientID:    app.ClientID,
+		RedirectURI: redir,
+		Pubkey:      identity.pubkey,
+		Scopes:      scopes,
+	})
+	flash.Update(func(txn *flashdb.Tx) error {
+		return txn.SetEx("oauthcode:"+code, string(grant), int64(AUTHORIZE_CODE_TTL.Seconds()))
+	})
+
+	if redir == OOB_REDIRECT_URI {
+		oobTemplate.Execute(w, struct{ Name, Code string }{app.Name, code})
+		return
 	}
 
 	re, err := url.Parse(redir)
@@ -29,21 +412,117 @@ func oauthHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid redirect_uri", 400)
 		return
 	}
-
 	qs := re.Query()
-
-	// TODO maybe we need something else here -- for now it's just to trigger an action from the trontend
-	qs.Add("code", "bla")
-
+	qs.Set("code", code)
+	if state := params.Get("state"); state != "" {
+		qs.Set("state", state)
+	}
 	re.RawQuery = qs.Encode()
 	http.Redirect(w, r, re.String(), http.StatusFound)
 }
 
+func newOneTimeCode() string {
+	code := randomString(6)
+	flash.Update(func(txn *flashdb.Tx) error {
+		return txn.SetEx("otc:"+code, "1", int64(AUTHORIZE_CODE_TTL.Seconds()))
+	})
+	return code
+}
+
+// checkLocalPassword accepts either the password set on BISU_PASSWORD or, when that
+// isn't set, a one-time code printed on the terminal (each code works only once).
+func checkLocalPassword(given string) bool {
+	if given == "" {
+		return false
+	}
+
+	if password := os.Getenv("BISU_PASSWORD"); password != "" {
+		return subtle.ConstantTimeCompare([]byte(given), []byte(password)) == 1
+	}
+
+	ok := false
+	flash.Update(func(txn *flashdb.Tx) error {
+		if v, _ := txn.Get("otc:" + given); v == "1" {
+			ok = true
+			return txn.Delete("otc:" + given)
+		}
+		return nil
+	})
+	return ok
+}
+
 func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := requestParams(r)
+	if err != nil {
+		jsonError(w, "invalid request", 400)
+		return
+	}
+
+	app := loadApp(r.Context(), params.Get("client_id"))
+	if app == nil || subtle.ConstantTimeCompare([]byte(app.ClientSecret), []byte(params.Get("client_secret"))) != 1 {
+		jsonError(w, "invalid_client", 401)
+		return
+	}
+
+	var tok *oauthToken
+	switch params.Get("grant_type") {
+	case "authorization_code":
+		key := "oauthcode:" + params.Get("code")
+		var grant authorizationGrant
+		flash.Update(func(txn *flashdb.Tx) error {
+			v, _ := txn.Get(key)
+			json.Unmarshal([]byte(v), &grant)
+			return txn.Delete(key)
+		})
+		if grant.ClientID != app.ClientID || grant.RedirectURI != params.Get("redirect_uri") {
+			jsonError(w, "invalid_grant", 400)
+			return
+		}
+		tok, err = issueToken(r.Context(), app.ClientID, grant.Pubkey, grant.Scopes, true)
+	case "client_credentials":
+		// these tokens only identify the app, they can't be used to act on behalf of the user
+		scopes := params.Get("scope")
+		if scopes == "" {
+			scopes = DEFAULT_SCOPES
+		}
+		tok, err = issueToken(r.Context(), app.ClientID, "", scopesSubset(scopes, app.Scopes), false)
+	default:
+		jsonError(w, "unsupported_grant_type", 400)
+		return
+	}
+	if err != nil {
+		jsonError(w, "failed to issue token: "+err.Error(), 500)
+		return
+	}
+
 	json.NewEncoder(w).Encode(token{
-		AccessToken: "_",
+		AccessToken: tok.Token,
 		TokenType:   "Bearer",
-		Scope:       "read write follow push",
+		Scope:       tok.Scopes,
 		CreatedAt:   int64(nostr.Now()),
 	})
 }
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := requestParams(r)
+	if err != nil {
+		jsonError(w, "invalid request", 400)
+		return
+	}
+
+	app := loadApp(r.Context(), params.Get("client_id"))
+	if app == nil || subtle.ConstantTimeCompare([]byte(app.ClientSecret), []byte(params.Get("client_secret"))) != 1 {
+		jsonError(w, "invalid_client", 401)
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(),
+		`DELETE FROM oauth_tokens WHERE token = $1 AND client_id = $2`,
+		params.Get("token"), app.ClientID,
+	); err != nil {
+		jsonError(w, "failed to revoke token: "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{})
+}
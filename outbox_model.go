@@ -4,10 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const HINT_HALF_LIFE = time.Hour * 24 * 30
+
+// how much each kind of signal is worth, these are multiplied by how fresh the signal is
+const (
+	HINT_WEIGHT_NIP65          = 10.0 // nip65 adoption gives us a very certain outcome
+	HINT_WEIGHT_KIND3          = 6.0  // but kind3 is not that bad either
+	HINT_WEIGHT_NIP05          = 4.0  // hints are not worth a lot, except when set by the people themselves
+	HINT_WEIGHT_NPROFILE       = 3.0
+	HINT_WEIGHT_TAG            = 2.0
+	HINT_WEIGHT_SUCCESS        = 5.0   // we actually got something from them there
+	HINT_WEIGHT_FAILED_ATTEMPT = -3.0  // we tried and didn't get anything since
+	HINT_WEIGHT_INVALID        = -20.0 // relays that lie to us are worse than useless
 )
 
 func fetchInboxRelaysForUser(ctx context.Context, pubkey string, n int, strict bool) []string {
@@ -16,51 +33,137 @@ func fetchInboxRelaysForUser(ctx context.Context, pubkey string, n int, strict b
 SELECT relay
 FROM pubkey_relays
 WHERE pubkey = $1
-  AND last_kind3_inbox > 0
-  OR last_nip65_inbox > 0
-ORDER BY greatest(last_kind3_inbox, last_nip65_inbox)
+  AND (last_kind3_inbox > 0 OR last_nip65_inbox > 0)
+ORDER BY max(last_kind3_inbox, last_nip65_inbox) DESC
 LIMIT $2
     `, pubkey, n)
 
 	if !strict {
 		// fill in with relays that everybody uses
-		for len(relays) < n {
-			n++
-			relays = append(relays, defaultRelays[n%len(defaultRelays)])
+		defaultRelays := getConfig().DefaultRelays
+		for i := 0; len(relays) < n; i++ {
+			relays = append(relays, defaultRelays[i%len(defaultRelays)])
 		}
 	}
 
 	return relays
 }
 
-func fetchOutboxRelaysForUser(ctx context.Context, pubkey string, n int, strict bool) []string {
-	strictLine := ""
-	if strict {
-		strictLine = " AND (last_fetched_success > 0 OR last_nip65_outbox > 0 OR last_nip65_outbox > 0 OR last_kind3_outbox > 0 OR last_hint_tag > 0 OR last_hint_nprofile > 0 OR last_hint_nip05 > 0)"
+// relayHints is everything we know about a pubkey using a relay, each field is the last time
+// we got that signal.
+type relayHints struct {
+	Relay              string          `db:"relay"`
+	LastFetchedAttempt nostr.Timestamp `db:"last_fetched_attempt"`
+	LastFetchedSuccess nostr.Timestamp `db:"last_fetched_success"`
+	LastHintNprofile   nostr.Timestamp `db:"last_hint_nprofile"`
+	LastHintNip05      nostr.Timestamp `db:"last_hint_nip05"`
+	LastHintTag        nostr.Timestamp `db:"last_hint_tag"`
+	LastNip65Outbox    nostr.Timestamp `db:"last_nip65_outbox"`
+	LastKind3Outbox    nostr.Timestamp `db:"last_kind3_outbox"`
+	LastInvalidData    nostr.Timestamp `db:"last_invalid_data"`
+}
+
+// hintDecay is 1 for something that just happened and halves every HINT_HALF_LIFE.
+func hintDecay(now nostr.Timestamp, when nostr.Timestamp) float64 {
+	if when == 0 {
+		return 0
+	}
+	age := float64(now - when)
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, age/HINT_HALF_LIFE.Seconds())
+}
+
+// listDecay is for signals that come from replaceable events: relays in the newest list are
+// fully trusted, relays that were in an older list but not in the newest are barely worth
+// anything.
+func listDecay(now nostr.Timestamp, when nostr.Timestamp, newest nostr.Timestamp) float64 {
+	if when == 0 {
+		return 0
+	}
+	if when >= newest {
+		return 1
 	}
+	return 0.1 * hintDecay(now, when)
+}
 
-	relays := make([]string, 0, n+5)
-	db.SelectContext(ctx, &relays, `
-SELECT relay
+// score tells how likely we are to find the pubkey's notes on this relay, given the newest
+// NIP-65 and kind 3 lists we have for them.
+func (h relayHints) score(now nostr.Timestamp, newestNip65 nostr.Timestamp, newestKind3 nostr.Timestamp) float64 {
+	score := listDecay(now, h.LastNip65Outbox, newestNip65)*HINT_WEIGHT_NIP65 +
+		listDecay(now, h.LastKind3Outbox, newestKind3)*HINT_WEIGHT_KIND3 +
+		hintDecay(now, h.LastHintNip05)*HINT_WEIGHT_NIP05 +
+		hintDecay(now, h.LastHintNprofile)*HINT_WEIGHT_NPROFILE +
+		hintDecay(now, h.LastHintTag)*HINT_WEIGHT_TAG +
+		hintDecay(now, h.LastFetchedSuccess)*HINT_WEIGHT_SUCCESS +
+		hintDecay(now, h.LastInvalidData)*HINT_WEIGHT_INVALID
+
+	// we've been trying to get stuff from here but it hasn't worked since
+	if h.LastFetchedAttempt > h.LastFetchedSuccess {
+		score += hintDecay(now, h.LastFetchedAttempt) * HINT_WEIGHT_FAILED_ATTEMPT
+	}
+
+	return score
+}
+
+// rankRelayHints returns the relays from best to worst, leaving out the ones that we have
+// more reasons to avoid than to use.
+func rankRelayHints(hints []relayHints, now nostr.Timestamp) []string {
+	var newestNip65, newestKind3 nostr.Timestamp
+	for _, h := range hints {
+		if h.LastNip65Outbox > newestNip65 {
+			newestNip65 = h.LastNip65Outbox
+		}
+		if h.LastKind3Outbox > newestKind3 {
+			newestKind3 = h.LastKind3Outbox
+		}
+	}
+
+	scores := make(map[string]float64, len(hints))
+	relays := make([]string, 0, len(hints))
+	for _, h := range hints {
+		score := h.score(now, newestNip65, newestKind3)
+		if score <= 0 {
+			continue
+		}
+		scores[h.Relay] = score
+		relays = append(relays, h.Relay)
+	}
+
+	sort.Slice(relays, func(i, j int) bool {
+		if scores[relays[i]] == scores[relays[j]] {
+			return relays[i] < relays[j]
+		}
+		return scores[relays[i]] > scores[relays[j]]
+	})
+	return relays
+}
+
+func fetchOutboxRelaysForUser(ctx context.Context, pubkey string, n int, strict bool) []string {
+	hints := make([]relayHints, 0, 20)
+	if err := db.SelectContext(ctx, &hints, `
+SELECT relay, last_fetched_attempt, last_fetched_success, last_hint_nprofile, last_hint_nip05,
+  last_hint_tag, last_nip65_outbox, last_kind3_outbox, last_invalid_data
 FROM pubkey_relays
-WHERE pubkey = $1`+strictLine+`
-ORDER BY (
-  last_fetched_attempt * -5 + -- this has negative power
-  last_fetched_success * 5 + -- which should be compensated by this
-  last_nip65_outbox * 2.5 + -- nip65 adoption gives us a very certain outcome
-  last_kind3_outbox * 2 + -- but kind3 is not that bad either
-  last_hint_tag * 0.5 + -- hints are not worth a lot
-  last_hint_nprofile * 0.7 +
-  last_hint_nip05 * 1 + -- except when is set by the people themselves
-  random() * extract(epoch from now())
-) DESC
-LIMIT $2
-    `, pubkey, n)
+WHERE pubkey = $1
+    `, pubkey); err != nil {
+		log.Warn().Err(err).Str("pubkey", pubkey).Msg("failed to read relay hints")
+	}
+
+	// skip the relays that are failing right now
+	relays := healthyRelays(rankRelayHints(hints, nostr.Now()))
+	if len(relays) > n {
+		relays = relays[0:n]
+	}
 
 	if !strict {
 		// fill in with relays that everybody uses
-		for len(relays) < n {
-			relays = append(relays, defaultRelays[n%len(defaultRelays)])
+		defaultRelays := healthyRelays(getConfig().DefaultRelays)
+		for i := 0; len(relays) < n && i < len(defaultRelays); i++ {
+			if !slices.Contains(relays, defaultRelays[i]) {
+				relays = append(relays, defaultRelays[i])
+			}
 		}
 	}
 
@@ -74,9 +177,7 @@ func saveLastAttempted(ctx context.Context, pubkey string, relay string) {
 		return
 	}
 
-	_, err := db.ExecContext(ctx, `SELECT set_if_more_recent($1, $2, 'last_fetched_attempt', $3)`,
-		pubkey, nostr.NormalizeURL(relay), time.Now().Unix())
-	if err != nil {
+	if err := setIfMoreRecent(ctx, pubkey, relay, "last_fetched_attempt", nostr.Now()); err != nil {
 		log.Error().Err(err).Str("pubkey", pubkey).Str("relay", relay).Msg("failed to save last attempted")
 	}
 }
@@ -149,6 +250,8 @@ func grabRelaysFromEvent(ctx context.Context, evt *nostr.Event) {
 				}
 			}
 		}
+
+		outboxChanged(evt.PubKey)
 	}
 }
 
@@ -164,8 +267,26 @@ func saveLastFetched(ctx context.Context, pubkey string, relay string) {
 	}
 }
 
+// saveLastSeen remembers the newest event we've got from this author on this relay, so we
+// know where to resume from after being offline.
+func saveLastSeen(ctx context.Context, pubkey string, relay string, when nostr.Timestamp) {
+	_, err := db.ExecContext(ctx, `
+INSERT INTO pubkey_relays (pubkey, relay, last_seen_event) VALUES ($1, $2, $3)
+ON CONFLICT (pubkey, relay) DO UPDATE SET last_seen_event = max(last_seen_event, excluded.last_seen_event)
+    `, pubkey, nostr.NormalizeURL(relay), when)
+	if err != nil {
+		log.Error().Err(err).Str("pubkey", pubkey).Str("relay", relay).Msg("failed to save last seen")
+	}
+}
+
 func getLastFetched(ctx context.Context, pubkey string, relay string) *nostr.Timestamp {
-	return nil
+	var last nostr.Timestamp
+	db.GetContext(ctx, &last, `SELECT last_seen_event FROM pubkey_relays WHERE pubkey = $1 AND relay = $2`,
+		pubkey, nostr.NormalizeURL(relay))
+	if last == 0 {
+		return nil
+	}
+	return &last
 }
 
 func saveNprofileHint(ctx context.Context, pubkey string, relay string, when nostr.Timestamp) {
@@ -210,79 +331,30 @@ func saveKind3Inbox(ctx context.Context, pubkey string, relay string, when nostr
 	}
 }
 
+// setIfMoreRecent stores the time of a signal about a pubkey using a relay, unless we already
+// have a more recent one.
 func setIfMoreRecent(ctx context.Context, pubkey string, relay string, column string, when nostr.Timestamp) error {
 	if when == 0 {
 		return fmt.Errorf("when is zero")
 	}
 
-	var current int64
-	err := db.GetContext(ctx, &current,
-		`SELECT `+column+` FROM pubkey_relays WHERE pubkey = $1 AND relay = $2`,
-		pubkey,
-		nostr.NormalizeURL(relay),
-	)
-	if err != nil {
-		return err
-	}
-
-	if int64(when) > current {
-		_, err = db.ExecContext(ctx, `INSERT INTO relays (pubkey, relay, `+column+`) VALUES ($1, $2, $3)`,
-			pubkey, relay, when)
-		fmt.Println("~>", err)
-	}
+	_, err := db.ExecContext(ctx, `
+INSERT INTO pubkey_relays (pubkey, relay, `+column+`) VALUES ($1, $2, $3)
+ON CONFLICT (pubkey, relay) DO UPDATE SET `+column+` = max(`+column+`, excluded.`+column+`)
+    `, pubkey, nostr.NormalizeURL(relay), when)
 	return err
 }
 
-func startListening() {
-	ctx := context.Background()
-
-	pfollows := loadContactList(ctx, profile.pubkey)
-	var follows []Follow
-	if pfollows != nil {
-		follows = *pfollows
-	}
-	follows = append(follows, Follow{Pubkey: profile.pubkey})
-
-	log.Debug().Int("n", len(follows)).Msg("listening to notes from all the people we follow")
-	queries := make(map[string]nostr.Filter)
-	for _, follow := range follows {
-		relays := fetchOutboxRelaysForUser(ctx, follow.Pubkey, 3, false)
-		for _, r := range relays {
-			filter, ok := queries[r]
-			if !ok {
-				filter.Kinds = []int{1}
-				filter.Authors = make([]string, 0, 20)
-				filter.Limit = 200
-				now := nostr.Now()
-				filter.Since = &now
-			}
-			filter.Authors = append(filter.Authors, follow.Pubkey)
-			lastFetched := getLastFetched(ctx, follow.Pubkey, r)
-			if lastFetched != nil && *lastFetched < *filter.Since {
-				filter.Since = lastFetched
-			}
-			queries[r] = filter
-		}
+// ingestFollowedEvent handles an event from someone we follow that came from a relay.
+func ingestFollowedEvent(ctx context.Context, relay string, evt *nostr.Event) {
+	if !acceptEvent(ctx, relay, evt) {
+		return
 	}
-
-	// dispatch all queries
-	for r, filter := range queries {
-		go func(r string, filter nostr.Filter) {
-			relay, err := pool.EnsureRelay(r)
-			if err != nil {
-				log.Warn().Err(err).Str("relay", r).Msg("failed to connect")
-				return
-			}
-			sub, err := relay.Subscribe(ctx, nostr.Filters{filter}, nostr.WithLabel("background"))
-			if err != nil {
-				log.Warn().Err(err).Str("relay", r).Stringer("filter", filter).Msg("failed to subscribe")
-				return
-			}
-
-			for evt := range sub.Events {
-				log.Debug().Stringer("event", evt).Msg("got event")
-				store.SaveEvent(ctx, evt)
-			}
-		}(r, filter)
+	log.Debug().Stringer("event", evt).Msg("got event")
+	saveLastSeen(ctx, evt.PubKey, relay, evt.CreatedAt)
+	if evt.Kind == 5 {
+		handleDeletion(ctx, evt)
+		return
 	}
+	saveEvent(ctx, evt)
 }
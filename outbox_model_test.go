@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+func TestRankRelayHints(t *testing.T) {
+	now := nostr.Now()
+	day := nostr.Timestamp(24 * 60 * 60)
+
+	for _, tc := range []struct {
+		name     string
+		hints    []relayHints
+		expected []string
+	}{
+		{
+			"signal types",
+			[]relayHints{
+				{Relay: "wss://tag", LastHintTag: now},
+				{Relay: "wss://nprofile", LastHintNprofile: now},
+				{Relay: "wss://nip05", LastHintNip05: now},
+				{Relay: "wss://kind3", LastKind3Outbox: now},
+				{Relay: "wss://nip65", LastNip65Outbox: now},
+			},
+			[]string{"wss://nip65", "wss://kind3", "wss://nip05", "wss://nprofile", "wss://tag"},
+		},
+		{
+			"fresh hints beat old ones",
+			[]relayHints{
+				{Relay: "wss://old", LastHintNip05: now - 90*day},
+				{Relay: "wss://new", LastHintTag: now - day},
+			},
+			[]string{"wss://new", "wss://old"},
+		},
+		{
+			"relays gone from the newest relay list",
+			[]relayHints{
+				{Relay: "wss://dropped", LastNip65Outbox: now - 10*day},
+				{Relay: "wss://current", LastNip65Outbox: now - 5*day},
+				{Relay: "wss://hinted", LastHintTag: now},
+			},
+			[]string{"wss://current", "wss://hinted", "wss://dropped"},
+		},
+		{
+			"successes and failures",
+			[]relayHints{
+				{Relay: "wss://failing", LastNip65Outbox: now, LastFetchedSuccess: now - 20*day, LastFetchedAttempt: now},
+				{Relay: "wss://working", LastNip65Outbox: now, LastFetchedSuccess: now, LastFetchedAttempt: now - day},
+				{Relay: "wss://only-failing", LastFetchedAttempt: now},
+			},
+			[]string{"wss://working", "wss://failing"},
+		},
+		{
+			"invalid data",
+			[]relayHints{
+				{Relay: "wss://liar", LastNip65Outbox: now, LastInvalidData: now - day},
+				{Relay: "wss://honest", LastHintTag: now},
+			},
+			[]string{"wss://honest"},
+		},
+	} {
+		if ranked := rankRelayHints(tc.hints, now); !slices.Equal(ranked, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, ranked)
+		}
+	}
+}
+
+func TestRelayHintStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+	resetRelaysHealth(t)
+	setTestConfig(t, func(c *Config) { c.DefaultRelays = []string{"wss://default.example.com"} })
+
+	pk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	now := nostr.Now()
+
+	saveTagHint(ctx, pk, "wss://tag.example.com", now-10)
+	saveNip65Outbox(ctx, pk, "wss://outbox.example.com/", now-100)
+	saveKind3Outbox(ctx, pk, "wss://outbox.example.com", now-50)
+
+	// an older signal doesn't overwrite a newer one
+	saveTagHint(ctx, pk, "wss://tag.example.com", now-1000)
+	var tag nostr.Timestamp
+	db.GetContext(ctx, &tag, `SELECT last_hint_tag FROM pubkey_relays WHERE pubkey = $1 AND relay = $2`,
+		pk, "wss://tag.example.com")
+	if tag != now-10 {
+		t.Fatalf("tag hint was overwritten by an older one: %d", tag)
+	}
+
+	if relays := fetchOutboxRelaysForUser(ctx, pk, 2, true); !slices.Equal(relays,
+		[]string{"wss://outbox.example.com", "wss://tag.example.com"}) {
+		t.Fatalf("got %v", relays)
+	}
+	if relays := fetchOutboxRelaysForUser(ctx, pk, 3, false); len(relays) != 3 ||
+		relays[2] != "wss://default.example.com" {
+		t.Fatalf("expected a default relay to fill in, got %v", relays)
+	}
+
+	// a relay that fails to connect goes away
+	recordRelayFailure("wss://outbox.example.com", "connection refused")
+	if relays := fetchOutboxRelaysForUser(ctx, pk, 2, true); !slices.Equal(relays,
+		[]string{"wss://tag.example.com"}) {
+		t.Fatalf("expected the failing relay to be skipped, got %v", relays)
+	}
+}
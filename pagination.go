@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	DEFAULT_PAGE_LIMIT = 20
+	MAX_PAGE_LIMIT     = 40
+
+	// how many extra events we ask the store for so events that share the
+	// cursor's timestamp don't push wanted events out of the page
+	PAGE_TIES_MARGIN = 20
+
+	// min_id wants the events immediately after the cursor, but the store gives
+	// us the newest first, so we go back from the newest this many at a time
+	MIN_ID_SCAN_LIMIT = 1000
+)
+
+// pageCursor is a position in a timeline. timelines are ordered by (created_at, id),
+// which is stable even when many events share the same timestamp.
+type pageCursor struct {
+	CreatedAt nostr.Timestamp
+	ID        string
+}
+
+func cursorFromEvent(evt *nostr.Event) *pageCursor {
+	return &pageCursor{CreatedAt: evt.CreatedAt, ID: evt.ID}
+}
+
+// compare returns -1 if evt comes before c (it's older), 1 if it comes after and 0 if it's the same.
+func (c pageCursor) compare(evt *nostr.Event) int {
+	switch {
+	case evt.CreatedAt < c.CreatedAt:
+		return -1
+	case evt.CreatedAt > c.CreatedAt:
+		return 1
+	default:
+		return strings.Compare(evt.ID, c.ID)
+	}
+}
+
+// paginator implements mastodon's max_id/since_id/min_id/limit semantics on top of the
+// local event store and is shared by all the endpoints that return lists of statuses.
+type paginator struct {
+	limit int
+	max   *pageCursor // only events older than this
+	since *pageCursor // only events newer than this, newest first
+	min   *pageCursor // only events newer than this, the ones immediately after it
+
+	// set when a cursor was given but we couldn't find the event it points to
+	unknown bool
+}
+
+func parsePaginator(ctx context.Context, qs url.Values) *paginator {
+	return parsePaginatorWith(qs, func(id string) *pageCursor {
+		if evt := loadEvent(ctx, id, nil, nil); evt != nil {
+			return cursorFromEvent(evt)
+		}
+		return nil
+	})
+}
+
+// parsePaginatorWith is for lists that aren't queried from the event store, with a
+// different way of finding where each id is.
+func parsePaginatorWith(qs url.Values, find func(id string) *pageCursor) *paginator {
+	p := &paginator{limit: DEFAULT_PAGE_LIMIT}
+
+	if limit, _ := strconv.Atoi(qs.Get("limit")); limit > 0 {
+		p.limit = limit
+	}
+	if p.limit > MAX_PAGE_LIMIT {
+		p.limit = MAX_PAGE_LIMIT
+	}
+
+	p.max = p.resolve(qs.Get("max_id"), find)
+	p.since = p.resolve(qs.Get("since_id"), find)
+	p.min = p.resolve(qs.Get("min_id"), find)
+
+	return p
+}
+
+func (p *paginator) resolve(id string, find func(id string) *pageCursor) *pageCursor {
+	if id == "" {
+		return nil
+	}
+
+	if cursor := find(id); cursor != nil {
+		return cursor
+	}
+
+	p.unknown = true
+	return nil
+}
+
+// query runs the base filter against the local store and returns at most p.limit
+// events that fall inside the cursors, ordered from newest to oldest.
+func (p *paginator) query(ctx context.Context, base nostr.Filter) ([]*nostr.Event, error) {
+	if p.unknown {
+		// we can't know where the client is in the timeline
+		return []*nostr.Event{}, nil
+	}
+
+	filter := base
+	filter.Limit = p.limit + PAGE_TIES_MARGIN
+	if p.max != nil {
+		until := p.max.CreatedAt
+		filter.Until = &until
+	}
+	for _, lower := range []*pageCursor{p.since, p.min} {
+		if lower != nil && (filter.Since == nil || *filter.Since < lower.CreatedAt) {
+			since := lower.CreatedAt
+			filter.Since = &since
+		}
+	}
+
+	var events []*nostr.Event
+	if p.min != nil {
+		var err error
+		if events, err = p.walkBack(ctx, filter); err != nil {
+			return nil, err
+		}
+	} else {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		events = make([]*nostr.Event, 0, filter.Limit)
+		for evt := range ch {
+			if p.inside(evt) {
+				events = append(events, evt)
+			}
+		}
+	}
+
+	sortNewestFirst(events)
+	if len(events) > p.limit {
+		if p.min != nil {
+			// take the oldest ones, closest to the cursor
+			events = events[len(events)-p.limit:]
+		} else {
+			events = events[0:p.limit]
+		}
+	}
+
+	for _, evt := range events {
+		touchEvent(evt.ID)
+	}
+	return events, nil
+}
+
+// walkBack is for min_id, which wants the events immediately after the cursor while the store
+// gives us the newest first: it goes back from the newest in steps of MIN_ID_SCAN_LIMIT until
+// it reaches the cursor, keeping the oldest events it saw.
+func (p *paginator) walkBack(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	filter.Limit = MIN_ID_SCAN_LIMIT
+	seen := make(map[string]bool)
+	var kept []*nostr.Event
+	for {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		scanned, fresh := 0, 0
+		var oldest nostr.Timestamp
+		for evt := range ch {
+			if scanned == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			scanned++
+			if seen[evt.ID] || !p.inside(evt) {
+				continue
+			}
+			seen[evt.ID] = true
+			fresh++
+			kept = append(kept, evt)
+		}
+		if scanned < filter.Limit {
+			// nothing older than this until the cursor
+			return kept, nil
+		}
+
+		sortNewestFirst(kept)
+		if len(kept) > p.limit {
+			kept = kept[len(kept)-p.limit:]
+		}
+		// the events at the oldest timestamp come again, unless they were all we got, when
+		// more than we can scan at once share a second and we move on to the previous one
+		until := oldest
+		if fresh == 0 {
+			until--
+		}
+		filter.Until = &until
+	}
+}
+
+// inside tells if an event is between the cursors.
+func (p *paginator) inside(evt *nostr.Event) bool {
+	return (p.max == nil || p.max.compare(evt) < 0) &&
+		(p.since == nil || p.since.compare(evt) > 0) &&
+		(p.min == nil || p.min.compare(evt) > 0)
+}
+
+func sortNewestFirst(events []*nostr.Event) {
+	sort.Slice(events, func(i, j int) bool {
+		return cursorFromEvent(events[j]).compare(events[i]) > 0
+	})
+}
+
+// setLinkHeader writes the RFC 5988 Link header clients use to load the next (older)
+// and previous (newer) pages. events must be the ordered result of query().
+func (p *paginator) setLinkHeader(w http.ResponseWriter, r *http.Request, events []*nostr.Event) {
+	if len(events) == 0 {
+		return
+	}
+	p.setLinkHeaderIDs(w, r, events[0].ID, events[len(events)-1].ID)
+}
+
+// setLinkHeaderIDs is setLinkHeader for lists that aren't made of events, given the ids of
+// the first (newest) and last (oldest) items.
+func (p *paginator) setLinkHeaderIDs(w http.ResponseWriter, r *http.Request, newest string, oldest string) {
+	link := func(param string, id string) string {
+		qs := r.URL.Query()
+		qs.Del("max_id")
+		qs.Del("since_id")
+		qs.Del("min_id")
+		qs.Set("limit", strconv.Itoa(p.limit))
+		qs.Set(param, id)
+		return "http://" + srv.Addr + r.URL.Path + "?" + qs.Encode()
+	}
+
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="prev"`,
+		link("max_id", oldest),
+		link("min_id", newest),
+	))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPaginatorMinID(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	// more events after the cursor than we scan at once, three in each second
+	sk := nostr.GeneratePrivateKey()
+	start := nostr.Timestamp(1700000000)
+	var events []*nostr.Event
+	for i := 0; i < MIN_ID_SCAN_LIMIT+200; i++ {
+		evt := &nostr.Event{Kind: 1, CreatedAt: start + nostr.Timestamp(i/3), Tags: nostr.Tags{}, Content: fmt.Sprint(i)}
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+		events = append(events, evt)
+	}
+	sortNewestFirst(events)
+	oldestFirst := make([]*nostr.Event, len(events))
+	for i, evt := range events {
+		oldestFirst[len(events)-1-i] = evt
+	}
+
+	// paging forward from the oldest one goes through all the others, in order
+	cursor := oldestFirst[0]
+	got := 0
+	for {
+		p := parsePaginator(ctx, url.Values{"min_id": {cursor.ID}, "limit": {"40"}})
+		page, err := p.query(ctx, nostr.Filter{Kinds: []int{1}})
+		if err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for i := range page {
+			// pages are newest first
+			expected := oldestFirst[got+len(page)-i]
+			if page[i].ID != expected.ID {
+				t.Fatalf("after %d events: expected %s at %d, got %s", got, expected.Content, i, page[i].Content)
+			}
+		}
+		got += len(page)
+		cursor = page[0]
+	}
+	if got != len(events)-1 {
+		t.Errorf("expected to see %d events, saw %d", len(events)-1, got)
+	}
+}
@@ -40,6 +40,14 @@ func loadProfile(ctx context.Context, pubkey string) *Profile {
 		return profile
 	}
 
+	if isLocalOnly(ctx) {
+		// not cached when missing, someone logged in may still find it on relays
+		if metadataEvent := loadReplaceableEventFromLocalStore(ctx, pubkey, 0); metadataEvent != nil {
+			return toProfile(metadataEvent)
+		}
+		return nil
+	}
+
 	metadataEvent := loadReplaceableEvent(ctx, pubkey, 0)
 	if metadataEvent == nil {
 		log.Debug().Str("pubkey", pubkey).Msg("failed to load metadata event, storing nil on cache")
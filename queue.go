@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	PUBLISH_RETRY_BASE     = time.Second * 15
+	PUBLISH_RETRY_MAX      = time.Hour
+	PUBLISH_QUEUE_TTL      = time.Hour * 24 * 3
+	PUBLISH_RESULT_TTL     = time.Hour * 24
+	PUBLISH_QUEUE_BATCH    = 100
+	PUBLISH_QUEUE_WORKERS  = 8
+	PUBLISH_QUEUE_INTERVAL = time.Second * 10
+	PUBLISH_DRAIN_TIMEOUT  = time.Minute * 10
+)
+
+// what became of a queued (event, relay) pair. only pending ones are retried, the others are
+// kept for PUBLISH_RESULT_TTL so we can tell what each relay said.
+const (
+	PUBLISH_PENDING   = "pending"
+	PUBLISH_PUBLISHED = "published"
+	PUBLISH_REJECTED  = "rejected"
+	PUBLISH_EXPIRED   = "expired"
+)
+
+// queuedPublish is an event waiting to be accepted by one relay, or the outcome of that. each
+// (event, relay) pair is retried on its own until the relay says OK or rejects it for good.
+type queuedPublish struct {
+	EventID     string `db:"event_id" json:"id"`
+	Relay       string `db:"relay" json:"relay"`
+	Pubkey      string `db:"pubkey" json:"pubkey"`
+	Event       string `db:"event" json:"-"`
+	Inbox       bool   `db:"inbox" json:"inbox"`
+	Status      string `db:"status" json:"status"`
+	Attempts    int    `db:"attempts" json:"attempts"`
+	NextAttempt int64  `db:"next_attempt" json:"next_attempt"`
+	LastError   string `db:"last_error" json:"last_error"`
+	CreatedAt   int64  `db:"created_at" json:"created_at"`
+	ExpiresAt   int64  `db:"expires_at" json:"expires_at"`
+}
+
+// publishQueueNudge wakes the queue worker up so new events don't wait for the next tick.
+var publishQueueNudge = make(chan struct{}, 1)
+
+func nudgePublishQueue() {
+	select {
+	case publishQueueNudge <- struct{}{}:
+	default:
+	}
+}
+
+func enqueuePublish(ctx context.Context, evt *nostr.Event, targets []string, inbox map[string]bool) error {
+	j, _ := json.Marshal(evt)
+	now := time.Now()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, relay := range targets {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO publish_queue (event_id, relay, pubkey, event, inbox, next_attempt, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (event_id, relay) DO UPDATE SET
+  status = 'pending', inbox = excluded.inbox, attempts = 0, next_attempt = excluded.next_attempt,
+  last_error = '', expires_at = excluded.expires_at
+WHERE publish_queue.status != 'pending'
+        `, evt.ID, relay, evt.PubKey, string(j), inbox[relay], now.Unix(), now.Unix(), now.Add(PUBLISH_QUEUE_TTL).Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// runPublishQueue keeps sending queued events until they're accepted or expire.
+func runPublishQueue() {
+	ticker := time.NewTicker(PUBLISH_QUEUE_INTERVAL)
+	for {
+		processPublishQueue(context.Background())
+
+		select {
+		case <-ticker.C:
+		case <-publishQueueNudge:
+		}
+	}
+}
+
+// processPublishQueue makes one attempt at every item that is due and returns what happened.
+func processPublishQueue(ctx context.Context) []publishResult {
+	now := time.Now().Unix()
+
+	db.ExecContext(ctx, `DELETE FROM publish_queue WHERE status != 'pending' AND expires_at < $1`, now)
+	if res, err := db.ExecContext(ctx, `
+UPDATE publish_queue SET status = 'expired', expires_at = $1
+WHERE status = 'pending' AND expires_at < $2
+    `, time.Now().Add(PUBLISH_RESULT_TTL).Unix(), now); err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Warn().Int64("n", n).Msg("gave up on publishing some events")
+		}
+	}
+
+	var items []queuedPublish
+	if err := db.SelectContext(ctx, &items, `
+SELECT * FROM publish_queue
+WHERE status = 'pending' AND next_attempt <= $1
+ORDER BY next_attempt
+LIMIT $2
+    `, now, PUBLISH_QUEUE_BATCH); err != nil {
+		log.Error().Err(err).Msg("failed to read publish queue")
+		return nil
+	}
+
+	results := make([]publishResult, len(items))
+	sem := make(chan struct{}, PUBLISH_QUEUE_WORKERS)
+	wg := sync.WaitGroup{}
+	for i, item := range items {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, item queuedPublish) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = attemptPublish(ctx, item)
+		}(i, item)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// drainPublishQueue is for commands that exit when they're done: it keeps going through the
+// queue until nothing is due or the timeout passes and returns how many are left for later.
+func drainPublishQueue(ctx context.Context, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	published, failed := 0, 0
+	for ctx.Err() == nil {
+		results := processPublishQueue(ctx)
+		if len(results) == 0 {
+			break
+		}
+		for _, res := range results {
+			if res.OK {
+				published++
+			} else {
+				failed++
+			}
+		}
+	}
+
+	var remaining int
+	db.GetContext(context.Background(), &remaining, `SELECT count(*) FROM publish_queue WHERE status = 'pending'`)
+	log.Info().Int("published", published).Int("failed", failed).Int("queued", remaining).
+		Msg("done publishing, what's still queued will be retried the next time bisu runs")
+	return remaining
+}
+
+func attemptPublish(ctx context.Context, item queuedPublish) publishResult {
+	res := publishResult{Relay: item.Relay, Inbox: item.Inbox}
+
+	var evt nostr.Event
+	if err := json.Unmarshal([]byte(item.Event), &evt); err != nil {
+		// this should never happen, but if it does there is no point in retrying
+		res.Error = err.Error()
+		finishPublish(ctx, item, PUBLISH_REJECTED, res.Error)
+		return res
+	}
+
+	permanent := false
+	pctx, cancel := context.WithTimeout(ctx, PUBLISH_TIMEOUT)
+	defer cancel()
+	if r, err := ensureRelay(item.Relay); err != nil {
+		res.Error = err.Error()
+	} else if status, err := r.Publish(pctx, evt); err == nil && status == nostr.PublishStatusSucceeded {
+		res.OK = true
+	} else if err != nil {
+		reason := strings.TrimPrefix(err.Error(), "msg: ")
+		recordRelayReason(item.Relay, reason)
+		switch strings.SplitN(reason, ":", 2)[0] {
+		case "duplicate":
+			res.OK = true
+		case "blocked", "invalid", "pow", "restricted":
+			permanent = true
+		}
+		res.Error = reason
+	} else {
+		res.Error = "no response"
+	}
+
+	if res.OK {
+		log.Debug().Str("id", evt.ID).Str("relay", item.Relay).Bool("inbox", item.Inbox).Msg("event published")
+		finishPublish(ctx, item, PUBLISH_PUBLISHED, res.Error)
+		return res
+	} else if permanent {
+		log.Warn().Str("id", evt.ID).Str("relay", item.Relay).Str("reason", res.Error).Msg("relay rejected event")
+		finishPublish(ctx, item, PUBLISH_REJECTED, res.Error)
+		return res
+	}
+
+	log.Warn().Str("id", evt.ID).Str("relay", item.Relay).Int("attempts", item.Attempts+1).Str("err", res.Error).
+		Msg("event failed to be published, will retry")
+	db.ExecContext(ctx, `
+UPDATE publish_queue SET attempts = attempts + 1, next_attempt = $1, last_error = $2
+WHERE event_id = $3 AND relay = $4
+    `, time.Now().Add(publishBackoff(item.Attempts)).Unix(), res.Error, item.EventID, item.Relay)
+	return res
+}
+
+// finishPublish stops retrying an (event, relay) pair and keeps the outcome for a while.
+func finishPublish(ctx context.Context, item queuedPublish, status string, reason string) {
+	db.ExecContext(ctx, `
+UPDATE publish_queue SET status = $1, attempts = attempts + 1, last_error = $2, expires_at = $3
+WHERE event_id = $4 AND relay = $5
+    `, status, reason, time.Now().Add(PUBLISH_RESULT_TTL).Unix(), item.EventID, item.Relay)
+}
+
+// publishBackoff doubles the wait after each failure, up to PUBLISH_RETRY_MAX.
+func publishBackoff(attempts int) time.Duration {
+	wait := PUBLISH_RETRY_BASE
+	for i := 0; i < attempts && wait < PUBLISH_RETRY_MAX; i++ {
+		wait *= 2
+	}
+	if wait > PUBLISH_RETRY_MAX {
+		wait = PUBLISH_RETRY_MAX
+	}
+	return wait
+}
+
+// cancelQueuedPublish stops trying to publish an event, for when it's deleted before going out.
+func cancelQueuedPublish(ctx context.Context, eventID string) {
+	db.ExecContext(ctx, `DELETE FROM publish_queue WHERE event_id = $1`, eventID)
+}
+
+// queueHandler shows what is waiting to be published by the current identity and what each
+// relay said about what was recently published. POST retries everything that is pending right
+// away and DELETE with ?id= drops an event from the queue.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	identity := getIdentity(r.Context())
+
+	switch r.Method {
+	case "POST":
+		db.ExecContext(r.Context(), `UPDATE publish_queue SET next_attempt = 0 WHERE pubkey = $1 AND status = 'pending'`, identity.pubkey)
+		nudgePublishQueue()
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			jsonError(w, "missing id", 400)
+			return
+		}
+		db.ExecContext(r.Context(), `DELETE FROM publish_queue WHERE pubkey = $1 AND event_id = $2`, identity.pubkey, id)
+	}
+
+	items := make([]queuedPublish, 0)
+	if err := db.SelectContext(r.Context(), &items, `
+SELECT * FROM publish_queue WHERE pubkey = $1 ORDER BY created_at DESC, relay
+    `, identity.pubkey); err != nil {
+		jsonError(w, "failed to read queue: "+err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPublishQueueRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	offline := "ws://127.0.0.1:1"
+
+	signer := &keySigner{sk: nostr.GeneratePrivateKey()}
+	pk, _ := signer.GetPublicKey(ctx)
+	id := &Identity{signer: signer, pubkey: pk, writeRelays: []string{relay.URL, offline}}
+
+	// publishing doesn't wait for relays
+	evt, err := id.publish(ctx, &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "queued"})
+	if err != nil {
+		t.Fatalf("publish should succeed even with relays offline: %s", err)
+	}
+
+	processPublishQueue(ctx)
+	if events := relay.Events(); len(events) != 1 || events[0].ID != evt.ID {
+		t.Fatalf("online relay didn't get the event")
+	}
+
+	var pending []queuedPublish
+	db.Select(&pending, `SELECT * FROM publish_queue WHERE status = 'pending'`)
+	if len(pending) != 1 || pending[0].Relay != offline || pending[0].Attempts != 1 || pending[0].LastError == "" {
+		t.Fatalf("expected only the offline relay to be pending with one attempt, got %v", pending)
+	}
+	if pending[0].NextAttempt <= time.Now().Unix() {
+		t.Fatalf("next attempt should be in the future")
+	}
+
+	// nothing is due yet
+	if results := processPublishQueue(ctx); len(results) != 0 {
+		t.Fatalf("expected no attempts before the backoff, got %v", results)
+	}
+
+	// a relay that rejects an event isn't tried again
+	bad := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "forged"}
+	bad.Sign(nostr.GeneratePrivateKey())
+	bad.PubKey = pk
+	enqueuePublish(ctx, bad, []string{relay.URL}, nil)
+	if results := processPublishQueue(ctx); len(results) != 1 || results[0].OK {
+		t.Fatalf("expected the forged event to be rejected, got %v", results)
+	}
+	if results := processPublishQueue(ctx); len(results) != 0 {
+		t.Fatalf("rejected event was retried: %v", results)
+	}
+
+	// and what each relay said is still there to be seen
+	w := httptest.NewRecorder()
+	queueHandler(w, httptest.NewRequest("GET", "/api/bisu/queue", nil).
+		WithContext(context.WithValue(ctx, identityContextKey{}, id)))
+	var items []queuedPublish
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatalf("invalid response %s: %s", w.Body.String(), err)
+	}
+	statuses := make(map[string]queuedPublish)
+	for _, item := range items {
+		statuses[item.EventID+" "+item.Relay] = item
+	}
+	if len(items) != 3 ||
+		statuses[evt.ID+" "+relay.URL].Status != PUBLISH_PUBLISHED ||
+		statuses[evt.ID+" "+offline].Status != PUBLISH_PENDING ||
+		statuses[bad.ID+" "+relay.URL].Status != PUBLISH_REJECTED ||
+		statuses[bad.ID+" "+relay.URL].LastError != "invalid: bad signature" {
+		t.Fatalf("unexpected queue %+v", items)
+	}
+
+	// queuing a published event again sends it again
+	enqueuePublish(ctx, evt, []string{relay.URL}, nil)
+	if results := processPublishQueue(ctx); len(results) != 1 || !results[0].OK {
+		t.Fatalf("expected the event to be published again, got %v", results)
+	}
+
+	// deleting the event drops it from the queue
+	cancelQueuedPublish(ctx, evt.ID)
+	db.Select(&pending, `SELECT * FROM publish_queue WHERE event_id = $1`, evt.ID)
+	if len(pending) != 0 {
+		t.Fatalf("event should be gone from the queue, got %v", pending)
+	}
+}
+
+func TestPublishBackoff(t *testing.T) {
+	for attempts, expected := range []time.Duration{
+		PUBLISH_RETRY_BASE,
+		PUBLISH_RETRY_BASE * 2,
+		PUBLISH_RETRY_BASE * 4,
+		PUBLISH_RETRY_BASE * 8,
+	} {
+		if got := publishBackoff(attempts); got != expected {
+			t.Fatalf("attempt %d: expected %s, got %s", attempts, expected, got)
+		}
+	}
+	if got := publishBackoff(100); got != PUBLISH_RETRY_MAX {
+		t.Fatalf("backoff should be capped, got %s", got)
+	}
+}
+
+func TestDrainPublishQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	offline := "ws://127.0.0.1:1"
+
+	// more than a single pass goes through
+	sk := nostr.GeneratePrivateKey()
+	n := PUBLISH_QUEUE_BATCH + 20
+	for i := 0; i < n; i++ {
+		evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: fmt.Sprint(i)}
+		evt.Sign(sk)
+		enqueuePublish(ctx, evt, []string{relay.URL}, nil)
+	}
+	evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "nowhere"}
+	evt.Sign(sk)
+	enqueuePublish(ctx, evt, []string{offline}, nil)
+
+	if remaining := drainPublishQueue(ctx, time.Second*10); remaining != 1 {
+		t.Fatalf("only the offline relay should be left, got %d", remaining)
+	}
+	if got := len(relay.Events()); got != n {
+		t.Fatalf("expected %d events published, got %d", n, got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newLocalRelay exposes the local store as a relay, so nostr clients can read what we have even
+// when offline. only our own identities can write to it, after NIP-42 auth, and what they write
+// is published like anything posted through the mastodon api.
+func newLocalRelay(serviceURL string) *khatru.Relay {
+	relay := khatru.NewRelay()
+	relay.ServiceURL = serviceURL
+	relay.Info.Name = "bisu"
+	relay.Info.Description = "the local cache of a bisu instance"
+	relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 1, 9, 11, 40, 42)
+	if len(identities) > 0 {
+		relay.Info.PubKey = identities[0].pubkey
+	}
+
+	relay.QueryEvents = append(relay.QueryEvents, queryLocalRelay)
+	relay.CountEvents = append(relay.CountEvents, store.CountEvents)
+	relay.RejectEvent = append(relay.RejectEvent, rejectLocalRelayEvent)
+	relay.StoreEvent = append(relay.StoreEvent, storeLocalRelayEvent)
+	return relay
+}
+
+// withRelay sends websocket connections and NIP-11 requests made to the root to the relay and
+// everything else to the mux.
+func withRelay(relay http.Handler, mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && (strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+			r.Header.Get("Accept") == "application/nostr+json") {
+			relay.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// privateEvent is something only the people involved should get, even if it's encrypted.
+func privateEvent(evt *nostr.Event) bool {
+	return evt.Kind == 4 || evt.Kind == 1059
+}
+
+func queryLocalRelay(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch, err := store.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	authed := khatru.GetAuthed(ctx)
+	results := make(chan *nostr.Event)
+	go func() {
+		defer close(results)
+		for evt := range ch {
+			if privateEvent(evt) && (authed == "" ||
+				(evt.PubKey != authed && !evt.Tags.ContainsAny("p", []string{authed}))) {
+				continue
+			}
+			touchEvent(evt.ID)
+
+			select {
+			case results <- evt:
+			case <-ctx.Done():
+				// drain so the store can release the query
+				for range ch {
+				}
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+func rejectLocalRelayEvent(ctx context.Context, evt *nostr.Event) (bool, string) {
+	authed := khatru.GetAuthed(ctx)
+	if authed == "" {
+		return true, "auth-required: only the owners of this relay can write to it"
+	}
+	if evt.PubKey != authed || !isOwnPubkey(authed) {
+		return true, "restricted: only the owners of this relay can write to it"
+	}
+	if evt.Kind >= 20000 && evt.Kind < 30000 {
+		return true, "blocked: ephemeral events aren't relayed"
+	}
+	if isGone(ctx, evt) {
+		return true, "blocked: this event was deleted"
+	}
+	return false, ""
+}
+
+func storeLocalRelayEvent(ctx context.Context, evt *nostr.Event) error {
+	id := getIdentityByPubkey(evt.PubKey)
+	if id == nil {
+		// rejectLocalRelayEvent doesn't let this happen
+		return nil
+	}
+	if evt.Kind == 5 {
+		handleDeletion(ctx, evt)
+	}
+	return id.publishSigned(ctx, evt)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestLocalRelayWrites(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	me := nostr.GeneratePrivateKey()
+	mypk, _ := nostr.GetPublicKey(me)
+	stranger := nostr.GeneratePrivateKey()
+	strangerpk, _ := nostr.GetPublicKey(stranger)
+	previous := identities
+	identities = []*Identity{{pubkey: mypk, writeRelays: []string{"wss://write.example.com"}}}
+	t.Cleanup(func() { identities = previous })
+
+	sign := func(sk string, kind int, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: tags, Content: "hello"}
+		evt.Sign(sk)
+		return evt
+	}
+	authed := func(pubkey string) context.Context {
+		return context.WithValue(ctx, khatru.AUTH_CONTEXT_KEY, pubkey)
+	}
+
+	note := sign(me, 1, nostr.Tags{})
+	for _, tc := range []struct {
+		ctx    context.Context
+		evt    *nostr.Event
+		prefix string
+	}{
+		{ctx, note, "auth-required:"},
+		{authed(strangerpk), sign(stranger, 1, nostr.Tags{}), "restricted:"},
+		{authed(mypk), sign(stranger, 1, nostr.Tags{}), "restricted:"},
+		{authed(mypk), sign(me, 20001, nostr.Tags{}), "blocked:"},
+		{authed(mypk), note, ""},
+	} {
+		reject, msg := rejectLocalRelayEvent(tc.ctx, tc.evt)
+		if reject != (tc.prefix != "") || !strings.HasPrefix(msg, tc.prefix) {
+			t.Errorf("kind %d by %s: expected %q, got %v %q", tc.evt.Kind, short(tc.evt.PubKey), tc.prefix, reject, msg)
+		}
+	}
+
+	// accepted events are stored and published
+	if err := storeLocalRelayEvent(authed(mypk), note); err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+	if storedEvent(t, note.ID) == nil {
+		t.Fatalf("note wasn't stored")
+	}
+	var relays []string
+	db.SelectContext(ctx, &relays, `SELECT relay FROM publish_queue WHERE event_id = $1`, note.ID)
+	if len(relays) != 1 || relays[0] != "wss://write.example.com" {
+		t.Fatalf("note wasn't queued for our write relays: %v", relays)
+	}
+
+	deletion := sign(me, 5, nostr.Tags{{"e", note.ID}})
+	storeLocalRelayEvent(authed(mypk), deletion)
+	if storedEvent(t, note.ID) != nil {
+		t.Fatalf("deleted note is still there")
+	}
+	if reject, _ := rejectLocalRelayEvent(authed(mypk), note); !reject {
+		t.Fatalf("a deleted note shouldn't be accepted again")
+	}
+}
+
+func TestLocalRelayQueries(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	alice := nostr.GeneratePrivateKey()
+	alicepk, _ := nostr.GetPublicKey(alice)
+	bobpk, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	note := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "public"}
+	note.Sign(alice)
+	saveEvent(ctx, note)
+	dm := &nostr.Event{Kind: 4, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", bobpk}}, Content: "secret?iv=x"}
+	dm.Sign(alice)
+	saveEvent(ctx, dm)
+
+	query := func(ctx context.Context) []string {
+		ch, err := queryLocalRelay(ctx, nostr.Filter{Authors: []string{alicepk}})
+		if err != nil {
+			t.Fatalf("query failed: %s", err)
+		}
+		var ids []string
+		for evt := range ch {
+			ids = append(ids, evt.ID)
+		}
+		return ids
+	}
+
+	if ids := query(ctx); len(ids) != 1 || ids[0] != note.ID {
+		t.Errorf("anonymous readers should only see the note, got %v", ids)
+	}
+	if ids := query(context.WithValue(ctx, khatru.AUTH_CONTEXT_KEY, bobpk)); len(ids) != 2 {
+		t.Errorf("the recipient should see the dm too, got %v", ids)
+	}
+}
+
+func TestWithRelay(t *testing.T) {
+	relay := newLocalRelay("ws://localhost:7001")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("mux")) })
+	handler := withRelay(relay, mux)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/nostr+json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var info struct {
+		Name          string `json:"name"`
+		SupportedNIPs []int  `json:"supported_nips"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Name != "bisu" || len(info.SupportedNIPs) == 0 {
+		t.Fatalf("expected the relay information document, got %s", w.Body.String())
+	}
+
+	for _, target := range []string{"/", "/api/v1/instance"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Body.String() != "mux" {
+			t.Errorf("%s should go to the mux", target)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	RELAY_CONNECT_TIMEOUT = time.Second * 15
+	RELAY_BACKOFF_BASE    = time.Second * 10
+	RELAY_BACKOFF_MAX     = time.Hour
+	RELAY_MAX_NOTICES     = 5
+	RELAY_LATENCY_WEIGHT  = 0.3 // how much a new measure moves the average
+)
+
+// relayHealth is what we know about how a relay has been treating us since we started.
+type relayHealth struct {
+	URL string `json:"url"`
+
+	Connected           bool      `json:"connected"`
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Disconnects         int       `json:"disconnects"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	RetryAt             time.Time `json:"retry_at,omitempty"`
+	LatencyMs           float64   `json:"latency_ms"`
+
+	// what the relay told us
+	Notices      []string `json:"notices,omitempty"`
+	AuthRequired bool     `json:"auth_required"`
+	RateLimited  int      `json:"rate_limited"`
+	Restricted   int      `json:"restricted"`
+
+	InvalidEvents int `json:"invalid_events"`
+
+	// only in the api, how many of the people the identity follows we listen to here
+	Following int `json:"following,omitempty"`
+}
+
+var (
+	healthMu     sync.Mutex
+	relaysHealth = make(map[string]*relayHealth)
+
+	// guards our access to pool.Relays, connecting happens under a per-relay lock
+	poolMu       sync.Mutex
+	connectLocks = make(map[string]*sync.Mutex)
+)
+
+func getRelayHealth(url string) *relayHealth {
+	h, ok := relaysHealth[url]
+	if !ok {
+		h = &relayHealth{URL: url}
+		relaysHealth[url] = h
+	}
+	return h
+}
+
+// ensureRelay is like pool.EnsureRelay, but keeps track of how each relay behaves and refuses
+// to try again while a relay that keeps failing is in its backoff period.
+func ensureRelay(url string) (*nostr.Relay, error) {
+	nm := nostr.NormalizeURL(url)
+
+	poolMu.Lock()
+	lock, ok := connectLocks[nm]
+	if !ok {
+		lock = &sync.Mutex{}
+		connectLocks[nm] = lock
+	}
+	poolMu.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	poolMu.Lock()
+	relay, ok := pool.Relays[nm]
+	poolMu.Unlock()
+	if ok && relay.IsConnected() {
+		return relay, nil
+	}
+
+	healthMu.Lock()
+	retryAt := getRelayHealth(nm).RetryAt
+	healthMu.Unlock()
+	if time.Now().Before(retryAt) {
+		return nil, fmt.Errorf("not trying %s again until %s", nm, retryAt.Format(time.TimeOnly))
+	}
+
+	ctx, cancel := context.WithTimeout(pool.Context, RELAY_CONNECT_TIMEOUT)
+	defer cancel()
+	start := time.Now()
+	relay, err := nostr.RelayConnect(ctx, nm,
+		nostr.WithNoticeHandler(func(notice string) { recordRelayNotice(nm, notice) }),
+		nostr.WithAuthHandler(func(ctx context.Context, evt *nostr.Event) bool {
+			// we don't authenticate yet, but it explains why a relay may be giving us nothing
+			recordRelayAuthChallenge(nm)
+			return false
+		}),
+	)
+	if err != nil {
+		recordRelayFailure(nm, err.Error())
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	recordRelaySuccess(nm, time.Since(start))
+
+	go func() {
+		<-relay.Context().Done()
+		recordRelayDisconnect(nm, relay.ConnectionError)
+	}()
+
+	poolMu.Lock()
+	pool.Relays[nm] = relay
+	poolMu.Unlock()
+	return relay, nil
+}
+
+// dialRelay opens a connection of our own to a relay, for the messages the relay library
+// doesn't know about. reads stop blocking when ctx is done, call done when finished.
+func dialRelay(ctx context.Context, url string) (conn *websocket.Conn, done func(), err error) {
+	dctx, cancel := context.WithTimeout(ctx, RELAY_CONNECT_TIMEOUT)
+	conn, _, err = websocket.DefaultDialer.DialContext(dctx, url, nil)
+	cancel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect: %w", err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+	return conn, func() {
+		close(finished)
+		conn.Close()
+	}, nil
+}
+
+func writeRelayMessage(conn *websocket.Conn, v ...any) error {
+	b, _ := json.Marshal(v)
+	return conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// readRelayMessage waits for the next message that looks like one, returning its label and
+// the rest of the array.
+func readRelayMessage(conn *websocket.Conn, wait time.Duration) (string, []json.RawMessage, error) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return "", nil, err
+		}
+
+		var msg []json.RawMessage
+		var label string
+		if json.Unmarshal(message, &msg) != nil || len(msg) < 2 || json.Unmarshal(msg[0], &label) != nil {
+			continue
+		}
+		return label, msg[1:], nil
+	}
+}
+
+// unsupportedRelays remembers the relays that didn't understand something we asked, so we
+// don't keep asking them for a while.
+type unsupportedRelays struct {
+	mu    sync.Mutex
+	since map[string]time.Time
+	retry time.Duration
+}
+
+func newUnsupportedRelays(retry time.Duration) *unsupportedRelays {
+	return &unsupportedRelays{since: make(map[string]time.Time), retry: retry}
+}
+
+func (u *unsupportedRelays) mark(url string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.since[url] = time.Now()
+}
+
+func (u *unsupportedRelays) supported(url string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Since(u.since[url]) > u.retry
+}
+
+// relayBackoff doubles the wait after each consecutive failure, up to RELAY_BACKOFF_MAX.
+func relayBackoff(failures int) time.Duration {
+	wait := RELAY_BACKOFF_BASE
+	for i := 1; i < failures && wait < RELAY_BACKOFF_MAX; i++ {
+		wait *= 2
+	}
+	if wait > RELAY_BACKOFF_MAX {
+		wait = RELAY_BACKOFF_MAX
+	}
+	return wait
+}
+
+func recordRelaySuccess(url string, latency time.Duration) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := getRelayHealth(url)
+	h.Connected = true
+	h.Successes++
+	h.ConsecutiveFailures = 0
+	h.LastSuccess = time.Now()
+	h.RetryAt = time.Time{}
+	ms := float64(latency) / float64(time.Millisecond)
+	if h.LatencyMs == 0 {
+		h.LatencyMs = ms
+	} else {
+		h.LatencyMs += (ms - h.LatencyMs) * RELAY_LATENCY_WEIGHT
+	}
+}
+
+func recordRelayFailure(url string, reason string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := getRelayHealth(url)
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastFailure = time.Now()
+	h.LastError = reason
+	h.RetryAt = h.LastFailure.Add(relayBackoff(h.ConsecutiveFailures))
+	log.Warn().Str("relay", url).Str("reason", reason).Int("failures", h.ConsecutiveFailures).
+		Time("retry", h.RetryAt).Msg("relay failed")
+}
+
+func recordRelayDisconnect(url string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := getRelayHealth(url)
+	h.Connected = false
+	h.Disconnects++
+	if err != nil {
+		h.LastError = err.Error()
+	}
+}
+
+func recordRelayNotice(url string, notice string) {
+	log.Debug().Str("relay", url).Str("notice", notice).Msg("got notice")
+	recordRelayReason(url, notice)
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := getRelayHealth(url)
+	h.Notices = append(h.Notices, notice)
+	if len(h.Notices) > RELAY_MAX_NOTICES {
+		h.Notices = h.Notices[len(h.Notices)-RELAY_MAX_NOTICES:]
+	}
+}
+
+func recordRelayAuthChallenge(url string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	getRelayHealth(url).AuthRequired = true
+}
+
+// recordRelayReason looks at the machine-readable prefix of a message from a relay (from an
+// OK or a NOTICE) and takes note of the ones that affect us. a rate limit counts as a failure
+// so we back off.
+//
+// CLOSED messages would be handled here too, but our version of go-nostr doesn't give them to us.
+func recordRelayReason(url string, reason string) {
+	prefix := strings.SplitN(reason, ":", 2)[0]
+	switch prefix {
+	case "rate-limited":
+		healthMu.Lock()
+		getRelayHealth(url).RateLimited++
+		healthMu.Unlock()
+		recordRelayFailure(url, reason)
+	case "auth-required":
+		recordRelayAuthChallenge(url)
+	case "restricted", "blocked":
+		healthMu.Lock()
+		getRelayHealth(url).Restricted++
+		healthMu.Unlock()
+	}
+}
+
+// relayUsable is false while a relay is backing off.
+func relayUsable(url string) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, ok := relaysHealth[nostr.NormalizeURL(url)]
+	return !ok || !time.Now().Before(h.RetryAt)
+}
+
+// relayPenalty is used to sort relays that are otherwise equally good, lower is better. it's
+// roughly in milliseconds.
+func relayPenalty(url string) float64 {
+	url = nostr.NormalizeURL(url)
+	healthMu.Lock()
+	h, ok := relaysHealth[url]
+	if !ok {
+		healthMu.Unlock()
+		return 0
+	}
+	penalty := h.LatencyMs + float64(h.ConsecutiveFailures*1000+h.RateLimited*500+h.Restricted*2000)
+	if h.AuthRequired {
+		penalty += 1000
+	}
+	healthMu.Unlock()
+
+	return penalty + float64(invalidEventsFrom(url)*5000)
+}
+
+// healthyRelays removes the relays that are backing off and puts the ones that have been
+// behaving badly at the end. if all of them are backing off the list is returned untouched,
+// so we still have something to try.
+func healthyRelays(relays []string) []string {
+	usable := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		if relayUsable(relay) {
+			usable = append(usable, relay)
+		}
+	}
+	if len(usable) == 0 {
+		return relays
+	}
+
+	// only reorder when the difference is meaningful, otherwise keep the preference we got
+	penalties := make(map[string]int, len(usable))
+	for _, relay := range usable {
+		penalties[relay] = int(relayPenalty(relay) / 1000)
+	}
+	sort.SliceStable(usable, func(i, j int) bool { return penalties[usable[i]] < penalties[usable[j]] })
+	return usable
+}
+
+func relaysHealthSnapshot() []relayHealth {
+	healthMu.Lock()
+	list := make([]relayHealth, 0, len(relaysHealth))
+	for _, h := range relaysHealth {
+		c := *h
+		c.Notices = append([]string{}, h.Notices...)
+		list = append(list, c)
+	}
+	healthMu.Unlock()
+
+	for i := range list {
+		list[i].InvalidEvents = invalidEventsFrom(list[i].URL)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	return list
+}
+
+func relaysHandler(w http.ResponseWriter, r *http.Request) {
+	identity := getIdentity(r.Context())
+
+	following := make(map[string]int)
+	identity.mu.Lock()
+	fm := identity.follows
+	identity.mu.Unlock()
+	if fm != nil {
+		fm.mu.Lock()
+		for relay, sub := range fm.subs {
+			following[nostr.NormalizeURL(relay)] = len(sub.authors)
+		}
+		fm.mu.Unlock()
+	}
+
+	list := relaysHealthSnapshot()
+	for i := range list {
+		list[i].Following = following[list[i].URL]
+		delete(following, list[i].URL)
+	}
+	// relays we are subscribed to but haven't connected yet
+	for relay, n := range following {
+		list = append(list, relayHealth{URL: relay, Following: n})
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func resetRelaysHealth(t *testing.T) {
+	healthMu.Lock()
+	relaysHealth = make(map[string]*relayHealth)
+	healthMu.Unlock()
+	t.Cleanup(func() {
+		healthMu.Lock()
+		relaysHealth = make(map[string]*relayHealth)
+		healthMu.Unlock()
+	})
+}
+
+func TestRelayBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:   RELAY_BACKOFF_BASE,
+		2:   RELAY_BACKOFF_BASE * 2,
+		4:   RELAY_BACKOFF_BASE * 8,
+		100: RELAY_BACKOFF_MAX,
+	} {
+		if wait := relayBackoff(failures); wait != expected {
+			t.Errorf("after %d failures expected %s, got %s", failures, expected, wait)
+		}
+	}
+}
+
+func TestEnsureRelayBacksOff(t *testing.T) {
+	resetRelaysHealth(t)
+
+	// a relay that is gone
+	server := httptest.NewServer(nil)
+	dead := "ws" + strings.TrimPrefix(server.URL, "http")
+	server.Close()
+
+	if _, err := ensureRelay(dead); err == nil {
+		t.Fatalf("connecting to a dead relay should fail")
+	}
+	if relayUsable(dead) {
+		t.Fatalf("relay should be backing off after a failure")
+	}
+
+	// we don't even try again while backing off
+	_, err := ensureRelay(dead)
+	if err == nil || !strings.Contains(err.Error(), "not trying") {
+		t.Fatalf("expected a backoff error, got %v", err)
+	}
+	if h := relaysHealthSnapshot(); len(h) != 1 || h[0].Failures != 1 || h[0].ConsecutiveFailures != 1 {
+		t.Fatalf("second attempt shouldn't count as a failure: %+v", h)
+	}
+
+	// a good relay
+	relay := startTestRelay(t)
+	if _, err := ensureRelay(relay.URL); err != nil {
+		t.Fatalf("failed to connect to test relay: %s", err)
+	}
+	for _, h := range relaysHealthSnapshot() {
+		if h.URL == relay.URL && (!h.Connected || h.Successes != 1 || h.LatencyMs <= 0) {
+			t.Fatalf("success wasn't recorded: %+v", h)
+		}
+	}
+
+	// unhealthy relays are left out
+	if relays := healthyRelays([]string{dead, relay.URL}); !slices.Equal(relays, []string{relay.URL}) {
+		t.Fatalf("expected only the good relay, got %v", relays)
+	}
+	if relays := healthyRelays([]string{dead}); len(relays) != 1 {
+		t.Fatalf("when everything is failing we should still get something to try")
+	}
+}
+
+func TestRelayReasons(t *testing.T) {
+	resetRelaysHealth(t)
+
+	a := "wss://a.example.com"
+	b := "wss://b.example.com"
+	c := "wss://c.example.com"
+
+	recordRelaySuccess(a, time.Millisecond*100)
+	recordRelaySuccess(b, time.Millisecond*100)
+	recordRelaySuccess(c, time.Millisecond*100)
+
+	recordRelayNotice(b, "auth-required: we only serve our members")
+	recordRelayReason(c, "rate-limited: slow down")
+
+	if relayUsable(c) {
+		t.Fatalf("rate-limited relay should back off")
+	}
+	if relays := healthyRelays([]string{b, a, c}); !slices.Equal(relays, []string{a, b}) {
+		t.Fatalf("expected the relay that wants auth to go last, got %v", relays)
+	}
+
+	for _, h := range relaysHealthSnapshot() {
+		switch h.URL {
+		case b:
+			if !h.AuthRequired || len(h.Notices) != 1 {
+				t.Fatalf("auth requirement wasn't recorded: %+v", h)
+			}
+		case c:
+			if h.RateLimited != 1 || h.ConsecutiveFailures != 1 {
+				t.Fatalf("rate limit wasn't recorded: %+v", h)
+			}
+		}
+	}
+}
@@ -1,15 +1,5 @@
 package main
 
-var defaultRelays = []string{
-	"wss://nostr-pub.wellorder.net",
-	"wss://nos.lol",
-	"wss://relay.damus.io",
-	"wss://nostr.mom",
-	"wss://nostr-pub.wellorder.net",
-	"wss://relay.nostr.band",
-	"wss://relay.shitforce.one",
-}
-
 var paidRelays = []string{
 	"wss://offchain.pub",
 	"wss://atlas.nostr.land",
@@ -22,17 +12,6 @@ var contactListRelays = []string{
 	"wss://relay.nostr.band",
 }
 
-var profileRelays = []string{
-	"wss://purplepag.es",
-	"wss://relay.nostr.band",
-}
-
 var relayListRelays = []string{
 	"wss://purplepag.es",
 }
-
-var searchRelays = []string{
-	"wss://relay.nostr.band",
-	"wss://nostr.wine",
-	"wss://relay.noswhere.com",
-}
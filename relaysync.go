@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/bisu/negentropy"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	SYNC_INTERVAL          = time.Hour * 6
+	SYNC_STARTUP_DELAY     = time.Minute * 2
+	SYNC_NEGENTROPY_WAIT   = time.Second * 15 // how long a relay has to answer each message
+	SYNC_FETCH_CHUNK       = 100
+	SYNC_FETCH_TIMEOUT     = time.Second * 20
+	SYNC_UNSUPPORTED_RETRY = time.Hour * 24
+)
+
+const (
+	SYNC_NEGENTROPY = "negentropy"
+	SYNC_REQ        = "req"
+)
+
+// relays that didn't understand NEG-OPEN, we go straight to REQ with them.
+var noNegentropy = newUnsupportedRelays(SYNC_UNSUPPORTED_RETRY)
+
+type syncResult struct {
+	Relay      string `json:"relay"`
+	Method     string `json:"method"`
+	Downloaded int    `json:"downloaded"`
+	Uploaded   int    `json:"uploaded"`
+	Error      string `json:"error,omitempty"`
+}
+
+// runRelaySync reconciles the local store with our relays every now and then.
+func runRelaySync() {
+	time.Sleep(SYNC_STARTUP_DELAY)
+	for {
+		for _, id := range identities {
+			id.syncWithRelays(context.Background())
+		}
+		time.Sleep(SYNC_INTERVAL)
+	}
+}
+
+// syncWithRelays makes our own events be both here and on all our write relays and fetches the
+// recent posts of the people we follow that our read relays have and we don't. other people's
+// events are only downloaded, spreading them is up to them.
+func (id *Identity) syncWithRelays(ctx context.Context) []syncResult {
+	var results []syncResult
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	run := func(url string, filter nostr.Filter, upload bool) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := syncRelay(ctx, url, filter, upload)
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+
+	own := nostr.Filter{Authors: []string{id.pubkey}}
+	for _, url := range id.writeRelays {
+		run(url, own, true)
+	}
+	for _, url := range id.readRelays {
+		if !slices.Contains(id.writeRelays, url) {
+			run(url, own, false)
+		}
+	}
+	wg.Wait()
+
+	if days := getConfig().BackfillDays; days > 0 {
+		since := nostr.Now() - nostr.Timestamp(days*24*60*60)
+		followed := id.followedAuthors(ctx)[1:] // we're the first, and were synced above
+		for start := 0; start < len(followed); start += BACKFILL_CHUNK_SIZE {
+			end := start + BACKFILL_CHUNK_SIZE
+			if end > len(followed) {
+				end = len(followed)
+			}
+			filter := nostr.Filter{Kinds: []int{1, 5, 30023}, Authors: followed[start:end], Since: &since}
+			for _, url := range id.readRelays {
+				run(url, filter, false)
+			}
+			wg.Wait()
+		}
+	}
+
+	downloaded, uploaded := 0, 0
+	for _, res := range results {
+		downloaded += res.Downloaded
+		uploaded += res.Uploaded
+	}
+	if uploaded > 0 {
+		nudgePublishQueue()
+	}
+	log.Info().Str("pubkey", id.pubkey).Int("downloaded", downloaded).Int("uploaded", uploaded).
+		Msg("synced with relays")
+	return results
+}
+
+// syncRelay finds out which events matching filter are missing on each side, with negentropy
+// if the relay supports it and by fetching everything otherwise, then fetches what we lack and,
+// if upload is set, queues what the relay lacks to be published there.
+func syncRelay(ctx context.Context, url string, filter nostr.Filter, upload bool) syncResult {
+	url = nostr.NormalizeURL(url)
+	res := syncResult{Relay: url}
+	if !relayUsable(url) {
+		res.Error = "relay is backing off"
+		return res
+	}
+
+	local := make(map[string]*nostr.Event)
+	if ch, err := store.QueryEvents(ctx, filter); err == nil {
+		for evt := range ch {
+			local[evt.ID] = evt
+		}
+	}
+
+	var have []string
+	var fetched []*nostr.Event
+	var err error
+	if noNegentropy.supported(url) {
+		res.Method = SYNC_NEGENTROPY
+		var need []string
+		if have, need, err = negentropyDiff(ctx, url, filter, local); err == nil {
+			fetched, err = fetchByIDs(ctx, url, need)
+		} else if ctx.Err() == nil {
+			log.Debug().Err(err).Str("relay", url).Msg("negentropy failed, falling back to REQ")
+			if errors.Is(err, errNoNegentropy) {
+				noNegentropy.mark(url)
+			}
+			res.Method = ""
+		}
+	}
+	if res.Method == "" {
+		res.Method = SYNC_REQ
+		have, fetched, err = reqDiff(ctx, url, filter, local)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	for _, evt := range fetched {
+		if _, ok := local[evt.ID]; ok || !filter.Matches(evt) {
+			continue
+		}
+		ingestFollowedEvent(ctx, url, evt)
+		res.Downloaded++
+	}
+
+	if upload {
+		for _, id := range have {
+			evt := local[id]
+			if evt == nil || !rebroadcastable(evt) {
+				continue
+			}
+			if err := enqueuePublish(ctx, evt, []string{url}, nil); err != nil {
+				res.Error = err.Error()
+				break
+			}
+			res.Uploaded++
+		}
+	}
+
+	log.Debug().Str("relay", url).Str("method", res.Method).Int("downloaded", res.Downloaded).
+		Int("uploaded", res.Uploaded).Msg("synced")
+	return res
+}
+
+// errNoNegentropy is what negentropyDiff fails with when the relay itself turned negentropy
+// down, as opposed to us not reaching it or it refusing a single filter with NEG-ERR.
+var errNoNegentropy = errors.New("relay doesn't do negentropy")
+
+// negentropyDiff runs NIP-77 on its own connection, as the relay library doesn't know about
+// NEG-* messages, and returns the ids only we have and the ones only the relay has.
+func negentropyDiff(ctx context.Context, url string, filter nostr.Filter, local map[string]*nostr.Event) (have []string, need []string, err error) {
+	neg := negentropy.New()
+	for _, evt := range local {
+		neg.Add(int64(evt.CreatedAt), evt.ID)
+	}
+
+	conn, done, err := dialRelay(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer done()
+
+	subID := "bisu-sync"
+	if err := writeRelayMessage(conn, "NEG-OPEN", subID, filter, hex.EncodeToString(neg.Initiate())); err != nil {
+		return nil, nil, err
+	}
+
+	answered := false
+	for {
+		label, args, err := readRelayMessage(conn, SYNC_NEGENTROPY_WAIT)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			// relays that don't know NEG-OPEN often just ignore it, but a dropped connection
+			// or a relay that stops answering midway tells nothing about what it supports
+			var nerr net.Error
+			if !answered && errors.As(err, &nerr) && nerr.Timeout() {
+				return nil, nil, fmt.Errorf("%w: no answer: %s", errNoNegentropy, err)
+			}
+			return nil, nil, err
+		}
+		answered = true
+
+		var sub, payload string
+		json.Unmarshal(args[0], &sub)
+		if len(args) > 1 {
+			json.Unmarshal(args[1], &payload)
+		}
+
+		switch label {
+		case "NOTICE":
+			recordRelayNotice(url, sub)
+			return nil, nil, fmt.Errorf("%w: notice: %s", errNoNegentropy, sub)
+		case "NEG-ERR":
+			// about this filter only, like "blocked: too many records"
+			if sub == subID {
+				return nil, nil, fmt.Errorf("NEG-ERR: %s", payload)
+			}
+		case "NEG-MSG":
+			if sub != subID {
+				continue
+			}
+			b, err := hex.DecodeString(payload)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid NEG-MSG: %w", err)
+			}
+			next, h, n, err := neg.Reconcile(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			have = append(have, h...)
+			need = append(need, n...)
+			if next == nil {
+				writeRelayMessage(conn, "NEG-CLOSE", subID)
+				return have, need, nil
+			}
+			if err := writeRelayMessage(conn, "NEG-MSG", subID, hex.EncodeToString(next)); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// reqDiff is the fallback for relays without negentropy: it fetches everything matching filter.
+// relays cap how many events they return, so only what's newer than the oldest event we got
+// is considered missing there, unless we got nothing at all.
+func reqDiff(ctx context.Context, url string, filter nostr.Filter, local map[string]*nostr.Event) (have []string, fetched []*nostr.Event, err error) {
+	relay, err := ensureRelay(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	qctx, cancel := context.WithTimeout(ctx, SYNC_FETCH_TIMEOUT)
+	defer cancel()
+	fetched, err = relay.QuerySync(qctx, filter, nostr.WithLabel("sync"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote := make(map[string]struct{}, len(fetched))
+	oldest := nostr.Timestamp(0)
+	for i, evt := range fetched {
+		remote[evt.ID] = struct{}{}
+		if i == 0 || evt.CreatedAt < oldest {
+			oldest = evt.CreatedAt
+		}
+	}
+	for id, evt := range local {
+		if _, ok := remote[id]; !ok && evt.CreatedAt >= oldest {
+			have = append(have, id)
+		}
+	}
+	return have, fetched, nil
+}
+
+func fetchByIDs(ctx context.Context, url string, ids []string) ([]*nostr.Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	relay, err := ensureRelay(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*nostr.Event
+	for start := 0; start < len(ids); start += SYNC_FETCH_CHUNK {
+		end := start + SYNC_FETCH_CHUNK
+		if end > len(ids) {
+			end = len(ids)
+		}
+		qctx, cancel := context.WithTimeout(ctx, SYNC_FETCH_TIMEOUT)
+		chunk, err := relay.QuerySync(qctx, nostr.Filter{IDs: ids[start:end]}, nostr.WithLabel("sync"))
+		cancel()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, chunk...)
+	}
+	return events, nil
+}
+
+// syncCommand runs the sync subcommand and prints what happened on each relay.
+func syncCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bisu sync", flag.ContinueOnError)
+	pubkey := fs.String("pubkey", "", "only this identity (default all of them)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	found := false
+	for _, id := range identities {
+		if *pubkey != "" && id.pubkey != *pubkey {
+			continue
+		}
+		found = true
+		for _, res := range id.syncWithRelays(ctx) {
+			j, _ := json.Marshal(res)
+			fmt.Println(string(j))
+		}
+	}
+	if !found {
+		return fmt.Errorf("no identity with pubkey %s", *pubkey)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSyncRelay(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	n := 0
+	note := func() *nostr.Event {
+		n++
+		evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Timestamp(1700000000 + n/3), Tags: nostr.Tags{}, Content: fmt.Sprint("note ", n)}
+		evt.Sign(sk)
+		return evt
+	}
+
+	withNeg := startTestRelay(t)
+	withNeg.Negentropy = true
+	withoutNeg := startTestRelay(t)
+
+	// enough shared events for ranges to be compared by fingerprint
+	for i := 0; i < 80; i++ {
+		evt := note()
+		saveEvent(ctx, evt)
+		withNeg.events = append(withNeg.events, evt)
+		withoutNeg.events = append(withoutNeg.events, evt)
+	}
+	onlyHere := note()
+	saveEvent(ctx, onlyHere)
+	onlyThere := note()
+	withNeg.events = append(withNeg.events, onlyThere)
+	withoutNeg.events = append(withoutNeg.events, onlyThere)
+
+	queued := func(url string) []string {
+		var ids []string
+		db.SelectContext(ctx, &ids, `SELECT event_id FROM publish_queue WHERE relay = $1`, url)
+		return ids
+	}
+
+	own := nostr.Filter{Authors: []string{pk}}
+	res := syncRelay(ctx, withNeg.URL, own, true)
+	if res.Error != "" || res.Method != SYNC_NEGENTROPY || res.Downloaded != 1 || res.Uploaded != 1 {
+		t.Fatalf("unexpected negentropy sync result %+v", res)
+	}
+	if storedEvent(t, onlyThere.ID) == nil {
+		t.Errorf("missing event wasn't downloaded")
+	}
+	if ids := queued(res.Relay); len(ids) != 1 || ids[0] != onlyHere.ID {
+		t.Errorf("expected only %s to be queued, got %v", onlyHere.ID, ids)
+	}
+
+	// nothing left to do now
+	if res := syncRelay(ctx, withNeg.URL, own, true); res.Downloaded != 0 || res.Uploaded != 1 {
+		t.Errorf("unexpected second sync %+v", res)
+	}
+
+	// a relay that doesn't know NEG-OPEN gets a plain REQ, and then only that for a while
+	for i := 0; i < 2; i++ {
+		res := syncRelay(ctx, withoutNeg.URL, own, false)
+		if res.Error != "" || res.Method != SYNC_REQ || res.Uploaded != 0 {
+			t.Fatalf("unexpected fallback sync result %+v", res)
+		}
+		if len(queued(res.Relay)) != 0 {
+			t.Errorf("nothing should be uploaded to a relay we only read from")
+		}
+	}
+	if noNegentropy.supported(nostr.NormalizeURL(withoutNeg.URL)) {
+		t.Errorf("relay should have been marked as not supporting negentropy")
+	}
+
+	// not reaching a relay says nothing about what it supports
+	down := "ws://127.0.0.1:1"
+	if res := syncRelay(ctx, down, own, false); res.Error == "" {
+		t.Errorf("sync with a relay that is down should fail, got %+v", res)
+	}
+	if !noNegentropy.supported(nostr.NormalizeURL(down)) {
+		t.Errorf("a relay we couldn't reach shouldn't be marked as not supporting negentropy")
+	}
+
+	// a filter the relay refuses with NEG-ERR is synced with REQ, and only that filter
+	limited := startTestRelay(t)
+	limited.Negentropy = true
+	limited.NegLimit = 10
+	limited.events = append(limited.events, withNeg.Events()...)
+	if res := syncRelay(ctx, limited.URL, own, false); res.Error != "" || res.Method != SYNC_REQ {
+		t.Errorf("unexpected sync result after NEG-ERR %+v", res)
+	}
+	if !noNegentropy.supported(nostr.NormalizeURL(limited.URL)) {
+		t.Errorf("a relay that refused one filter shouldn't be marked as not supporting negentropy")
+	}
+	few := nostr.Filter{IDs: []string{onlyThere.ID}}
+	if res := syncRelay(ctx, limited.URL, few, false); res.Error != "" || res.Method != SYNC_NEGENTROPY {
+		t.Errorf("unexpected sync result for a small filter %+v", res)
+	}
+
+	// and neither is one that drops the connection
+	dropping := startRawRelay(t, func(ws *websocket.Conn, message []byte) bool {
+		req, ok := nostr.ParseMessage(message).(*nostr.ReqEnvelope)
+		if ok {
+			eose := nostr.EOSEEnvelope(req.SubscriptionID)
+			b, _ := eose.MarshalJSON()
+			ws.WriteMessage(websocket.TextMessage, b)
+		}
+		return ok
+	})
+	if res := syncRelay(ctx, dropping, own, false); res.Method != SYNC_REQ {
+		t.Errorf("unexpected sync result after a dropped connection %+v", res)
+	}
+	if !noNegentropy.supported(nostr.NormalizeURL(dropping)) {
+		t.Errorf("a relay that dropped the connection shouldn't be marked as not supporting negentropy")
+	}
+}
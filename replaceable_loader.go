@@ -106,7 +106,7 @@ func batchLoadReplaceableEvents(
 	defer close(newEvents)
 	go func() {
 		for evt := range newEvents {
-			store.SaveEvent(ctx, evt)
+			saveEvent(ctx, evt)
 		}
 	}()
 
@@ -120,7 +120,11 @@ func batchLoadReplaceableEvents(
 			}
 
 			// insert this event at the desired position
-			pos := keyPositions[evt.PubKey] // @unchecked: it must succeed because it must be a key we passed
+			pos, ok := keyPositions[evt.PubKey]
+			if !ok {
+				// not one of the keys we asked for, the relay is misbehaving
+				continue
+			}
 			if results[pos].Data == nil || results[pos].Data.CreatedAt < evt.CreatedAt {
 				results[pos] = &dataloader.Result[*nostr.Event]{Data: evt}
 				newEvents <- evt
@@ -132,6 +136,9 @@ func batchLoadReplaceableEvents(
 }
 
 func determineRelaysToQuery(ctx context.Context, pubkey string, kind int) []string {
+	cfg := getConfig()
+	profileRelays, defaultRelays := cfg.ProfileRelays, cfg.DefaultRelays
+
 	// search in specific relays for user
 	relays := fetchOutboxRelaysForUser(ctx, pubkey, 1, false)
 
@@ -145,6 +152,8 @@ func determineRelaysToQuery(ctx context.Context, pubkey string, kind int) []stri
 		relays = append(relays, relayListRelays...)
 	}
 
+	relays = healthyRelays(relays)
+	defaultRelays = healthyRelays(defaultRelays)
 	for len(relays) < 3 {
 		serial++
 		relays = append(relays, defaultRelays[serial%len(defaultRelays)])
@@ -186,7 +195,7 @@ func batchReplaceableRelayQueries(
 			defer cancel()
 
 			n := len(filter.Authors)
-			rl, _ := pool.EnsureRelay(url)
+			rl, _ := ensureRelay(url)
 			if rl == nil {
 				return
 			}
@@ -204,11 +213,15 @@ func batchReplaceableRelayQueries(
 						return
 					}
 
+					if !filter.Matches(evt) || !acceptEvent(ctx, url, evt) {
+						continue
+					}
+
 					all <- evt
 
 					if evt.Kind != 10002 &&
 						!slices.Contains(relayListRelays, sub.Relay.URL) &&
-						!slices.Contains(profileRelays, sub.Relay.URL) {
+						!slices.Contains(getConfig().ProfileRelays, sub.Relay.URL) {
 						// associate relays
 						go func() {
 							saveLastFetched(bg, evt.PubKey, sub.Relay.URL)
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip10"
+)
+
+const (
+	RETENTION_INTERVAL    = time.Minute * 10
+	RETENTION_INDEX_BATCH = 2000 // events from before we tracked them indexed per run
+	RETENTION_SCAN_BATCH  = 500
+	RETENTION_SCAN_LIMIT  = 10000 // most candidates looked at per run
+	RETENTION_EVICT_LIMIT = 2000  // most events removed per run
+)
+
+// eventAccess is what we keep about each stored event to decide what to evict.
+type eventAccess struct {
+	ID        string          `db:"id"`
+	PubKey    string          `db:"pubkey"`
+	Kind      int             `db:"kind"`
+	CreatedAt nostr.Timestamp `db:"created_at"`
+	Root      string          `db:"root"`
+	Size      int64           `db:"size"`
+}
+
+var (
+	accessMu sync.Mutex
+	accessed = make(map[string]int64)
+)
+
+// trackEvent remembers an event we just stored, as if it had just been accessed.
+func trackEvent(ctx context.Context, evt *nostr.Event, accessedAt int64) {
+	root := ""
+	if tag := nip10.GetThreadRoot(evt.Tags); tag != nil {
+		root = tag.Value()
+	}
+	db.ExecContext(ctx, `
+INSERT INTO event_access (id, pubkey, kind, created_at, root, size, accessed_at) VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (id) DO NOTHING
+    `, evt.ID, evt.PubKey, evt.Kind, evt.CreatedAt, root, len(evt.String()), accessedAt)
+}
+
+// touchEvent marks an event as used so it's evicted later. these are written in batches.
+func touchEvent(id string) {
+	accessMu.Lock()
+	accessed[id] = time.Now().Unix()
+	accessMu.Unlock()
+}
+
+func flushEventAccesses(ctx context.Context) {
+	accessMu.Lock()
+	batch := accessed
+	accessed = make(map[string]int64, len(batch))
+	accessMu.Unlock()
+
+	for id, when := range batch {
+		db.ExecContext(ctx, `UPDATE event_access SET accessed_at = max(accessed_at, $1) WHERE id = $2`, when, id)
+	}
+}
+
+// runRetention keeps the event store under the configured size, a little at a time.
+func runRetention() {
+	for {
+		time.Sleep(RETENTION_INTERVAL)
+
+		ctx := context.Background()
+		flushEventAccesses(ctx)
+		indexStoredEvents(ctx)
+		if maxMB := getConfig().MaxStoreMB; maxMB > 0 {
+			if n := evictEvents(ctx, int64(maxMB)*1024*1024); n > 0 {
+				log.Info().Int("n", n).Msg("evicted events from the local store")
+			}
+		}
+	}
+}
+
+// indexStoredEvents goes backwards through events that were stored before we started tracking
+// them, a batch at each call, so they can be evicted too.
+func indexStoredEvents(ctx context.Context) {
+	var until nostr.Timestamp
+	if err := db.GetContext(ctx, &until, `SELECT until FROM event_access_backfill`); err != nil || until == -1 {
+		return
+	}
+	if until == 0 {
+		until = nostr.Now()
+	}
+
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Until: &until, Limit: RETENTION_INDEX_BATCH})
+	if err != nil {
+		return
+	}
+	n := 0
+	oldest := until
+	for evt := range ch {
+		// we don't know when they were last used, so say it was when they were created
+		trackEvent(ctx, evt, int64(evt.CreatedAt))
+		if evt.CreatedAt < oldest {
+			oldest = evt.CreatedAt
+		}
+		n++
+	}
+
+	next := oldest
+	if n < RETENTION_INDEX_BATCH {
+		next = -1
+	} else if oldest == until {
+		// a full batch in a single second, skip it so we don't loop forever
+		next--
+	}
+	db.ExecContext(ctx, `UPDATE event_access_backfill SET until = $1`, next)
+}
+
+// retentionPolicy tells which events we keep no matter how long ago they were used.
+type retentionPolicy struct {
+	cutoff    nostr.Timestamp
+	followed  map[string]bool
+	protected map[string]bool // ids of events and of thread roots
+}
+
+func loadRetentionPolicy(ctx context.Context) retentionPolicy {
+	p := retentionPolicy{
+		cutoff:    nostr.Now() - nostr.Timestamp(60*60*24*getConfig().RetentionDays),
+		followed:  make(map[string]bool),
+		protected: make(map[string]bool),
+	}
+
+	own := make([]string, 0, len(identities))
+	for _, id := range identities {
+		own = append(own, id.pubkey)
+		id.mu.Lock()
+		fm := id.follows
+		id.mu.Unlock()
+		if fm != nil {
+			for _, author := range fm.currentAuthors() {
+				p.followed[author] = true
+			}
+		}
+	}
+	if len(own) == 0 {
+		return p
+	}
+
+	// what we posted, replied to, reposted, favourited and bookmarked
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{1, 6, 7, 10003}, Authors: own})
+	if err != nil {
+		return p
+	}
+	for evt := range ch {
+		if evt.Kind == 1 {
+			p.protected[evt.ID] = true
+		}
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				p.protected[tag[1]] = true
+			}
+		}
+	}
+
+	return p
+}
+
+func (p retentionPolicy) keep(ea eventAccess) bool {
+	if isOwnPubkey(ea.PubKey) {
+		return true
+	}
+	if p.followed[ea.PubKey] && (ea.CreatedAt >= p.cutoff || ea.Kind == 0 || ea.Kind == 3 || ea.Kind == 10002) {
+		return true
+	}
+	return p.protected[ea.ID] || (ea.Root != "" && p.protected[ea.Root])
+}
+
+// evictEvents removes the least recently used events that the policy doesn't keep until the
+// store is under maxBytes, or until we've done enough for now.
+func evictEvents(ctx context.Context, maxBytes int64) int {
+	var total int64
+	if err := db.GetContext(ctx, &total, `SELECT coalesce(sum(size), 0) FROM event_access`); err != nil || total <= maxBytes {
+		return 0
+	}
+
+	policy := loadRetentionPolicy(ctx)
+
+	ids := make([]string, 0, RETENTION_SCAN_BATCH)
+	var freed int64
+	var lastAccessed int64 = -1
+	lastID := ""
+	for scanned := 0; scanned < RETENTION_SCAN_LIMIT && freed < total-maxBytes && len(ids) < RETENTION_EVICT_LIMIT; {
+		var batch []struct {
+			eventAccess
+			AccessedAt int64 `db:"accessed_at"`
+		}
+		if err := db.SelectContext(ctx, &batch, `
+SELECT id, pubkey, kind, created_at, root, size, accessed_at FROM event_access
+WHERE (accessed_at, id) > ($1, $2)
+ORDER BY accessed_at, id
+LIMIT $3
+        `, lastAccessed, lastID, RETENTION_SCAN_BATCH); err != nil {
+			log.Warn().Err(err).Msg("failed to read events to evict")
+			break
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, ea := range batch {
+			scanned++
+			lastAccessed, lastID = ea.AccessedAt, ea.ID
+			if policy.keep(ea.eventAccess) {
+				continue
+			}
+			ids = append(ids, ea.ID)
+			freed += ea.Size
+			if freed >= total-maxBytes || len(ids) >= RETENTION_EVICT_LIMIT {
+				break
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0
+	}
+
+	evicted := 0
+	for start := 0; start < len(ids); start += RETENTION_SCAN_BATCH {
+		end := start + RETENTION_SCAN_BATCH
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var events []*nostr.Event
+		if ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: ids[start:end]}); err == nil {
+			for evt := range ch {
+				events = append(events, evt)
+			}
+		}
+		for _, evt := range events {
+			// this isn't a deletion, so we don't tell clients or drop it from the cache
+			if err := store.DeleteEvent(ctx, evt); err != nil {
+				log.Warn().Err(err).Str("id", evt.ID).Msg("failed to evict event")
+				continue
+			}
+			db.ExecContext(ctx, `DELETE FROM expirations WHERE id = $1`, evt.ID)
+			evicted++
+		}
+		// also forget the ones that weren't in the store anymore
+		for _, id := range ids[start:end] {
+			db.ExecContext(ctx, `DELETE FROM event_access WHERE id = $1`, id)
+		}
+	}
+
+	return evicted
+}
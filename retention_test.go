@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestEvictEvents(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+	setTestConfig(t, func(c *Config) { c.RetentionDays = 30 })
+
+	me := nostr.GeneratePrivateKey()
+	friend := nostr.GeneratePrivateKey()
+	stranger := nostr.GeneratePrivateKey()
+	mypk, _ := nostr.GetPublicKey(me)
+	friendpk, _ := nostr.GetPublicKey(friend)
+
+	id := &Identity{pubkey: mypk}
+	id.follows = newFollowManager(id)
+	id.follows.authors[friendpk] = nil
+	previous := identities
+	identities = []*Identity{id}
+	t.Cleanup(func() { identities = previous })
+
+	day := time.Hour * 24
+	post := func(sk string, kind int, ago time.Duration, tags nostr.Tags) *nostr.Event {
+		evt := &nostr.Event{
+			Kind:      kind,
+			CreatedAt: nostr.Timestamp(time.Now().Add(-ago).Unix()),
+			Tags:      tags,
+			Content:   ago.String(),
+		}
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+		return evt
+	}
+
+	// the oldest ones are the least recently used
+	mine := post(me, 1, 400*day, nostr.Tags{})
+	friendOld := post(friend, 1, 60*day, nostr.Tags{})
+	friendNew := post(friend, 1, 10*day, nostr.Tags{})
+	friendProfile := post(friend, 0, 300*day, nostr.Tags{})
+	replyToMe := post(stranger, 1, 300*day, nostr.Tags{{"e", mine.ID, "", "root"}})
+	favourited := post(stranger, 1, 300*day, nostr.Tags{})
+	post(me, 7, 300*day, nostr.Tags{{"e", favourited.ID}, {"p", favourited.PubKey}})
+	bookmarked := post(stranger, 1, 300*day, nostr.Tags{})
+	post(me, 10003, day, nostr.Tags{{"e", bookmarked.ID}})
+	randomOld := post(stranger, 1, 200*day, nostr.Tags{})
+	randomUsed := post(stranger, 1, 100*day, nostr.Tags{})
+	randomNew := post(stranger, 1, day, nostr.Tags{})
+
+	// nothing to do under the limit
+	if n := evictEvents(ctx, 1024*1024); n != 0 {
+		t.Fatalf("evicted %d events under the limit", n)
+	}
+
+	for _, evt := range []*nostr.Event{
+		mine, friendOld, friendNew, friendProfile, replyToMe, favourited, bookmarked, randomOld, randomUsed, randomNew,
+	} {
+		db.ExecContext(ctx, `UPDATE event_access SET accessed_at = $1 WHERE id = $2`, evt.CreatedAt, evt.ID)
+	}
+	touchEvent(randomUsed.ID)
+	flushEventAccesses(ctx)
+
+	// ask for just enough space so two events have to go
+	var total int64
+	db.GetContext(ctx, &total, `SELECT sum(size) FROM event_access`)
+	size := int64(len(randomOld.String()))
+	if n := evictEvents(ctx, total-size-1); n != 2 {
+		t.Fatalf("expected 2 events evicted, got %d", n)
+	}
+
+	for _, evt := range []*nostr.Event{randomOld, friendOld} {
+		if storedEvent(t, evt.ID) != nil {
+			t.Errorf("%s should have been evicted", evt.Content)
+		}
+	}
+	for _, evt := range []*nostr.Event{
+		mine, friendNew, friendProfile, replyToMe, favourited, bookmarked, randomUsed, randomNew,
+	} {
+		if storedEvent(t, evt.ID) == nil {
+			t.Errorf("%s (kind %d) should have been kept", evt.Content, evt.Kind)
+		}
+	}
+}
+
+func TestIndexStoredEvents(t *testing.T) {
+	ctx := context.Background()
+	setupTestStorage(t)
+
+	sk := nostr.GeneratePrivateKey()
+	for i := 0; i < 3; i++ {
+		evt := nostr.Event{Kind: 1, CreatedAt: nostr.Now() - nostr.Timestamp(i), Tags: nostr.Tags{}, Content: "old"}
+		evt.Sign(sk)
+		// straight to the store, as if it had been saved before we tracked events
+		store.SaveEvent(ctx, &evt)
+	}
+
+	indexStoredEvents(ctx)
+	var n int
+	db.GetContext(ctx, &n, `SELECT count(*) FROM event_access`)
+	if n != 3 {
+		t.Fatalf("expected 3 indexed events, got %d", n)
+	}
+	var until int
+	db.GetContext(ctx, &until, `SELECT until FROM event_access_backfill`)
+	if until != -1 {
+		t.Fatalf("indexing should be done, got %d", until)
+	}
+}
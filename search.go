@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -25,15 +26,38 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	case "accounts":
 		filter.Kinds = []int{0}
 	}
-	events := pool.SubManyEose(r.Context(), searchRelays, nostr.Filters{filter})
-	accounts := make([]*Account, 0, limit)
-	i := 0
-	for evt := range events {
-		accounts = append(accounts, toAccount(r.Context(), toProfile(evt.Event), nil))
-		i++
-		if i >= limit {
-			break
-		}
+
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	seen := make(map[string]bool)
+	results := make([]*nostr.Event, 0, limit)
+	for _, url := range getConfig().SearchRelays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := ensureRelay(url)
+			if err != nil {
+				return
+			}
+			events, _ := relay.QuerySync(r.Context(), filter)
+			for _, evt := range events {
+				if !acceptEvent(r.Context(), url, evt) {
+					continue
+				}
+				mu.Lock()
+				if !seen[evt.ID] && len(results) < limit {
+					seen[evt.ID] = true
+					results = append(results, evt)
+				}
+				mu.Unlock()
+			}
+		}(url)
+	}
+	wg.Wait()
+
+	accounts := make([]*Account, 0, len(results))
+	for _, evt := range results {
+		accounts = append(accounts, toAccount(r.Context(), toProfile(evt), nil))
 	}
 
 	json.NewEncoder(w).Encode(searchResponse{
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/fiatjaf/bisu/nip49"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+)
+
+// Signer is everything that needs the private key of an identity. it may be a key we
+// hold in memory or a remote signer that we talk to over relays.
+type Signer interface {
+	GetPublicKey(ctx context.Context) (string, error)
+	SignEvent(ctx context.Context, evt *nostr.Event) error
+	Encrypt(ctx context.Context, plaintext string, recipient string) (string, error)
+	Decrypt(ctx context.Context, ciphertext string, sender string) (string, error)
+}
+
+// keySigner holds the private key in memory.
+type keySigner struct {
+	sk string
+}
+
+func newKeySigner(sk string) (*keySigner, error) {
+	if _, err := nostr.GetPublicKey(sk); err != nil {
+		return nil, fmt.Errorf("private key is invalid: %w", err)
+	}
+	return &keySigner{sk: sk}, nil
+}
+
+func (ks *keySigner) GetPublicKey(ctx context.Context) (string, error) {
+	return nostr.GetPublicKey(ks.sk)
+}
+
+func (ks *keySigner) SignEvent(ctx context.Context, evt *nostr.Event) error {
+	return evt.Sign(ks.sk)
+}
+
+func (ks *keySigner) Encrypt(ctx context.Context, plaintext string, recipient string) (string, error) {
+	key, err := nip44.ComputeSharedSecret(recipient, ks.sk)
+	if err != nil {
+		return "", err
+	}
+	return nip44.Encrypt(plaintext, key)
+}
+
+func (ks *keySigner) Decrypt(ctx context.Context, ciphertext string, sender string) (string, error) {
+	key, err := nip44.ComputeSharedSecret(sender, ks.sk)
+	if err != nil {
+		return "", err
+	}
+	return nip44.Decrypt(ciphertext, key)
+}
+
+var errKeyLocked = fmt.Errorf("key is locked, unlock it with its passphrase on the authorization page")
+
+// encryptedKeySigner holds a NIP-49 encrypted key. it can't do anything until it's
+// unlocked with the passphrase, but it knows its pubkey so the identity can be loaded.
+type encryptedKeySigner struct {
+	ncryptsec string
+	pubkey    string
+
+	mu       sync.Mutex
+	unlocked *keySigner
+}
+
+func (es *encryptedKeySigner) IsLocked() bool {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.unlocked == nil
+}
+
+func (es *encryptedKeySigner) Unlock(passphrase string) error {
+	sk, err := nip49.Decrypt(es.ncryptsec, passphrase)
+	if err != nil {
+		return err
+	}
+	ks, err := newKeySigner(sk)
+	if err != nil {
+		return err
+	}
+	pk, _ := ks.GetPublicKey(context.Background())
+	if es.pubkey != "" && pk != es.pubkey {
+		return fmt.Errorf("encrypted key is for %s, not %s", pk, es.pubkey)
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.pubkey = pk
+	es.unlocked = ks
+	return nil
+}
+
+func (es *encryptedKeySigner) signer() (*keySigner, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.unlocked == nil {
+		return nil, errKeyLocked
+	}
+	return es.unlocked, nil
+}
+
+func (es *encryptedKeySigner) GetPublicKey(ctx context.Context) (string, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.pubkey == "" {
+		return "", errKeyLocked
+	}
+	return es.pubkey, nil
+}
+
+func (es *encryptedKeySigner) SignEvent(ctx context.Context, evt *nostr.Event) error {
+	ks, err := es.signer()
+	if err != nil {
+		return err
+	}
+	return ks.SignEvent(ctx, evt)
+}
+
+func (es *encryptedKeySigner) Encrypt(ctx context.Context, plaintext string, recipient string) (string, error) {
+	ks, err := es.signer()
+	if err != nil {
+		return "", err
+	}
+	return ks.Encrypt(ctx, plaintext, recipient)
+}
+
+func (es *encryptedKeySigner) Decrypt(ctx context.Context, ciphertext string, sender string) (string, error) {
+	ks, err := es.signer()
+	if err != nil {
+		return "", err
+	}
+	return ks.Decrypt(ctx, ciphertext, sender)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// testBunker is an in-process stand-in for a NIP-46 remote signer holding a single key.
+type testBunker struct {
+	sk     string
+	pubkey string
+	secret string
+}
+
+func startTestBunker(t *testing.T, relay *testRelay, secret string) *testBunker {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	tb := &testBunker{sk: sk, pubkey: pk, secret: secret}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go keepSubscribed(ctx, relay.URL, "test-bunker", func() nostr.Filter {
+		return nostr.Filter{Kinds: []int{nostr.KindNostrConnect}, Tags: nostr.TagMap{"p": []string{pk}}}
+	}, func(evt *nostr.Event) {
+		tb.handle(ctx, relay, evt)
+	})
+
+	return tb
+}
+
+func (tb *testBunker) handle(ctx context.Context, relay *testRelay, evt *nostr.Event) {
+	key, _ := nip04.ComputeSharedSecret(evt.PubKey, tb.sk)
+	plaintext, err := nip04.Decrypt(evt.Content, key)
+	if err != nil {
+		return
+	}
+	var req bunkerRequest
+	if err := json.Unmarshal([]byte(plaintext), &req); err != nil {
+		return
+	}
+
+	signer := &keySigner{sk: tb.sk}
+	resp := bunkerResponse{ID: req.ID}
+	switch req.Method {
+	case "connect":
+		if len(req.Params) < 2 || req.Params[1] != tb.secret {
+			resp.Error = "wrong secret"
+		} else {
+			resp.Result = "ack"
+		}
+	case "get_public_key":
+		resp.Result = tb.pubkey
+	case "sign_event":
+		var unsigned nostr.Event
+		json.Unmarshal([]byte(req.Params[0]), &unsigned)
+		if err := signer.SignEvent(ctx, &unsigned); err != nil {
+			resp.Error = err.Error()
+		} else {
+			j, _ := json.Marshal(unsigned)
+			resp.Result = string(j)
+		}
+	case "nip44_encrypt":
+		resp.Result, err = signer.Encrypt(ctx, req.Params[1], req.Params[0])
+	case "nip44_decrypt":
+		resp.Result, err = signer.Decrypt(ctx, req.Params[1], req.Params[0])
+	default:
+		resp.Error = "unsupported method " + req.Method
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	tb.respond(ctx, relay, evt.PubKey, resp)
+}
+
+func (tb *testBunker) respond(ctx context.Context, relay *testRelay, client string, resp bunkerResponse) {
+	key, _ := nip04.ComputeSharedSecret(client, tb.sk)
+	j, _ := json.Marshal(resp)
+	content, _ := nip04.Encrypt(string(j), key)
+	answer := nostr.Event{
+		Kind:      nostr.KindNostrConnect,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", client}},
+		Content:   content,
+	}
+	answer.Sign(tb.sk)
+
+	if r, err := ensureRelay(relay.URL); err == nil {
+		r.Publish(ctx, answer)
+	}
+}
+
+func TestBunkerSigner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	relay := startTestRelay(t)
+	tb := startTestBunker(t, relay, "s3cr3t")
+
+	bs, err := connectBunker(ctx, bunkerConfig{
+		URI:          "bunker://" + tb.pubkey + "?relay=" + relay.URL + "&secret=s3cr3t",
+		ClientSecret: nostr.GeneratePrivateKey(),
+	})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+
+	pk, _ := bs.GetPublicKey(ctx)
+	if pk != tb.pubkey {
+		t.Fatalf("got pubkey %s, expected %s", pk, tb.pubkey)
+	}
+
+	evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "hello from the bunker"}
+	if err := bs.SignEvent(ctx, evt); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != tb.pubkey {
+		t.Fatalf("event wasn't properly signed: %s", evt)
+	}
+
+	other := &keySigner{sk: nostr.GeneratePrivateKey()}
+	otherPk, _ := other.GetPublicKey(ctx)
+	ciphertext, err := bs.Encrypt(ctx, "secret message", otherPk)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if plaintext, err := other.Decrypt(ctx, ciphertext, tb.pubkey); err != nil || plaintext != "secret message" {
+		t.Fatalf("recipient couldn't decrypt: %q, %v", plaintext, err)
+	}
+
+	reply, _ := other.Encrypt(ctx, "secret reply", tb.pubkey)
+	if plaintext, err := bs.Decrypt(ctx, reply, otherPk); err != nil || plaintext != "secret reply" {
+		t.Fatalf("bunker couldn't decrypt: %q, %v", plaintext, err)
+	}
+}
+
+func TestBunkerSignerWrongSecret(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	relay := startTestRelay(t)
+	tb := startTestBunker(t, relay, "s3cr3t")
+
+	_, err := connectBunker(ctx, bunkerConfig{
+		URI:          "bunker://" + tb.pubkey + "?relay=" + relay.URL + "&secret=wrong",
+		ClientSecret: nostr.GeneratePrivateKey(),
+	})
+	if err == nil || !strings.Contains(err.Error(), "wrong secret") {
+		t.Fatalf("expected connect to fail with the bunker's error, got %v", err)
+	}
+}
+
+func TestWaitNostrConnect(t *testing.T) {
+	relay := startTestRelay(t)
+	tb := startTestBunker(t, relay, "")
+	attacker := startTestBunker(t, relay, "")
+
+	connect := func(timeout time.Duration, answer func(client string, secret string)) (*bunkerSigner, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		uris := make(chan string, 1)
+		go func() {
+			u, _ := url.Parse(<-uris)
+			answer(u.Host, u.Query().Get("secret"))
+		}()
+		return waitNostrConnect(ctx, nostr.GeneratePrivateKey(), []string{relay.URL}, uris)
+	}
+
+	// someone watching the relay sees our pubkey, but not the secret
+	_, err := connect(time.Second, func(client string, secret string) {
+		attacker.respond(context.Background(), relay, client, bunkerResponse{ID: "x", Result: "ack"})
+		attacker.respond(context.Background(), relay, client, bunkerResponse{ID: "x", Result: secret + "x"})
+	})
+	if err == nil {
+		t.Fatalf("a signer without the secret shouldn't be accepted")
+	}
+
+	bs, err := connect(time.Second*10, func(client string, secret string) {
+		attacker.respond(context.Background(), relay, client, bunkerResponse{ID: "x", Result: "ack"})
+		tb.respond(context.Background(), relay, client, bunkerResponse{ID: "x", Result: secret})
+	})
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	if bs.remotePubkey != tb.pubkey || bs.userPubkey != tb.pubkey {
+		t.Fatalf("expected the signer with the secret, got %s", bs.remotePubkey)
+	}
+}
+
+func TestParseBunkerURI(t *testing.T) {
+	pk := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	for _, tc := range []struct {
+		uri    string
+		relays int
+		ok     bool
+	}{
+		{"bunker://" + pk + "?relay=wss://relay.one&relay=wss://relay.two&secret=x", 2, true},
+		{"bunker://" + pk, 0, false},
+		{"bunker://npub1xyz?relay=wss://relay.one", 0, false},
+		{"nostrconnect://" + pk + "?relay=wss://relay.one", 0, false},
+	} {
+		remote, relays, _, err := parseBunkerURI(tc.uri)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%s: expected ok=%v, got %v", tc.uri, tc.ok, err)
+		}
+		if tc.ok && (remote != pk || len(relays) != tc.relays) {
+			t.Fatalf("%s: got %s %v", tc.uri, remote, relays)
+		}
+	}
+}
@@ -12,16 +12,24 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-var streamingConns = make([]*websocket.Conn, 0, 10)
-
 func streamingHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// browsers send the access token as a subprotocol and expect it to be echoed back
+	var responseHeader http.Header
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to upgrade websocket connection on streaming handler")
 		return
 	}
 
-	streamingConns = append(streamingConns, conn)
+	identity := getIdentity(r.Context())
+	identity.mu.Lock()
+	identity.streamingConns = append(identity.streamingConns, conn)
+	identity.mu.Unlock()
+
 	topic := r.URL.Query().Get("stream")
 	switch topic {
 	case "public":
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	FOLLOW_RELAYS_PER_AUTHOR   = 3
+	FOLLOW_REBALANCE_INTERVAL  = time.Minute * 30
+	FOLLOW_REBALANCE_DEBOUNCE  = time.Second * 10
+	FOLLOW_RESUBSCRIBE_OVERLAP = 60 // seconds, so nothing is lost while we swap subscriptions
+	RESUBSCRIBE_MIN_WAIT       = time.Second
+	RESUBSCRIBE_MAX_WAIT       = time.Minute * 10
+)
+
+// followManager keeps one subscription per relay with the authors we follow that publish
+// there. when the follow set or someone's outbox relays change only the subscriptions of
+// the relays that are affected are replaced.
+type followManager struct {
+	id *Identity
+
+	mu      sync.Mutex
+	authors map[string][]string        // author -> relays we listen to them on
+	subs    map[string]*followRelaySub // relay -> subscription
+
+	rebalance chan struct{}
+}
+
+type followRelaySub struct {
+	authors  []string // sorted
+	cancel   context.CancelFunc
+	closedAt nostr.Timestamp // when the relay dropped it, zero while it's running
+}
+
+func newFollowManager(id *Identity) *followManager {
+	return &followManager{
+		id:        id,
+		authors:   make(map[string][]string),
+		subs:      make(map[string]*followRelaySub),
+		rebalance: make(chan struct{}, 1),
+	}
+}
+
+func (id *Identity) startListening() {
+	ctx, cancel := context.WithCancel(context.Background())
+	fm := newFollowManager(id)
+	id.mu.Lock()
+	id.stopListening = cancel
+	id.follows = fm
+	id.mu.Unlock()
+
+	authors := id.followedAuthors(ctx)
+	log.Debug().Int("n", len(authors)).Str("pubkey", id.pubkey).Msg("listening to notes from all the people we follow")
+	fm.update(ctx, authors)
+
+	// fetch what we missed while we were offline
+	go id.backfill(ctx, authors)
+
+	// and keep track of changes to our follows
+	go fm.watchContactList(ctx)
+
+	// and of who zaps us
+	go id.watchZaps(ctx)
+
+	ticker := time.NewTicker(FOLLOW_REBALANCE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-fm.rebalance:
+			// wait a little so many changes at once trigger a single rebalance
+			time.Sleep(FOLLOW_REBALANCE_DEBOUNCE)
+		}
+		fm.update(ctx, fm.currentAuthors())
+	}
+}
+
+// followedAuthors is everybody in our contact list plus ourselves.
+func (id *Identity) followedAuthors(ctx context.Context) []string {
+	var follows []Follow
+	if pfollows := loadContactList(ctx, id.pubkey); pfollows != nil {
+		follows = *pfollows
+	}
+	return id.authorsFrom(follows)
+}
+
+func (id *Identity) authorsFrom(follows []Follow) []string {
+	authors := []string{id.pubkey}
+	for _, follow := range follows {
+		if follow.Pubkey != id.pubkey && nostr.IsValidPublicKeyHex(follow.Pubkey) &&
+			!slices.Contains(authors, follow.Pubkey) {
+			authors = append(authors, follow.Pubkey)
+		}
+	}
+	return authors
+}
+
+// update makes our subscriptions match the given set of authors and returns the ones
+// that weren't being followed before.
+func (fm *followManager) update(ctx context.Context, authors []string) (added []string) {
+	assignment := make(map[string][]string, len(authors))
+	desired := make(map[string][]string)
+	for _, author := range authors {
+		relays := fetchOutboxRelaysForUser(ctx, author, FOLLOW_RELAYS_PER_AUTHOR, false)
+		assignment[author] = relays
+		for _, relay := range relays {
+			if !slices.Contains(desired[relay], author) {
+				desired[relay] = append(desired[relay], author)
+			}
+		}
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	for author := range assignment {
+		if _, ok := fm.authors[author]; !ok {
+			added = append(added, author)
+		}
+	}
+	fm.authors = assignment
+
+	// relays we don't need anymore
+	for relay, sub := range fm.subs {
+		if _, ok := desired[relay]; !ok {
+			sub.cancel()
+			delete(fm.subs, relay)
+		}
+	}
+
+	// relays that are new, have a different set of authors or that dropped us
+	changed := 0
+	for relay, authors := range desired {
+		sort.Strings(authors)
+		since := nostr.Now()
+		if current, ok := fm.subs[relay]; ok {
+			if current.closedAt == 0 && slices.Equal(current.authors, authors) {
+				continue
+			}
+			current.cancel()
+			if current.closedAt != 0 {
+				since = current.closedAt
+			}
+			since -= FOLLOW_RESUBSCRIBE_OVERLAP
+		}
+		fm.subs[relay] = fm.subscribe(ctx, relay, authors, since)
+		changed++
+	}
+
+	if changed > 0 {
+		log.Debug().Str("pubkey", fm.id.pubkey).Int("changed", changed).Int("relays", len(fm.subs)).
+			Msg("updated follow subscriptions")
+	}
+
+	return added
+}
+
+func (fm *followManager) subscribe(ctx context.Context, url string, authors []string, since nostr.Timestamp) *followRelaySub {
+	ctx, cancel := context.WithCancel(ctx)
+	fs := &followRelaySub{authors: authors, cancel: cancel}
+
+	go func() {
+		defer func() {
+			if ctx.Err() != nil {
+				return
+			}
+			// the relay is gone, the next rebalance subscribes again from here, on this relay
+			// or on others if it keeps failing
+			fm.mu.Lock()
+			fs.closedAt = nostr.Now()
+			fm.mu.Unlock()
+			fm.rebalanceSoon()
+		}()
+
+		relay, err := ensureRelay(url)
+		if err != nil {
+			log.Debug().Err(err).Str("relay", url).Msg("not subscribing")
+			return
+		}
+		sub, err := relay.Subscribe(ctx, nostr.Filters{{
+			Kinds:   []int{1, 5, 30023},
+			Authors: authors,
+			Since:   &since,
+			Limit:   200,
+		}}, nostr.WithLabel("background"))
+		if err != nil {
+			log.Warn().Err(err).Str("relay", url).Msg("failed to subscribe")
+			return
+		}
+
+		for evt := range sub.Events {
+			ingestFollowedEvent(ctx, url, evt)
+		}
+		log.Debug().Str("relay", url).Msg("follow subscription closed")
+	}()
+
+	return fs
+}
+
+func (fm *followManager) currentAuthors() []string {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	authors := make([]string, 0, len(fm.authors))
+	for author := range fm.authors {
+		authors = append(authors, author)
+	}
+	return authors
+}
+
+func (fm *followManager) isFollowing(pubkey string) bool {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	_, ok := fm.authors[pubkey]
+	return ok
+}
+
+// rebalanceSoon asks for the subscriptions to be recomputed, for when outbox data changes.
+func (fm *followManager) rebalanceSoon() {
+	select {
+	case fm.rebalance <- struct{}{}:
+	default:
+	}
+}
+
+// watchContactList listens for new versions of our kind 3 published by any client.
+func (fm *followManager) watchContactList(ctx context.Context) {
+	pubkey := fm.id.pubkey
+	relays := append(append([]string{}, fm.id.writeRelays...), fm.id.readRelays...)
+	since := nostr.Now()
+
+	wg := sync.WaitGroup{}
+	for i, url := range relays {
+		if slices.Contains(relays[0:i], url) {
+			continue
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			keepSubscribed(ctx, url, "contacts", func() nostr.Filter {
+				return nostr.Filter{Kinds: []int{3}, Authors: []string{pubkey}, Since: &since}
+			}, func(evt *nostr.Event) {
+				fm.handleContactList(ctx, url, evt)
+			})
+		}(url)
+	}
+	wg.Wait()
+}
+
+// keepSubscribed holds a subscription to a single relay until ctx is canceled, subscribing
+// again whenever the relay drops it or can't be reached, waiting longer after each failure.
+// filter is called before each attempt, so it can resume from what was already seen.
+func keepSubscribed(ctx context.Context, url string, label string, filter func() nostr.Filter, handle func(*nostr.Event)) {
+	wait := RESUBSCRIBE_MIN_WAIT
+	for {
+		start := time.Now()
+		if relay, err := ensureRelay(url); err != nil {
+			log.Debug().Err(err).Str("relay", url).Str("label", label).Msg("not subscribing")
+		} else if sub, err := relay.Subscribe(ctx, nostr.Filters{filter()}, nostr.WithLabel(label)); err != nil {
+			log.Warn().Err(err).Str("relay", url).Str("label", label).Msg("failed to subscribe")
+		} else {
+			for evt := range sub.Events {
+				handle(evt)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a subscription that lasted a while is a relay that works, so start over
+		if time.Since(start) > RESUBSCRIBE_MAX_WAIT {
+			wait = RESUBSCRIBE_MIN_WAIT
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, RESUBSCRIBE_MAX_WAIT)
+	}
+}
+
+func (fm *followManager) handleContactList(ctx context.Context, relay string, evt *nostr.Event) {
+	if evt.Kind != 3 || evt.PubKey != fm.id.pubkey || !acceptEvent(ctx, relay, evt) {
+		return
+	}
+
+	current := loadReplaceableEventFromLocalStore(ctx, evt.PubKey, 3)
+	if current != nil && current.CreatedAt >= evt.CreatedAt {
+		return
+	}
+	if current != nil {
+		store.DeleteEvent(ctx, current)
+	}
+	saveEvent(ctx, evt)
+	follows := parseContactList(evt)
+	contactListsCache.Set(evt.PubKey, &follows, 1)
+
+	added := fm.update(ctx, fm.id.authorsFrom(follows))
+	log.Info().Str("pubkey", evt.PubKey).Int("follows", len(follows)).Int("added", len(added)).
+		Msg("contact list changed")
+	if len(added) > 0 {
+		go fm.id.backfill(ctx, added)
+	}
+}
+
+// outboxChanged is called when we learn new relays for someone, so the identities that
+// follow them can move their subscriptions.
+func outboxChanged(pubkey string) {
+	for _, id := range identities {
+		id.mu.Lock()
+		fm := id.follows
+		id.mu.Unlock()
+		if fm != nil && fm.isFollowing(pubkey) {
+			fm.rebalanceSoon()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFollowManagerUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	setTestConfig(t, func(c *Config) { c.DefaultRelays = []string{relay.URL} })
+
+	a := nostr.GeneratePrivateKey()
+	b := nostr.GeneratePrivateKey()
+	c := nostr.GeneratePrivateKey()
+	pa, _ := nostr.GetPublicKey(a)
+	pb, _ := nostr.GetPublicKey(b)
+	pc, _ := nostr.GetPublicKey(c)
+
+	fm := newFollowManager(&Identity{pubkey: pa})
+	if added := fm.update(ctx, []string{pa, pb}); len(added) != 2 {
+		t.Fatalf("expected both authors to be added, got %v", added)
+	}
+	first := fm.subs[relay.URL]
+	if first == nil || len(fm.subs) != 1 || len(first.authors) != 2 {
+		t.Fatalf("expected a single subscription with both authors, got %v", fm.subs)
+	}
+
+	// nothing changed, so nothing is resubscribed
+	fm.update(ctx, []string{pb, pa})
+	if fm.subs[relay.URL] != first {
+		t.Fatalf("subscription was replaced without changes")
+	}
+
+	// swap one author
+	added := fm.update(ctx, []string{pa, pc})
+	if len(added) != 1 || added[0] != pc {
+		t.Fatalf("expected only %s to be added, got %v", pc, added)
+	}
+	if fm.subs[relay.URL] == first || fm.isFollowing(pb) || !fm.isFollowing(pc) {
+		t.Fatalf("subscription wasn't updated")
+	}
+
+	// c's notes now arrive
+	time.Sleep(time.Millisecond * 200)
+	evt := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "new follow"}
+	evt.Sign(c)
+	r, _ := ensureRelay(relay.URL)
+	r.Publish(ctx, evt)
+	for storedEvent(t, evt.ID) == nil {
+		if ctx.Err() != nil {
+			t.Fatalf("note from new follow never arrived")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// c announces an outbox relay, so we start listening to them there
+	other := startTestRelay(t)
+	saveNip65Outbox(ctx, pc, other.URL, nostr.Now())
+	if added := fm.update(ctx, []string{pa, pc}); len(added) != 0 {
+		t.Fatalf("nobody should have been added, got %v", added)
+	}
+	if fm.subs[relay.URL] == nil || fm.subs[other.URL] == nil || len(fm.subs[other.URL].authors) != 1 ||
+		fm.subs[other.URL].authors[0] != pc || fm.authors[pc][0] != other.URL {
+		t.Fatalf("subscription didn't move to the new outbox: %v", fm.authors)
+	}
+}
+
+func TestFollowManagerResubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	setTestConfig(t, func(c *Config) { c.DefaultRelays = []string{relay.URL} })
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	fm := newFollowManager(&Identity{pubkey: pk, writeRelays: []string{relay.URL}})
+	fm.update(ctx, []string{pk})
+	go fm.watchContactList(ctx)
+	time.Sleep(time.Millisecond * 200)
+
+	relay.Drop()
+	for {
+		fm.mu.Lock()
+		closed := fm.subs[relay.URL].closedAt != 0
+		fm.mu.Unlock()
+		if closed {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("dropped subscription wasn't noticed")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	select {
+	case <-fm.rebalance:
+	default:
+		t.Fatalf("a rebalance should have been asked for")
+	}
+
+	// published while we weren't listening
+	note := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "missed"}
+	note.Sign(sk)
+	friend, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	contacts := nostr.Event{Kind: 3, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", friend}}}
+	contacts.Sign(sk)
+	relay.mu.Lock()
+	relay.events = append(relay.events, &note, &contacts)
+	relay.mu.Unlock()
+
+	fm.update(ctx, []string{pk})
+	for storedEvent(t, note.ID) == nil {
+		if ctx.Err() != nil {
+			t.Fatalf("note published while the relay was down never arrived")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	for !fm.isFollowing(friend) {
+		if ctx.Err() != nil {
+			t.Fatalf("contact list published while the relay was down never arrived")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
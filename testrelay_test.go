@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/bisu/negentropy"
+	"github.com/fiatjaf/bisu/nip45"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testRelay is a tiny in-memory nostr relay so tests can exercise code that talks to relays
+// without leaving the machine.
+type testRelay struct {
+	URL        string
+	Negentropy bool // answer NIP-77 messages instead of ignoring them
+	NegLimit   int  // refuse NEG-OPEN with NEG-ERR when more events than this match, if set
+	Count      bool // answer COUNT, with HyperLogLog values when possible
+
+	mu         sync.Mutex
+	events     []*nostr.Event
+	subs       map[*testRelayConn]map[string]nostr.Filters
+	countConns map[*testRelayConn]bool
+}
+
+type testRelayConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	neg  *negentropy.Negentropy
+}
+
+func (c *testRelayConn) sendRaw(v ...any) {
+	b, _ := json.Marshal(v)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func (c *testRelayConn) send(env nostr.Envelope) {
+	b, _ := env.MarshalJSON()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func startTestRelay(t *testing.T) *testRelay {
+	rl := &testRelay{
+		subs:       make(map[*testRelayConn]map[string]nostr.Filters),
+		countConns: make(map[*testRelayConn]bool),
+	}
+	server := httptest.NewServer(http.HandlerFunc(rl.serve))
+	t.Cleanup(server.Close)
+	rl.URL = "ws" + strings.TrimPrefix(server.URL, "http")
+	return rl
+}
+
+// startRawRelay is for relays that misbehave in ways testRelay doesn't: handle gets every
+// message and the connection is closed when it returns false.
+func startRawRelay(t *testing.T, handle func(ws *websocket.Conn, message []byte) bool) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil || !handle(ws, message) {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func (rl *testRelay) Events() []*nostr.Event {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return append([]*nostr.Event{}, rl.events...)
+}
+
+// CountConnections is how many connections sent COUNT so far.
+func (rl *testRelay) CountConnections() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.countConns)
+}
+
+// Drop closes every connection, like a relay that restarts.
+func (rl *testRelay) Drop() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for conn := range rl.subs {
+		conn.conn.Close()
+	}
+}
+
+func (rl *testRelay) serve(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	conn := &testRelayConn{conn: ws}
+
+	rl.mu.Lock()
+	rl.subs[conn] = make(map[string]nostr.Filters)
+	rl.mu.Unlock()
+	defer func() {
+		rl.mu.Lock()
+		delete(rl.subs, conn)
+		rl.mu.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if rl.Negentropy && rl.handleNegentropy(conn, message) {
+			continue
+		}
+
+		switch env := nostr.ParseMessage(message).(type) {
+		case *nostr.EventEnvelope:
+			evt := env.Event
+			if ok, _ := evt.CheckSignature(); !ok {
+				reason := "invalid: bad signature"
+				conn.send(&nostr.OKEnvelope{EventID: evt.ID, OK: false, Reason: &reason})
+				continue
+			}
+
+			rl.mu.Lock()
+			rl.events = append(rl.events, &evt)
+			listeners := make(map[*testRelayConn][]string)
+			for c, subs := range rl.subs {
+				for id, filters := range subs {
+					if filters.Match(&evt) {
+						listeners[c] = append(listeners[c], id)
+					}
+				}
+			}
+			rl.mu.Unlock()
+
+			conn.send(&nostr.OKEnvelope{EventID: evt.ID, OK: true})
+			for c, ids := range listeners {
+				for _, id := range ids {
+					id := id
+					c.send(&nostr.EventEnvelope{SubscriptionID: &id, Event: evt})
+				}
+			}
+		case *nostr.ReqEnvelope:
+			rl.mu.Lock()
+			rl.subs[conn][env.SubscriptionID] = env.Filters
+			matched := make([]*nostr.Event, 0)
+			for _, evt := range rl.events {
+				if env.Filters.Match(evt) {
+					matched = append(matched, evt)
+				}
+			}
+			rl.mu.Unlock()
+
+			for _, evt := range matched {
+				conn.send(&nostr.EventEnvelope{SubscriptionID: &env.SubscriptionID, Event: *evt})
+			}
+			eose := nostr.EOSEEnvelope(env.SubscriptionID)
+			conn.send(&eose)
+		case *nostr.CloseEnvelope:
+			rl.mu.Lock()
+			delete(rl.subs[conn], string(*env))
+			rl.mu.Unlock()
+		case *nostr.CountEnvelope:
+			if !rl.Count {
+				notice := nostr.NoticeEnvelope("unknown message")
+				conn.send(&notice)
+				continue
+			}
+			rl.answerCount(conn, env)
+		case nil:
+			notice := nostr.NoticeEnvelope("unknown message")
+			conn.send(&notice)
+		}
+	}
+}
+
+// handleNegentropy answers NEG-OPEN and NEG-MSG as the non-initiating side.
+func (rl *testRelay) handleNegentropy(conn *testRelayConn, message []byte) bool {
+	var msg []json.RawMessage
+	var label, subID string
+	if json.Unmarshal(message, &msg) != nil || len(msg) < 2 {
+		return false
+	}
+	json.Unmarshal(msg[0], &label)
+	json.Unmarshal(msg[1], &subID)
+
+	var payload string
+	switch label {
+	case "NEG-OPEN":
+		var filter nostr.Filter
+		json.Unmarshal(msg[2], &filter)
+		json.Unmarshal(msg[3], &payload)
+
+		neg := negentropy.New()
+		matched := 0
+		rl.mu.Lock()
+		for _, evt := range rl.events {
+			if filter.Matches(evt) {
+				neg.Add(int64(evt.CreatedAt), evt.ID)
+				matched++
+			}
+		}
+		rl.mu.Unlock()
+		if rl.NegLimit > 0 && matched > rl.NegLimit {
+			conn.sendRaw("NEG-ERR", subID, "blocked: too many records")
+			return true
+		}
+		conn.neg = neg
+	case "NEG-MSG":
+		json.Unmarshal(msg[2], &payload)
+	case "NEG-CLOSE":
+		conn.neg = nil
+		return true
+	default:
+		return false
+	}
+
+	b, _ := hex.DecodeString(payload)
+	answer, _, _, err := conn.neg.Reconcile(b)
+	if err != nil {
+		conn.sendRaw("NEG-ERR", subID, "error: "+err.Error())
+		return true
+	}
+	conn.sendRaw("NEG-MSG", subID, hex.EncodeToString(answer))
+	return true
+}
+
+func (rl *testRelay) answerCount(conn *testRelayConn, env *nostr.CountEnvelope) {
+	result := map[string]any{}
+	var hll *nip45.HyperLogLog
+	if len(env.Filters) == 1 && len(env.Filters[0].Tags) == 1 {
+		for _, values := range env.Filters[0].Tags {
+			if offset, err := nip45.Offset(values[0]); err == nil && len(values) == 1 {
+				hll = nip45.New(offset)
+			}
+		}
+	}
+
+	count := 0
+	rl.mu.Lock()
+	rl.countConns[conn] = true
+	for _, evt := range rl.events {
+		if env.Filters.Match(evt) {
+			count++
+			if hll != nil {
+				hll.Add(evt.PubKey)
+			}
+		}
+	}
+	rl.mu.Unlock()
+
+	result["count"] = count
+	if hll != nil {
+		result["hll"] = hll.Encode()
+	}
+	conn.sendRaw("COUNT", env.SubscriptionID, result)
+}
@@ -6,11 +6,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/maphash"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 	"unsafe"
 
 	"github.com/arriqaaq/flashdb"
+	"github.com/tidwall/gjson"
 )
 
 // shortUint64 is the same as short(), but returns the result as a uint64 number
@@ -56,3 +60,33 @@ func jsonError(w http.ResponseWriter, msg string, code int) {
 }
 
 func pointerHasher[V any](_ maphash.Seed, k *V) uint64 { return uint64(uintptr(unsafe.Pointer(k))) }
+
+// requestParams reads parameters the way mastodon does: from a json body, a form body
+// or the querystring, since different clients use different ways.
+func requestParams(r *http.Request) (url.Values, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.Form, nil
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	params := r.URL.Query()
+	gjson.ParseBytes(b).ForEach(func(key, value gjson.Result) bool {
+		if value.IsArray() {
+			for _, item := range value.Array() {
+				params.Add(key.String(), item.String())
+			}
+		} else {
+			params.Set(key.String(), value.String())
+		}
+		return true
+	})
+	return params, nil
+}
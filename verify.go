@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const MAX_EVENT_FUTURE_DRIFT = time.Minute * 15
+
+type verifyJob struct {
+	evt  *nostr.Event
+	done chan error
+}
+
+var (
+	verifyJobs      chan verifyJob
+	startVerifiers  sync.Once
+	invalidMu       sync.Mutex
+	invalidPerRelay = make(map[string]int)
+)
+
+// checkEvent does the actual work: the id must be the hash of the serialized event, the
+// signature must be valid for it and it can't be from the future.
+func checkEvent(evt *nostr.Event) error {
+	hash := sha256.Sum256(evt.Serialize())
+	if hex.EncodeToString(hash[:]) != evt.ID {
+		return fmt.Errorf("id doesn't match the event hash")
+	}
+	if ok, err := evt.CheckSignature(); !ok {
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+		return fmt.Errorf("invalid signature")
+	}
+	if evt.CreatedAt.Time().After(time.Now().Add(MAX_EVENT_FUTURE_DRIFT)) {
+		return fmt.Errorf("created_at is too far in the future")
+	}
+	return nil
+}
+
+// verifyEvent checks an event using a fixed number of workers, so a flood of events from
+// relays doesn't take all the CPU.
+func verifyEvent(ctx context.Context, evt *nostr.Event) error {
+	startVerifiers.Do(func() {
+		verifyJobs = make(chan verifyJob)
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go func() {
+				for job := range verifyJobs {
+					job.done <- checkEvent(job.evt)
+				}
+			}()
+		}
+	})
+
+	job := verifyJob{evt, make(chan error, 1)}
+	select {
+	case verifyJobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acceptEvent verifies an event we got from a relay, punishing the relay if it's invalid.
+// it also refuses events that were deleted by their authors or have expired.
+func acceptEvent(ctx context.Context, relay string, evt *nostr.Event) bool {
+	err := verifyEvent(ctx, evt)
+	if err != nil {
+		if ctx.Err() == nil {
+			reportInvalidEvent(relay, evt, err)
+		}
+		return false
+	}
+	return !isGone(ctx, evt)
+}
+
+func reportInvalidEvent(relay string, evt *nostr.Event, err error) {
+	log.Warn().Err(err).Str("relay", relay).Str("id", evt.ID).Msg("relay sent us an invalid event")
+
+	invalidMu.Lock()
+	invalidPerRelay[relay]++
+	invalidMu.Unlock()
+
+	// so we stop preferring this relay for this pubkey
+	if nostr.IsValidPublicKeyHex(evt.PubKey) {
+		go func() {
+			if err := setIfMoreRecent(context.Background(), evt.PubKey, relay, "last_invalid_data", nostr.Now()); err != nil {
+				log.Debug().Err(err).Str("relay", relay).Msg("failed to save invalid data mark")
+			}
+		}()
+	}
+}
+
+// invalidEventsFrom tells how many invalid events a relay has sent us since we started.
+func invalidEventsFrom(relay string) int {
+	invalidMu.Lock()
+	defer invalidMu.Unlock()
+	return invalidPerRelay[relay]
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestVerifyEvent(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	signed := func(mutate func(*nostr.Event)) *nostr.Event {
+		evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "hello"}
+		evt.Sign(sk)
+		if mutate != nil {
+			mutate(evt)
+		}
+		return evt
+	}
+
+	for name, tc := range map[string]struct {
+		evt *nostr.Event
+		ok  bool
+	}{
+		"valid":            {signed(nil), true},
+		"tampered content": {signed(func(e *nostr.Event) { e.Content = "bye" }), false},
+		"id of something else": {signed(func(e *nostr.Event) {
+			e.ID = "0000000000000000000000000000000000000000000000000000000000000000"
+		}), false},
+		"garbage signature": {signed(func(e *nostr.Event) { e.Sig = "xx" }), false},
+		"from the future": {signed(func(e *nostr.Event) {
+			e.CreatedAt = nostr.Timestamp(time.Now().Add(time.Hour).Unix())
+			e.Sign(sk)
+		}), false},
+		"slightly ahead": {signed(func(e *nostr.Event) {
+			e.CreatedAt = nostr.Timestamp(time.Now().Add(time.Minute).Unix())
+			e.Sign(sk)
+		}), true},
+	} {
+		err := verifyEvent(context.Background(), tc.evt)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok=%v, got %v", name, tc.ok, err)
+		}
+	}
+}
+
+func TestAcceptEventCountsInvalid(t *testing.T) {
+	setupTestStorage(t)
+
+	evt := &nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "hello"}
+	evt.Sign(nostr.GeneratePrivateKey())
+	evt.Content = "forged"
+
+	relay := "wss://liar.example.com"
+	before := invalidEventsFrom(relay)
+	if acceptEvent(context.Background(), relay, evt) {
+		t.Fatalf("forged event was accepted")
+	}
+	if invalidEventsFrom(relay) != before+1 {
+		t.Fatalf("invalid event wasn't counted")
+	}
+}
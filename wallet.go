@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+const WALLET_TIMEOUT = time.Second * 60 // payments can take a while to get through
+
+// walletConnection is a NIP-47 wallet we can ask to pay invoices, as given by a
+// nostr+walletconnect://<wallet pubkey>?relay=<relay>&secret=<our key> string.
+type walletConnection struct {
+	pubkey string
+	relay  string
+	secret string
+}
+
+func parseWalletConnect(uri string) (*walletConnection, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nostr+walletconnect" && u.Scheme != "nostrwalletconnect" {
+		return nil, fmt.Errorf("expected a nostr+walletconnect:// url")
+	}
+
+	wc := &walletConnection{
+		pubkey: u.Host,
+		relay:  u.Query().Get("relay"),
+		secret: u.Query().Get("secret"),
+	}
+	if wc.pubkey == "" {
+		wc.pubkey = u.Opaque
+	}
+	if !nostr.IsValidPublicKeyHex(wc.pubkey) {
+		return nil, fmt.Errorf("invalid wallet pubkey '%s'", wc.pubkey)
+	}
+	if r, err := url.Parse(wc.relay); err != nil || (r.Scheme != "wss" && r.Scheme != "ws") || r.Host == "" {
+		return nil, fmt.Errorf("invalid relay '%s'", wc.relay)
+	}
+	if _, err := nostr.GetPublicKey(wc.secret); err != nil || len(wc.secret) != 64 {
+		return nil, fmt.Errorf("invalid secret")
+	}
+	return wc, nil
+}
+
+type walletResponse struct {
+	ResultType string `json:"result_type"`
+	Error      *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Result struct {
+		Preimage string `json:"preimage"`
+	} `json:"result"`
+}
+
+// payInvoice sends a pay_invoice request to the wallet and waits for its answer, returning
+// the preimage, which is only taken as proof of payment if it hashes to the payment hash.
+func (wc *walletConnection) payInvoice(ctx context.Context, invoice string) (string, error) {
+	_, _, paymentHash, err := decodeBolt11(invoice)
+	if err != nil {
+		return "", err
+	}
+	if paymentHash == nil {
+		return "", fmt.Errorf("invoice has no payment hash")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, WALLET_TIMEOUT)
+	defer cancel()
+
+	shared, err := nip04.ComputeSharedSecret(wc.pubkey, wc.secret)
+	if err != nil {
+		return "", err
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"method": "pay_invoice",
+		"params": map[string]any{"invoice": invoice},
+	})
+	content, err := nip04.Encrypt(string(payload), shared)
+	if err != nil {
+		return "", err
+	}
+
+	request := nostr.Event{
+		Kind:      23194,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", wc.pubkey}},
+		Content:   content,
+	}
+	if err := request.Sign(wc.secret); err != nil {
+		return "", err
+	}
+
+	relay, err := ensureRelay(wc.relay)
+	if err != nil {
+		return "", err
+	}
+	// subscribe before sending so a quick answer isn't missed
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{
+		Kinds:   []int{23195},
+		Authors: []string{wc.pubkey},
+		Tags:    nostr.TagMap{"e": []string{request.ID}},
+	}})
+	if err != nil {
+		return "", err
+	}
+	defer sub.Unsub()
+	if _, err := relay.Publish(ctx, request); err != nil {
+		return "", fmt.Errorf("failed to send request to the wallet: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("the wallet didn't answer")
+		case evt, ok := <-sub.Events:
+			if !ok {
+				return "", fmt.Errorf("the wallet relay closed the subscription")
+			}
+			if checkEvent(evt) != nil {
+				continue
+			}
+			plain, err := nip04.Decrypt(evt.Content, shared)
+			if err != nil {
+				continue
+			}
+			var resp walletResponse
+			if err := json.Unmarshal([]byte(plain), &resp); err != nil {
+				return "", fmt.Errorf("the wallet sent an invalid response: %w", err)
+			}
+			if resp.Error != nil {
+				return "", fmt.Errorf("the wallet failed to pay: %s (%s)", resp.Error.Message, resp.Error.Code)
+			}
+			preimage, err := hex.DecodeString(resp.Result.Preimage)
+			if hash := sha256.Sum256(preimage); err != nil || !bytes.Equal(hash[:], paymentHash) {
+				return "", fmt.Errorf("the wallet says it paid, but sent a preimage that isn't for the invoice")
+			}
+			return resp.Result.Preimage, nil
+		}
+	}
+}
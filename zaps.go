@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	ZAP_PARAMS_TTL         = time.Hour
+	ZAP_RECEIPTS_LIMIT     = 100
+	ZAP_REQUEST_RELAYS     = 5
+	BOLT11_SIGNATURE_WORDS = 104 // 65 bytes in 5-bit words, at the end of every invoice
+)
+
+// lnurlPayParams is what a LUD-06 server says about paying someone. zaps are only possible
+// when it allows nostr and tells which key signs the receipts.
+type lnurlPayParams struct {
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	AllowsNostr bool   `json:"allowsNostr"`
+	NostrPubkey string `json:"nostrPubkey"`
+
+	lnurl string // bech32-encoded, sent back to the callback
+}
+
+// zap is a receipt we validated.
+type zap struct {
+	ID        string          `db:"id"`
+	Recipient string          `db:"recipient"`
+	Sender    string          `db:"sender"`
+	EventID   string          `db:"event_id"`
+	Amount    int64           `db:"amount"` // millisatoshis
+	Comment   string          `db:"comment"`
+	CreatedAt nostr.Timestamp `db:"created_at"`
+}
+
+// zapPayment is what the zap endpoint returns.
+type zapPayment struct {
+	Amount   int64  `json:"amount"` // sats
+	Invoice  string `json:"invoice"`
+	Preimage string `json:"preimage"`
+}
+
+// lnurlFromProfile gives the LNURL-pay url of someone, from their lightning address (LUD-16)
+// or their bech32 LNURL (LUD-06).
+func lnurlFromProfile(profile *Profile) (string, error) {
+	if name, domain, ok := strings.Cut(profile.LUD16, "@"); ok && name != "" && domain != "" {
+		scheme := "https"
+		host, _, err := net.SplitHostPort(domain)
+		if err != nil {
+			host = domain
+		}
+		if ip := net.ParseIP(host); strings.HasSuffix(host, ".onion") || host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			scheme = "http"
+		}
+		return scheme + "://" + domain + "/.well-known/lnurlp/" + url.PathEscape(name), nil
+	}
+
+	if profile.LUD06 != "" {
+		hrp, data, err := bech32.DecodeNoLimit(strings.ToLower(profile.LUD06))
+		if err != nil || hrp != "lnurl" {
+			return "", fmt.Errorf("invalid lud06 '%s'", profile.LUD06)
+		}
+		b, err := bech32.ConvertBits(data, 5, 8, false)
+		if err != nil {
+			return "", fmt.Errorf("invalid lud06 '%s'", profile.LUD06)
+		}
+		return string(b), nil
+	}
+
+	return "", fmt.Errorf("no lightning address")
+}
+
+func encodeLNURL(u string) string {
+	data, _ := bech32.ConvertBits([]byte(u), 8, 5, true)
+	lnurl, _ := bech32.Encode("lnurl", data)
+	return lnurl
+}
+
+// fetchZapParams gets the LNURL-pay parameters of someone and checks that they can be zapped.
+// failures are cached for a while like missing profiles are.
+func fetchZapParams(ctx context.Context, pubkey string) (*lnurlPayParams, error) {
+	if params, ok := zapParamsCache.Get(pubkey); ok {
+		if params.Callback == "" {
+			return nil, fmt.Errorf("can't zap %s, tried recently", pubkey)
+		}
+		return params, nil
+	}
+
+	params, err := func() (*lnurlPayParams, error) {
+		profile := loadProfile(ctx, pubkey)
+		if profile == nil {
+			return nil, fmt.Errorf("no profile")
+		}
+		u, err := lnurlFromProfile(profile)
+		if err != nil {
+			return nil, err
+		}
+		params := &lnurlPayParams{}
+		if err := fetchJSON(ctx, u, "application/json", params); err != nil {
+			return nil, err
+		}
+		if params.Callback == "" {
+			return nil, fmt.Errorf("%s has no callback", u)
+		}
+		if !params.AllowsNostr || !nostr.IsValidPublicKeyHex(params.NostrPubkey) {
+			return nil, fmt.Errorf("%s doesn't support zaps", u)
+		}
+		params.lnurl = encodeLNURL(u)
+		return params, nil
+	}()
+	if err != nil {
+		log.Debug().Err(err).Str("pubkey", pubkey).Msg("failed to fetch zap params, storing nil on cache")
+		zapParamsCache.SetWithTTL(pubkey, &lnurlPayParams{}, 1, CACHE_TTL_NOT_FOUND)
+		return nil, err
+	}
+	zapParamsCache.SetWithTTL(pubkey, params, 1, ZAP_PARAMS_TTL)
+	return params, nil
+}
+
+// decodeBolt11 gets the amount in millisatoshis, the description hash and the payment hash out
+// of an invoice. its signature isn't checked: what makes a zap receipt trustworthy is who
+// signed it.
+func decodeBolt11(invoice string) (msats int64, descriptionHash []byte, paymentHash []byte, err error) {
+	hrp, data, err := bech32.DecodeNoLimit(strings.ToLower(invoice))
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid invoice: %w", err)
+	}
+	if !strings.HasPrefix(hrp, "ln") {
+		return 0, nil, nil, fmt.Errorf("invalid invoice prefix '%s'", hrp)
+	}
+
+	// lnbc2500u, lntb20m etc
+	i := strings.IndexAny(hrp, "0123456789")
+	if i == -1 {
+		return 0, nil, nil, fmt.Errorf("invoice has no amount")
+	}
+	amount := hrp[i:]
+	multiplier := amount[len(amount)-1]
+	if multiplier >= '0' && multiplier <= '9' {
+		multiplier = 0
+	} else {
+		amount = amount[:len(amount)-1]
+	}
+	n, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid invoice amount '%s'", hrp[i:])
+	}
+	switch multiplier {
+	case 0:
+		msats = n * 100_000_000_000
+	case 'm':
+		msats = n * 100_000_000
+	case 'u':
+		msats = n * 100_000
+	case 'n':
+		msats = n * 100
+	case 'p':
+		if n%10 != 0 {
+			return 0, nil, nil, fmt.Errorf("invoice amount isn't a whole millisatoshi")
+		}
+		msats = n / 10
+	default:
+		return 0, nil, nil, fmt.Errorf("invalid invoice amount '%s'", hrp[i:])
+	}
+
+	// a 35-bit timestamp, then tagged fields of type, 10-bit length and data
+	if len(data) < 7+BOLT11_SIGNATURE_WORDS {
+		return 0, nil, nil, fmt.Errorf("invoice is too short")
+	}
+	fields := data[7 : len(data)-BOLT11_SIGNATURE_WORDS]
+	for len(fields) >= 3 {
+		typ, length := fields[0], int(fields[1])<<5|int(fields[2])
+		if len(fields) < 3+length {
+			return 0, nil, nil, fmt.Errorf("invoice has a truncated field")
+		}
+		if typ == 23 && length == 52 { // 'h'
+			descriptionHash, _ = bech32.ConvertBits(fields[3:3+length], 5, 8, false)
+		}
+		if typ == 1 && length == 52 { // 'p'
+			paymentHash, _ = bech32.ConvertBits(fields[3:3+length], 5, 8, false)
+		}
+		fields = fields[3+length:]
+	}
+
+	return msats, descriptionHash, paymentHash, nil
+}
+
+// validateZapReceipt checks a kind 9735 like NIP-57 says: it must be signed by the key the
+// recipient's LNURL server zaps with and carry a valid zap request whose amount is the one
+// of the invoice that was paid.
+func validateZapReceipt(ctx context.Context, receipt *nostr.Event) (*zap, error) {
+	if receipt.Kind != 9735 {
+		return nil, fmt.Errorf("not a zap receipt")
+	}
+	p := receipt.Tags.GetFirst([]string{"p", ""})
+	bolt11 := receipt.Tags.GetFirst([]string{"bolt11", ""})
+	description := receipt.Tags.GetFirst([]string{"description", ""})
+	if p == nil || bolt11 == nil || description == nil {
+		return nil, fmt.Errorf("missing p, bolt11 or description")
+	}
+	recipient := (*p)[1]
+
+	var request nostr.Event
+	if err := json.Unmarshal([]byte((*description)[1]), &request); err != nil {
+		return nil, fmt.Errorf("invalid zap request: %w", err)
+	}
+	if request.Kind != 9734 {
+		return nil, fmt.Errorf("zap request has kind %d", request.Kind)
+	}
+	if err := checkEvent(&request); err != nil {
+		return nil, fmt.Errorf("invalid zap request: %w", err)
+	}
+	if ps := request.Tags.GetAll([]string{"p", ""}); len(ps) != 1 || ps[0][1] != recipient {
+		return nil, fmt.Errorf("zap request isn't for %s", recipient)
+	}
+
+	var eventID string
+	if e := request.Tags.GetFirst([]string{"e", ""}); e != nil {
+		eventID = (*e)[1]
+	}
+	if e := receipt.Tags.GetFirst([]string{"e", ""}); (e == nil && eventID != "") || (e != nil && (*e)[1] != eventID) {
+		return nil, fmt.Errorf("receipt and zap request are for different events")
+	}
+
+	msats, descriptionHash, _, err := decodeBolt11((*bolt11)[1])
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte((*description)[1]))
+	if !bytes.Equal(descriptionHash, hash[:]) {
+		return nil, fmt.Errorf("invoice wasn't made for this zap request")
+	}
+	if amount := request.Tags.GetFirst([]string{"amount", ""}); amount != nil && (*amount)[1] != strconv.FormatInt(msats, 10) {
+		return nil, fmt.Errorf("zap request asked for %s msats, invoice is for %d", (*amount)[1], msats)
+	}
+
+	params, err := fetchZapParams(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.PubKey != params.NostrPubkey {
+		return nil, fmt.Errorf("receipt wasn't signed by the zapper of %s", recipient)
+	}
+
+	return &zap{
+		ID:        receipt.ID,
+		Recipient: recipient,
+		Sender:    request.PubKey,
+		EventID:   eventID,
+		Amount:    msats,
+		Comment:   request.Content,
+		CreatedAt: receipt.CreatedAt,
+	}, nil
+}
+
+// ingestZapReceipt handles a zap receipt that came from a relay, it becomes a notification
+// when it's for one of our identities.
+func ingestZapReceipt(ctx context.Context, relay string, receipt *nostr.Event) {
+	var known bool
+	if err := db.GetContext(ctx, &known, `SELECT EXISTS (SELECT 1 FROM zaps WHERE id = $1)`, receipt.ID); err != nil || known {
+		return
+	}
+	if !acceptEvent(ctx, relay, receipt) {
+		return
+	}
+	z, err := validateZapReceipt(ctx, receipt)
+	if err != nil {
+		log.Debug().Err(err).Str("relay", relay).Str("id", receipt.ID).Msg("invalid zap receipt")
+		return
+	}
+	if err := saveZap(ctx, z, receipt); err != nil {
+		log.Warn().Err(err).Str("id", receipt.ID).Msg("failed to save zap")
+	}
+}
+
+func saveZap(ctx context.Context, z *zap, receipt *nostr.Event) error {
+	saveEvent(ctx, receipt)
+
+	if _, err := db.NamedExecContext(ctx, `
+INSERT INTO zaps (id, recipient, sender, event_id, amount, comment, created_at)
+VALUES (:id, :recipient, :sender, :event_id, :amount, :comment, :created_at)
+ON CONFLICT (id) DO NOTHING
+    `, z); err != nil {
+		return err
+	}
+	if z.EventID != "" {
+		eventCountsCache.Delete(z.EventID)
+	}
+
+	if getIdentityByPubkey(z.Recipient) == nil || z.Sender == z.Recipient {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, `
+INSERT INTO notifications (id, pubkey, type, account, status_id, created_at)
+VALUES ($1, $2, 'zap', $3, $4, $5)
+ON CONFLICT (id, pubkey) DO NOTHING
+    `, z.ID, z.Recipient, z.Sender, z.EventID, z.CreatedAt)
+	return err
+}
+
+// zapsAmount is the sum in millisatoshis of the zaps we know an event got.
+func zapsAmount(ctx context.Context, eventID string) int64 {
+	var msats int64
+	db.GetContext(ctx, &msats, `SELECT coalesce(sum(amount), 0) FROM zaps WHERE event_id = $1`, eventID)
+	return msats
+}
+
+// fetchZapReceipts gets the zaps of an event from the relays where its author is zapped.
+func fetchZapReceipts(ctx context.Context, eventID string, relays []string) {
+	filter := nostr.Filter{
+		Kinds: []int{9735},
+		Tags:  nostr.TagMap{"e": []string{eventID}},
+		Limit: ZAP_RECEIPTS_LIMIT,
+	}
+
+	wg := sync.WaitGroup{}
+	for _, url := range relays {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			relay, err := ensureRelay(url)
+			if err != nil {
+				return
+			}
+			receipts, err := relay.QuerySync(ctx, filter)
+			if err != nil {
+				log.Debug().Err(err).Str("relay", url).Msg("failed to fetch zap receipts")
+			}
+			for _, receipt := range receipts {
+				ingestZapReceipt(ctx, url, receipt)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+// watchZaps listens for zap receipts to us on our read relays, picking up from the latest one
+// we have whenever a relay drops us.
+func (id *Identity) watchZaps(ctx context.Context) {
+	filter := func() nostr.Filter {
+		since := nostr.Now() - nostr.Timestamp(getConfig().BackfillDays*24*60*60)
+		var latest nostr.Timestamp
+		if err := db.GetContext(ctx, &latest, `SELECT coalesce(max(created_at), 0) FROM zaps WHERE recipient = $1`, id.pubkey); err == nil && latest > since {
+			since = latest
+		}
+		return nostr.Filter{Kinds: []int{9735}, Tags: nostr.TagMap{"p": []string{id.pubkey}}, Since: &since}
+	}
+
+	wg := sync.WaitGroup{}
+	for i, url := range id.readRelays {
+		if slices.Contains(id.readRelays[0:i], url) {
+			continue
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			keepSubscribed(ctx, url, "zaps", filter, func(receipt *nostr.Event) {
+				ingestZapReceipt(ctx, url, receipt)
+			})
+		}(url)
+	}
+	wg.Wait()
+}
+
+// zap pays someone, for one of their events if target isn't nil. the zap request asks for
+// the receipt to be published on our read relays and on the inbox relays of the recipient.
+func (id *Identity) zap(ctx context.Context, wallet *walletConnection, params *lnurlPayParams,
+	recipient string, target *nostr.Event, msats int64, comment string,
+) (*zapPayment, error) {
+	if msats < params.MinSendable || (params.MaxSendable > 0 && msats > params.MaxSendable) {
+		return nil, fmt.Errorf("amount must be between %d and %d sats", params.MinSendable/1000, params.MaxSendable/1000)
+	}
+
+	relays := nostr.Tag{"relays"}
+	for _, relay := range append(append([]string{}, id.readRelays...),
+		fetchInboxRelaysForUser(ctx, recipient, ZAP_REQUEST_RELAYS, false)...) {
+		if !slices.Contains(relays[1:], relay) {
+			relays = append(relays, relay)
+		}
+	}
+	request := &nostr.Event{
+		Kind:      9734,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			relays,
+			{"amount", strconv.FormatInt(msats, 10)},
+			{"lnurl", params.lnurl},
+			{"p", recipient},
+		},
+		Content: comment,
+	}
+	if target != nil {
+		request.Tags = append(request.Tags, nostr.Tag{"e", target.ID})
+	}
+	if err := id.signer.SignEvent(ctx, request); err != nil {
+		return nil, fmt.Errorf("failed to sign zap request: %w", err)
+	}
+	requestJSON, _ := json.Marshal(request)
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback: %w", err)
+	}
+	qs := callback.Query()
+	qs.Set("amount", strconv.FormatInt(msats, 10))
+	qs.Set("nostr", string(requestJSON))
+	qs.Set("lnurl", params.lnurl)
+	callback.RawQuery = qs.Encode()
+
+	var invoice struct {
+		PR     string `json:"pr"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := fetchJSON(ctx, callback.String(), "application/json", &invoice); err != nil {
+		return nil, fmt.Errorf("failed to get invoice: %w", err)
+	}
+	if invoice.Status == "ERROR" {
+		return nil, fmt.Errorf("failed to get invoice: %s", invoice.Reason)
+	}
+
+	// don't pay anything but what we asked for
+	amount, descriptionHash, _, err := decodeBolt11(invoice.PR)
+	if err != nil {
+		return nil, err
+	}
+	if amount != msats {
+		return nil, fmt.Errorf("got an invoice for %d msats instead of %d", amount, msats)
+	}
+	hash := sha256.Sum256(requestJSON)
+	if !bytes.Equal(descriptionHash, hash[:]) {
+		return nil, fmt.Errorf("got an invoice that isn't for our zap request")
+	}
+
+	preimage, err := wallet.payInvoice(ctx, invoice.PR)
+	if err != nil {
+		return nil, err
+	}
+	return &zapPayment{Amount: msats / 1000, Invoice: invoice.PR, Preimage: preimage}, nil
+}
+
+// zapHandler zaps a status or an account with the wallet in wallet_connect.
+func zapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, "use POST", 405)
+		return
+	}
+	if getConfig().WalletConnect == "" {
+		jsonError(w, "no wallet_connect configured", 503)
+		return
+	}
+	wallet, err := parseWalletConnect(getConfig().WalletConnect)
+	if err != nil {
+		jsonError(w, "invalid wallet_connect: "+err.Error(), 503)
+		return
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		jsonError(w, "wrong body: "+err.Error(), 400)
+		return
+	}
+	sats, err := strconv.ParseInt(params.Get("amount"), 10, 64)
+	if err != nil || sats < 1 {
+		jsonError(w, "amount must be a positive number of sats", 422)
+		return
+	}
+
+	var target *nostr.Event
+	recipient := params.Get("account_id")
+	if id := params.Get("status_id"); id != "" {
+		if target = loadEvent(r.Context(), id, nil, nil); target == nil {
+			jsonError(w, "status not found", 404)
+			return
+		}
+		recipient = target.PubKey
+	}
+	if !nostr.IsValidPublicKeyHex(recipient) {
+		jsonError(w, "status_id or account_id is required", 422)
+		return
+	}
+
+	lnurl, err := fetchZapParams(r.Context(), recipient)
+	if err != nil {
+		jsonError(w, "can't zap: "+err.Error(), 422)
+		return
+	}
+
+	payment, err := getIdentity(r.Context()).zap(r.Context(), wallet, lnurl, recipient, target, sats*1000, params.Get("comment"))
+	if err != nil {
+		jsonError(w, "failed to zap: "+err.Error(), 502)
+		return
+	}
+	json.NewEncoder(w).Encode(payment)
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil/bech32"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// testInvoice makes a bolt11 invoice with a payment hash, a description hash and a fake
+// signature, which is all we look at.
+func testInvoice(msats int64, description string) string {
+	hash := sha256.Sum256([]byte(description))
+	paymentHash := sha256.Sum256(testPreimage(hash[:]))
+	data := make([]byte, 7) // timestamp
+	for _, field := range []struct {
+		typ   byte
+		value []byte
+	}{{1, paymentHash[:]}, {23, hash[:]}} {
+		words, _ := bech32.ConvertBits(field.value, 8, 5, true)
+		data = append(data, field.typ, byte(len(words)>>5), byte(len(words)&31))
+		data = append(data, words...)
+	}
+	data = append(data, make([]byte, BOLT11_SIGNATURE_WORDS)...)
+	invoice, _ := bech32.Encode(fmt.Sprintf("lnbc%dp", msats*10), data)
+	return invoice
+}
+
+// testPreimage is what pays a testInvoice, it comes from the description hash so the test
+// wallet can find it from the invoice alone.
+func testPreimage(descriptionHash []byte) []byte {
+	preimage := sha256.Sum256(append([]byte("preimage"), descriptionHash...))
+	return preimage[:]
+}
+
+// testLNURLServer is a stand-in for a lightning address provider that supports zaps.
+type testLNURLServer struct {
+	host string
+	sk   string
+	pk   string
+
+	mu       sync.Mutex
+	requests []string // zap requests the callback got
+}
+
+func startTestLNURLServer(t *testing.T) *testLNURLServer {
+	ln := &testLNURLServer{sk: nostr.GeneratePrivateKey()}
+	ln.pk, _ = nostr.GetPublicKey(ln.sk)
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	ln.host = strings.TrimPrefix(server.URL, "http://")
+
+	mux.HandleFunc("/.well-known/lnurlp/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"tag":         "payRequest",
+			"callback":    server.URL + "/callback",
+			"minSendable": 1000,
+			"maxSendable": 100_000_000,
+			"allowsNostr": true,
+			"nostrPubkey": ln.pk,
+		})
+	})
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		msats, _ := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		request := r.URL.Query().Get("nostr")
+		ln.mu.Lock()
+		ln.requests = append(ln.requests, request)
+		ln.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"pr": testInvoice(msats, request), "routes": []any{}})
+	})
+
+	return ln
+}
+
+func (ln *testLNURLServer) receipt(request *nostr.Event, msats int64) *nostr.Event {
+	description, _ := json.Marshal(request)
+	receipt := &nostr.Event{
+		Kind:      9735,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", request.Tags.GetFirst([]string{"p", ""}).Value()},
+			{"bolt11", testInvoice(msats, string(description))},
+			{"description", string(description)},
+		},
+	}
+	if e := request.Tags.GetFirst([]string{"e", ""}); e != nil {
+		receipt.Tags = append(receipt.Tags, nostr.Tag{"e", e.Value()})
+	}
+	receipt.Sign(ln.sk)
+	return receipt
+}
+
+// testWallet is a stand-in for a NIP-47 wallet service, it pays every invoice up to a limit.
+type testWallet struct {
+	sk     string
+	pubkey string
+	limit  int64 // msats
+
+	mu          sync.Mutex
+	paid        []string
+	badPreimage bool // answer with a preimage that isn't for the invoice
+}
+
+func startTestWallet(t *testing.T, relay *testRelay, limit int64) *testWallet {
+	tw := &testWallet{sk: nostr.GeneratePrivateKey(), limit: limit}
+	tw.pubkey, _ = nostr.GetPublicKey(tw.sk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go keepSubscribed(ctx, relay.URL, "test-wallet", func() nostr.Filter {
+		return nostr.Filter{Kinds: []int{23194}, Tags: nostr.TagMap{"p": []string{tw.pubkey}}}
+	}, func(evt *nostr.Event) {
+		tw.handle(ctx, relay, evt)
+	})
+
+	return tw
+}
+
+func (tw *testWallet) handle(ctx context.Context, relay *testRelay, evt *nostr.Event) {
+	key, _ := nip04.ComputeSharedSecret(evt.PubKey, tw.sk)
+	plaintext, err := nip04.Decrypt(evt.Content, key)
+	if err != nil {
+		return
+	}
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			Invoice string `json:"invoice"`
+		} `json:"params"`
+	}
+	json.Unmarshal([]byte(plaintext), &req)
+
+	resp := map[string]any{"result_type": req.Method}
+	if msats, h, _, err := decodeBolt11(req.Params.Invoice); err != nil || msats > tw.limit {
+		resp["error"] = map[string]any{"code": "INSUFFICIENT_BALANCE", "message": "not enough sats"}
+	} else {
+		tw.mu.Lock()
+		tw.paid = append(tw.paid, req.Params.Invoice)
+		preimage := testPreimage(h)
+		if tw.badPreimage {
+			preimage = testPreimage(nil)
+		}
+		tw.mu.Unlock()
+		resp["result"] = map[string]any{"preimage": hex.EncodeToString(preimage)}
+	}
+
+	j, _ := json.Marshal(resp)
+	content, _ := nip04.Encrypt(string(j), key)
+	answer := nostr.Event{
+		Kind:      23195,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", evt.PubKey}, {"e", evt.ID}},
+		Content:   content,
+	}
+	answer.Sign(tw.sk)
+
+	r, _ := ensureRelay(relay.URL)
+	r.Publish(ctx, answer)
+}
+
+// setupZapTest gets everything toStatus and fetchZapParams need without leaving the machine.
+func setupZapTest(t *testing.T, mutate func(*Config)) *testRelay {
+	setupTestStorage(t)
+
+	relay := startTestRelay(t)
+	setTestConfig(t, func(cfg *Config) {
+		cfg.DefaultRelays = []string{relay.URL}
+		if mutate != nil {
+			mutate(cfg)
+		}
+	})
+	setContactListRelays(t, relay.URL)
+
+	t.Cleanup(waitForCountRefreshes)
+	return relay
+}
+
+func TestDecodeBolt11(t *testing.T) {
+	hash := sha256.Sum256([]byte("zap"))
+	words, _ := bech32.ConvertBits([]byte("short"), 8, 5, true)
+	noAmount, _ := bech32.Encode("lnbc", append(words, make([]byte, BOLT11_SIGNATURE_WORDS)...))
+	fraction, _ := bech32.Encode("lnbc21p", append(words, make([]byte, BOLT11_SIGNATURE_WORDS)...))
+	payment := sha256.Sum256(testPreimage(hash[:]))
+	example, _ := hex.DecodeString("0001020304050607080900010203040506070809000102030405060708090102")
+	for _, tc := range []struct {
+		invoice string
+		msats   int64
+		hash    []byte
+		payment []byte
+		fails   bool
+	}{
+		// from the BOLT-11 examples, with a "d" description instead of "h"
+		{invoice: "lnbc2500u1pvjluezpp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpuaztrnwngzn3kdzw5hydlzf03qdgm2hdq27cqv3agm2awhz5se903vruatfhq77w3ls4evs3ch9zw97j25emudupq63nyw24cg27h2rspfj9srp", msats: 250_000_000, payment: example},
+		{invoice: testInvoice(21_000, "zap"), msats: 21_000, hash: hash[:], payment: payment[:]},
+		{invoice: strings.ToUpper(testInvoice(1, "zap")), msats: 1, hash: hash[:], payment: payment[:]},
+		{invoice: noAmount, fails: true},
+		{invoice: strings.Replace(testInvoice(21_000, "zap"), "lnbc210000p", "lnbc210001p", 1), fails: true}, // checksum
+		{invoice: fraction, fails: true},
+		{invoice: encodeLNURL("https://example.com"), fails: true},
+	} {
+		msats, h, p, err := decodeBolt11(tc.invoice)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("expected %s to fail", tc.invoice)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to decode %s: %s", tc.invoice, err)
+			continue
+		}
+		if msats != tc.msats || string(h) != string(tc.hash) || string(p) != string(tc.payment) {
+			t.Errorf("%s: expected %d, %x and %x, got %d, %x and %x", tc.invoice, tc.msats, tc.hash, tc.payment, msats, h, p)
+		}
+	}
+}
+
+func TestZapReceipts(t *testing.T) {
+	ctx := context.Background()
+	relay := setupZapTest(t, nil)
+	ln := startTestLNURLServer(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	me := &Identity{pubkey: pk, readRelays: []string{relay.URL}}
+	previous := identities
+	identities = []*Identity{me}
+	t.Cleanup(func() { identities = previous })
+
+	bobSk := nostr.GeneratePrivateKey()
+	bob, _ := nostr.GetPublicKey(bobSk)
+	sign := func(sk string, evt *nostr.Event) *nostr.Event {
+		evt.CreatedAt = nostr.Now()
+		evt.Sign(sk)
+		return evt
+	}
+	saveEvent(ctx, sign(sk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "me", "lud16": "me@` + ln.host + `"}`}))
+	saveEvent(ctx, sign(bobSk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "bob"}`}))
+	note := sign(sk, &nostr.Event{Kind: 1, Tags: nostr.Tags{}, Content: "zap me"})
+	saveEvent(ctx, note)
+
+	zapRequest := func(recipient string, msats int64, tags ...nostr.Tag) *nostr.Event {
+		return sign(bobSk, &nostr.Event{Kind: 9734, Content: "great note", Tags: append(nostr.Tags{
+			{"relays", relay.URL},
+			{"amount", strconv.FormatInt(msats, 10)},
+			{"p", recipient},
+		}, tags...)})
+	}
+
+	// none of these are zaps of 21 sats
+	request := zapRequest(pk, 21_000, nostr.Tag{"e", note.ID})
+	forged := ln.receipt(request, 21_000)
+	forged.Sign(bobSk)
+	otherRequest := zapRequest(pk, 21_000, nostr.Tag{"e", note.ID})
+	otherRequest.Content = "another"
+	otherRequest.Sign(bobSk)
+	swapped := ln.receipt(request, 21_000)
+	swapped.Tags[1][1] = ln.receipt(otherRequest, 21_000).Tags[1][1]
+	swapped.Sign(ln.sk)
+	retargeted := ln.receipt(request, 21_000)
+	retargeted.Tags[3][1] = bob
+	retargeted.Sign(ln.sk)
+	tampered := ln.receipt(request, 21_000)
+	tampered.Tags[2][1] = strings.Replace(tampered.Tags[2][1], "great", "grate", 1)
+	tampered.Sign(ln.sk)
+	for name, receipt := range map[string]*nostr.Event{
+		"signed by someone else":     forged,
+		"amount differs":             ln.receipt(request, 1_000),
+		"invoice for another":        swapped,
+		"for another event":          retargeted,
+		"tampered zap request":       tampered,
+		"zap request for someone":    ln.receipt(zapRequest(bob, 21_000), 21_000),
+		"zap request for two people": ln.receipt(sign(bobSk, &nostr.Event{Kind: 9734, Tags: nostr.Tags{{"p", pk}, {"p", bob}}}), 21_000),
+	} {
+		if _, err := validateZapReceipt(ctx, receipt); err == nil {
+			t.Errorf("%s: receipt should be invalid", name)
+		}
+	}
+
+	// a valid one from a relay
+	receipt := ln.receipt(request, 21_000)
+	relay.events = append(relay.events, receipt)
+	fetchZapReceipts(ctx, note.ID, []string{relay.URL})
+	// and another one we got twice
+	another := ln.receipt(zapRequest(pk, 100_000), 100_000)
+	ingestZapReceipt(ctx, relay.URL, another)
+	ingestZapReceipt(ctx, relay.URL, another)
+
+	if status := toStatus(ctx, note); status.Pleroma.ZapsAmount != 21 {
+		t.Errorf("expected 21 sats zapped to the note, got %d", status.Pleroma.ZapsAmount)
+	}
+
+	rctx := context.WithValue(ctx, identityContextKey{}, me)
+	list := func(target string) []Notification {
+		w := httptest.NewRecorder()
+		notificationsHandler(w, httptest.NewRequest("GET", target, nil).WithContext(rctx))
+		var notifications []Notification
+		if err := json.Unmarshal(w.Body.Bytes(), &notifications); err != nil {
+			t.Fatalf("invalid response %s: %s", w.Body.String(), err)
+		}
+		return notifications
+	}
+
+	notifications := list("/api/v1/notifications")
+	if len(notifications) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(notifications))
+	}
+	byID := map[string]Notification{}
+	for _, n := range notifications {
+		if n.Type != "zap" || n.Account.ID != bob || n.Zap == nil {
+			t.Errorf("unexpected notification %+v", n)
+			continue
+		}
+		byID[n.ID] = n
+	}
+	if n := byID[receipt.ID]; n.Zap == nil || n.Zap.Amount != 21 || n.Zap.Comment != "great note" ||
+		n.Status == nil || n.Status.ID != note.ID {
+		t.Errorf("unexpected notification for the note %+v", n)
+	}
+	if n := byID[another.ID]; n.Zap == nil || n.Zap.Amount != 100 || n.Status != nil {
+		t.Errorf("unexpected notification for the profile %+v", n)
+	}
+
+	if page := list("/api/v1/notifications?limit=1&max_id=" + notifications[0].ID); len(page) != 1 || page[0].ID != notifications[1].ID {
+		t.Errorf("expected the second notification on the next page, got %v", page)
+	}
+	if page := list("/api/v1/notifications?exclude_types[]=zap"); len(page) != 0 {
+		t.Errorf("expected zaps to be excluded, got %v", page)
+	}
+}
+
+func TestWatchZaps(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	relay := setupZapTest(t, nil)
+	ln := startTestLNURLServer(t)
+
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	profile := &nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: `{"lud16": "me@` + ln.host + `"}`}
+	profile.Sign(sk)
+	saveEvent(ctx, profile)
+	me := &Identity{pubkey: pk, readRelays: []string{relay.URL, relay.URL}}
+
+	receipt := func(comment string) *nostr.Event {
+		request := &nostr.Event{Kind: 9734, CreatedAt: nostr.Now(), Content: comment, Tags: nostr.Tags{{"p", pk}}}
+		request.Sign(nostr.GeneratePrivateKey())
+		return ln.receipt(request, 21_000)
+	}
+	waitFor := func(receipt *nostr.Event) {
+		for {
+			var known bool
+			db.GetContext(ctx, &known, `SELECT EXISTS (SELECT 1 FROM zaps WHERE id = $1)`, receipt.ID)
+			if known {
+				return
+			}
+			if ctx.Err() != nil {
+				t.Fatalf("zap %s never arrived", receipt.Content)
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+
+	wctx, stop := context.WithCancel(ctx)
+	t.Cleanup(stop)
+	go me.watchZaps(wctx)
+	time.Sleep(time.Millisecond * 200)
+
+	first := receipt("first")
+	r, _ := ensureRelay(relay.URL)
+	r.Publish(ctx, *first)
+	waitFor(first)
+
+	// sent while the relay had dropped us
+	relay.Drop()
+	second := receipt("second")
+	relay.mu.Lock()
+	relay.events = append(relay.events, second)
+	relay.mu.Unlock()
+	waitFor(second)
+}
+
+func TestZapHandler(t *testing.T) {
+	ctx := context.Background()
+	ln := startTestLNURLServer(t)
+	walletRelay := startTestRelay(t)
+	wallet := startTestWallet(t, walletRelay, 50_000)
+	secret := fmt.Sprintf("%064s", nostr.GeneratePrivateKey()) // it's shorter when it starts with zeros
+	relay := setupZapTest(t, func(cfg *Config) {
+		cfg.WalletConnect = "nostr+walletconnect://" + wallet.pubkey + "?relay=" + url.QueryEscape(walletRelay.URL) + "&secret=" + secret
+	})
+
+	sk := nostr.GeneratePrivateKey()
+	signer, _ := newKeySigner(sk)
+	me := &Identity{signer: signer, readRelays: []string{relay.URL}}
+	me.pubkey, _ = nostr.GetPublicKey(sk)
+	rctx := context.WithValue(ctx, identityContextKey{}, me)
+
+	aliceSk := nostr.GeneratePrivateKey()
+	alice, _ := nostr.GetPublicKey(aliceSk)
+	sign := func(sk string, evt *nostr.Event) *nostr.Event {
+		evt.CreatedAt = nostr.Now()
+		evt.Sign(sk)
+		saveEvent(ctx, evt)
+		return evt
+	}
+	sign(aliceSk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "alice", "lud16": "alice@` + ln.host + `"}`})
+	note := sign(aliceSk, &nostr.Event{Kind: 1, Tags: nostr.Tags{}, Content: "hello"})
+	carolSk := nostr.GeneratePrivateKey()
+	carol, _ := nostr.GetPublicKey(carolSk)
+	sign(carolSk, &nostr.Event{Kind: 0, Tags: nostr.Tags{}, Content: `{"name": "carol"}`})
+
+	zap := func(form string) (int, map[string]string) {
+		r := httptest.NewRequest("POST", "/api/bisu/zap", strings.NewReader(form)).WithContext(rctx)
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		zapHandler(w, r)
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := zap("status_id=" + note.ID + "&amount=21&comment=nice")
+	if code != 200 {
+		t.Fatalf("zap failed with %d: %v", code, resp)
+	}
+	if _, h, _, _ := decodeBolt11(resp["invoice"]); resp["preimage"] != hex.EncodeToString(testPreimage(h)) {
+		t.Errorf("unexpected preimage %s", resp["preimage"])
+	}
+	wallet.mu.Lock()
+	if len(wallet.paid) != 1 || wallet.paid[0] != resp["invoice"] {
+		t.Errorf("the wallet should have paid %s, paid %v", resp["invoice"], wallet.paid)
+	}
+	wallet.mu.Unlock()
+
+	var request nostr.Event
+	ln.mu.Lock()
+	json.Unmarshal([]byte(ln.requests[0]), &request)
+	ln.mu.Unlock()
+	if request.Kind != 9734 || request.PubKey != me.pubkey || request.Content != "nice" || checkEvent(&request) != nil {
+		t.Errorf("invalid zap request %s", ln.requests[0])
+	}
+	for _, tag := range []nostr.Tag{{"p", alice}, {"e", note.ID}, {"amount", "21000"}} {
+		if got := request.Tags.GetFirst([]string{tag[0], ""}); got == nil || got.Value() != tag[1] {
+			t.Errorf("zap request should have %v, got %v", tag, request.Tags)
+		}
+	}
+	if relays := request.Tags.GetFirst([]string{"relays", ""}); relays == nil || (*relays)[1] != relay.URL {
+		t.Errorf("zap request should ask for the receipt on our relays, got %v", relays)
+	}
+
+	for _, tc := range []struct {
+		form string
+		code int
+	}{
+		{"account_id=" + alice + "&amount=10", 200},
+		{"account_id=" + alice + "&amount=100", 502}, // more than the wallet has
+		{"account_id=" + alice + "&amount=0", 422},
+		{"account_id=" + alice, 422},
+		{"account_id=" + carol + "&amount=10", 422}, // no lightning address
+		{"status_id=" + strings.Repeat("0", 64) + "&amount=10", 404},
+		{"amount=10", 422},
+	} {
+		if code, resp := zap(tc.form); code != tc.code {
+			t.Errorf("%s: expected %d, got %d: %v", tc.form, tc.code, code, resp)
+		}
+	}
+
+	// a wallet that can't prove it paid
+	wallet.mu.Lock()
+	wallet.badPreimage = true
+	wallet.mu.Unlock()
+	if code, resp := zap("account_id=" + alice + "&amount=10"); code != 502 || resp["preimage"] != "" {
+		t.Errorf("expected a wrong preimage to fail, got %d: %v", code, resp)
+	}
+
+	setTestConfig(t, func(cfg *Config) { cfg.DefaultRelays = []string{relay.URL} })
+	if code, _ := zap("account_id=" + alice + "&amount=10"); code != 503 {
+		t.Errorf("expected 503 without a wallet, got %d", code)
+	}
+}